@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// account statuses, stored in Userlist.status
+// a deleted user is gone; their loans, holds and fines stay behind, for statistics,
+// under an anonymous account of that status that nobody can log in to
+const (
+	AccountActive   = "active"
+	AccountInactive = "inactive"
+	AccountDeleted  = "deleted"
+)
+
+var ErrAccountInactive = errors.New("Account deactivated.")
+var ErrAccountExpired = errors.New("Account expired.")
+var ErrUnreturnedBooks = errors.New("The user still has unreturned books.")
+
+// Account : whether a user may log in and borrow, and until when
+// an account that never expires has no ExpiresAt
+type Account struct {
+	UserID    string
+	Status    string
+	ExpiresAt sql.NullTime
+}
+
+// usable : nil if the account may be used at now, else why not
+func (a Account) usable(now time.Time) error {
+	if a.Status == AccountInactive {
+		return ErrAccountInactive
+	}
+	if a.ExpiresAt.Valid && !now.Before(a.ExpiresAt.Time) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+// checkAccount : nil if the user's account may log in and borrow at now
+func (lib *Library) checkAccount(userID string, now time.Time) error {
+	account, err := lib.store.Account(userID)
+	if err != nil {
+		return err
+	}
+	return account.usable(now)
+}
+
+// UserAccount : the status and expiry of a user's account
+func (lib *Library) UserAccount(ctx context.Context, userID string) (Account, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	account, err := lib.store.Account(userID)
+	return account, opError(err, "user.account", "", userID)
+}
+
+// DeactivateUser : stop a user from logging in, borrowing and placing holds, e.g. once they graduate
+// their sessions end, but they can still return what they borrowed
+func (lib *Library) DeactivateUser(ctx context.Context, userID string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.setAccountStatus("user.deactivate", userID, AccountInactive)
+}
+
+// ReactivateUser : let a deactivated user back in
+// an expired account also needs a later expiry, see SetUserExpiry
+func (lib *Library) ReactivateUser(ctx context.Context, userID string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.setAccountStatus("user.reactivate", userID, AccountActive)
+}
+
+func (lib *Library) setAccountStatus(op, userID, status string) error {
+	err := lib.transaction(func(tx *Library) error {
+		account, err := tx.store.Account(userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.store.SetAccountStatus(userID, status); err != nil {
+			return err
+		}
+		if status == AccountInactive {
+			if err := tx.store.RevokeSessions(userID); err != nil {
+				return err
+			}
+		}
+		return tx.audit(op, userID, map[string]interface{}{"status": account.Status}, map[string]interface{}{"status": status})
+	})
+	logger := lib.log().With(F("op", op), F("user", userID))
+	if err != nil {
+		logger.failed("Changing an account's status failed.", err)
+		return opError(err, op, "", userID)
+	}
+	logger.Info("Account status changed.", F("status", status))
+	return nil
+}
+
+// SetUserExpiry : let a user's account expire at expiresAt, e.g. at the end of a term, or never if it is zero
+// an expired account is refused like a deactivated one
+func (lib *Library) SetUserExpiry(ctx context.Context, userID string, expiresAt time.Time) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	expiry := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+	err := lib.transaction(func(tx *Library) error {
+		account, err := tx.store.Account(userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.store.SetAccountExpiry(userID, expiry); err != nil {
+			return err
+		}
+		return tx.audit("user.expiry", userID, map[string]interface{}{"expires": account.ExpiresAt},
+			map[string]interface{}{"expires": expiry})
+	})
+	logger := lib.log().With(F("op", "user.expiry"), F("user", userID))
+	if err != nil {
+		logger.failed("Changing an account's expiry failed.", err)
+		return opError(err, "user.expiry", "", userID)
+	}
+	logger.Info("Account expiry changed.", F("expires", expiresAt))
+	return nil
+}
+
+// anonIDTries : how many anonymous IDs DeleteUser draws before giving up on finding a free one
+const anonIDTries = 3
+
+// DeleteUser : remove a user and everything that names them, keeping their loans anonymized for statistics
+// refused while they have unreturned books or owe fines; their holds are cancelled.
+// The audit log is exempt: it is append-only, its triggers refuse any change, so that it stays a
+// trustworthy record of who did what. Its entries keep the user's ID, and the name and category
+// they were given; nothing links that ID to the anonymous one. The ID stays taken by a deleted row,
+// so that no later account is handed those entries
+func (lib *Library) DeleteUser(ctx context.Context, userID string) error {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	var err error
+	for try := 0; try < anonIDTries; try++ {
+		err = lib.deleteUser(ctx, userID)
+		// the anonymous ID drawn may already be taken, draw another
+		if !errors.Is(err, ErrUserExists) {
+			break
+		}
+	}
+	logger := lib.log().With(F("op", "user.delete"), F("user", userID))
+	if err != nil {
+		logger.failed("Deleting a user failed.", err)
+		return opError(err, "user.delete", "", userID)
+	}
+	logger.Info("User deleted.")
+	return nil
+}
+
+func (lib *Library) deleteUser(ctx context.Context, userID string) error {
+	anonID, password, err := lib.anonymousAccount()
+	if err != nil {
+		return err
+	}
+	return lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.User(userID); err != nil {
+			return err
+		}
+		loans, err := tx.CheckUnreturned(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if len(loans) > 0 {
+			return ErrUnreturnedBooks
+		}
+		balance, err := tx.store.FineBalance(userID)
+		if err != nil {
+			return err
+		}
+		if balance > 0 {
+			return ErrFinesOutstanding
+		}
+		holds, err := tx.store.UserHolds(userID)
+		if err != nil {
+			return err
+		}
+		for _, hold := range holds {
+			if err := tx.CancelHold(ctx, hold.ISBN, userID); err != nil {
+				return err
+			}
+		}
+		if err := tx.store.AnonymizeUser(userID, anonID, password); err != nil {
+			return err
+		}
+		return tx.audit("user.delete", userID, nil, map[string]interface{}{"status": AccountDeleted})
+	})
+}
+
+// anonymousAccount : a random ID for a deleted user's records, and the hash of a password nobody knows
+func (lib *Library) anonymousAccount() (string, string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	// "deleted-" and 8 hex digits fill the 16 characters of an ID
+	anonID := AccountDeleted + "-" + hex.EncodeToString(buf[:4])
+	password, err := lib.hasher.Hash(hex.EncodeToString(buf[4:]))
+	return anonID, password, err
+}
+
+// userDataJSON : everything the library holds about a user, as ExportUserData writes it
+type userDataJSON struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Role        string      `json:"role"`
+	Category    string      `json:"category"`
+	Status      string      `json:"status"`
+	ExpiresAt   *time.Time  `json:"expires_at,omitempty"`
+	Overdue     int         `json:"overdue"`
+	Loans       []loanJSON  `json:"loans"`
+	Holds       []holdJSON  `json:"holds"`
+	FineBalance int         `json:"fine_balance"`
+	Fines       []fineJSON  `json:"fines"`
+	Audit       []auditJSON `json:"audit"`
+	ExportedAt  time.Time   `json:"exported_at"`
+}
+
+// ExportUserData : write everything the library holds about a user to w as JSON:
+// their profile and account, every loan, their holds, fines, and the audit entries by or about them.
+// The password, even hashed, is left out, and so are the values of entries they made about others,
+// which would reveal someone else's data
+func (lib *Library) ExportUserData(ctx context.Context, w io.Writer, userID string) error {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	err := lib.exportUserData(ctx, w, userID)
+	logger := lib.log().With(F("op", "user.export"), F("user", userID))
+	if err != nil {
+		logger.failed("Exporting a user's data failed.", err)
+		return opError(err, "user.export", "", userID)
+	}
+	logger.Info("User data exported.")
+	return nil
+}
+
+func (lib *Library) exportUserData(ctx context.Context, w io.Writer, userID string) error {
+	user, err := lib.store.User(userID)
+	if err != nil {
+		return err
+	}
+	account, err := lib.store.Account(userID)
+	if err != nil {
+		return err
+	}
+	category, err := lib.store.UserCategoryPolicy(userID)
+	if err != nil {
+		return err
+	}
+	res := userDataJSON{ID: user.ID, Name: user.Name, Role: Role(user.Type).String(), Category: category.Category,
+		Status: account.Status, Overdue: user.Overdue, ExportedAt: lib.now()}
+	if account.ExpiresAt.Valid {
+		res.ExpiresAt = &account.ExpiresAt.Time
+	}
+
+	loans, err := lib.CheckBorrowHistory(ctx, userID)
+	if err != nil {
+		return err
+	}
+	res.Loans = toLoanJSON(loans)
+	holds, err := lib.UserHolds(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if res.Holds, err = toHoldJSON(ctx, lib, holds); err != nil {
+		return err
+	}
+	balance, entries, err := lib.Fines(ctx, userID)
+	if err != nil {
+		return err
+	}
+	res.FineBalance, res.Fines = balance, toFineJSON(entries)
+	audit, err := lib.store.Audit(AuditFilter{User: userID})
+	if err != nil {
+		return err
+	}
+	for i := range audit {
+		if audit[i].Target != userID {
+			audit[i].Before, audit[i].After = "", ""
+		}
+	}
+	res.Audit = toAuditJSON(audit)
+
+	// who looked at someone's data is itself worth recording
+	if err := lib.audit("user.export", userID, nil, nil); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
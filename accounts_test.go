@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountStatus(t *testing.T) {
+	alib := newHoldLibrary(t)
+	defer alib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	alib.clock = NewFakeClock(now)
+	var tests = []struct {
+		testid int
+		action string
+		userID string
+		err    error
+	}{
+		{0, "deactivate", `18307130006`, nil},
+		{1, "login", `18307130006`, ErrAccountInactive},
+		{2, "borrow", `18307130006`, ErrAccountInactive},
+		{3, "hold", `18307130006`, ErrAccountInactive},
+		{4, "deactivate", `nobody`, ErrUserNotExists},
+		{5, "reactivate", `18307130006`, nil},
+		{6, "login", `18307130006`, nil},
+		{7, "borrow", `18307130006`, nil},
+		{8, "expire yesterday", `18307130068`, nil},
+		{9, "login", `18307130068`, ErrAccountExpired},
+		{10, "hold", `18307130068`, ErrAccountExpired},
+		{11, "expire yesterday", `18307130006`, nil},
+		{12, "extend", `18307130006`, ErrAccountExpired},
+		{13, "return", `18307130006`, nil},
+		{14, "expire never", `18307130068`, nil},
+		{15, "login", `18307130068`, nil},
+		{16, "expire tomorrow", `18307130068`, nil},
+		{17, "borrow", `18307130068`, nil},
+	}
+
+	passwords := map[string]string{`18307130006`: `578152`, `18307130068`: `987430`}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var err error
+			switch tt.action {
+			case "deactivate":
+				err = alib.DeactivateUser(ctx, tt.userID)
+			case "reactivate":
+				err = alib.ReactivateUser(ctx, tt.userID)
+			case "expire yesterday":
+				err = alib.SetUserExpiry(ctx, tt.userID, now.AddDate(0, 0, -1))
+			case "expire tomorrow":
+				err = alib.SetUserExpiry(ctx, tt.userID, now.AddDate(0, 0, 1))
+			case "expire never":
+				err = alib.SetUserExpiry(ctx, tt.userID, time.Time{})
+			case "login":
+				_, err = alib.IdentifyUser(ctx, tt.userID, passwords[tt.userID])
+			case "borrow":
+				_, err = alib.BorrowBook(ctx, ISBN, tt.userID, now)
+			case "hold":
+				_, err = alib.PlaceHold(ctx, ISBN, tt.userID, now)
+			case "extend":
+				_, err = alib.ExtendDeadline(ctx, ISBN, tt.userID)
+			case "return":
+				_, err = alib.ReturnBook(ctx, ISBN, tt.userID)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if tt.err == ErrAccountInactive || tt.err == ErrAccountExpired {
+				if statusOf(err) != http.StatusForbidden || exitCode(err) != ExitAuth {
+					t.Errorf("got status %d and exit code %d, want %d and %d", statusOf(err), exitCode(err), http.StatusForbidden, ExitAuth)
+				}
+			}
+		})
+	}
+
+	// a deactivated user's sessions end with it
+	session, err := alib.Login(ctx, `18307130101`, `246810`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alib.DeactivateUser(ctx, `18307130101`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alib.Authenticate(ctx, session.Token); err == nil {
+		t.Error("got a session, want it revoked")
+	}
+	// so do an expired user's, for as long as the account stays expired
+	session, err = alib.Login(ctx, `18307130102`, `135791`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alib.SetUserExpiry(ctx, `18307130102`, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	alib.clock = NewFakeClock(now.Add(2 * time.Hour))
+	if _, err := alib.Authenticate(ctx, session.Token); !errors.Is(err, ErrAccountExpired) {
+		t.Errorf("got %v, want %v", err, ErrAccountExpired)
+	}
+	if err := alib.SetUserExpiry(ctx, `18307130102`, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alib.Authenticate(ctx, session.Token); err != nil {
+		t.Errorf("got %v, want the session back", err)
+	}
+	account, err := alib.UserAccount(ctx, `18307130101`)
+	if err != nil || account.Status != AccountInactive || account.ExpiresAt.Valid {
+		t.Errorf("got %+v, %v, want an inactive account that never expires", account, err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	dlib := newHoldLibrary(t)
+	defer dlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	dlib.clock = NewFakeClock(now)
+	if _, err := dlib.BorrowBook(ctx, ISBN, `18307130006`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dlib.PlaceHold(ctx, ISBN, `18307130068`, now); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dlib.DeleteUser(ctx, `18307130006`)
+	if !errors.Is(err, ErrUnreturnedBooks) || statusOf(err) != http.StatusConflict {
+		t.Fatalf("got %v, want %v", err, ErrUnreturnedBooks)
+	}
+	if _, err := dlib.ReturnBook(ctx, ISBN, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []string{`18307130006`, `18307130068`} {
+		if err := dlib.DeleteUser(ctx, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dlib.DeleteUser(ctx, `18307130006`); !errors.Is(err, ErrUserNotExists) {
+		t.Errorf("got %v, want %v", err, ErrUserNotExists)
+	}
+	if _, err := dlib.IdentifyUser(ctx, `18307130006`, `578152`); !errors.Is(err, ErrPassword) {
+		t.Errorf("got %v, want %v", err, ErrPassword)
+	}
+	// the ID stays taken, so that no new account is handed the deleted one's audit entries
+	if err := dlib.AddUser(ctx, Users{`18307130006`, `Alice`, `135791`, 0, 1}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("got %v, want %v", err, ErrUserExists)
+	}
+	var export bytes.Buffer
+	if err := dlib.ExportUserData(ctx, &export, `18307130006`); !errors.Is(err, ErrUserNotExists) || export.Len() != 0 {
+		t.Errorf("got %v, %q, want %v and nothing exported", err, export.String(), ErrUserNotExists)
+	}
+	// the loan is still counted, under an ID that names nobody
+	var userID string
+	err = dlib.store.(*sqlStore).db.QueryRow(`SELECT user_id FROM Recordlist`).Scan(&userID)
+	if err != nil || !strings.HasPrefix(userID, AccountDeleted+"-") {
+		t.Errorf("got %q, %v, want an anonymous borrower", userID, err)
+	}
+	if _, err := dlib.IdentifyUser(ctx, userID, ""); !errors.Is(err, ErrPassword) {
+		t.Errorf("got %v, want nobody to log in as %s", err, userID)
+	}
+	// an anonymous ID drawn twice is refused, for DeleteUser to draw another
+	if err := dlib.store.AnonymizeUser(`18307130101`, userID, ""); !errors.Is(err, ErrUserExists) {
+		t.Errorf("got %v, want %v", err, ErrUserExists)
+	}
+	// the deleted reader's hold no longer keeps the book from the next one
+	if _, err := dlib.BorrowBook(ctx, ISBN, `18307130101`, now); err != nil {
+		t.Errorf("got %v, want the book borrowed", err)
+	}
+}
+
+func TestExportUserData(t *testing.T) {
+	elib := newHoldLibrary(t)
+	defer elib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	elib.clock = NewFakeClock(now)
+	if _, err := elib.BorrowBook(ctx, ISBN, `18307130006`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := elib.PlaceHold(ctx, ISBN, `18307130068`, now); err != nil {
+		t.Fatal(err)
+	}
+	// what Alicia did to someone else is hers to see, but not their data
+	if err := elib.As(`18307130006`, OriginCLI).AddUser(ctx, Users{`18307130103`, `Eliza`, `112358`, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := elib.ExportUserData(ctx, &buf, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	var res userDataJSON
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != `18307130006` || res.Name != `Alicia` || res.Status != AccountActive || len(res.Loans) != 1 ||
+		res.Loans[0].ISBN != ISBN || len(res.Holds) != 0 || len(res.Audit) == 0 {
+		t.Errorf("got %+v, want Alicia's account and her loan", res)
+	}
+	if strings.Contains(buf.String(), `password`) || strings.Contains(buf.String(), `$2a$`) {
+		t.Errorf("got %s, want no password", buf.String())
+	}
+	var added int
+	for _, entry := range res.Audit {
+		if entry.Action != "user.add" {
+			continue
+		}
+		added++
+		if entry.Target != `18307130006` && (entry.Actor != `18307130006` || entry.After != nil) {
+			t.Errorf("got %+v, want Alicia's entry without its values", entry)
+		}
+	}
+	if added != 2 || !strings.Contains(buf.String(), `Alicia`) || strings.Contains(buf.String(), `Eliza`) {
+		t.Errorf("got %s, want Alicia's own entry in full and Eliza's name left out", buf.String())
+	}
+
+	if err := elib.ExportUserData(ctx, &buf, `nobody`); !errors.Is(err, ErrUserNotExists) {
+		t.Errorf("got %v, want %v", err, ErrUserNotExists)
+	}
+}
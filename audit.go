@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// where a change came from, stored in Auditlist.origin
+const (
+	OriginCLI    = "cli"
+	OriginAPI    = "api"
+	OriginSystem = "system"
+)
+
+// SystemActor : the actor recorded for changes nobody in particular asked for
+const SystemActor = "system"
+
+// AuditEntry : one change to the library, who made it, from where and when
+// Target is the user a change is about, or else the book, copy or policy;
+// Before and After are JSON objects of the values that changed, empty if there were none
+type AuditEntry struct {
+	EntryID   int
+	Actor     string
+	Action    string
+	Target    string
+	Before    string
+	After     string
+	Origin    string
+	CreatedAt time.Time
+}
+
+// AuditFilter : which audit entries to list, empty fields match everything
+// User matches the actor or the target, Action an action like "loan.borrow" or a group like "loan";
+// From and To bound the time, To excluded
+type AuditFilter struct {
+	User   string
+	Action string
+	From   time.Time
+	To     time.Time
+}
+
+var ErrDateRange = errors.New("The end of the range must come after its start.")
+
+// As : the library acting for actor from origin
+// whatever the returned library changes is audited under them
+func (lib *Library) As(actor, origin string) *Library {
+	res := *lib
+	res.actor = actor
+	res.origin = origin
+	return &res
+}
+
+// actorID : who the library acts as, the system if nobody in particular
+func (lib *Library) actorID() string {
+	if lib.actor == "" {
+		return SystemActor
+	}
+	return lib.actor
+}
+
+// audit : record a change, in the transaction that makes it if there is one
+// before and after are encoded as JSON, nil for no values
+func (lib *Library) audit(action, target string, before, after interface{}) error {
+	entry := AuditEntry{Actor: lib.actorID(), Action: action, Target: target, Origin: lib.origin, CreatedAt: lib.now()}
+	if entry.Origin == "" {
+		entry.Origin = OriginSystem
+	}
+	for _, value := range []struct {
+		v   interface{}
+		dst *string
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if value.v == nil {
+			continue
+		}
+		buf, err := json.Marshal(value.v)
+		if err != nil {
+			return err
+		}
+		*value.dst = string(buf)
+	}
+	return lib.store.InsertAudit(entry)
+}
+
+// Audit : the audit entries matching a filter, newest first
+func (lib *Library) Audit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		return nil, ErrDateRange
+	}
+	AuditList, err := lib.store.Audit(filter)
+	if err != nil {
+		lib.log().failed("Querying the audit log failed.", err, F("op", "audit.list"), F("user", filter.User), F("action", filter.Action))
+		return nil, err
+	}
+	return AuditList, nil
+}
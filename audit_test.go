@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	alib := newHoldLibrary(t)
+	defer alib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var start = time.Now()
+	staff := alib.As(`librarian`, OriginCLI)
+	if _, err := staff.BorrowBook(ctx, ISBN, `18307130006`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alib.As(`18307130068`, OriginAPI).PlaceHold(ctx, ISBN, `18307130068`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := staff.ReturnBook(ctx, ISBN, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	if err := alib.As(`root`, OriginCLI).ModifyPassword(ctx, `18307130006`, `new`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := staff.AddCopy(ctx, ISBN, `CW-0002`, `A3-12`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// what fails leaves no trace
+	staff.BorrowBook(ctx, ISBN, `nobody`, time.Now())
+
+	var tests = []struct {
+		testid  int
+		filter  AuditFilter
+		err     error
+		actions string
+	}{
+		{0, AuditFilter{User: `18307130006`}, nil, `[user.password loan.return loan.borrow user.add]`},
+		{1, AuditFilter{User: `librarian`}, nil, `[copy.add loan.return loan.borrow]`},
+		{2, AuditFilter{Action: `loan`}, nil, `[loan.return loan.borrow]`},
+		{3, AuditFilter{Action: `hold.place`}, nil, `[hold.place]`},
+		{4, AuditFilter{Action: `loa`}, nil, `[]`},
+		{5, AuditFilter{User: `18307130068`, From: start}, nil, `[hold.place]`},
+		{6, AuditFilter{Action: `loan`, To: start}, nil, `[]`},
+		{7, AuditFilter{From: time.Now().Add(time.Hour)}, nil, `[]`},
+		{8, AuditFilter{From: start, To: start}, ErrDateRange, `[]`},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			res, err := alib.Audit(ctx, tt.filter)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			actions := []string{}
+			for _, entry := range res {
+				actions = append(actions, entry.Action)
+			}
+			if got := fmt.Sprint(actions); got != tt.actions {
+				t.Errorf("got %s, want %s", got, tt.actions)
+			}
+		})
+	}
+
+	res, _ := alib.Audit(ctx, AuditFilter{})
+	if len(res) != 10 {
+		t.Errorf("got %d entries, want 10", len(res))
+	}
+	for _, entry := range res {
+		switch entry.Action {
+		case "loan.borrow":
+			if entry.Actor != `librarian` || entry.Origin != OriginCLI || entry.Before != `` ||
+				!strings.Contains(entry.After, `"copy":"978-0385545938-1"`) {
+				t.Errorf("got %+v, want the librarian lending copy 1", entry)
+			}
+		case "hold.place":
+			if entry.Actor != `18307130068` || entry.Origin != OriginAPI {
+				t.Errorf("got %+v, want the reader over the API", entry)
+			}
+		case "user.password":
+			if entry.Before != `` || entry.After != `` {
+				t.Errorf("got %+v, want no values", entry)
+			}
+		case "user.add":
+			if entry.Actor != SystemActor || entry.Origin != OriginSystem {
+				t.Errorf("got %+v, want the system", entry)
+			}
+		}
+	}
+
+	for _, query := range []string{`UPDATE Auditlist SET actor = 'nobody'`, `DELETE FROM Auditlist`} {
+		if _, err := alib.store.(*sqlStore).db.Exec(query); err == nil {
+			t.Errorf("%s: got nil, want the log to be append-only", query)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Role : what kind of account a user has, stored in Userlist.type
+type Role int
+
+const (
+	RoleAdmin     Role = 0
+	RoleReader    Role = 1
+	RoleGuest     Role = 2
+	RoleLibrarian Role = 3
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleAdmin:
+		return "admin"
+	case RoleReader:
+		return "reader"
+	case RoleGuest:
+		return "guest"
+	case RoleLibrarian:
+		return "librarian"
+	}
+	return "unknown"
+}
+
+// Permission : something a session may be allowed to do
+type Permission string
+
+const (
+	PermNone         Permission = ""
+	PermQueryBooks   Permission = "books:query"
+	PermManageBooks  Permission = "books:manage"
+	PermOwnLoans     Permission = "loans:own"
+	PermAnyLoans     Permission = "loans:any"
+	PermOwnPassword  Permission = "password:own"
+	PermManageUsers  Permission = "users:manage"
+	PermManagePolicy Permission = "policy:manage"
+	PermManageFines  Permission = "fines:manage"
+	PermAudit        Permission = "audit:read"
+	PermReports      Permission = "reports:read"
+	PermOwnData      Permission = "data:own"
+)
+
+// rolePermissions : the single source of truth for who may do what
+var rolePermissions = map[Role][]Permission{
+	RoleGuest:     {PermQueryBooks},
+	RoleReader:    {PermQueryBooks, PermOwnLoans, PermOwnPassword, PermOwnData},
+	RoleLibrarian: {PermQueryBooks, PermOwnLoans, PermOwnPassword, PermOwnData, PermAnyLoans, PermManageBooks, PermManageFines},
+	RoleAdmin:     {PermQueryBooks, PermOwnLoans, PermOwnPassword, PermOwnData, PermAnyLoans, PermManageBooks, PermManageUsers, PermManagePolicy, PermManageFines, PermAudit, PermReports},
+}
+
+// commandPermissions : what each CLI command requires
+var commandPermissions = map[string]Permission{
+	"exit":         PermNone,
+	"help":         PermNone,
+	"search":       PermQueryBooks,
+	"title":        PermQueryBooks,
+	"author":       PermQueryBooks,
+	"isbn":         PermQueryBooks,
+	"subject":      PermQueryBooks,
+	"year":         PermQueryBooks,
+	"bookinfo":     PermQueryBooks,
+	"borrow":       PermOwnLoans,
+	"return":       PermOwnLoans,
+	"deadline":     PermOwnLoans,
+	"extend":       PermOwnLoans,
+	"history":      PermOwnLoans,
+	"unreturned":   PermOwnLoans,
+	"overdue":      PermOwnLoans,
+	"hold":         PermOwnLoans,
+	"holds":        PermOwnLoans,
+	"cancelhold":   PermOwnLoans,
+	"queue":        PermAnyLoans,
+	"fines":        PermOwnLoans,
+	"pay":          PermManageFines,
+	"waive":        PermManageFines,
+	"lost":         PermManageBooks,
+	"pw":           PermOwnPassword,
+	"adduser":      PermManageUsers,
+	"userpw":       PermManageUsers,
+	"revoke":       PermManageUsers,
+	"deactivate":   PermManageUsers,
+	"reactivate":   PermManageUsers,
+	"expire":       PermManageUsers,
+	"deleteuser":   PermManageUsers,
+	"mydata":       PermOwnData,
+	"addbook":      PermManageBooks,
+	"removebook":   PermManageBooks,
+	"editbook":     PermManageBooks,
+	"import":       PermManageBooks,
+	"export":       PermManageBooks,
+	"copies":       PermManageBooks,
+	"addcopy":      PermManageBooks,
+	"removecopy":   PermManageBooks,
+	"repair":       PermManageBooks,
+	"reinstate":    PermManageBooks,
+	"withdrawals":  PermManageBooks,
+	"unrepair":     PermManageBooks,
+	"movecopy":     PermManageBooks,
+	"borrowcopy":   PermAnyLoans,
+	"bookclass":    PermManageBooks,
+	"usercategory": PermManageUsers,
+	"policy":       PermManagePolicy,
+	"setpolicy":    PermManagePolicy,
+	"setcategory":  PermManagePolicy,
+	"audit":        PermAudit,
+	"report":       PermReports,
+}
+
+// Session : a logged-in user, or a guest
+// Token is only known to whoever logged in; the database keeps its hash
+type Session struct {
+	Token     string
+	UserID    string
+	Name      string
+	Role      Role
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// DefaultSessionTTL : how long a session lasts unless configured otherwise
+var DefaultSessionTTL = 8 * time.Hour
+
+var ErrNotLoggedIn = errors.New("Please log in first.")
+var ErrSessionInvalid = errors.New("Invalid session.")
+var ErrSessionExpired = errors.New("Session expired. Please log in again.")
+var ErrPermissionDenied = errors.New("Permission denied.")
+
+// GuestSession : the session of someone who hasn't logged in
+func GuestSession() Session {
+	return Session{Name: "guest", Role: RoleGuest}
+}
+
+// Can : whether the session's role grants p
+func (s Session) Can(p Permission) bool {
+	if p == PermNone {
+		return true
+	}
+	for _, granted := range rolePermissions[s.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken : what the database stores instead of the token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Login : check the password and open a session
+func (lib *Library) Login(ctx context.Context, userid, password string) (Session, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	user, err := lib.IdentifyUser(ctx, userid, password)
+	if err != nil {
+		return Session{}, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Session{}, err
+	}
+	ttl := lib.sessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	now := lib.now()
+	session := Session{
+		Token:     hex.EncodeToString(buf),
+		UserID:    user.ID,
+		Name:      user.Name,
+		Role:      Role(user.Type),
+		ExpiresAt: now.Add(ttl),
+	}
+
+	err = lib.transaction(func(tx *Library) error {
+		err := tx.store.InsertSession(hashToken(session.Token), user.ID, now, session.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		// whoever was acting before, it is the user who logs in
+		return tx.As(user.ID, lib.origin).audit("session.login", user.ID, nil, map[string]interface{}{"expires": session.ExpiresAt})
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// Authenticate : the session a token belongs to, if it is still valid
+// and its user's account is neither deactivated nor expired
+func (lib *Library) Authenticate(ctx context.Context, token string) (Session, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	session, err := lib.store.Session(hashToken(token))
+	if err != nil {
+		return Session{}, err
+	}
+	if session.Revoked {
+		return Session{}, ErrSessionInvalid
+	}
+	if !lib.now().Before(session.ExpiresAt) {
+		return Session{}, ErrSessionExpired
+	}
+	if err := lib.checkAccount(session.UserID, lib.now()); err != nil {
+		return Session{}, err
+	}
+	session.Token = token
+	return session, nil
+}
+
+// Logout : end the session of a token
+func (lib *Library) Logout(ctx context.Context, token string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.transaction(func(tx *Library) error {
+		session, err := tx.store.Session(hashToken(token))
+		if err != nil {
+			return err
+		}
+		if err := tx.store.RevokeSession(hashToken(token)); err != nil {
+			return err
+		}
+		return tx.As(session.UserID, lib.origin).audit("session.logout", session.UserID, nil, nil)
+	})
+}
+
+// RevokeSessions : end every session of a user, e.g. after an admin reset their password
+func (lib *Library) RevokeSessions(ctx context.Context, userID string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.transaction(func(tx *Library) error {
+		if err := tx.store.RevokeSessions(userID); err != nil {
+			return err
+		}
+		return tx.audit("session.revoke", userID, nil, nil)
+	})
+}
+
+// Authorize : whether the session may do something requiring p
+func (lib *Library) Authorize(s Session, p Permission) error {
+	if s.Can(p) {
+		return nil
+	}
+	if s.Role == RoleGuest {
+		return ErrNotLoggedIn
+	}
+	return ErrPermissionDenied
+}
+
+// AuthorizeFor : whether the session may act on the given user's loans
+// acting on oneself needs own, acting on someone else needs others
+func (lib *Library) AuthorizeFor(s Session, userID string, own, others Permission) error {
+	if userID == s.UserID && s.UserID != "" {
+		return lib.Authorize(s, own)
+	}
+	return lib.Authorize(s, others)
+}
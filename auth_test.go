@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	var tests = []struct {
+		role Role
+		perm Permission
+		err  error
+	}{
+		{RoleGuest, PermNone, nil},
+		{RoleGuest, PermQueryBooks, nil},
+		{RoleGuest, PermOwnLoans, ErrNotLoggedIn},
+		{RoleReader, PermOwnLoans, nil},
+		{RoleReader, PermOwnPassword, nil},
+		{RoleReader, PermAnyLoans, ErrPermissionDenied},
+		{RoleReader, PermManageBooks, ErrPermissionDenied},
+		{RoleLibrarian, PermAnyLoans, nil},
+		{RoleLibrarian, PermManageBooks, nil},
+		{RoleLibrarian, PermManageUsers, ErrPermissionDenied},
+		{RoleAdmin, PermManageUsers, nil},
+		{RoleAdmin, PermAnyLoans, nil},
+		{Role(7), PermQueryBooks, ErrPermissionDenied},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%s %s", tt.role, tt.perm)
+		t.Run(testname, func(t *testing.T) {
+			err := lib.Authorize(Session{UserID: "someone", Role: tt.role}, tt.perm)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCommandPermissions(t *testing.T) {
+	for command, perm := range commandPermissions {
+		if !(Session{Role: RoleAdmin}).Can(perm) {
+			t.Errorf("admin can't run %q", command)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	alib := newTestLibrary(t)
+	defer alib.store.Close()
+	if err := alib.AddUser(ctx, Users{`18307130006`, `Alicia`, `578152`, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := alib.Login(ctx, `18307130006`, `123456`); !errors.Is(err, ErrPassword) {
+		t.Errorf("got %v, want %v", err, ErrPassword)
+	}
+
+	first, err := alib.Login(ctx, `18307130006`, `578152`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := alib.Login(ctx, `18307130006`, `578152`)
+	if first.Token == second.Token || len(first.Token) != 64 {
+		t.Errorf("got tokens %q and %q", first.Token, second.Token)
+	}
+
+	session, err := alib.Authenticate(ctx, first.Token)
+	if err != nil || session.UserID != `18307130006` || session.Role != RoleReader {
+		t.Errorf("got %+v %v", session, err)
+	}
+	if _, err := alib.Authenticate(ctx, "not a token"); !errors.Is(err, ErrSessionInvalid) {
+		t.Errorf("got %v, want %v", err, ErrSessionInvalid)
+	}
+
+	if err := alib.Logout(ctx, first.Token); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if _, err := alib.Authenticate(ctx, first.Token); !errors.Is(err, ErrSessionInvalid) {
+		t.Errorf("got %v, want %v after logout", err, ErrSessionInvalid)
+	}
+	if _, err := alib.Authenticate(ctx, second.Token); err != nil {
+		t.Errorf("got %v, want nil for the other session", err)
+	}
+
+	if err := alib.RevokeSessions(ctx, `18307130006`); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if _, err := alib.Authenticate(ctx, second.Token); !errors.Is(err, ErrSessionInvalid) {
+		t.Errorf("got %v, want %v after revocation", err, ErrSessionInvalid)
+	}
+
+	alib.sessionTTL = time.Nanosecond
+	short, _ := alib.Login(ctx, `18307130006`, `578152`)
+	time.Sleep(time.Millisecond)
+	if _, err := alib.Authenticate(ctx, short.Token); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("got %v, want %v", err, ErrSessionExpired)
+	}
+}
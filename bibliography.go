@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// BookDetails : the bibliographic record of a book beyond what Books lists
+// Authors are in the order they are credited, and Books.Author is them joined with ", ";
+// a Year or Pages of 0 means unknown
+type BookDetails struct {
+	ISBN        string
+	Authors     []string
+	Subjects    []string
+	Edition     string
+	Year        int
+	Language    string
+	Pages       int
+	Description string
+}
+
+var ErrNoAuthor = errors.New("A book needs at least one author.")
+var ErrInvalidYear = errors.New("Invalid publication year.")
+var ErrInvalidPages = errors.New("Page count can't be negative.")
+
+// splitAuthors : the authors in a combined author string, e.g. "Thomas H. Cormen, Charles E. Leiserson"
+// names are separated by ',', ';', " & " or " and "; empty and repeated names are dropped
+// splitAuthorsSQL does the same for migrations
+func splitAuthors(s string) []string {
+	s = strings.NewReplacer(";", ",", " & ", ",", " and ", ",").Replace(s)
+	var res []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// parsePublisher : the name, edition and year in a combined publisher string
+// "Pearson; 3 edition (July 6, 2015)" is Pearson, 3 and 2015, "Doubleday (2020)" is Doubleday and 2020;
+// anything else is the name alone. parsePublisherSQL does the same for migrations
+func parsePublisher(s string) (name, edition string, year int) {
+	semicolon := strings.Index(s, ";")
+	paren := strings.Index(s, " (")
+	if semicolon < 0 && (paren < 0 || !strings.HasSuffix(s, ")")) {
+		return s, "", 0
+	}
+
+	if semicolon >= 0 {
+		name = strings.TrimSpace(s[:semicolon])
+		rest := strings.TrimSpace(s[semicolon+1:])
+		if i := strings.Index(strings.ToLower(rest), " edition"); i >= 0 {
+			edition = strings.TrimSpace(rest[:i])
+		}
+	} else {
+		name = strings.TrimSpace(s[:paren])
+	}
+	if strings.HasSuffix(s, ")") && len(s) >= 5 {
+		last := s[len(s)-5 : len(s)-1]
+		if strings.Trim(last, "0123456789") == "" {
+			year, _ = strconv.Atoi(last)
+		}
+	}
+	return name, edition, year
+}
+
+// cleanList : the items trimmed, without empty and repeated ones
+func cleanList(items []string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item != "" && !seen[strings.ToLower(item)] {
+			seen[strings.ToLower(item)] = true
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// QueryBookDetails : the bibliographic record of a book
+func (lib *Library) QueryBookDetails(ctx context.Context, ISBN string) (BookDetails, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	ISBN = canonicalISBN(ISBN)
+	details, err := lib.store.BookDetails(ISBN)
+	if err != nil {
+		lib.log().failed("Querying book details failed.", err, F("op", "book.query"), F("isbn", ISBN))
+		return details, opError(err, "book.query", ISBN, "")
+	}
+	return details, nil
+}
+
+// SetBookDetails : replace the bibliographic record of a book
+// authors and subjects are trimmed and deduplicated, and the book's author becomes the authors joined
+func (lib *Library) SetBookDetails(ctx context.Context, details BookDetails) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	details.ISBN = canonicalISBN(details.ISBN)
+	details.Authors = cleanList(details.Authors)
+	details.Subjects = cleanList(details.Subjects)
+	details.Edition = strings.TrimSpace(details.Edition)
+	details.Language = strings.TrimSpace(details.Language)
+	details.Description = strings.TrimSpace(details.Description)
+	if len(details.Authors) == 0 {
+		return ErrNoAuthor
+	}
+	// nothing was printed before 1450, nor can it be published after next year
+	if details.Year != 0 && (details.Year < 1450 || details.Year > lib.now().Year()+1) {
+		return ErrInvalidYear
+	}
+	if details.Pages < 0 {
+		return ErrInvalidPages
+	}
+
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(details.ISBN); err != nil {
+			return err
+		}
+		before, err := tx.store.BookDetails(details.ISBN)
+		if err != nil {
+			return err
+		}
+		if err := tx.store.SaveBookDetails(details); err != nil {
+			return err
+		}
+		return tx.audit("book.details", details.ISBN, before, details)
+	})
+	logger := lib.log().With(F("op", "book.details"), F("isbn", details.ISBN))
+	if err != nil {
+		logger.failed("Updating book details failed.", err)
+		return opError(err, "book.details", details.ISBN, "")
+	}
+	logger.Info("Book details updated.")
+	return nil
+}
+
+// QueryBookSubject : query books by subject, ignoring case
+func (lib *Library) QueryBookSubject(ctx context.Context, subject string) ([]Books, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	BookList, err := lib.store.BooksBySubject(strings.TrimSpace(subject))
+	if err != nil {
+		lib.log().failed("Querying books failed.", err, F("op", "book.query"), F("subject", subject))
+		return nil, opError(err, "book.query", "", "")
+	}
+
+	return BookList, nil
+}
+
+// QueryBookYear : query books published from one year to another, both included
+func (lib *Library) QueryBookYear(ctx context.Context, from, to int) ([]Books, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if from > to {
+		from, to = to, from
+	}
+	BookList, err := lib.store.BooksByYear(from, to)
+	if err != nil {
+		lib.log().failed("Querying books failed.", err, F("op", "book.query"), F("from", from), F("to", to))
+		return nil, opError(err, "book.query", "", "")
+	}
+
+	return BookList, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var bibliographyTests = []struct {
+	testid    int
+	author    string
+	publisher string
+	authors   string
+	name      string
+	edition   string
+	year      int
+}{
+	{0, `Thomas H. Cormen, Charles E. Leiserson, Ronald L. Rivest, Clifford Stein`, `The MIT Press; third edition (July 31, 2009)`,
+		`[Thomas H. Cormen Charles E. Leiserson Ronald L. Rivest Clifford Stein]`, `The MIT Press`, `third`, 2009},
+	{1, `Robert C. Martin`, `Pearson; 1 edition (August 1, 2008)`, `[Robert C. Martin]`, `Pearson`, `1`, 2008},
+	{2, `Mark Owens and Delia Owens`, `Mariner Books (2014)`, `[Mark Owens Delia Owens]`, `Mariner Books`, ``, 2014},
+	{3, `Kernighan & Ritchie; Kernighan`, `Prentice Hall; 2nd Edition`, `[Kernighan Ritchie]`, `Prentice Hall`, `2nd`, 0},
+	{4, `John Grisham`, `Doubleday`, `[John Grisham]`, `Doubleday`, ``, 0},
+	{5, `Jill Tomlinson,`, `Egmont (UK)`, `[Jill Tomlinson]`, `Egmont`, ``, 0},
+	{6, `William Shakespeare`, `Ungar (New York, 1957`, `[William Shakespeare]`, `Ungar (New York, 1957`, ``, 0},
+}
+
+func TestParseBibliography(t *testing.T) {
+	for _, tt := range bibliographyTests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			if got := fmt.Sprint(splitAuthors(tt.author)); got != tt.authors {
+				t.Errorf("got %s, want %s", got, tt.authors)
+			}
+			name, edition, year := parsePublisher(tt.publisher)
+			if name != tt.name || edition != tt.edition || year != tt.year {
+				t.Errorf("got %q %q %d, want %q %q %d", name, edition, year, tt.name, tt.edition, tt.year)
+			}
+		})
+	}
+}
+
+func TestSplitBibliography(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	mlib := Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+
+	if err := mlib.Migrate(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+	// the migration must split the strings the way AddBook does
+	for _, tt := range bibliographyTests {
+		_, err := store.(*sqlStore).db.Exec(`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+			VALUES ('Title', ?, ?, ?, 0, 0)`, fmt.Sprintf("978-%010d", tt.testid), tt.author, tt.publisher)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mlib.Migrate(ctx, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range bibliographyTests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			ISBN := fmt.Sprintf("978-%010d", tt.testid)
+			details, err := store.BookDetails(ISBN)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(details.Authors); got != tt.authors {
+				t.Errorf("got %s, want %s", got, tt.authors)
+			}
+			book, _ := store.Book(ISBN)
+			if book.Publisher != tt.name || details.Edition != tt.edition || details.Year != tt.year {
+				t.Errorf("got %q %q %d, want %q %q %d", book.Publisher, details.Edition, details.Year, tt.name, tt.edition, tt.year)
+			}
+		})
+	}
+
+	if err := mlib.Migrate(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range bibliographyTests {
+		var publisher string
+		store.(*sqlStore).db.QueryRow(`SELECT publisher FROM Booklist WHERE ISBN = ?`,
+			fmt.Sprintf("978-%010d", tt.testid)).Scan(&publisher)
+		if publisher != tt.publisher {
+			t.Errorf("got %q after rolling back, want %q", publisher, tt.publisher)
+		}
+	}
+}
+
+func TestBookDetails(t *testing.T) {
+	blib := newTestLibrary(t)
+	defer blib.store.Close()
+
+	blib.AddBook(ctx, `Clean Code`, `978-0132350884`, `Robert C. Martin`, `Pearson; 1 edition (August 1, 2008)`, 1)
+	blib.AddBook(ctx, `Secrets of the Savanna`, `978-0544379657`, `Mark Owens and Delia Owens`, `Mariner Books (2014)`, 1)
+	blib.AddBook(ctx, `Where the Crawdads Sing`, `978-0735219090`, `Delia Owens`, `G.P. Putnam's Sons`, 1)
+
+	var tests = []struct {
+		testid  int
+		details BookDetails
+		err     error
+	}{
+		{0, BookDetails{ISBN: `9780735219090`, Authors: []string{` Delia Owens `}, Subjects: []string{`Fiction`, `Nature`, `fiction`},
+			Year: 2018, Language: `en`, Pages: 384, Description: `A coming-of-age story.`}, nil},
+		{1, BookDetails{ISBN: `978-0544379657`, Authors: []string{`Mark Owens`, `Delia Owens`}, Subjects: []string{`Nature`}, Year: 1992}, nil},
+		{2, BookDetails{ISBN: `978-0735219090`, Authors: []string{` `}}, ErrNoAuthor},
+		{3, BookDetails{ISBN: `978-0735219090`, Authors: []string{`Delia Owens`}, Year: 1200}, ErrInvalidYear},
+		{4, BookDetails{ISBN: `978-0735219090`, Authors: []string{`Delia Owens`}, Pages: -1}, ErrInvalidPages},
+		{5, BookDetails{ISBN: `978-0385545938`, Authors: []string{`John Grisham`}}, ErrBookNotExists},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			if err := blib.SetBookDetails(ctx, tt.details); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	details, err := blib.QueryBookDetails(ctx, `0735219095`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(details.Authors, details.Subjects, details.Year, details.Pages) != `[Delia Owens] [Fiction Nature] 2018 384` {
+		t.Errorf("got %+v, want the details set", details)
+	}
+	if book, _ := blib.store.Book(`978-0544379657`); book.Author != `Mark Owens, Delia Owens` || book.Publisher != `Mariner Books` {
+		t.Errorf("got %q %q, want the authors joined and the publisher name", book.Author, book.Publisher)
+	}
+
+	var titles = func(books []Books, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, book := range books {
+			res = append(res, book.Title)
+		}
+		return fmt.Sprint(res)
+	}
+	if got := titles(blib.QueryBookAuthor(ctx, `delia owens`)); got != `[Secrets of the Savanna Where the Crawdads Sing]` {
+		t.Errorf("got %s, want both books by Delia Owens", got)
+	}
+	if got := titles(blib.QueryBookAuthor(ctx, `Mark`)); got != `[Secrets of the Savanna]` {
+		t.Errorf("got %s, want the book by Mark Owens", got)
+	}
+	if got := titles(blib.QueryBookSubject(ctx, `NATURE`)); got != `[Secrets of the Savanna Where the Crawdads Sing]` {
+		t.Errorf("got %s, want both nature books", got)
+	}
+	if got := titles(blib.QueryBookYear(ctx, 2020, 2000)); got != `[Clean Code Where the Crawdads Sing]` {
+		t.Errorf("got %s, want the books of 2000 to 2020, oldest first", got)
+	}
+	res, err := blib.Search(ctx, `owens year:<2000`, 1, 10, false)
+	if err != nil || titles(res.Books, nil) != `[Secrets of the Savanna]` {
+		t.Errorf("got %+v %v, want the book of 1992", res, err)
+	}
+}
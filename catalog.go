@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
+)
+
+// catalog formats for import and export
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatMARC    = "marc"
+	FormatMARCXML = "marcxml"
+)
+
+var CatalogFormats = []string{FormatCSV, FormatJSONL, FormatMARC, FormatMARCXML}
+
+// what an import does with a row
+const (
+	ImportAdd   = "add"
+	ImportMerge = "merge"
+	ImportSkip  = "skip"
+)
+
+var ErrUnknownFormat = errors.New("Unknown catalog format.")
+var ErrCatalogColumns = errors.New("The CSV header must name isbn, title, author and publisher columns.")
+var ErrCatalogRow = errors.New("Malformed row.")
+var ErrMissingField = errors.New("ISBN, title, author and publisher are required.")
+
+// catalogRow : a book read from a catalog file, or why it couldn't be read
+// Line is the line of a JSON Lines file, the row of a CSV file counting the header as row 1,
+// or the number of a MARC record
+type catalogRow struct {
+	Line int
+	Book Books
+	Err  error
+}
+
+// ImportRow : what an import did, or would do in a dry run, with one row
+type ImportRow struct {
+	Line   int
+	ISBN   string
+	Title  string
+	Stock  int
+	Action string
+	Err    error
+}
+
+// ImportReport : every row of an import and how many were added, merged and skipped
+type ImportReport struct {
+	Rows    []ImportRow
+	Added   int
+	Merged  int
+	Skipped int
+}
+
+// ImportBooks : add every book of a catalog file like AddBook does,
+// merging the stock of ISBNs already in the library
+// a row that can't be read or added is skipped and reported, the others go ahead;
+// a dry run only validates and reports what would be done
+func (lib *Library) ImportBooks(ctx context.Context, r io.Reader, format string, dryRun bool) (ImportReport, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	var report ImportReport
+	logger := lib.log().With(F("op", "book.import"), F("format", format), F("dry_run", dryRun))
+	rows, err := readCatalog(r, format)
+	if err != nil {
+		logger.failed("Importing books failed.", err)
+		return report, err
+	}
+
+	// ISBNs earlier rows of a dry run would have added
+	seen := map[string]bool{}
+	for _, row := range rows {
+		res := ImportRow{Line: row.Line, ISBN: row.Book.ISBN, Title: row.Book.Title, Stock: row.Book.Stock, Err: row.Err}
+		if res.Err == nil {
+			res.Err = validateCatalogBook(&row.Book)
+			res.ISBN = row.Book.ISBN
+		}
+		if res.Err == nil {
+			res.Action = ImportAdd
+			_, err := lib.store.Book(row.Book.ISBN)
+			if err == nil || seen[row.Book.ISBN] {
+				res.Action = ImportMerge
+			} else if !errors.Is(err, ErrBookNotExists) {
+				res.Err = err
+			}
+		}
+		if res.Err == nil && !dryRun {
+			_, res.Err = lib.AddBook(ctx, row.Book.Title, row.Book.ISBN, row.Book.Author, row.Book.Publisher, row.Book.Stock)
+		}
+
+		if res.Err != nil {
+			res.Action = ImportSkip
+			report.Skipped++
+		} else if res.Action == ImportAdd {
+			seen[row.Book.ISBN] = true
+			report.Added++
+		} else {
+			report.Merged++
+		}
+		report.Rows = append(report.Rows, res)
+	}
+
+	logger.Info("Books imported.", F("added", report.Added), F("merged", report.Merged), F("skipped", report.Skipped))
+	return report, nil
+}
+
+// validateCatalogBook : check a book read from a catalog and put its ISBN in canonical form
+func validateCatalogBook(book *Books) error {
+	if book.ISBN == "" || book.Title == "" || book.Author == "" || book.Publisher == "" {
+		return ErrMissingField
+	}
+	canonical, err := isbn.Canonical(book.ISBN)
+	if err != nil {
+		return err
+	}
+	book.ISBN = canonical
+	// checked here too so that a dry run reports it
+	return checkStock(book.Stock)
+}
+
+// ExportBooks : write the catalog in the given format, removed books only if includeRemoved is set
+// stock is the number of copies in the library, so an export imports back into an empty library as it was
+func (lib *Library) ExportBooks(ctx context.Context, w io.Writer, format string, includeRemoved bool) (int, error) {
+	lib, _, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	if !contains(CatalogFormats, format) {
+		return 0, ErrUnknownFormat
+	}
+	logger := lib.log().With(F("op", "book.export"), F("format", format))
+	all, err := lib.store.AllBooks()
+	if err != nil {
+		logger.failed("Exporting books failed.", err)
+		return 0, err
+	}
+	BookList := []Books{}
+	for _, book := range all {
+		if book.Stock > 0 || includeRemoved {
+			BookList = append(BookList, book)
+		}
+	}
+	err = writeCatalog(w, format, BookList)
+	if err != nil {
+		logger.failed("Exporting books failed.", err)
+		return 0, err
+	}
+	logger.Info("Books exported.", F("books", len(BookList)))
+	return len(BookList), nil
+}
+
+// readCatalog : the books of a catalog file
+func readCatalog(r io.Reader, format string) ([]catalogRow, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(r)
+	case FormatJSONL:
+		return readJSONL(r)
+	case FormatMARC:
+		return readMARC(r)
+	case FormatMARCXML:
+		return readMARCXML(r)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// writeCatalog : write books as a catalog file
+func writeCatalog(w io.Writer, format string, books []Books) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, books)
+	case FormatJSONL:
+		return writeJSONL(w, books)
+	case FormatMARC:
+		return writeMARC(w, books)
+	case FormatMARCXML:
+		return writeMARCXML(w, books)
+	}
+	return ErrUnknownFormat
+}
+
+// parseStock : the stock column of a row, 1 if it is empty
+func parseStock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 1, nil
+	}
+	stock, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, ErrInvalidStock
+	}
+	return stock, nil
+}
+
+// catalogColumns : the columns of the CSV format, stock may be left out
+var catalogColumns = []string{"isbn", "title", "author", "publisher", "stock"}
+
+// readCSV : CSV with a header row naming the columns, in any order
+func readCSV(r io.Reader) ([]catalogRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, name := range catalogColumns[:4] {
+		if _, ok := index[name]; !ok {
+			return nil, ErrCatalogColumns
+		}
+	}
+
+	var rows []catalogRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			rows = append(rows, catalogRow{Line: line, Err: ErrCatalogRow})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != len(header) {
+			rows = append(rows, catalogRow{Line: line, Err: ErrCatalogRow})
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := catalogRow{Line: line, Book: Books{ISBN: field("isbn"), Title: field("title"), Author: field("author"), Publisher: field("publisher")}}
+		row.Book.Stock, row.Err = parseStock(field("stock"))
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func writeCSV(w io.Writer, books []Books) error {
+	writer := csv.NewWriter(w)
+	writer.Write(catalogColumns)
+	for _, book := range books {
+		writer.Write([]string{book.ISBN, book.Title, book.Author, book.Publisher, strconv.Itoa(book.Stock)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// catalogJSON : a book as a line of JSON Lines
+type catalogJSON struct {
+	ISBN      string `json:"isbn"`
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	Publisher string `json:"publisher"`
+	Stock     *int   `json:"stock,omitempty"`
+}
+
+// readJSONL : one JSON object per line, blank lines are skipped
+func readJSONL(r io.Reader) ([]catalogRow, error) {
+	var rows []catalogRow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var res catalogJSON
+		if err := json.Unmarshal([]byte(text), &res); err != nil {
+			rows = append(rows, catalogRow{Line: line, Err: ErrCatalogRow})
+			continue
+		}
+		row := catalogRow{Line: line, Book: Books{ISBN: strings.TrimSpace(res.ISBN), Title: strings.TrimSpace(res.Title),
+			Author: strings.TrimSpace(res.Author), Publisher: strings.TrimSpace(res.Publisher), Stock: 1}}
+		if res.Stock != nil {
+			row.Book.Stock = *res.Stock
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func writeJSONL(w io.Writer, books []Books) error {
+	encoder := json.NewEncoder(w)
+	for _, book := range books {
+		stock := book.Stock
+		if err := encoder.Encode(catalogJSON{book.ISBN, book.Title, book.Author, book.Publisher, &stock}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marcField : a field of a MARC record, control fields (tags below 010) have a Value instead of subfields
+type marcField struct {
+	Tag       string
+	Ind1      byte
+	Ind2      byte
+	Value     string
+	Subfields []marcSubfield
+}
+
+type marcSubfield struct {
+	Code  byte
+	Value string
+}
+
+// marcRecord : a MARC21 bibliographic record, as read from ISO 2709 or MARCXML
+type marcRecord struct {
+	Leader string
+	Fields []marcField
+}
+
+// MARC21 fields a book maps to:
+// 020 $a ISBN, 245 $a $b title, 100 $a and 700 $a authors, 264 or 260 $b publisher,
+// and an 852 holdings field for every copy
+const marcLeader = "00000nam a2200000 i 4500"
+
+// subfields : the values of a subfield in every field with the given tag
+func (rec marcRecord) subfields(tag string, code byte) []string {
+	var res []string
+	for _, field := range rec.Fields {
+		if field.Tag != tag {
+			continue
+		}
+		for _, sub := range field.Subfields {
+			if sub.Code == code {
+				res = append(res, sub.Value)
+			}
+		}
+	}
+	return res
+}
+
+func (rec marcRecord) count(tag string) int {
+	n := 0
+	for _, field := range rec.Fields {
+		if field.Tag == tag {
+			n++
+		}
+	}
+	return n
+}
+
+// trimISBD : a value without the trailing ISBD punctuation cataloguers put before the next subfield
+func trimISBD(s string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), " /:;,="))
+}
+
+// book : the book a MARC record describes
+func (rec marcRecord) book() Books {
+	var book Books
+	if isbns := rec.subfields("020", 'a'); len(isbns) > 0 {
+		// "9780735219090 (hardcover)"
+		if fields := strings.Fields(isbns[0]); len(fields) > 0 {
+			book.ISBN = fields[0]
+		}
+	}
+	var title []string
+	for _, code := range []byte{'a', 'b'} {
+		for _, s := range rec.subfields("245", code) {
+			if s = trimISBD(s); s != "" {
+				title = append(title, s)
+			}
+		}
+	}
+	book.Title = strings.Join(title, ": ")
+	var authors []string
+	for _, tag := range []string{"100", "110", "700", "710"} {
+		for _, s := range rec.subfields(tag, 'a') {
+			if s = trimISBD(s); s != "" {
+				authors = append(authors, s)
+			}
+		}
+	}
+	book.Author = strings.Join(authors, ", ")
+	for _, tag := range []string{"264", "260"} {
+		if publishers := rec.subfields(tag, 'b'); len(publishers) > 0 && book.Publisher == "" {
+			book.Publisher = trimISBD(publishers[0])
+		}
+	}
+	book.Stock = rec.count("852")
+	if book.Stock == 0 {
+		book.Stock = 1
+	}
+	return book
+}
+
+// marcOf : the MARC record of a book
+func marcOf(book Books) marcRecord {
+	rec := marcRecord{Leader: marcLeader}
+	rec.Fields = append(rec.Fields,
+		marcField{Tag: "001", Value: book.ISBN},
+		marcField{Tag: "020", Ind1: ' ', Ind2: ' ', Subfields: []marcSubfield{{'a', strings.Replace(book.ISBN, "-", "", -1)}}},
+		marcField{Tag: "100", Ind1: '1', Ind2: ' ', Subfields: []marcSubfield{{'a', book.Author}}},
+		marcField{Tag: "245", Ind1: '1', Ind2: '0', Subfields: []marcSubfield{{'a', book.Title}}},
+		marcField{Tag: "264", Ind1: ' ', Ind2: '1', Subfields: []marcSubfield{{'b', book.Publisher}}},
+	)
+	for i := 0; i < book.Stock; i++ {
+		rec.Fields = append(rec.Fields, marcField{Tag: "852", Ind1: ' ', Ind2: ' ', Subfields: []marcSubfield{{'p', fmt.Sprintf("%s-%d", book.ISBN, i+1)}}})
+	}
+	return rec
+}
+
+// ISO 2709 delimiters
+const (
+	marcSubfieldDelimiter = 0x1F
+	marcFieldTerminator   = 0x1E
+	marcRecordTerminator  = 0x1D
+)
+
+// readMARC : MARC21 records in ISO 2709, the binary format
+// a record that can't be decoded is reported and skipped; the file stops being read
+// if one can't even be told apart from the next
+func readMARC(r io.Reader) ([]catalogRow, error) {
+	var rows []catalogRow
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		// skip line breaks some tools put between records
+		for {
+			b, err := reader.Peek(1)
+			if err != nil || (b[0] != '\n' && b[0] != '\r') {
+				break
+			}
+			reader.ReadByte()
+		}
+		head, err := reader.Peek(5)
+		if err == io.EOF && len(head) == 0 {
+			break
+		}
+		length, convErr := strconv.Atoi(string(head))
+		if err != nil || convErr != nil || length < 25 {
+			rows = append(rows, catalogRow{Line: n, Err: ErrCatalogRow})
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			rows = append(rows, catalogRow{Line: n, Err: ErrCatalogRow})
+			break
+		}
+		rec, err := decodeMARC(data)
+		if err != nil {
+			rows = append(rows, catalogRow{Line: n, Err: err})
+			continue
+		}
+		rows = append(rows, catalogRow{Line: n, Book: rec.book()})
+	}
+	return rows, nil
+}
+
+// decodeMARC : one ISO 2709 record
+func decodeMARC(data []byte) (marcRecord, error) {
+	if len(data) < 25 || data[len(data)-1] != marcRecordTerminator {
+		return marcRecord{}, ErrCatalogRow
+	}
+	rec := marcRecord{Leader: string(data[:24])}
+	base, err := strconv.Atoi(string(data[12:17]))
+	if err != nil || base <= 24 || base > len(data) || data[base-1] != marcFieldTerminator {
+		return rec, ErrCatalogRow
+	}
+	directory := data[24 : base-1]
+	if len(directory)%12 != 0 {
+		return rec, ErrCatalogRow
+	}
+	for i := 0; i < len(directory); i += 12 {
+		entry := directory[i : i+12]
+		length, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil || length < 1 || base+start+length > len(data) {
+			return rec, ErrCatalogRow
+		}
+		value := data[base+start : base+start+length-1]
+		field := marcField{Tag: string(entry[:3])}
+		if field.Tag < "010" {
+			field.Value = string(value)
+		} else if len(value) >= 2 {
+			field.Ind1, field.Ind2 = value[0], value[1]
+			for _, sub := range bytes.Split(value[2:], []byte{marcSubfieldDelimiter})[1:] {
+				if len(sub) > 0 {
+					field.Subfields = append(field.Subfields, marcSubfield{sub[0], string(sub[1:])})
+				}
+			}
+		}
+		rec.Fields = append(rec.Fields, field)
+	}
+	return rec, nil
+}
+
+// encodeMARC : one ISO 2709 record
+func encodeMARC(rec marcRecord) []byte {
+	var directory, body bytes.Buffer
+	for _, field := range rec.Fields {
+		var value bytes.Buffer
+		if field.Tag < "010" {
+			value.WriteString(field.Value)
+		} else {
+			value.WriteByte(field.Ind1)
+			value.WriteByte(field.Ind2)
+			for _, sub := range field.Subfields {
+				value.WriteByte(marcSubfieldDelimiter)
+				value.WriteByte(sub.Code)
+				value.WriteString(sub.Value)
+			}
+		}
+		value.WriteByte(marcFieldTerminator)
+		fmt.Fprintf(&directory, "%3s%04d%05d", field.Tag, value.Len(), body.Len())
+		body.Write(value.Bytes())
+	}
+	directory.WriteByte(marcFieldTerminator)
+	base := 24 + directory.Len()
+	length := base + body.Len() + 1
+
+	leader := []byte(rec.Leader)
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+	res := append(leader, directory.Bytes()...)
+	res = append(res, body.Bytes()...)
+	return append(res, marcRecordTerminator)
+}
+
+func writeMARC(w io.Writer, books []Books) error {
+	for _, book := range books {
+		if _, err := w.Write(encodeMARC(marcOf(book))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MARCXML, http://www.loc.gov/standards/marcxml/
+type marcXMLCollection struct {
+	XMLName xml.Name        `xml:"http://www.loc.gov/MARC21/slim collection"`
+	Records []marcXMLRecord `xml:"record"`
+}
+
+type marcXMLRecord struct {
+	Leader        string             `xml:"leader"`
+	ControlFields []marcXMLControl   `xml:"controlfield"`
+	DataFields    []marcXMLDataField `xml:"datafield"`
+}
+
+type marcXMLControl struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcXMLDataField struct {
+	Tag       string            `xml:"tag,attr"`
+	Ind1      string            `xml:"ind1,attr"`
+	Ind2      string            `xml:"ind2,attr"`
+	Subfields []marcXMLSubfield `xml:"subfield"`
+}
+
+type marcXMLSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+func indicator(s string) byte {
+	if s == "" {
+		return ' '
+	}
+	return s[0]
+}
+
+// readMARCXML : a MARCXML collection, or a single record
+func readMARCXML(r io.Reader) ([]catalogRow, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var collection marcXMLCollection
+	if err := xml.Unmarshal(data, &collection); err != nil {
+		var single marcXMLRecord
+		if xml.Unmarshal(data, &single) != nil {
+			return nil, err
+		}
+		collection.Records = []marcXMLRecord{single}
+	}
+
+	var rows []catalogRow
+	for i, x := range collection.Records {
+		rec := marcRecord{Leader: x.Leader}
+		for _, field := range x.ControlFields {
+			rec.Fields = append(rec.Fields, marcField{Tag: field.Tag, Value: field.Value})
+		}
+		for _, field := range x.DataFields {
+			res := marcField{Tag: field.Tag, Ind1: indicator(field.Ind1), Ind2: indicator(field.Ind2)}
+			for _, sub := range field.Subfields {
+				if sub.Code != "" {
+					res.Subfields = append(res.Subfields, marcSubfield{sub.Code[0], sub.Value})
+				}
+			}
+			rec.Fields = append(rec.Fields, res)
+		}
+		rows = append(rows, catalogRow{Line: i + 1, Book: rec.book()})
+	}
+	return rows, nil
+}
+
+func writeMARCXML(w io.Writer, books []Books) error {
+	var collection marcXMLCollection
+	for _, book := range books {
+		rec := marcOf(book)
+		x := marcXMLRecord{Leader: rec.Leader}
+		for _, field := range rec.Fields {
+			if field.Tag < "010" {
+				x.ControlFields = append(x.ControlFields, marcXMLControl{field.Tag, field.Value})
+				continue
+			}
+			res := marcXMLDataField{Tag: field.Tag, Ind1: string(field.Ind1), Ind2: string(field.Ind2)}
+			for _, sub := range field.Subfields {
+				res.Subfields = append(res.Subfields, marcXMLSubfield{string(sub.Code), sub.Value})
+			}
+			x.DataFields = append(x.DataFields, res)
+		}
+		collection.Records = append(collection.Records, x)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(collection); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
+)
+
+const catalogCSV = `isbn,title,author,publisher,stock
+978-0735219090,Where the Crawdads Sing,Delia Owens,G.P. Putnam's Sons,2
+1984801252,Untamed,Glennon Doyle,The Dial Press,
+978-0735219091,Bad Check Digit,Nobody,Nowhere,1
+978-0385545938,Camino Winds,John Grisham,,1
+978-0544379657,Secrets of the Savanna,"Mark Owens, Delia Owens",Mariner Books,none
+978-0385545938,Camino Winds,John Grisham,Doubleday,3
+"978-1405272186,The Owl
+`
+
+func TestImportBooks(t *testing.T) {
+	ilib := newHoldLibrary(t)
+	defer ilib.store.Close()
+
+	// a dry run reports but changes nothing
+	report, err := ilib.ImportBooks(ctx, strings.NewReader(catalogCSV), FormatCSV, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 2 || report.Merged != 1 || report.Skipped != 4 {
+		t.Errorf("got %d %d %d, want 2 1 4", report.Added, report.Merged, report.Skipped)
+	}
+	if _, err := ilib.store.Book(`978-0735219090`); !errors.Is(err, ErrBookNotExists) {
+		t.Errorf("got %v after a dry run, want %v", err, ErrBookNotExists)
+	}
+
+	report, err = ilib.ImportBooks(ctx, strings.NewReader(catalogCSV), FormatCSV, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		testid int
+		line   int
+		ISBN   string
+		action string
+		err    error
+		stock  int
+	}{
+		{0, 2, `978-0735219090`, ImportAdd, nil, 2},
+		{1, 3, `978-1984801258`, ImportAdd, nil, 1},
+		{2, 4, `978-0735219091`, ImportSkip, isbn.ErrInvalid, 0},
+		{3, 5, `978-0385545938`, ImportSkip, ErrMissingField, 4},
+		{4, 6, `978-0544379657`, ImportSkip, ErrInvalidStock, 0},
+		{5, 7, `978-0385545938`, ImportMerge, nil, 4},
+		{6, 8, ``, ImportSkip, ErrCatalogRow, 0},
+	}
+
+	if len(report.Rows) != len(tests) {
+		t.Fatalf("got %d rows, want %d", len(report.Rows), len(tests))
+	}
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			row := report.Rows[tt.testid]
+			if row.Line != tt.line || row.Action != tt.action || row.Err != tt.err {
+				t.Errorf("got line %d %s %v, want line %d %s %v", row.Line, row.Action, row.Err, tt.line, tt.action, tt.err)
+			}
+			if tt.ISBN == `` {
+				return
+			}
+			book, err := ilib.store.Book(tt.ISBN)
+			if tt.stock == 0 {
+				if !errors.Is(err, ErrBookNotExists) {
+					t.Errorf("got %v, want %v", err, ErrBookNotExists)
+				}
+			} else if err != nil || book.Stock != tt.stock {
+				t.Errorf("got stock %d %v, want %d", book.Stock, err, tt.stock)
+			}
+		})
+	}
+
+	if _, err := ilib.ImportBooks(ctx, strings.NewReader("isbn,title\n"), FormatCSV, false); !errors.Is(err, ErrCatalogColumns) {
+		t.Errorf("got %v, want %v", err, ErrCatalogColumns)
+	}
+	if _, err := ilib.ImportBooks(ctx, strings.NewReader(""), "xlsx", false); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("got %v, want %v", err, ErrUnknownFormat)
+	}
+
+	jsonl := `{"isbn": "978-0544379657", "title": "Secrets of the Savanna", "author": "Mark Owens, Delia Owens", "publisher": "Mariner Books"}
+{"isbn": "978-0735219090", "title": "Where the Crawdads Sing", "author": "Delia Owens", "publisher": "G.P. Putnam's Sons", "stock": 1}
+{"isbn": "978-1405272186", "title":
+`
+	report, err = ilib.ImportBooks(ctx, strings.NewReader(jsonl), FormatJSONL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 1 || report.Merged != 1 || report.Skipped != 1 || report.Rows[2].Err != ErrCatalogRow {
+		t.Errorf("got %+v, want one row added, merged and skipped", report)
+	}
+	if book, _ := ilib.store.Book(`978-0735219090`); book.Stock != 3 {
+		t.Errorf("got stock %d, want 3", book.Stock)
+	}
+}
+
+func TestExportBooks(t *testing.T) {
+	elib := newHoldLibrary(t)
+	defer elib.store.Close()
+
+	if _, err := elib.ImportBooks(ctx, strings.NewReader(catalogCSV), FormatCSV, false); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := elib.store.AllBooks()
+
+	for i, format := range CatalogFormats {
+		testname := fmt.Sprintf("%d", i)
+		t.Run(testname, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := elib.ExportBooks(ctx, &buf, format, false)
+			if err != nil || n != len(want) {
+				t.Fatalf("got %d %v, want %d books", n, err, len(want))
+			}
+
+			flib := newTestLibrary(t)
+			defer flib.store.Close()
+			report, err := flib.ImportBooks(ctx, &buf, format, false)
+			if err != nil || report.Added != len(want) || report.Skipped != 0 {
+				t.Fatalf("got %+v %v, want %d books added", report, err, len(want))
+			}
+			got, _ := flib.store.AllBooks()
+			for j := range want {
+				w, g := want[j], got[j]
+				if g.ISBN != w.ISBN || g.Title != w.Title || g.Author != w.Author || g.Publisher != w.Publisher || g.Stock != w.Stock {
+					t.Errorf("got %+v, want %+v", g, w)
+				}
+			}
+		})
+	}
+}
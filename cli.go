@@ -0,0 +1,857 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exit codes of the command line
+const (
+	ExitOK       = 0
+	ExitFailure  = 1
+	ExitUsage    = 2
+	ExitAuth     = 3
+	ExitNotFound = 4
+	ExitConfig   = 5
+)
+
+var errUsage = errors.New("Invalid usage.")
+
+// cli : one run of a subcommand, by whoever the credentials belong to
+type cli struct {
+	ctx     context.Context
+	lib     *Library
+	session Session
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+// cliCommand : a subcommand, what it requires, and what it does with its arguments
+// loan commands acting on someone else's loans require PermAnyLoans on top of perm
+type cliCommand struct {
+	perm  Permission
+	usage string
+	run   func(c *cli, args []string) error
+}
+
+// cliCommands : every subcommand but repl, serve, schedule and migrate, by name
+var cliCommands = map[string]cliCommand{
+	"search":           {PermQueryBooks, "search [--page N] [--size N] [--removed] QUERY...", (*cli).search},
+	"book show":        {PermQueryBooks, "book show --isbn ISBN", (*cli).bookShow},
+	"book add":         {PermManageBooks, "book add --isbn ISBN --title TITLE --author AUTHOR --publisher PUBLISHER [--stock N]", (*cli).bookAdd},
+	"book remove":      {PermManageBooks, "book remove --isbn ISBN --reason lost|damaged|weeded|transferred [--copies N] [--note NOTE]", (*cli).bookRemove},
+	"book withdrawals": {PermManageBooks, "book withdrawals --isbn ISBN", (*cli).bookWithdrawals},
+	"book import":      {PermManageBooks, "book import --format FORMAT [--file FILE] [--dry-run]", (*cli).bookImport},
+	"book export":      {PermManageBooks, "book export --format FORMAT [--file FILE] [--removed]", (*cli).bookExport},
+	"copy list":        {PermManageBooks, "copy list --isbn ISBN", (*cli).copyList},
+	"copy add":         {PermManageBooks, "copy add --isbn ISBN [--barcode BARCODE] [--location SHELF]", (*cli).copyAdd},
+	"copy remove":      {PermManageBooks, "copy remove --barcode BARCODE --reason lost|damaged|weeded|transferred [--note NOTE]", (*cli).copyRemove},
+	"copy reinstate":   {PermManageBooks, "copy reinstate --barcode BARCODE", (*cli).copyReinstate},
+	"loan borrow":      {PermOwnLoans, "loan borrow [--user ID] (--isbn ISBN | --barcode BARCODE)", (*cli).loanBorrow},
+	"loan return":      {PermOwnLoans, "loan return [--user ID] --isbn ISBN | loan return --batch FILE", (*cli).loanReturn},
+	"loan extend":      {PermOwnLoans, "loan extend [--user ID] --isbn ISBN", (*cli).loanExtend},
+	"loan list":        {PermOwnLoans, "loan list [--user ID]", (*cli).loanList},
+	"loan history":     {PermOwnLoans, "loan history [--user ID]", (*cli).loanHistory},
+	"hold place":       {PermOwnLoans, "hold place [--user ID] --isbn ISBN", (*cli).holdPlace},
+	"hold cancel":      {PermOwnLoans, "hold cancel [--user ID] --isbn ISBN", (*cli).holdCancel},
+	"fine list":        {PermOwnLoans, "fine list [--user ID]", (*cli).fineList},
+	"fine pay":         {PermManageFines, "fine pay --user ID --amount AMOUNT", (*cli).finePay},
+	"user add":         {PermManageUsers, "user add --id ID --name NAME --password PASSWORD [--role reader|librarian|admin]", (*cli).userAdd},
+	"user passwd":      {PermOwnPassword, "user passwd [--id ID] --new-password PASSWORD", (*cli).userPasswd},
+	"user deactivate":  {PermManageUsers, "user deactivate --id ID", (*cli).userDeactivate},
+	"user reactivate":  {PermManageUsers, "user reactivate --id ID", (*cli).userReactivate},
+	"user expire":      {PermManageUsers, "user expire --id ID [--on YYYY-MM-DD]", (*cli).userExpire},
+	"user delete":      {PermManageUsers, "user delete --id ID", (*cli).userDelete},
+	"user data":        {PermOwnData, "user data [--id ID] [--out FILE]", (*cli).userData},
+	"report":           {PermReports, "report NAME [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--limit N] [--format table|csv|json] [--out FILE]", (*cli).report},
+	"audit":            {PermAudit, "audit [--user ID] [--action ACTION] [--from YYYY-MM-DD] [--to YYYY-MM-DD]", (*cli).audit},
+}
+
+// exitCode : the exit code an error, or the error it wraps, maps to
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case isAny(err, errUsage, ErrUnknownReport, ErrReportFormat, ErrUnknownFormat, ErrDateRange, ErrInvalidAmount, ErrInvalidStock,
+		ErrWithdrawalReason):
+		return ExitUsage
+	case isAny(err, ErrPassword, ErrNotLoggedIn, ErrSessionInvalid, ErrSessionExpired, ErrPermissionDenied,
+		ErrAccountInactive, ErrAccountExpired):
+		return ExitAuth
+	case isAny(err, ErrBookNotExists, ErrUserNotExists, ErrNotBorrowed, ErrNoHold, ErrCopyNotExists):
+		return ExitNotFound
+	}
+	return ExitFailure
+}
+
+// RunCLI : run the command line in args and return its exit code
+// credentials come from --login and --password before the subcommand,
+// or $LIBRARY_USER and $LIBRARY_PASSWORD; without them commands run as a guest.
+// Without a subcommand, or with "repl", it is the interactive system.
+// A library without a store is configured from --config and connected first
+func (lib *Library) RunCLI(args []string, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("library", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	configPath := global.String("config", os.Getenv("LIBRARY_CONFIG"), "configuration file, "+DefaultConfigFile+" by default")
+	login := global.String("login", os.Getenv("LIBRARY_USER"), "log in as this user")
+	password := global.String("password", os.Getenv("LIBRARY_PASSWORD"), "password of the user")
+	global.Usage = func() { lib.cliUsage(stderr) }
+	if err := global.Parse(args); err != nil {
+		return ExitUsage
+	}
+	args = global.Args()
+	ctx := context.Background()
+	if len(args) == 0 {
+		args = []string{"repl"}
+	}
+
+	cfg := DefaultConfig()
+	if lib.store == nil {
+		var err error
+		path := *configPath
+		if path == "" {
+			path = DefaultConfigFile
+		}
+		if cfg, err = LoadConfig(path, *configPath != ""); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitConfig
+		}
+		// dates typed and printed are in the library's time zone, as the database's are
+		time.Local, _ = time.LoadLocation(cfg.Timezone)
+		lib.Configure(cfg)
+		if err := lib.ConnectDB(ctx, cfg); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitConfig
+		}
+	}
+
+	if args[0] == "migrate" {
+		if err := lib.RunMigrate(ctx, args[1:]); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitFailure
+		}
+		return ExitOK
+	}
+	if err := lib.Migrate(ctx, LatestVersion()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return ExitFailure
+	}
+
+	switch args[0] {
+	case "repl":
+		lib.REPL(ctx)
+		return ExitOK
+	case "serve":
+		addr := cfg.ServerAddr()
+		if len(args) > 1 {
+			addr = args[1]
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitFailure
+		}
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		if err := lib.Serve(ctx, l, stop); err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitFailure
+		}
+		return ExitOK
+	case "schedule":
+		interval := cfg.SweepInterval
+		if len(args) > 1 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				fmt.Fprintln(stderr, "invalid interval", args[1])
+				return ExitUsage
+			}
+			interval = d
+		}
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		lib.RunScheduler(ctx, interval, stop)
+		return ExitOK
+	case "help":
+		lib.cliUsage(stdout)
+		return ExitOK
+	}
+
+	name, rest := args[0], args[1:]
+	if _, ok := cliCommands[name]; !ok && len(args) > 1 {
+		name, rest = args[0]+" "+args[1], args[2:]
+	}
+	cmd, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprintln(stderr, strings.Join(args, " ")+": command not found")
+		lib.cliUsage(stderr)
+		return ExitUsage
+	}
+
+	c := &cli{ctx: ctx, lib: lib, session: GuestSession(), stdout: stdout, stderr: stderr}
+	if *login != "" {
+		session, err := lib.Login(ctx, *login, *password)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitAuth
+		}
+		defer lib.Logout(ctx, session.Token)
+		c.session = session
+	}
+	if err := lib.Authorize(c.session, cmd.perm); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitCode(err)
+	}
+	c.lib = lib.As(c.session.UserID, OriginCLI)
+
+	err := cmd.run(c, rest)
+	if err == errUsage {
+		fmt.Fprintln(stderr, "usage: library [--login ID --password PASSWORD] "+cmd.usage)
+	} else if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	return exitCode(err)
+}
+
+// cliUsage : list the subcommands
+func (lib *Library) cliUsage(w io.Writer) {
+	var usages []string
+	for _, cmd := range cliCommands {
+		usages = append(usages, "\tlibrary "+cmd.usage)
+	}
+	sort.Strings(usages)
+	fmt.Fprintln(w, "usage: library [--config FILE] [--login ID --password PASSWORD] COMMAND [FLAGS]")
+	fmt.Fprintln(w, "\tlibrary [repl]")
+	fmt.Fprintln(w, "\tlibrary serve [ADDR]")
+	fmt.Fprintln(w, "\tlibrary schedule [INTERVAL]")
+	fmt.Fprintln(w, "\tlibrary migrate [up [VERSION] | down [STEPS] | status | reset]")
+	fmt.Fprintln(w, strings.Join(usages, "\n"))
+}
+
+// flags : a flag set for a subcommand that reports problems on stderr
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {}
+	return fs
+}
+
+// parse : parse args into fs, errUsage if they don't fit or a required flag is empty
+func (c *cli) parse(fs *flag.FlagSet, args []string, required ...string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	for _, name := range required {
+		if fs.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(c.stderr, "--%s is required\n", name)
+			return errUsage
+		}
+	}
+	return nil
+}
+
+// target : the user a loan command applies to, the logged-in one unless userID names someone else
+func (c *cli) target(userID string) (string, error) {
+	if userID == "" {
+		userID = c.session.UserID
+	}
+	if err := c.lib.AuthorizeFor(c.session, userID, PermOwnLoans, PermAnyLoans); err != nil {
+		return "", err
+	}
+	return userID, c.lib.CheckUserExists(c.ctx, userID)
+}
+
+// dates : a range from two YYYY-MM-DD flags, to included
+func dates(from, to string) (time.Time, time.Time, error) {
+	var r [2]time.Time
+	for i, s := range []string{from, to} {
+		if s == "" {
+			continue
+		}
+		t, err := time.ParseInLocation(dateTemplate, s, time.Local)
+		if err != nil {
+			return r[0], r[1], errUsage
+		}
+		r[i] = t
+	}
+	if !r[1].IsZero() {
+		r[1] = r[1].AddDate(0, 0, 1)
+	}
+	return r[0], r[1], nil
+}
+
+// open : the file to read, stdin for "-" or ""
+func open(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+func (c *cli) search(args []string) error {
+	fs := c.flags("search")
+	page := fs.Int("page", 1, "page of results")
+	size := fs.Int("size", SearchPageSize, "results per page")
+	removed := fs.Bool("removed", false, "include removed books")
+	if err := c.parse(fs, args); err != nil || fs.NArg() == 0 {
+		return errUsage
+	}
+	res, err := c.lib.Search(c.ctx, strings.Join(fs.Args(), " "), *page, *size, *removed && c.session.Can(PermManageBooks))
+	if err != nil {
+		return err
+	}
+	c.lib.PrintSearch(c.stdout, res)
+	return nil
+}
+
+func (c *cli) bookShow(args []string) error {
+	fs := c.flags("book show")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	books, err := c.lib.QueryBookISBN(c.ctx, *ISBN)
+	if err != nil {
+		return err
+	}
+	details, err := c.lib.QueryBookDetails(c.ctx, *ISBN)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintBookQuery(c.stdout, books, c.session.Can(PermManageBooks))
+	c.lib.PrintBookDetails(c.stdout, details)
+	return nil
+}
+
+func (c *cli) bookAdd(args []string) error {
+	fs := c.flags("book add")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	title := fs.String("title", "", "title")
+	author := fs.String("author", "", "authors, separated by commas")
+	publisher := fs.String("publisher", "", "publisher")
+	stock := fs.Int("stock", 1, "copies to add")
+	if err := c.parse(fs, args, "isbn", "title", "author", "publisher"); err != nil {
+		return err
+	}
+	_, err := c.lib.AddBook(c.ctx, *title, *ISBN, *author, *publisher, *stock)
+	return err
+}
+
+func (c *cli) bookRemove(args []string) error {
+	fs := c.flags("book remove")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	copies := fs.Int("copies", 1, "copies on the shelf to withdraw")
+	reason := fs.String("reason", "", "lost, damaged, weeded or transferred")
+	note := fs.String("note", "", "anything else worth recording")
+	if err := c.parse(fs, args, "isbn", "reason"); err != nil {
+		return err
+	}
+	_, err := c.lib.RemoveBook(c.ctx, *ISBN, *copies, *reason, *note)
+	return err
+}
+
+func (c *cli) bookWithdrawals(args []string) error {
+	fs := c.flags("book withdrawals")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	withdrawals, err := c.lib.Withdrawals(c.ctx, *ISBN)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintWithdrawals(c.stdout, withdrawals)
+	return nil
+}
+
+func (c *cli) bookImport(args []string) error {
+	fs := c.flags("book import")
+	format := fs.String("format", "", "csv, jsonl, marc or marcxml")
+	path := fs.String("file", "-", "file to import, - for stdin")
+	dryRun := fs.Bool("dry-run", false, "only report what would be done")
+	if err := c.parse(fs, args, "format"); err != nil {
+		return err
+	}
+	file, err := open(*path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	report, err := c.lib.ImportBooks(c.ctx, file, *format, *dryRun)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintImport(c.stdout, report)
+	if report.Skipped > 0 {
+		return ErrCatalogRow
+	}
+	return nil
+}
+
+func (c *cli) bookExport(args []string) error {
+	fs := c.flags("book export")
+	format := fs.String("format", "", "csv, jsonl, marc or marcxml")
+	path := fs.String("file", "-", "file to export to, - for stdout")
+	removed := fs.Bool("removed", false, "include removed books")
+	if err := c.parse(fs, args, "format"); err != nil {
+		return err
+	}
+	if *path == "-" {
+		_, err := c.lib.ExportBooks(c.ctx, c.stdout, *format, *removed)
+		return err
+	}
+	file, err := os.Create(*path)
+	if err != nil {
+		return err
+	}
+	n, err := c.lib.ExportBooks(c.ctx, file, *format, *removed)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		fmt.Fprintf(c.stdout, "%d book(s) exported.\n", n)
+	}
+	return err
+}
+
+func (c *cli) copyList(args []string) error {
+	fs := c.flags("copy list")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	copies, err := c.lib.Copies(c.ctx, *ISBN)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintCopies(c.stdout, copies)
+	return nil
+}
+
+func (c *cli) copyAdd(args []string) error {
+	fs := c.flags("copy add")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	barcode := fs.String("barcode", "", "barcode, generated if empty")
+	location := fs.String("location", "", "shelf")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	added, err := c.lib.AddCopy(c.ctx, *ISBN, *barcode, *location, c.lib.now())
+	if err == nil {
+		fmt.Fprintln(c.stdout, added)
+	}
+	return err
+}
+
+func (c *cli) copyRemove(args []string) error {
+	fs := c.flags("copy remove")
+	barcode := fs.String("barcode", "", "barcode of the copy")
+	reason := fs.String("reason", "", "lost, damaged, weeded or transferred")
+	note := fs.String("note", "", "anything else worth recording")
+	if err := c.parse(fs, args, "barcode", "reason"); err != nil {
+		return err
+	}
+	return c.lib.RemoveCopy(c.ctx, *barcode, *reason, *note)
+}
+
+func (c *cli) copyReinstate(args []string) error {
+	fs := c.flags("copy reinstate")
+	barcode := fs.String("barcode", "", "barcode of the copy")
+	if err := c.parse(fs, args, "barcode"); err != nil {
+		return err
+	}
+	return c.lib.ReinstateCopy(c.ctx, *barcode)
+}
+
+func (c *cli) loanBorrow(args []string) error {
+	fs := c.flags("loan borrow")
+	userID := fs.String("user", "", "borrower, yourself if empty")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	barcode := fs.String("barcode", "", "barcode of the copy")
+	if err := c.parse(fs, args); err != nil || (*ISBN == "") == (*barcode == "") {
+		return errUsage
+	}
+	if *barcode != "" && !c.session.Can(PermAnyLoans) {
+		return ErrPermissionDenied
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.lib.CheckOverdue(c.ctx, target, c.lib.now()); err != nil {
+		return err
+	}
+	var loan Loan
+	if *barcode != "" {
+		loan, err = c.lib.BorrowCopy(c.ctx, *barcode, target, c.lib.now())
+	} else {
+		loan, err = c.lib.BorrowBook(c.ctx, *ISBN, target, c.lib.now())
+	}
+	if err != nil {
+		return err
+	}
+	c.lib.PrintUnreturned(c.stdout, []Loan{loan})
+	return nil
+}
+
+// loanReturn : return a book, or with --batch every "USER ISBN" line of a file, e.g. from a desk scanner
+// a batch goes on past lines that fail and reports them, failing as a whole if any did
+func (c *cli) loanReturn(args []string) error {
+	fs := c.flags("loan return")
+	userID := fs.String("user", "", "borrower, yourself if empty")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	batch := fs.String("batch", "", `file of "USER ISBN" lines, - for stdin`)
+	if err := c.parse(fs, args); err != nil || (*ISBN == "") == (*batch == "") {
+		return errUsage
+	}
+	if *batch == "" {
+		target, err := c.target(*userID)
+		if err != nil {
+			return err
+		}
+		_, err = c.lib.ReturnBook(c.ctx, *ISBN, target)
+		return err
+	}
+
+	file, err := open(*batch)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var failed, line int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		err := errUsage
+		if len(fields) == 2 {
+			var target string
+			if target, err = c.target(fields[0]); err == nil {
+				_, err = c.lib.ReturnBook(c.ctx, fields[1], target)
+			}
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(c.stderr, "line %d: %s: %v\n", line, scanner.Text(), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d return(s) failed", failed, line)
+	}
+	return nil
+}
+
+func (c *cli) loanExtend(args []string) error {
+	fs := c.flags("loan extend")
+	userID := fs.String("user", "", "borrower, yourself if empty")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.lib.CheckOverdue(c.ctx, target, c.lib.now()); err != nil {
+		return err
+	}
+	loan, err := c.lib.ExtendDeadline(c.ctx, *ISBN, target)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintUnreturned(c.stdout, []Loan{loan})
+	return nil
+}
+
+func (c *cli) loanList(args []string) error {
+	fs := c.flags("loan list")
+	userID := fs.String("user", "", "borrower, yourself if empty")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	loans, err := c.lib.CheckUnreturned(c.ctx, target)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintUnreturned(c.stdout, loans)
+	return nil
+}
+
+func (c *cli) loanHistory(args []string) error {
+	fs := c.flags("loan history")
+	userID := fs.String("user", "", "borrower, yourself if empty")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	loans, err := c.lib.CheckBorrowHistory(c.ctx, target)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintHistory(c.stdout, loans)
+	return nil
+}
+
+func (c *cli) holdPlace(args []string) error {
+	fs := c.flags("hold place")
+	userID := fs.String("user", "", "reader, yourself if empty")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	_, err = c.lib.PlaceHold(c.ctx, *ISBN, target, c.lib.now())
+	return err
+}
+
+func (c *cli) holdCancel(args []string) error {
+	fs := c.flags("hold cancel")
+	userID := fs.String("user", "", "reader, yourself if empty")
+	ISBN := fs.String("isbn", "", "ISBN of the book")
+	if err := c.parse(fs, args, "isbn"); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	return c.lib.CancelHold(c.ctx, *ISBN, target)
+}
+
+func (c *cli) fineList(args []string) error {
+	fs := c.flags("fine list")
+	userID := fs.String("user", "", "reader, yourself if empty")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	target, err := c.target(*userID)
+	if err != nil {
+		return err
+	}
+	balance, entries, err := c.lib.Fines(c.ctx, target)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintFines(c.stdout, balance, entries)
+	return nil
+}
+
+func (c *cli) finePay(args []string) error {
+	fs := c.flags("fine pay")
+	userID := fs.String("user", "", "reader")
+	amount := fs.String("amount", "", `amount paid, e.g. "12.50"`)
+	if err := c.parse(fs, args, "user", "amount"); err != nil {
+		return err
+	}
+	cents, err := ParseMoney(*amount)
+	if err != nil {
+		return ErrInvalidAmount
+	}
+	return c.lib.PayFine(c.ctx, *userID, cents, c.session.UserID)
+}
+
+func (c *cli) userAdd(args []string) error {
+	fs := c.flags("user add")
+	userID := fs.String("id", "", "username")
+	name := fs.String("name", "", "real name")
+	password := fs.String("password", "", "password")
+	role := fs.String("role", RoleReader.String(), "reader, librarian or admin")
+	if err := c.parse(fs, args, "id", "name", "password"); err != nil {
+		return err
+	}
+	user := Users{ID: *userID, Name: *name, Password: *password}
+	switch *role {
+	case RoleReader.String():
+		user.Type = int(RoleReader)
+	case RoleLibrarian.String():
+		user.Type = int(RoleLibrarian)
+	case RoleAdmin.String():
+		user.Type = int(RoleAdmin)
+	default:
+		return errUsage
+	}
+	return c.lib.AddUser(c.ctx, user)
+}
+
+func (c *cli) userPasswd(args []string) error {
+	fs := c.flags("user passwd")
+	userID := fs.String("id", "", "username, yourself if empty")
+	password := fs.String("new-password", "", "the new password")
+	if err := c.parse(fs, args, "new-password"); err != nil {
+		return err
+	}
+	if *userID == "" {
+		*userID = c.session.UserID
+	}
+	if err := c.lib.AuthorizeFor(c.session, *userID, PermOwnPassword, PermManageUsers); err != nil {
+		return err
+	}
+	if err := c.lib.ModifyPassword(c.ctx, *userID, *password); err != nil {
+		return err
+	}
+	if *userID != c.session.UserID {
+		return c.lib.RevokeSessions(c.ctx, *userID)
+	}
+	return nil
+}
+
+func (c *cli) userDeactivate(args []string) error {
+	fs := c.flags("user deactivate")
+	userID := fs.String("id", "", "username")
+	if err := c.parse(fs, args, "id"); err != nil {
+		return err
+	}
+	return c.lib.DeactivateUser(c.ctx, *userID)
+}
+
+func (c *cli) userReactivate(args []string) error {
+	fs := c.flags("user reactivate")
+	userID := fs.String("id", "", "username")
+	if err := c.parse(fs, args, "id"); err != nil {
+		return err
+	}
+	return c.lib.ReactivateUser(c.ctx, *userID)
+}
+
+func (c *cli) userExpire(args []string) error {
+	fs := c.flags("user expire")
+	userID := fs.String("id", "", "username")
+	on := fs.String("on", "", "the day the account expires, YYYY-MM-DD, never if empty")
+	if err := c.parse(fs, args, "id"); err != nil {
+		return err
+	}
+	var expiresAt time.Time
+	if *on != "" {
+		t, err := time.ParseInLocation(dateTemplate, *on, time.Local)
+		if err != nil {
+			return errUsage
+		}
+		expiresAt = t
+	}
+	return c.lib.SetUserExpiry(c.ctx, *userID, expiresAt)
+}
+
+func (c *cli) userDelete(args []string) error {
+	fs := c.flags("user delete")
+	userID := fs.String("id", "", "username")
+	if err := c.parse(fs, args, "id"); err != nil {
+		return err
+	}
+	return c.lib.DeleteUser(c.ctx, *userID)
+}
+
+func (c *cli) userData(args []string) error {
+	fs := c.flags("user data")
+	userID := fs.String("id", "", "username, yourself if empty")
+	out := fs.String("out", "", "file to write to, stdout if empty")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		*userID = c.session.UserID
+	}
+	if err := c.lib.AuthorizeFor(c.session, *userID, PermOwnData, PermManageUsers); err != nil {
+		return err
+	}
+	if *out == "" {
+		return c.lib.ExportUserData(c.ctx, c.stdout, *userID)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = c.lib.ExportUserData(c.ctx, file, *userID)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *cli) report(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errUsage
+	}
+	fs := c.flags("report")
+	from := fs.String("from", "", "first day, YYYY-MM-DD")
+	to := fs.String("to", "", "last day, YYYY-MM-DD")
+	limit := fs.Int("limit", 0, "how many titles most-borrowed lists, all if 0")
+	format := fs.String("format", FormatTable, "table, csv or json")
+	out := fs.String("out", "", "file to write to, stdout if empty")
+	if err := c.parse(fs, args[1:]); err != nil {
+		return err
+	}
+	var r ReportRange
+	var err error
+	if r.From, r.To, err = dates(*from, *to); err != nil {
+		return err
+	}
+	if !contains(ReportFormats, *format) {
+		return ErrReportFormat
+	}
+	rows, err := c.lib.Report(c.ctx, args[0], r, *limit)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return WriteReport(c.stdout, rows, *format)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = WriteReport(file, rows, *format)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *cli) audit(args []string) error {
+	fs := c.flags("audit")
+	var filter AuditFilter
+	fs.StringVar(&filter.User, "user", "", "who acted or was acted on")
+	fs.StringVar(&filter.Action, "action", "", "e.g. loan or loan.borrow")
+	from := fs.String("from", "", "first day, YYYY-MM-DD")
+	to := fs.String("to", "", "last day, YYYY-MM-DD")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	var err error
+	if filter.From, filter.To, err = dates(*from, *to); err != nil {
+		return err
+	}
+	entries, err := c.lib.Audit(c.ctx, filter)
+	if err != nil {
+		return err
+	}
+	c.lib.PrintAudit(c.stdout, entries)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunCLI(t *testing.T) {
+	clib := newTestLibrary(t)
+	defer clib.store.Close()
+	for _, user := range []Users{
+		{`root`, `admin`, `root`, 0, 0},
+		{`18307130006`, `Alicia`, `578152`, 0, 1},
+		{`18307130068`, `Brandon`, `987430`, 0, 1},
+		{`librarian`, `Lydia`, `shelves`, 0, 3},
+	} {
+		if err := clib.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scans, err := ioutil.TempFile("", "scans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(scans.Name())
+	fmt.Fprintln(scans, "18307130068 978-0385545938")
+	fmt.Fprintln(scans, "18307130068 978-1984801258")
+	scans.Close()
+
+	staff := []string{"--login", "librarian", "--password", "shelves"}
+	alicia := []string{"--login", "18307130006", "--password", "578152"}
+	root := []string{"--login", "root", "--password", "root"}
+	var tests = []struct {
+		testid int
+		args   []string
+		code   int
+		out    string
+	}{
+		{0, []string{"book", "add", "--isbn", "978-0385545938", "--title", "Camino Winds", "--author", "John Grisham",
+			"--publisher", "Doubleday (April 28, 2020)", "--stock", "2"}, ExitAuth, ""},
+		{1, append(alicia, "book", "add", "--isbn", "978-0385545938"), ExitAuth, ""},
+		{2, append(staff, "book", "add", "--isbn", "978-0385545938", "--title", "Camino Winds"), ExitUsage, ""},
+		{3, append(staff, "book", "add", "--isbn", "978-0385545938", "--title", "Camino Winds", "--author", "John Grisham",
+			"--publisher", "Doubleday (April 28, 2020)", "--stock", "2"), ExitOK, ""},
+		{4, append(staff, "book", "add", "--isbn", "978-1984801258", "--title", "Untamed", "--author", "Glennon Doyle",
+			"--publisher", "The Dial Press"), ExitOK, ""},
+		{5, []string{"--login", "librarian", "--password", "wrong", "loan", "list"}, ExitAuth, ""},
+		{6, append(alicia, "loan", "borrow", "--isbn", "978-0385545938"), ExitOK, ""},
+		{7, append(alicia, "loan", "borrow", "--user", "18307130068", "--isbn", "978-0385545938"), ExitAuth, ""},
+		{8, append(staff, "loan", "borrow", "--user", "18307130068", "--isbn", "978-0385545938"), ExitOK, ""},
+		{9, append(staff, "loan", "borrow", "--user", "18307130068", "--isbn", "978-1984801258"), ExitOK, ""},
+		{10, append(staff, "loan", "borrow", "--user", "nobody", "--isbn", "978-1984801258"), ExitNotFound, ""},
+		{11, append(staff, "loan", "borrow", "--user", "18307130068"), ExitUsage, ""},
+		{12, append(staff, "loan", "return", "--batch", scans.Name()), ExitOK, ""},
+		{13, append(staff, "loan", "return", "--batch", scans.Name()), ExitFailure, ""},
+		{14, append(alicia, "loan", "return", "--isbn", "978-1984801258"), ExitNotFound, ""},
+		{15, append(alicia, "loan", "extend", "--isbn", "0385545932"), ExitOK, ""},
+		{16, append(staff, "report", "user-loans", "--format", "json"), ExitAuth, ""},
+		{17, append(root, "report", "user-loans", "--format", "csv"), ExitOK,
+			"user_id,name,loans,open,overdue\n18307130006,Alicia,1,1,0\n18307130068,Brandon,2,0,0\n"},
+		{18, append(root, "report", "most-borrowed", "--limit", "1", "--format", "json"), ExitOK,
+			"[\n  {\n    \"isbn\": \"978-0385545938\",\n    \"title\": \"Camino Winds\",\n    \"loans\": 2\n  }\n]\n"},
+		{19, append(root, "report", "overdue", "--from", "May 1st"), ExitUsage, ""},
+		{20, append(root, "report", "popular"), ExitUsage, ""},
+		{21, append(root, "user", "add", "--id", "18307130101", "--name", "Chloe", "--password", "246810"), ExitOK, ""},
+		{22, []string{"--login", "18307130101", "--password", "246810", "user", "passwd", "--new-password", "135791"}, ExitOK, ""},
+		{23, append(alicia, "user", "passwd", "--id", "18307130101", "--new-password", "000000"), ExitAuth, ""},
+		{24, []string{"--login", "18307130101", "--password", "135791", "loan", "list"}, ExitOK, ""},
+		{25, append(staff, "shelve", "books"), ExitUsage, ""},
+		{26, append(staff, "book", "add", "--isbn", "978-0525536291", "--title", "The Vanishing Half", "--author", "Brit Bennett",
+			"--publisher", "Riverhead Books", "--stock", "0"), ExitUsage, ""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := clib.RunCLI(tt.args, &stdout, &stderr)
+			if code != tt.code {
+				t.Errorf("got %d (%s), want %d", code, strings.TrimSpace(stderr.String()), tt.code)
+			}
+			if tt.out != "" && stdout.String() != tt.out {
+				t.Errorf("got %q, want %q", stdout.String(), tt.out)
+			}
+		})
+	}
+
+	if n, _ := clib.store.CountOpenRecords(`18307130068`); n != 0 {
+		t.Errorf("got %d, want the batch to have returned both of Brandon's books", n)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := clib.RunCLI([]string{"search", "camino"}, &stdout, &stderr); code != ExitOK {
+		t.Fatalf("got %d (%s), want %d", code, stderr.String(), ExitOK)
+	}
+	if !strings.Contains(stdout.String(), "Camino Winds") || !strings.Contains(stdout.String(), "page 1 of 1, 1 book(s)") {
+		t.Errorf("got %q, want the search results on stdout", stdout.String())
+	}
+
+	res, _ := clib.Audit(ctx, AuditFilter{Action: "loan.borrow", User: "librarian"})
+	if len(res) != 2 || res[0].Origin != OriginCLI {
+		t.Errorf("got %+v, want the librarian's two loans from the command line", res)
+	}
+}
+
+func TestRunCLIEnv(t *testing.T) {
+	clib := newTestLibrary(t)
+	defer clib.store.Close()
+	if err := clib.AddUser(ctx, Users{`root`, `admin`, `root`, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LIBRARY_USER", "root")
+	os.Setenv("LIBRARY_PASSWORD", "root")
+	defer os.Unsetenv("LIBRARY_USER")
+	defer os.Unsetenv("LIBRARY_PASSWORD")
+
+	var stdout, stderr bytes.Buffer
+	if code := clib.RunCLI([]string{"report", "utilization", "--format", "json"}, &stdout, &stderr); code != ExitOK {
+		t.Fatalf("got %d (%s), want %d", code, stderr.String(), ExitOK)
+	}
+	var rows []BookUtilization
+	if err := json.Unmarshal(stdout.Bytes(), &rows); err != nil || len(rows) != 0 {
+		t.Errorf("got %v %v, want an empty report", rows, err)
+	}
+	if code := clib.RunCLI([]string{"--password", "wrong", "audit"}, &stdout, &stderr); code != ExitAuth {
+		t.Errorf("got %d, want flags to override the environment", code)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock : where Library gets the current time from
+// deadlines, overdue checks, fines, holds, sessions and the audit log all read it,
+// so a FakeClock lets tests move the library through time
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock : the wall clock
+type RealClock struct{}
+
+// Now : the current wall-clock time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock : a clock that only moves when told to
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock : a fake clock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now : the time the clock was last set or advanced to
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance : move the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// AdvanceDays : move the clock forward by whole calendar days
+func (c *FakeClock) AdvanceDays(days int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.AddDate(0, 0, days)
+}
+
+// Set : stop the clock at now
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// now : the current time on the library's clock, the wall clock if it has none
+func (lib *Library) now() time.Time {
+	if lib.clock == nil {
+		return time.Now()
+	}
+	return lib.clock.Now()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, time.January, 31, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	clock.Advance(90 * time.Minute)
+	clock.AdvanceDays(29)
+	if want := time.Date(2020, time.February, 29, 10, 30, 0, 0, time.UTC); !clock.Now().Equal(want) {
+		t.Errorf("got %v, want %v", clock.Now(), want)
+	}
+	clock.Set(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("got %v, want %v", clock.Now(), start)
+	}
+
+	var nolib Library
+	if d := time.Since(nolib.now()); d < 0 || d > time.Minute {
+		t.Errorf("got %v, want a library without a clock on the wall clock", nolib.now())
+	}
+}
+
+func TestClockLoan(t *testing.T) {
+	clib := newHoldLibrary(t)
+	defer clib.store.Close()
+
+	const ISBN = `978-0385545938`
+	const userID = `18307130006`
+	clock := NewFakeClock(time.Date(2020, time.January, 6, 9, 0, 0, 0, time.UTC))
+	clib.clock = clock
+
+	// undergrads keep normal books 30 days, renew them 3 times by 30 days and pay 50 cents a day late
+	var tests = []struct {
+		testid  int
+		days    int
+		action  string
+		err     error
+		overdue int
+		balance int
+	}{
+		{0, 0, "borrow", nil, 0, 0},
+		{1, 29, "extend", nil, 0, 0},
+		{2, 30, "extend", nil, 0, 0},
+		{3, 30, "sweep", nil, 0, 0},
+		{4, 2, "sweep", nil, 1, 0},
+		{5, 0, "extend", ErrNoMoreExtended, 1, 0},
+		{6, 5, "return", nil, 0, 300},
+		{7, 0, "return", ErrNotBorrowed, 0, 300},
+		{8, 1, "borrow", nil, 0, 300},
+		{9, 31, "return", nil, 0, 350},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			clock.AdvanceDays(tt.days)
+			var err error
+			switch tt.action {
+			case "borrow":
+				_, err = clib.BorrowBook(ctx, ISBN, userID, clib.now())
+			case "extend":
+				_, err = clib.ExtendDeadline(ctx, ISBN, userID)
+			case "return":
+				_, err = clib.ReturnBook(ctx, ISBN, userID)
+			case "sweep":
+				_, err = clib.Sweep(ctx, clib.now())
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			user, _ := clib.store.User(userID)
+			balance, _, _ := clib.Fines(ctx, userID)
+			if user.Overdue != tt.overdue || balance != tt.balance {
+				t.Errorf("got overdue %d, balance %d, want %d, %d", user.Overdue, balance, tt.overdue, tt.balance)
+			}
+		})
+	}
+
+	records, _ := clib.CheckBorrowHistory(ctx, userID)
+	for _, record := range records {
+		if !record.Returned() || record.ReturnedAt.After(clib.now()) {
+			t.Errorf("got %v, want returns stamped by the clock", record.ReturnedAt)
+		}
+	}
+}
+
+// TestSimulateCirculation : half a year of readers borrowing, renewing and returning at random,
+// with the scheduler sweeping every night; counters, stock, fines and reminders must stay consistent
+func TestSimulateCirculation(t *testing.T) {
+	clib := newHoldLibrary(t)
+	defer clib.store.Close()
+
+	books := []string{`978-0385545938`, `978-1984801258`, `978-0735219090`}
+	if _, err := clib.AddBook(ctx, `Untamed`, books[1], `Glennon Doyle`, `The Dial Press`, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clib.AddBook(ctx, `Where the Crawdads Sing`, books[2], `Delia Owens`, `G.P. Putnam's Sons`, 1); err != nil {
+		t.Fatal(err)
+	}
+	users := []string{`18307130006`, `18307130068`, `18307130101`, `18307130102`}
+	clock := NewFakeClock(time.Date(2020, time.January, 6, 9, 0, 0, 0, time.UTC))
+	clib.clock = clock
+	recorder := &recordingNotifier{}
+	clib.notifier = recorder
+
+	rng := rand.New(rand.NewSource(17))
+	late := map[string]bool{}
+	lateReturns := 0
+	for day := 0; day < 183; day++ {
+		for _, userID := range users {
+			open, err := clib.CheckUnreturned(ctx, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ISBN := books[rng.Intn(len(books))]
+			switch r := rng.Float64(); {
+			case len(open) > 0 && r < 0.08:
+				ISBN = open[0].ISBN
+				wasLate := clib.now().After(open[0].Deadline)
+				if _, err := clib.ReturnBook(ctx, ISBN, userID); err != nil {
+					t.Fatalf("day %d: %s returning %s: %v", day, userID, ISBN, err)
+				}
+				if wasLate {
+					lateReturns++
+				}
+			case len(open) > 0 && r < 0.12:
+				_, err := clib.ExtendDeadline(ctx, open[0].ISBN, userID)
+				if err != nil && !errors.Is(err, ErrNoMoreExtended) {
+					t.Fatalf("day %d: %s extending: %v", day, userID, err)
+				}
+				if err == nil && clib.now().After(open[0].Deadline) {
+					t.Fatalf("day %d: %s renewed an overdue book", day, userID)
+				}
+			case r < 0.2:
+				_, err := clib.BorrowBook(ctx, ISBN, userID, clib.now())
+				switch {
+				case err == nil, isAny(err, ErrBookNotAvailable, ErrAlreadyBorrowed, ErrUserSuspended, ErrFinesOutstanding):
+				default:
+					t.Fatalf("day %d: %s borrowing %s: %v", day, userID, ISBN, err)
+				}
+			}
+		}
+
+		clock.Advance(15 * time.Hour)
+		if _, err := clib.Sweep(ctx, clib.now()); err != nil {
+			t.Fatalf("day %d: %v", day, err)
+		}
+		now := clib.now()
+
+		for _, userID := range users {
+			open, _ := clib.CheckUnreturned(ctx, userID)
+			overdue := 0
+			for _, record := range open {
+				if now.After(record.Deadline) {
+					overdue++
+					late[record.RecordID] = true
+				}
+			}
+			if user, _ := clib.store.User(userID); user.Overdue != overdue {
+				t.Fatalf("day %d: %s has overdue counter %d, want %d", day, userID, user.Overdue, overdue)
+			}
+		}
+		for _, ISBN := range books {
+			book, _ := clib.store.Book(ISBN)
+			loaned := 0
+			for _, userID := range users {
+				if _, err := clib.store.OpenRecord(ISBN, userID); err == nil {
+					loaned++
+				}
+			}
+			if book.Available != book.Stock-loaned {
+				t.Fatalf("day %d: %s has %d of %d available with %d on loan", day, ISBN, book.Available, book.Stock, loaned)
+			}
+		}
+		clock.Advance(9 * time.Hour)
+	}
+
+	fined := 0
+	for _, userID := range users {
+		_, entries, _ := clib.Fines(ctx, userID)
+		for _, entry := range entries {
+			if entry.Kind == FineOverdue {
+				fined++
+			}
+		}
+	}
+	if fined != lateReturns || lateReturns == 0 {
+		t.Errorf("got %d overdue fines, want one for each of the %d late returns", fined, lateReturns)
+	}
+	overdueNotices := 0
+	for _, notice := range recorder.notices {
+		if notice.Kind == NoticeOverdue {
+			overdueNotices++
+		}
+	}
+	if overdueNotices != len(late) {
+		t.Errorf("got %d overdue reminders, want one for each of the %d loans that went overdue", overdueNotices, len(late))
+	}
+}
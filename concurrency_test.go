@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestLibrary : a library on a fresh in-memory database
+func newTestLibrary(t *testing.T) *Library {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clib := &Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+	if err := clib.Migrate(ctx, LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	return clib
+}
+
+// newMySQLTestLibrary : a library on the MySQL database LIBRARY_TEST_MYSQL_DSN names, emptied first,
+// skipping the test when it is unset. Use a throwaway database, with parseTime=true in the DSN, e.g.
+// LIBRARY_TEST_MYSQL_DSN='root:secret@tcp(localhost:3306)/library_test?parseTime=true'
+func newMySQLTestLibrary(t *testing.T) *Library {
+	dsn := os.Getenv("LIBRARY_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("LIBRARY_TEST_MYSQL_DSN is unset")
+	}
+	store, err := NewMySQLStore(dsn, 25, 25, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clib := &Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+	if err := clib.Migrate(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := clib.Migrate(ctx, LatestVersion()); err != nil {
+		t.Fatal(err)
+	}
+	return clib
+}
+
+// concurrentLibraries : the libraries the concurrency tests race on
+// SQLite has a single connection, so its transactions take turns and never reach the
+// FOR UPDATE row locks that keep MySQL's apart; only the MySQL run tests those
+var concurrentLibraries = []struct {
+	name string
+	open func(t *testing.T) *Library
+}{
+	{"sqlite", newTestLibrary},
+	{"mysql", newMySQLTestLibrary},
+}
+
+// run : call fn from n goroutines at once and collect the errors
+func run(n int, fn func(i int) error) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = fn(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+// count : how many of errs are err
+func count(errs []error, err error) int {
+	n := 0
+	for _, e := range errs {
+		if errors.Is(e, err) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConcurrentBorrowReturn(t *testing.T) {
+	for _, backend := range concurrentLibraries {
+		t.Run(backend.name, func(t *testing.T) {
+			testConcurrentBorrowReturn(t, backend.open(t))
+		})
+	}
+}
+
+func testConcurrentBorrowReturn(t *testing.T, clib *Library) {
+	defer clib.store.Close()
+
+	const readers, copies = 20, 3
+	const ISBN = `978-0262033848`
+	if _, err := clib.AddBook(ctx, `Introduction to Algorithms`, ISBN, `Thomas H. Cormen`, `The MIT Press`, copies); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < readers; i++ {
+		if err := clib.AddUser(ctx, Users{fmt.Sprintf("reader%02d", i), "reader", "pw", 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Date(2020, time.May, 1, 14, 0, 0, 0, time.UTC)
+	errs := run(readers, func(i int) error {
+		_, err := clib.BorrowBook(ctx, ISBN, fmt.Sprintf("reader%02d", i), now)
+		return err
+	})
+	if n := count(errs, nil); n != copies {
+		t.Errorf("got %d borrows, want %d", n, copies)
+	}
+	if n := count(errs, ErrBookNotAvailable); n != readers-copies {
+		t.Errorf("got %d ErrBookNotAvailable, want %d: %v", n, readers-copies, errs)
+	}
+
+	book, err := clib.store.Book(ISBN)
+	if err != nil || book.Stock != copies || book.Available != 0 {
+		t.Errorf("got stock %d available %d, want %d and 0", book.Stock, book.Available, copies)
+	}
+	open := 0
+	for i := 0; i < readers; i++ {
+		res, _ := clib.CheckUnreturned(ctx, fmt.Sprintf("reader%02d", i))
+		open += len(res)
+	}
+	if open != copies {
+		t.Errorf("got %d open records, want %d", open, copies)
+	}
+
+	errs = run(readers, func(i int) error {
+		_, err := clib.ReturnBook(ctx, ISBN, fmt.Sprintf("reader%02d", i))
+		return err
+	})
+	if n := count(errs, nil); n != copies {
+		t.Errorf("got %d returns, want %d", n, copies)
+	}
+	if n := count(errs, ErrNotBorrowed); n != readers-copies {
+		t.Errorf("got %d ErrNotBorrowed, want %d: %v", n, readers-copies, errs)
+	}
+
+	book, err = clib.store.Book(ISBN)
+	if err != nil || book.Available != copies {
+		t.Errorf("got available %d, want %d", book.Available, copies)
+	}
+}
+
+func TestConcurrentBorrowSameUser(t *testing.T) {
+	for _, backend := range concurrentLibraries {
+		t.Run(backend.name, func(t *testing.T) {
+			testConcurrentBorrowSameUser(t, backend.open(t))
+		})
+	}
+}
+
+func testConcurrentBorrowSameUser(t *testing.T, clib *Library) {
+	defer clib.store.Close()
+
+	const ISBN = `978-0385545938`
+	if _, err := clib.AddBook(ctx, `Camino Winds`, ISBN, `John Grisham`, `Doubleday`, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := clib.AddUser(ctx, Users{`18307130002`, `Florrick`, `979148`, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.May, 1, 14, 0, 0, 0, time.UTC)
+	errs := run(10, func(i int) error {
+		_, err := clib.BorrowBook(ctx, ISBN, `18307130002`, now)
+		return err
+	})
+	if n := count(errs, nil); n != 1 {
+		t.Errorf("got %d borrows, want 1", n)
+	}
+	if n := count(errs, ErrAlreadyBorrowed); n != 9 {
+		t.Errorf("got %d ErrAlreadyBorrowed, want 9: %v", n, errs)
+	}
+
+	book, err := clib.store.Book(ISBN)
+	if err != nil || book.Available != 4 {
+		t.Errorf("got available %d, want 4", book.Available)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConfigFile : the configuration read unless --config or $LIBRARY_CONFIG says otherwise
+var DefaultConfigFile = "config.ini"
+
+// Config : everything the library can be configured with, see config.ini
+// each field is read from the `ini` key of its section, then overridden by the `env` variable;
+// durations are written like "30m" or "72h"
+type Config struct {
+	Backend  string `ini:"database.backend" env:"LIBRARY_DB_BACKEND"`
+	Host     string `ini:"database.host" env:"LIBRARY_DB_HOST"`
+	Port     int    `ini:"database.port" env:"LIBRARY_DB_PORT"`
+	User     string `ini:"database.user" env:"LIBRARY_DB_USER"`
+	Password string `ini:"database.password" env:"LIBRARY_DB_PASSWORD"`
+	Name     string `ini:"database.name" env:"LIBRARY_DB_NAME"`
+	Charset  string `ini:"database.charset" env:"LIBRARY_DB_CHARSET"`
+	Timezone string `ini:"database.timezone" env:"LIBRARY_TIMEZONE"`
+
+	Timeout        time.Duration `ini:"database.timeout" env:"LIBRARY_DB_TIMEOUT"`
+	BatchTimeout   time.Duration `ini:"database.batch_timeout" env:"LIBRARY_DB_BATCH_TIMEOUT"`
+	ConnectRetries int           `ini:"database.connect_retries" env:"LIBRARY_DB_CONNECT_RETRIES"`
+	ConnectBackoff time.Duration `ini:"database.connect_backoff" env:"LIBRARY_DB_CONNECT_BACKOFF"`
+
+	MaxOpen     int           `ini:"pool.max_open" env:"LIBRARY_POOL_MAX_OPEN"`
+	MaxIdle     int           `ini:"pool.max_idle" env:"LIBRARY_POOL_MAX_IDLE"`
+	MaxLifetime time.Duration `ini:"pool.max_lifetime" env:"LIBRARY_POOL_MAX_LIFETIME"`
+
+	SessionTTL time.Duration `ini:"auth.session_ttl" env:"LIBRARY_SESSION_TTL"`
+	BcryptCost int           `ini:"auth.bcrypt_cost" env:"LIBRARY_BCRYPT_COST"`
+
+	DefaultCategory string        `ini:"loans.default_category" env:"LIBRARY_DEFAULT_CATEGORY"`
+	HoldPickup      time.Duration `ini:"loans.hold_pickup" env:"LIBRARY_HOLD_PICKUP"`
+	RemindBefore    time.Duration `ini:"loans.remind_before" env:"LIBRARY_REMIND_BEFORE"`
+	NotifyFile      string        `ini:"loans.notify_file" env:"LIBRARY_NOTIFY_FILE"`
+	SweepInterval   time.Duration `ini:"loans.sweep_interval" env:"LIBRARY_SWEEP_INTERVAL"`
+
+	LogLevel  string `ini:"log.level" env:"LIBRARY_LOG_LEVEL"`
+	LogFormat string `ini:"log.format" env:"LIBRARY_LOG_FORMAT"`
+
+	ServerHost string `ini:"server.host" env:"LIBRARY_SERVER_HOST"`
+	ServerPort int    `ini:"server.port" env:"LIBRARY_SERVER_PORT"`
+}
+
+// ConfigError : everything wrong with a configuration, one problem per line
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// DefaultConfig : the configuration of a library nobody configured
+func DefaultConfig() Config {
+	return Config{
+		Backend:         "mysql",
+		Host:            "127.0.0.1",
+		Port:            3306,
+		Charset:         "utf8",
+		Timezone:        "Asia/Shanghai",
+		Timeout:         10 * time.Second,
+		BatchTimeout:    5 * time.Minute,
+		ConnectRetries:  5,
+		ConnectBackoff:  time.Second,
+		MaxOpen:         10,
+		MaxIdle:         5,
+		MaxLifetime:     30 * time.Minute,
+		SessionTTL:      DefaultSessionTTL,
+		DefaultCategory: "undergrad",
+		HoldPickup:      DefaultHoldPickup,
+		RemindBefore:    DefaultRemindBefore,
+		NotifyFile:      DefaultNotifyFile,
+		SweepInterval:   DefaultSweepInterval,
+		LogLevel:        "info",
+		LogFormat:       "text",
+		ServerPort:      8080,
+	}
+}
+
+// LoadConfig : the defaults, overridden by the file at path, overridden by the environment, validated
+// a missing file is only an error if path was asked for; the file may also be the old
+// config.ini of user, password, database name and backend on the first four lines
+func LoadConfig(path string, explicit bool) (Config, error) {
+	cfg := DefaultConfig()
+	file, err := os.Open(path)
+	if err == nil {
+		err = cfg.read(file, path)
+		file.Close()
+		if err != nil {
+			return cfg, err
+		}
+	} else if explicit || !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err := cfg.readEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// configField : a setting, where it is read from and where it goes
+type configField struct {
+	key   string
+	env   string
+	value reflect.Value
+}
+
+// fields : every setting of cfg
+func (cfg *Config) fields() []configField {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	var res []configField
+	for i := 0; i < t.NumField(); i++ {
+		res = append(res, configField{t.Field(i).Tag.Get("ini"), t.Field(i).Tag.Get("env"), v.Field(i)})
+	}
+	return res
+}
+
+// set : parse s into the field, as its type requires
+func set(field reflect.Value, s string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", s)
+		}
+		field.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like \"30m\"", s)
+		}
+		field.SetInt(int64(d))
+	}
+	return nil
+}
+
+// read : override cfg with an INI file of [section] headers, key = value lines and ; or # comments;
+// a value keeps a ; or # with a space before it only between double quotes
+func (cfg *Config) read(r io.Reader, name string) error {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if legacyConfig(lines) {
+		for i, dst := range []*string{&cfg.User, &cfg.Password, &cfg.Name, &cfg.Backend} {
+			if i < len(lines) && lines[i] != "" {
+				*dst = lines[i]
+			}
+		}
+		return nil
+	}
+
+	keys := map[string]reflect.Value{}
+	for _, f := range cfg.fields() {
+		keys[f.key] = f.value
+	}
+	var problems ConfigError
+	section := ""
+	for i, line := range lines {
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			problems = append(problems, fmt.Sprintf("%s:%d: expected key = value", name, i+1))
+			continue
+		}
+		key := section + "." + strings.TrimSpace(line[:eq])
+		value := iniValue(line[eq+1:])
+		field, ok := keys[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s:%d: unknown setting %s", name, i+1, key))
+			continue
+		}
+		if err := set(field, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s: %v", name, i+1, key, err))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// iniValue : a value without the comment after it, or what is between its double quotes
+func iniValue(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, `"`) {
+		if end := strings.Index(s[1:], `"`); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	if strings.HasPrefix(s, ";") || strings.HasPrefix(s, "#") {
+		return ""
+	}
+	for i := 1; i < len(s); i++ {
+		if (s[i] == ';' || s[i] == '#') && (s[i-1] == ' ' || s[i-1] == '\t') {
+			return strings.TrimSpace(s[:i])
+		}
+	}
+	return s
+}
+
+// legacyConfig : whether lines are the old config.ini, values alone without sections or keys
+func legacyConfig(lines []string) bool {
+	for _, line := range lines {
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		return line[0] != '[' && !strings.Contains(line, "=")
+	}
+	return false
+}
+
+// readEnv : override cfg with the environment variables lookup finds
+func (cfg *Config) readEnv(lookup func(string) (string, bool)) error {
+	var problems ConfigError
+	for _, f := range cfg.fields() {
+		if s, ok := lookup(f.env); ok {
+			if err := set(f.value, s); err != nil {
+				problems = append(problems, fmt.Sprintf("$%s: %v", f.env, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Validate : check that every setting makes sense, listing all that don't
+func (cfg Config) Validate() error {
+	var problems ConfigError
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(cfg.Backend == "mysql" || cfg.Backend == "sqlite", "database.backend: %q is neither mysql nor sqlite", cfg.Backend)
+	check(cfg.Name != "", "database.name: required, the database or, for sqlite, the file")
+	if cfg.Backend == "mysql" {
+		check(cfg.Host != "", "database.host: required for mysql")
+		check(cfg.Port > 0 && cfg.Port < 65536, "database.port: %d is not a port", cfg.Port)
+		check(cfg.User != "", "database.user: required for mysql")
+		check(cfg.Charset != "", "database.charset: required for mysql")
+	}
+	_, err := time.LoadLocation(cfg.Timezone)
+	check(err == nil, "database.timezone: %q is not a time zone like Asia/Shanghai", cfg.Timezone)
+	check(cfg.Timeout >= 0, "database.timeout: can't be negative, 0 means no limit")
+	check(cfg.BatchTimeout >= 0, "database.batch_timeout: can't be negative, 0 means no limit")
+	check(cfg.ConnectRetries >= 0, "database.connect_retries: can't be negative")
+	check(cfg.ConnectBackoff > 0, "database.connect_backoff: must be positive")
+	check(cfg.MaxOpen >= 0, "pool.max_open: can't be negative, 0 means no limit")
+	check(cfg.MaxIdle >= 0, "pool.max_idle: can't be negative")
+	check(cfg.MaxOpen == 0 || cfg.MaxIdle <= cfg.MaxOpen, "pool.max_idle: %d is more than pool.max_open", cfg.MaxIdle)
+	check(cfg.MaxLifetime >= 0, "pool.max_lifetime: can't be negative, 0 means forever")
+	check(cfg.SessionTTL > 0, "auth.session_ttl: must be positive")
+	check(cfg.BcryptCost == 0 || cfg.BcryptCost >= 4 && cfg.BcryptCost <= 31, "auth.bcrypt_cost: %d is not between 4 and 31", cfg.BcryptCost)
+	check(contains(Categories, cfg.DefaultCategory), "loans.default_category: %q is not one of %s", cfg.DefaultCategory, strings.Join(Categories, ", "))
+	check(cfg.HoldPickup > 0, "loans.hold_pickup: must be positive")
+	check(cfg.RemindBefore > 0, "loans.remind_before: must be positive")
+	check(cfg.NotifyFile != "", "loans.notify_file: required")
+	check(cfg.SweepInterval > 0, "loans.sweep_interval: must be positive")
+	check(contains(LogLevels, cfg.LogLevel), "log.level: %q is not one of %s", cfg.LogLevel, strings.Join(LogLevels, ", "))
+	check(contains(LogFormats, cfg.LogFormat), "log.format: %q is neither text nor json", cfg.LogFormat)
+	check(cfg.ServerPort > 0 && cfg.ServerPort < 65536, "server.port: %d is not a port", cfg.ServerPort)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// DSN : the data source name of the configured database
+func (cfg Config) DSN() string {
+	if cfg.Backend == "sqlite" {
+		return cfg.Name
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s&loc=%s&parseTime=true",
+		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name, url.QueryEscape(cfg.Charset), url.QueryEscape(cfg.Timezone))
+}
+
+// ServerAddr : the address the API listens on
+func (cfg Config) ServerAddr() string {
+	return fmt.Sprintf("%s:%d", cfg.ServerHost, cfg.ServerPort)
+}
+
+// Configure : set the library up as cfg says, short of connecting to the database
+func (lib *Library) Configure(cfg Config) {
+	lib.hasher = PasswordHasher{Cost: cfg.BcryptCost}
+	lib.sessionTTL = cfg.SessionTTL
+	lib.holdPickup = cfg.HoldPickup
+	lib.remindBefore = cfg.RemindBefore
+	lib.notifier = &FileNotifier{Path: cfg.NotifyFile}
+	lib.defaultCategory = cfg.DefaultCategory
+	lib.timeout, lib.batchTimeout = cfg.Timeout, cfg.BatchTimeout
+	lib.logger = NewLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if lib.clock == nil {
+		lib.clock = RealClock{}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		testid  int
+		content string
+		env     map[string]string
+		check   func(cfg Config) bool
+		err     string
+	}{
+		{0, "", nil, nil, "database.name: required"},
+		{1, "root\nsecret\nlibrary\n", nil, func(cfg Config) bool {
+			return cfg.User == "root" && cfg.Password == "secret" && cfg.Name == "library" && cfg.Backend == "mysql"
+		}, ""},
+		{2, "root\n\nlibrary.db\nsqlite\n", nil, func(cfg Config) bool {
+			return cfg.Name == "library.db" && cfg.Backend == "sqlite" && cfg.DSN() == "library.db"
+		}, ""},
+		{3, "[database]\nname = library\nuser = root\npassword = \"p;ss #1\" ; quoted\nport = 3307 ; comment\n[server]\nhost =   ; none\n",
+			nil, func(cfg Config) bool {
+				return cfg.Password == "p;ss #1" && cfg.Port == 3307 && cfg.ServerHost == "" &&
+					cfg.DSN() == "root:p;ss #1@tcp(127.0.0.1:3307)/library?charset=utf8&loc=Asia%2FShanghai&parseTime=true"
+			}, ""},
+		{4, "[database]\nname = library\nuser = root\n[auth]\nsession_ttl = 1h\n",
+			map[string]string{"LIBRARY_SESSION_TTL": "30m", "LIBRARY_DB_HOST": "db.library.local", "LIBRARY_SERVER_PORT": "9090"},
+			func(cfg Config) bool {
+				return cfg.SessionTTL == 30*time.Minute && cfg.Host == "db.library.local" && cfg.ServerAddr() == ":9090"
+			}, ""},
+		{5, "[database]\nname = library\nuser = root\nport = abc\nhots = db\n", nil, nil,
+			"config.ini:4: database.port: \"abc\" is not a whole number\n\tconfig.ini:5: unknown setting database.hots"},
+		{6, "[database]\nname = library\nuser = root\n", map[string]string{"LIBRARY_HOLD_PICKUP": "two days"}, nil,
+			"$LIBRARY_HOLD_PICKUP: \"two days\" is not a duration"},
+		{7, "[database]\nbackend = oracle\nname = library\ntimezone = Mars/Olympus\n[pool]\nmax_open = 2\nmax_idle = 3\n" +
+			"[loans]\ndefault_category = alumni\n[log]\nlevel = loud\nformat = xml\n", nil, nil,
+			"database.backend: \"oracle\" is neither mysql nor sqlite\n" +
+				"\tdatabase.timezone: \"Mars/Olympus\" is not a time zone like Asia/Shanghai\n" +
+				"\tpool.max_idle: 3 is more than pool.max_open\n" +
+				"\tloans.default_category: \"alumni\" is not one of undergrad, postgrad, staff\n" +
+				"\tlog.level: \"loud\" is not one of debug, info, warn, error\n" +
+				"\tlog.format: \"xml\" is neither text nor json"},
+		{8, "[database]\nname = library\nuser = root\ntimeout = 2s\nconnect_backoff = 0\n",
+			map[string]string{"LIBRARY_DB_CONNECT_RETRIES": "-1"}, nil,
+			"database.connect_retries: can't be negative\n\tdatabase.connect_backoff: must be positive"},
+		{9, "[database]\nname = library\nuser = root\ntimeout = 2s\nbatch_timeout = 0\n", nil, func(cfg Config) bool {
+			return cfg.Timeout == 2*time.Second && cfg.BatchTimeout == 0 && cfg.ConnectRetries == 5
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			path := filepath.Join(dir, "config.ini")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			cfg, err := LoadConfig(path, true)
+			if tt.err == "" && err != nil || tt.err != "" && err == nil {
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+			// every expected problem is reported, whatever the directory the file is in
+			for _, problem := range strings.Split(tt.err, "\n\t") {
+				if problem != "" && !strings.Contains(err.Error(), problem) {
+					t.Errorf("got %v, want %q", err, problem)
+				}
+			}
+			if tt.check != nil && !tt.check(cfg) {
+				t.Errorf("got %+v", cfg)
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "missing.ini"), true); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file asked for to be an error", err)
+	}
+	os.Setenv("LIBRARY_DB_NAME", "library")
+	defer os.Unsetenv("LIBRARY_DB_NAME")
+	os.Setenv("LIBRARY_DB_USER", "root")
+	defer os.Unsetenv("LIBRARY_DB_USER")
+	if cfg, err := LoadConfig(filepath.Join(dir, "missing.ini"), false); err != nil || cfg.Name != "library" {
+		t.Errorf("got %v, want the defaults and the environment without a file", err)
+	}
+}
+
+func TestSampleConfig(t *testing.T) {
+	cfg, err := LoadConfig("config.ini", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != DefaultConfigWith(func(c *Config) { c.User, c.Password, c.Name, c.BcryptCost = "Username", "Password", "DBName", 10 }) {
+		t.Errorf("got %+v, want config.ini to list the defaults", cfg)
+	}
+}
+
+// DefaultConfigWith : the default configuration, changed by fn
+func DefaultConfigWith(fn func(c *Config)) Config {
+	cfg := DefaultConfig()
+	fn(&cfg)
+	return cfg
+}
+
+func TestDefaultCategory(t *testing.T) {
+	clib := newTestLibrary(t)
+	defer clib.store.Close()
+
+	cfg := DefaultConfig()
+	cfg.DefaultCategory = "postgrad"
+	cfg.BcryptCost = 4
+	clib.Configure(cfg)
+	if err := clib.AddUser(ctx, Users{`18307130006`, `Alicia`, `578152`, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if category, _ := clib.store.UserCategoryPolicy(`18307130006`); category.Category != "postgrad" {
+		t.Errorf("got %q, want postgrad", category.Category)
+	}
+}
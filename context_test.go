@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextDone(t *testing.T) {
+	xlib := newHoldLibrary(t)
+	defer xlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	if _, err := xlib.BorrowBook(ctx, ISBN, `18307130068`, now); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	expired, cancel := context.WithDeadline(ctx, now)
+	defer cancel()
+
+	var tests = []struct {
+		testid int
+		ctx    context.Context
+		op     func(ctx context.Context) error
+		err    error
+	}{
+		{0, cancelled, func(ctx context.Context) error { _, err := xlib.BorrowBook(ctx, ISBN, `18307130006`, now); return err },
+			context.Canceled},
+		{1, expired, func(ctx context.Context) error { _, err := xlib.BorrowBook(ctx, ISBN, `18307130006`, now); return err },
+			ErrTimeout},
+		{2, expired, func(ctx context.Context) error { _, err := xlib.ReturnBook(ctx, ISBN, `18307130068`); return err },
+			ErrTimeout},
+		{3, expired, func(ctx context.Context) error { _, err := xlib.CheckUnreturned(ctx, `18307130068`); return err },
+			ErrTimeout},
+		{4, expired, func(ctx context.Context) error { _, err := xlib.Search(ctx, "camino", 1, 10, false); return err },
+			context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			err := tt.op(tt.ctx)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if tt.err != context.Canceled && statusOf(err) != http.StatusServiceUnavailable {
+				t.Errorf("got status %d, want %d", statusOf(err), http.StatusServiceUnavailable)
+			}
+		})
+	}
+
+	// nothing was done by the operations that gave up
+	if res, err := xlib.CheckUnreturned(ctx, `18307130068`); err != nil || len(res) != 1 {
+		t.Errorf("got %v, %v, want the loan still open", res, err)
+	}
+}
+
+func TestLibraryTimeout(t *testing.T) {
+	xlib := newHoldLibrary(t)
+	defer xlib.store.Close()
+
+	// every operation runs out of time as soon as it starts
+	xlib.timeout = time.Nanosecond
+	if _, err := xlib.QueryBookISBN(ctx, `978-0385545938`); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	xlib.timeout = time.Minute
+	if _, err := xlib.QueryBookISBN(ctx, `978-0385545938`); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	var buf bytes.Buffer
+	clib := Library{logger: NewLogger(&buf, "info", "text")}
+	cfg := DefaultConfig()
+	cfg.Name, cfg.User, cfg.Port = "library", "root", 1
+	cfg.ConnectRetries, cfg.ConnectBackoff = 2, time.Millisecond
+
+	if err := clib.ConnectDB(ctx, cfg); err == nil {
+		t.Fatal("got nil, want an unreachable database")
+	}
+	if clib.store != nil {
+		t.Error("got a store, want none")
+	}
+	if n := strings.Count(buf.String(), `msg="Database unreachable, retrying."`); n != cfg.ConnectRetries {
+		t.Errorf("got %d retries, want %d: %s", n, cfg.ConnectRetries, buf.String())
+	}
+	if !strings.Contains(buf.String(), `retry=2 wait=2ms`) {
+		t.Errorf("got %q, want the wait doubled", buf.String())
+	}
+}
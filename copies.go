@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// copy statuses, stored in Copylist.status
+// shelf, loan, held and repair copies are in stock; only shelf copies are available
+const (
+	CopyShelf     = "shelf"
+	CopyLoan      = "loan"
+	CopyHeld      = "held"
+	CopyRepair    = "repair"
+	CopyLost      = "lost"
+	CopyWithdrawn = "withdrawn"
+)
+
+// Copy : one physical item of a book
+type Copy struct {
+	Barcode    string
+	ISBN       string
+	Status     string
+	Location   string
+	AcquiredAt time.Time
+}
+
+var ErrCopyNotExists = errors.New("Copy not exists.")
+var ErrCopyExists = errors.New("Copy barcode already in use.")
+var ErrCopyStatus = errors.New("The copy can't be changed to that status now.")
+
+// newBarcode : a barcode for the next copy of a book, ISBN-n
+// copies are never deleted, so the count of all of them only grows
+func (lib *Library) newBarcode(ISBN string) (string, error) {
+	n, err := lib.store.CountCopies(ISBN)
+	if err != nil {
+		return "", err
+	}
+	for {
+		n = n + 1
+		barcode := fmt.Sprintf("%s-%d", ISBN, n)
+		_, err := lib.store.Copy(barcode)
+		if errors.Is(err, ErrCopyNotExists) {
+			return barcode, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// addCopy : put a new copy into stock, to a waiting reader first if there is one
+// must run in a transaction holding the book's row lock
+func (lib *Library) addCopy(item Copy, now time.Time) error {
+	item.Status = CopyShelf
+	err := lib.store.InsertCopy(item)
+	if err != nil {
+		return err
+	}
+	return lib.releaseCopy(item, now)
+}
+
+// AddCopy : add one copy of a book already in the library
+// an empty barcode gets one generated
+// require book's ISBN, the barcode, where it is shelved and when it was acquired
+func (lib *Library) AddCopy(ctx context.Context, bookISBN, barcode, location string, acquiredAt time.Time) (string, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(bookISBN); err != nil {
+			return err
+		}
+		var err error
+		if barcode == "" {
+			barcode, err = tx.newBarcode(bookISBN)
+			if err != nil {
+				return err
+			}
+		} else if _, err = tx.store.Copy(barcode); !errors.Is(err, ErrCopyNotExists) {
+			if err == nil {
+				err = ErrCopyExists
+			}
+			return err
+		}
+		err = tx.addCopy(Copy{Barcode: barcode, ISBN: bookISBN, Location: location, AcquiredAt: acquiredAt}, lib.now())
+		if err != nil {
+			return err
+		}
+		return tx.audit("copy.add", barcode, nil, map[string]interface{}{"isbn": bookISBN, "location": location})
+	})
+
+	logger := lib.log().With(F("op", "copy.add"), F("isbn", bookISBN), F("copy", barcode))
+	if err != nil {
+		logger.failed("Adding a copy failed.", err)
+		return "", wrapError(err, &OpError{Op: "copy.add", ISBN: bookISBN, CopyID: barcode})
+	}
+
+	logger.Info("Copy added.", F("location", location))
+	return barcode, nil
+}
+
+// Copies : every copy of a book, withdrawn and lost ones included
+func (lib *Library) Copies(ctx context.Context, bookISBN string) ([]Copy, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	if _, err := lib.store.Book(bookISBN); err != nil {
+		return nil, opError(err, "copy.list", bookISBN, "")
+	}
+	CopyList, err := lib.store.Copies(bookISBN)
+	if err != nil {
+		lib.log().failed("Querying copies failed.", err, F("op", "copy.list"), F("isbn", bookISBN))
+		return nil, opError(err, "copy.list", bookISBN, "")
+	}
+	return CopyList, nil
+}
+
+// lockCopy : run fn on a copy with its book and then the copy itself locked
+func (lib *Library) lockCopy(barcode string, fn func(tx *Library, item Copy) error) error {
+	item, err := lib.store.Copy(barcode)
+	if err != nil {
+		return err
+	}
+	return lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(item.ISBN); err != nil {
+			return err
+		}
+		// read the copy again under the lock, it may have changed in between
+		item, err := tx.store.Copy(barcode)
+		if err != nil {
+			return err
+		}
+		return fn(tx, item)
+	})
+}
+
+// RemoveCopy : withdraw a copy that is on the shelf or in repair
+// require the barcode, the reason (lost, damaged, weeded or transferred) and an optional note
+func (lib *Library) RemoveCopy(ctx context.Context, barcode, reason, note string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	err := lib.lockCopy(barcode, func(tx *Library, item Copy) error {
+		if item.Status != CopyShelf && item.Status != CopyRepair {
+			return ErrCopyStatus
+		}
+		w, err := tx.withdraw(Withdrawal{ISBN: item.ISBN, Reason: reason, Note: note}, []string{barcode})
+		if err != nil {
+			return err
+		}
+		after, err := tx.store.Copy(barcode)
+		if err != nil {
+			return err
+		}
+		return tx.audit("copy.remove", barcode, map[string]interface{}{"status": item.Status},
+			map[string]interface{}{"status": after.Status, "reason": reason, "note": note, "withdrawal": w.WithdrawalID})
+	})
+
+	logger := lib.log().With(F("op", "copy.remove"), F("copy", barcode))
+	if err != nil {
+		logger.failed("Removing a copy failed.", err)
+		return copyError(err, "copy.remove", barcode, "")
+	}
+
+	logger.Info("Copy removed.", F("reason", reason))
+	return nil
+}
+
+// RepairCopy : send a copy on the shelf to repair, or bring one back from it
+// a repaired copy goes to a waiting reader first if there is one
+// require the barcode and whether it goes to repair
+func (lib *Library) RepairCopy(ctx context.Context, barcode string, toRepair bool) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	err := lib.lockCopy(barcode, func(tx *Library, item Copy) error {
+		var err error
+		if toRepair && item.Status == CopyShelf {
+			err = tx.store.SetCopyStatus(barcode, CopyRepair)
+		} else if !toRepair && item.Status == CopyRepair {
+			err = tx.releaseCopy(item, lib.now())
+		} else {
+			return ErrCopyStatus
+		}
+		if err != nil {
+			return err
+		}
+		after, err := tx.store.Copy(barcode)
+		if err != nil {
+			return err
+		}
+		return tx.audit("copy.repair", barcode, map[string]interface{}{"status": item.Status},
+			map[string]interface{}{"status": after.Status})
+	})
+
+	logger := lib.log().With(F("op", "copy.repair"), F("copy", barcode))
+	if err != nil {
+		logger.failed("Updating a copy failed.", err)
+		return copyError(err, "copy.repair", barcode, "")
+	}
+
+	logger.Info("Copy updated.", F("repair", toRepair))
+	return nil
+}
+
+// MoveCopy : record where a copy is shelved
+func (lib *Library) MoveCopy(ctx context.Context, barcode, location string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	err := lib.lockCopy(barcode, func(tx *Library, item Copy) error {
+		if err := tx.store.SetCopyLocation(barcode, location); err != nil {
+			return err
+		}
+		return tx.audit("copy.move", barcode, map[string]interface{}{"location": item.Location},
+			map[string]interface{}{"location": location})
+	})
+	logger := lib.log().With(F("op", "copy.move"), F("copy", barcode))
+	if err != nil {
+		logger.failed("Moving a copy failed.", err)
+		return copyError(err, "copy.move", barcode, "")
+	}
+	logger.Info("Copy moved.", F("location", location))
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCopyBackfill(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	mlib := Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+
+	if err := mlib.Migrate(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	// three copies: one on the shelf, one on loan and one set aside for a hold
+	var now = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	for _, query := range []string{
+		`INSERT INTO Userlist(id, name, password, overdue, type) VALUES ('18307130006', 'Alicia', '', 0, 1)`,
+		`INSERT INTO Userlist(id, name, password, overdue, type) VALUES ('18307130068', 'Brandon', '', 0, 1)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Camino Winds', '978-0385545938', 'John Grisham', 'Doubleday', 3, 1)`,
+		`INSERT INTO Recordlist(book_id, user_id, IsReturned, borrow_date, deadline, extendtimes)
+		 VALUES ('978-0385545938', '18307130006', FALSE, ?, ?, 0)`,
+		`INSERT INTO Holdlist(book_id, user_id, status, placed_at, pickup_deadline)
+		 VALUES ('978-0385545938', '18307130068', 'ready', ?, ?)`,
+	} {
+		if _, err := store.(*sqlStore).db.Exec(query, now, now.AddDate(0, 1, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mlib.Migrate(ctx, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	CopyList, err := store.Copies(`978-0385545938`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses = map[string]string{}
+	for _, item := range CopyList {
+		statuses[item.Barcode] = item.Status
+	}
+	var want = map[string]string{
+		`978-0385545938-1`:  CopyShelf,
+		`978-0385545938-L1`: CopyLoan,
+		`978-0385545938-H1`: CopyHeld,
+	}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", statuses, want)
+	}
+
+	book, _ := store.Book(`978-0385545938`)
+	if book.Stock != 3 || book.Available != 1 {
+		t.Errorf("got stock %d available %d, want 3 1", book.Stock, book.Available)
+	}
+	record, err := store.OpenRecord(`978-0385545938`, `18307130006`)
+	if err != nil || record.copyID != `978-0385545938-L1` {
+		t.Errorf("got %q %v, want the loan copy", record.copyID, err)
+	}
+
+	if err := mlib.Migrate(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := mlib.Migrate(ctx, 6); err != nil {
+		t.Fatal(err)
+	}
+	if book, _ := store.Book(`978-0385545938`); book.Stock != 3 || book.Available != 1 {
+		t.Errorf("got stock %d available %d after a round trip, want 3 1", book.Stock, book.Available)
+	}
+}
+
+func TestCopies(t *testing.T) {
+	clib := newHoldLibrary(t)
+	defer clib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var now = time.Now()
+	barcode, err := clib.AddCopy(ctx, ISBN, `CW-0002`, `A3-12`, now)
+	if err != nil || barcode != `CW-0002` {
+		t.Fatalf("got %q %v, want CW-0002", barcode, err)
+	}
+	if _, err := clib.AddCopy(ctx, ISBN, `CW-0002`, ``, now); !errors.Is(err, ErrCopyExists) {
+		t.Errorf("got %v, want %v", err, ErrCopyExists)
+	}
+
+	var tests = []struct {
+		testid    int
+		action    string
+		barcode   string
+		userID    string
+		err       error
+		stock     int
+		available int
+	}{
+		{0, "repair", `CW-0002`, ``, nil, 2, 1},
+		{1, "repair", `CW-0002`, ``, ErrCopyStatus, 2, 1},
+		{2, "borrowcopy", `CW-0002`, `18307130006`, ErrBookNotAvailable, 2, 1},
+		{3, "borrow", ``, `18307130006`, nil, 2, 0},
+		{4, "hold", ``, `18307130068`, nil, 2, 0},
+		{5, "unrepair", `CW-0002`, ``, nil, 2, 0},
+		{6, "remove", `CW-0002`, ``, ErrCopyStatus, 2, 0},
+		{7, "borrowcopy", `CW-0002`, `18307130101`, ErrBookNotAvailable, 2, 0},
+		{8, "borrowcopy", `CW-0002`, `18307130068`, nil, 2, 0},
+		{9, "return", ``, `18307130006`, nil, 2, 1},
+		{10, "remove", `978-0385545938-1`, ``, nil, 1, 0},
+		{11, "remove", `978-0385545938-1`, ``, ErrCopyStatus, 1, 0},
+		{12, "repair", `CW-0404`, ``, ErrCopyNotExists, 1, 0},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var err error
+			switch tt.action {
+			case "repair":
+				err = clib.RepairCopy(ctx, tt.barcode, true)
+			case "unrepair":
+				err = clib.RepairCopy(ctx, tt.barcode, false)
+			case "remove":
+				err = clib.RemoveCopy(ctx, tt.barcode, WithdrawDamaged, `water damage`)
+			case "hold":
+				_, err = clib.PlaceHold(ctx, ISBN, tt.userID, now)
+			case "borrow":
+				_, err = clib.BorrowBook(ctx, ISBN, tt.userID, now)
+			case "borrowcopy":
+				_, err = clib.BorrowCopy(ctx, tt.barcode, tt.userID, now)
+			case "return":
+				_, err = clib.ReturnBook(ctx, ISBN, tt.userID)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			book, _ := clib.store.Book(ISBN)
+			if book.Stock != tt.stock || book.Available != tt.available {
+				t.Errorf("got stock %d available %d, want %d %d", book.Stock, book.Available, tt.stock, tt.available)
+			}
+		})
+	}
+
+	if err := clib.MoveCopy(ctx, `CW-0002`, `B1-04`); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	CopyList, _ := clib.Copies(ctx, ISBN)
+	if len(CopyList) != 2 || CopyList[1].Barcode != `CW-0002` || CopyList[1].Location != `B1-04` {
+		t.Errorf("got %+v, want CW-0002 moved to B1-04", CopyList)
+	}
+}
+
+func TestAddBookStock(t *testing.T) {
+	clib := newTestLibrary(t)
+	defer clib.store.Close()
+
+	for _, stock := range []int{0, -3} {
+		if _, err := clib.AddBook(ctx, `Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday`, stock); !errors.Is(err, ErrInvalidStock) {
+			t.Errorf("got %v, want %v", err, ErrInvalidStock)
+		}
+	}
+	// nothing is left behind that has no copies
+	if _, err := clib.store.Book(`978-0385545938`); err != ErrBookNotExists {
+		t.Errorf("got %v, want %v", err, ErrBookNotExists)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrTimeout : the database didn't answer before the operation's timeout, see database.timeout
+var ErrTimeout = errors.New("The database didn't answer in time.")
+
+// OpError : an operation that failed, what it was about and why
+// Err is one of the Err variables, or whatever the database said;
+// test for the former with errors.Is, e.g. errors.Is(err, ErrBookNotExists),
+// and get at the book or user with errors.As
+type OpError struct {
+	Op     string
+	ISBN   string
+	CopyID string
+	UserID string
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	var about []string
+	if e.ISBN != "" {
+		about = append(about, "book "+e.ISBN)
+	}
+	if e.CopyID != "" {
+		about = append(about, "copy "+e.CopyID)
+	}
+	if e.UserID != "" {
+		about = append(about, "user "+e.UserID)
+	}
+	if len(about) == 0 {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + strings.Join(about, ", ") + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError : err as an *OpError of op on a book and a user, either may be empty, nil if err is nil
+// an *OpError from a public method op called becomes one of op, keeping what it was about,
+// and a context.DeadlineExceeded from the database becomes ErrTimeout
+func opError(err error, op, ISBN, userID string) error {
+	return wrapError(err, &OpError{Op: op, ISBN: ISBN, UserID: userID})
+}
+
+// copyError : err as an *OpError of op on a copy, like opError
+func copyError(err error, op, barcode, userID string) error {
+	return wrapError(err, &OpError{Op: op, CopyID: barcode, UserID: userID})
+}
+
+func wrapError(err error, e *OpError) error {
+	if err == nil {
+		return nil
+	}
+	e.Err = err
+	if inner, ok := err.(*OpError); ok {
+		if e.ISBN == "" {
+			e.ISBN = inner.ISBN
+		}
+		if e.CopyID == "" {
+			e.CopyID = inner.CopyID
+		}
+		if e.UserID == "" {
+			e.UserID = inner.UserID
+		}
+		e.Err = inner.Err
+	}
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		e.Err = ErrTimeout
+	}
+	return e
+}
+
+// isAny : whether err is or wraps one of targets
+func isAny(err error, targets ...error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpError(t *testing.T) {
+	var tests = []struct {
+		testid int
+		err    error
+		want   string
+	}{
+		{0, opError(ErrBookNotAvailable, "loan.borrow", `978-0385545938`, `18307130006`),
+			"loan.borrow book 978-0385545938, user 18307130006: There is no available book."},
+		{1, copyError(ErrCopyNotExists, "copy.repair", `CW-0001`, ""), "copy.repair copy CW-0001: Copy not exists."},
+		{2, opError(ErrUnknownCategory, "policy.loan", "", ""), "policy.loan: Unknown reader category."},
+		{3, opError(opError(ErrUserNotExists, "user.check", "", `nobody`), "loan.borrow", `978-0385545938`, ""),
+			"loan.borrow book 978-0385545938, user nobody: User not exists."},
+		{4, opError(nil, "loan.borrow", `978-0385545938`, `18307130006`), ""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			if tt.want == "" {
+				if tt.err != nil {
+					t.Errorf("got %v, want nil", tt.err)
+				}
+				return
+			}
+			if tt.err.Error() != tt.want {
+				t.Errorf("got %q, want %q", tt.err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLoanErrors(t *testing.T) {
+	elib := newHoldLibrary(t)
+	defer elib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	elib.clock = NewFakeClock(now)
+	loan, err := elib.BorrowBook(ctx, ISBN, `18307130006`, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.Title != `Camino Winds` || loan.UserID != `18307130006` || !loan.Deadline.After(now) || loan.Returned() {
+		t.Errorf("got %+v, want an open loan of Camino Winds", loan)
+	}
+
+	_, err = elib.BorrowBook(ctx, ISBN, `18307130068`, now)
+	var opErr *OpError
+	if !errors.Is(err, ErrBookNotAvailable) || !errors.As(err, &opErr) {
+		t.Fatalf("got %v, want an *OpError wrapping ErrBookNotAvailable", err)
+	}
+	if opErr.Op != "loan.borrow" || opErr.ISBN != ISBN || opErr.UserID != `18307130068` {
+		t.Errorf("got %+v, want loan.borrow of %s by 18307130068", opErr, ISBN)
+	}
+
+	extended, err := elib.ExtendDeadline(ctx, ISBN, `18307130006`)
+	if err != nil || extended.Renewals != 1 || !extended.Deadline.After(loan.Deadline) {
+		t.Errorf("got %+v, %v, want the deadline extended once", extended, err)
+	}
+	returned, err := elib.ReturnBook(ctx, ISBN, `18307130006`)
+	if err != nil || !returned.Returned() || returned.RecordID != loan.RecordID {
+		t.Errorf("got %+v, %v, want record %s returned", returned, err, loan.RecordID)
+	}
+
+	// the history still names a book whose every copy is gone
+	if _, err := elib.RemoveBook(ctx, ISBN, 1, WithdrawWeeded, ""); err != nil {
+		t.Fatal(err)
+	}
+	history, err := elib.CheckBorrowHistory(ctx, `18307130006`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	elib.PrintHistory(&buf, history)
+	elib.PrintUnreturned(&buf, history)
+	if strings.Count(buf.String(), `Camino Winds`) != 2 {
+		t.Errorf("got %q, want the title in both tables", buf.String())
+	}
+}
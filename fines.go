@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ledger entry kinds, stored in Finelist.kind
+// charges are positive amounts, payments and waivers negative ones
+const (
+	FineOverdue = "overdue"
+	FineLost    = "lost"
+	FinePayment = "payment"
+	FineWaiver  = "waiver"
+)
+
+// FineActor : the actor recorded for charges the library makes by itself
+const FineActor = "system"
+
+// FineEntry : one line of a user's ledger, amounts in cents
+type FineEntry struct {
+	EntryID   string
+	UserID    string
+	Kind      string
+	Amount    int
+	ISBN      sql.NullString
+	RecordID  sql.NullString
+	Note      sql.NullString
+	Actor     string
+	CreatedAt time.Time
+}
+
+var ErrFinesOutstanding = errors.New("Outstanding fines over the limit. Please pay them first.")
+var ErrInvalidAmount = errors.New("The amount must be positive and no more than what is owed.")
+
+// FormatMoney : cents as "12.50"
+func FormatMoney(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// ParseMoney : "12.5" or "12.50" as cents
+// only digits are accepted around the point, so no sign slips through strconv.Atoi
+func ParseMoney(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.SplitN(s, ".", 2)
+	if !isDigits(parts[0]) {
+		return 0, ErrInvalidAmount
+	}
+	units, err := strconv.Atoi(parts[0])
+	if err != nil || units > (maxInt-99)/100 {
+		return 0, ErrInvalidAmount
+	}
+	cents := 0
+	if len(parts) == 2 {
+		frac := parts[1]
+		if len(frac) > 2 || !isDigits(frac) {
+			return 0, ErrInvalidAmount
+		}
+		if len(frac) == 1 {
+			frac += "0"
+		}
+		cents, _ = strconv.Atoi(frac)
+	}
+	return units*100 + cents, nil
+}
+
+// maxInt : the largest int, so that amounts in cents don't overflow
+const maxInt = int(^uint(0) >> 1)
+
+// isDigits : whether s is made of '0' to '9' only, and not empty
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// overdueDays : how many days late a loan due at deadline is at now, every started day counts
+func overdueDays(deadline, now time.Time) int {
+	if !now.After(deadline) {
+		return 0
+	}
+	return int(math.Ceil(now.Sub(deadline).Hours() / 24))
+}
+
+// overdueFine : what a loan due at deadline and returned at now costs
+// MaxFine caps the total unless it is 0
+func overdueFine(policy LoanPolicy, deadline, now time.Time) int {
+	fine := overdueDays(deadline, now) * policy.DailyFine
+	if policy.MaxFine > 0 && fine > policy.MaxFine {
+		fine = policy.MaxFine
+	}
+	return fine
+}
+
+// chargeOverdue : add the overdue fine of a record that is being closed at now
+// must run in a transaction
+func (lib *Library) chargeOverdue(record Records, policy LoanPolicy, now time.Time) error {
+	fine := overdueFine(policy, record.deadline, now)
+	if fine <= 0 {
+		return nil
+	}
+	days := overdueDays(record.deadline, now)
+	return lib.store.InsertFine(FineEntry{
+		UserID:    record.userID,
+		Kind:      FineOverdue,
+		Amount:    fine,
+		ISBN:      sql.NullString{String: record.bookID, Valid: true},
+		RecordID:  sql.NullString{String: record.recordID, Valid: true},
+		Note:      sql.NullString{String: fmt.Sprintf("%d day(s) late", days), Valid: true},
+		Actor:     FineActor,
+		CreatedAt: now,
+	})
+}
+
+// Fines : what a user owes and the ledger it comes from
+func (lib *Library) Fines(ctx context.Context, userID string) (int, []FineEntry, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if err := lib.CheckUserExists(ctx, userID); err != nil {
+		return 0, nil, opError(err, "fine.list", "", userID)
+	}
+	balance, err := lib.store.FineBalance(userID)
+	var FineList []FineEntry
+	if err == nil {
+		FineList, err = lib.store.Fines(userID)
+	}
+	if err != nil {
+		lib.log().failed("Querying fines failed.", err, F("op", "fine.list"), F("user", userID))
+		return 0, nil, opError(err, "fine.list", "", userID)
+	}
+	return balance, FineList, nil
+}
+
+// settle : record a payment or waiver of amount cents, no more than the balance
+func (lib *Library) settle(userID, kind string, amount int, note, actor string) error {
+	err := lib.transaction(func(tx *Library) error {
+		// lock the user so that concurrent payments can't both pass the balance check
+		if _, err := tx.store.User(userID); err != nil {
+			return err
+		}
+		balance, err := tx.store.FineBalance(userID)
+		if err != nil {
+			return err
+		}
+		if amount <= 0 || amount > balance {
+			return ErrInvalidAmount
+		}
+		err = tx.store.InsertFine(FineEntry{
+			UserID:    userID,
+			Kind:      kind,
+			Amount:    -amount,
+			Note:      sql.NullString{String: note, Valid: note != ""},
+			Actor:     actor,
+			CreatedAt: lib.now(),
+		})
+		if err != nil {
+			return err
+		}
+		return tx.audit("fine."+kind, userID, map[string]interface{}{"balance": balance},
+			map[string]interface{}{"balance": balance - amount, "amount": amount, "note": note})
+	})
+
+	logger := lib.log().With(F("op", "fine."+kind), F("user", userID), F("amount", amount))
+	if err != nil {
+		logger.failed("Settling a fine failed.", err)
+		return opError(err, "fine."+kind, "", userID)
+	}
+	logger.Info("Fine settled.", F("by", actor))
+	return nil
+}
+
+// PayFine : record that a user paid amount cents
+// require user's ID, the amount and who took the payment
+func (lib *Library) PayFine(ctx context.Context, userID string, amount int, actor string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.settle(userID, FinePayment, amount, "", actor)
+}
+
+// WaiveFine : forgive amount cents of what a user owes
+// require user's ID, the amount, the reason and who waived it
+func (lib *Library) WaiveFine(ctx context.Context, userID string, amount int, note, actor string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.settle(userID, FineWaiver, amount, note, actor)
+}
+
+// DeclareLost : close the loan of a copy the user lost and charge for it
+// the copy leaves stock; the user pays the replacement fee plus any overdue fine so far
+// require book's ISBN, user's ID and who declared it
+func (lib *Library) DeclareLost(ctx context.Context, bookISBN, userID, actor string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(bookISBN); err != nil {
+			return err
+		}
+		record, err := tx.store.OpenRecord(bookISBN, userID)
+		if err != nil {
+			return err
+		}
+
+		now := lib.now()
+		err = tx.store.CloseRecord(record.recordID, now)
+		if err != nil {
+			return err
+		}
+		err = tx.recountOverdue(userID, now)
+		if err != nil {
+			return err
+		}
+		// the copy was on loan, so it only leaves stock, not available
+		w, err := tx.withdraw(Withdrawal{ISBN: bookISBN, Reason: WithdrawLost, Actor: actor,
+			RecordID: sql.NullString{String: record.recordID, Valid: true}}, []string{record.copyID})
+		if err != nil {
+			return err
+		}
+
+		policy, _, err := tx.store.Policy(userID, bookISBN)
+		if err != nil {
+			return err
+		}
+		err = tx.chargeOverdue(record, policy, now)
+		if err != nil {
+			return err
+		}
+		if policy.ReplacementFee > 0 {
+			err = tx.store.InsertFine(FineEntry{
+				UserID:    userID,
+				Kind:      FineLost,
+				Amount:    policy.ReplacementFee,
+				ISBN:      sql.NullString{String: bookISBN, Valid: true},
+				RecordID:  sql.NullString{String: record.recordID, Valid: true},
+				Actor:     actor,
+				CreatedAt: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.audit("loan.lost", userID, map[string]interface{}{"isbn": bookISBN, "copy": record.copyID, "deadline": record.deadline},
+			map[string]interface{}{"isbn": bookISBN, "copy": record.copyID, "fee": policy.ReplacementFee, "withdrawal": w.WithdrawalID})
+	})
+
+	logger := lib.log().With(F("op", "loan.lost"), F("user", userID), F("isbn", bookISBN))
+	if err != nil {
+		logger.failed("Declaring a book lost failed.", err)
+		return opError(err, "loan.lost", bookISBN, userID)
+	}
+
+	logger.Info("Book declared lost.", F("by", actor))
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseMoney(t *testing.T) {
+	var tests = []struct {
+		testid int
+		input  string
+		cents  int
+		err    error
+	}{
+		{0, `12`, 1200, nil},
+		{1, `12.5`, 1250, nil},
+		{2, `0.05`, 5, nil},
+		{3, ` 3.20 `, 320, nil},
+		{4, `-1`, 0, ErrInvalidAmount},
+		{5, `1.234`, 0, ErrInvalidAmount},
+		{6, `abc`, 0, ErrInvalidAmount},
+		{7, `1.`, 0, ErrInvalidAmount},
+		{8, `1.-5`, 0, ErrInvalidAmount},
+		{9, `-0.50`, 0, ErrInvalidAmount},
+		{10, `1.+5`, 0, ErrInvalidAmount},
+		{11, `+1`, 0, ErrInvalidAmount},
+		{12, `.5`, 0, ErrInvalidAmount},
+		{13, `1 000`, 0, ErrInvalidAmount},
+		{14, `92233720368547758`, 0, ErrInvalidAmount},
+		{15, `99999999999999999999`, 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			cents, err := ParseMoney(tt.input)
+			if !errors.Is(err, tt.err) || cents != tt.cents {
+				t.Errorf("got %d %v, want %d %v", cents, err, tt.cents, tt.err)
+			}
+			if err == nil && FormatMoney(cents) != fmt.Sprintf("%d.%02d", tt.cents/100, tt.cents%100) {
+				t.Errorf("got %s", FormatMoney(cents))
+			}
+		})
+	}
+}
+
+func TestOverdueFine(t *testing.T) {
+	var deadline = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	var policy = LoanPolicy{DailyFine: 50, MaxFine: 2000}
+
+	var tests = []struct {
+		testid int
+		now    time.Time
+		policy LoanPolicy
+		fine   int
+	}{
+		{0, deadline.Add(-time.Hour), policy, 0},
+		{1, deadline, policy, 0},
+		{2, deadline.Add(time.Minute), policy, 50},
+		{3, deadline.AddDate(0, 0, 3), policy, 150},
+		{4, deadline.AddDate(0, 0, 3).Add(time.Hour), policy, 200},
+		{5, deadline.AddDate(1, 0, 0), policy, 2000},
+		{6, deadline.AddDate(1, 0, 0), LoanPolicy{DailyFine: 50}, 365 * 50},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			if fine := overdueFine(tt.policy, deadline, tt.now); fine != tt.fine {
+				t.Errorf("got %d, want %d", fine, tt.fine)
+			}
+		})
+	}
+}
+
+func TestFinesLedger(t *testing.T) {
+	flib := newTestLibrary(t)
+	defer flib.store.Close()
+
+	flib.AddUser(ctx, Users{`18307130006`, `Alicia`, `578152`, 0, 1})
+	flib.AddBook(ctx, `Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday`, 2)
+	flib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 2)
+
+	// ten days late on a normal book at 0.50 a day
+	var now = time.Now()
+	flib.BorrowBook(ctx, `978-0385545938`, `18307130006`, now.AddDate(0, 0, -40).Add(time.Hour))
+	if _, err := flib.ReturnBook(ctx, `978-0385545938`, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	balance, entries, _ := flib.Fines(ctx, `18307130006`)
+	if balance != 500 || len(entries) != 1 || entries[0].Kind != FineOverdue {
+		t.Fatalf("got %d %+v, want one overdue fine of 500", balance, entries)
+	}
+
+	// losing a book on time only costs the replacement fee
+	flib.BorrowBook(ctx, `978-1984801258`, `18307130006`, now)
+	if err := flib.DeclareLost(ctx, `978-1984801258`, `18307130006`, `root`); err != nil {
+		t.Fatal(err)
+	}
+	book, _ := flib.store.Book(`978-1984801258`)
+	if book.Stock != 1 || book.Available != 1 {
+		t.Errorf("got stock %d available %d, want 1 1", book.Stock, book.Available)
+	}
+
+	var tests = []struct {
+		testid  int
+		action  string
+		amount  int
+		balance int
+		err     error
+	}{
+		{0, "borrow", 0, 5500, ErrFinesOutstanding},
+		{1, "pay", 6000, 5500, ErrInvalidAmount},
+		{2, "pay", 0, 5500, ErrInvalidAmount},
+		{3, "pay", 4000, 1500, nil},
+		{4, "borrow", 0, 1500, ErrFinesOutstanding},
+		{5, "waive", 500, 1000, nil},
+		{6, "borrow", 0, 1000, nil},
+		{7, "waive", 1000, 0, nil},
+		{8, "waive", 1, 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var err error
+			switch tt.action {
+			case "borrow":
+				_, err = flib.BorrowBook(ctx, `978-0385545938`, `18307130006`, now)
+			case "pay":
+				err = flib.PayFine(ctx, `18307130006`, tt.amount, `librarian`)
+			case "waive":
+				err = flib.WaiveFine(ctx, `18307130006`, tt.amount, `first offence`, `root`)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if balance, _, _ := flib.Fines(ctx, `18307130006`); balance != tt.balance {
+				t.Errorf("got balance %d, want %d", balance, tt.balance)
+			}
+		})
+	}
+
+	if _, entries, _ := flib.Fines(ctx, `18307130006`); len(entries) != 5 {
+		t.Errorf("got %d ledger entries, want 5", len(entries))
+	}
+}
+
+func TestLostOverdueCounter(t *testing.T) {
+	flib := newHoldLibrary(t)
+	defer flib.store.Close()
+
+	now := time.Now()
+	if _, err := flib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Camino Winds was counted overdue ten days ago; Untamed became overdue since, uncounted
+	if _, err := flib.BorrowBook(ctx, `978-0385545938`, `18307130006`, now.AddDate(0, 0, -40)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := flib.BorrowBook(ctx, `978-1984801258`, `18307130006`, now.AddDate(0, 0, -35)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := flib.CheckOverdue(ctx, `18307130006`, now.AddDate(0, 0, -10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// losing Untamed leaves Camino Winds counted
+	if err := flib.DeclareLost(ctx, `978-1984801258`, `18307130006`, `root`); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := flib.store.User(`18307130006`); err != nil || user.Overdue != 1 {
+		t.Errorf("got %d, %v, want the overdue counter at 1", user.Overdue, err)
+	}
+	if _, err := flib.ReturnBook(ctx, `978-0385545938`, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := flib.store.User(`18307130006`); err != nil || user.Overdue != 0 {
+		t.Errorf("got %d, %v, want the overdue counter at 0", user.Overdue, err)
+	}
+}
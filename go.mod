@@ -6,5 +6,7 @@ require (
 	github.com/bndr/gotabulate v1.1.2 // indirect
 	github.com/go-sql-driver/mysql v1.4.0
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/modood/table v0.0.0-20200225102042-88de94bb9876
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
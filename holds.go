@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// hold statuses, stored in Holdlist.status
+// a hold waits in the queue until a copy is set aside for it, then it is ready
+// until the reader borrows the copy, cancels, or lets the pickup deadline pass
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+// Hold : a reader's place in the queue for a book
+// CopyID and PickupDeadline are only set once a copy has been set aside
+type Hold struct {
+	HoldID         string
+	ISBN           string
+	UserID         string
+	Status         string
+	PlacedAt       time.Time
+	PickupDeadline sql.NullTime
+	CopyID         string
+}
+
+// DefaultHoldPickup : how long a copy is set aside unless configured otherwise
+var DefaultHoldPickup = 72 * time.Hour
+
+var ErrAlreadyHeld = errors.New("You already have a hold on this book.")
+var ErrNoHold = errors.New("No hold on this book.")
+var ErrBookAvailable = errors.New("There are available copies. Borrow one instead.")
+
+// pickupDeadline : when a copy set aside at now stops being kept
+func (lib *Library) pickupDeadline(now time.Time) time.Time {
+	pickup := lib.holdPickup
+	if pickup <= 0 {
+		pickup = DefaultHoldPickup
+	}
+	return now.Add(pickup)
+}
+
+// releaseCopy : set a copy that just came back aside for the first reader waiting for it,
+// or put it back on the shelf if nobody is
+// must run in a transaction holding the book's row lock
+func (lib *Library) releaseCopy(item Copy, now time.Time) error {
+	hold, err := lib.store.NextHold(item.ISBN)
+	if errors.Is(err, ErrNoHold) {
+		return lib.store.SetCopyStatus(item.Barcode, CopyShelf)
+	}
+	if err != nil {
+		return err
+	}
+	err = lib.store.SetCopyStatus(item.Barcode, CopyHeld)
+	if err != nil {
+		return err
+	}
+	return lib.store.ReadyHold(hold.HoldID, item.Barcode, lib.pickupDeadline(now))
+}
+
+// releaseHeldCopy : release the copy set aside for a hold that is no longer ready
+func (lib *Library) releaseHeldCopy(hold Hold, now time.Time) error {
+	item, err := lib.store.Copy(hold.CopyID)
+	if err != nil {
+		return err
+	}
+	return lib.releaseCopy(item, now)
+}
+
+// expireHolds : move the copies of ready holds past their pickup deadline to the next reader
+// and return how many holds expired
+// must run in a transaction holding the book's row lock
+func (lib *Library) expireHolds(ISBN string, now time.Time) (int, error) {
+	expired, err := lib.store.ExpiredHolds(ISBN, now)
+	if err != nil {
+		return 0, err
+	}
+	for _, hold := range expired {
+		err = lib.store.SetHoldStatus(hold.HoldID, HoldExpired)
+		if err != nil {
+			return 0, err
+		}
+		err = lib.releaseHeldCopy(hold, now)
+		if err != nil {
+			return 0, err
+		}
+		// whoever happened to touch the book didn't expire the hold, the pickup deadline did
+		err = lib.As(SystemActor, OriginSystem).audit("hold.expire", hold.UserID,
+			map[string]interface{}{"isbn": ISBN, "copy": hold.CopyID, "status": HoldReady},
+			map[string]interface{}{"isbn": ISBN, "status": HoldExpired})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// ExpireHolds : pass on the copies of a book whose pickup deadline has passed
+// it commits on its own, so the queue moves on even if what comes after fails
+func (lib *Library) ExpireHolds(ctx context.Context, bookISBN string, now time.Time) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(bookISBN); err != nil {
+			return err
+		}
+		_, err := tx.expireHolds(bookISBN, now)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrBookNotExists) {
+		lib.log().failed("Expiring holds failed.", err, F("op", "hold.expire"), F("isbn", bookISBN))
+	}
+	return opError(err, "hold.expire", bookISBN, "")
+}
+
+// PlaceHold : join the queue for a book that has no available copy, and return the hold
+// require book's ISBN, user's ID
+func (lib *Library) PlaceHold(ctx context.Context, bookISBN, userID string, now time.Time) (Hold, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	lib.ExpireHolds(ctx, bookISBN, now)
+	var res Hold
+	err := lib.transaction(func(tx *Library) error {
+		book, err := tx.store.Book(bookISBN)
+		if err != nil {
+			return err
+		}
+		if book.Stock <= 0 {
+			return ErrBookNotExists
+		}
+
+		_, err = tx.store.OpenRecord(bookISBN, userID)
+		if err == nil {
+			return ErrAlreadyBorrowed
+		}
+		if !errors.Is(err, ErrNotBorrowed) {
+			return err
+		}
+		_, err = tx.store.ActiveHold(bookISBN, userID)
+		if err == nil {
+			return ErrAlreadyHeld
+		}
+		if !errors.Is(err, ErrNoHold) {
+			return err
+		}
+		if err := tx.checkAccount(userID, now); err != nil {
+			return err
+		}
+
+		loan, _, err := tx.store.Policy(userID, bookISBN)
+		if err != nil {
+			return err
+		}
+		if loan.LoanDays <= 0 {
+			return ErrNotLoanable
+		}
+		if book.Available > 0 {
+			return ErrBookAvailable
+		}
+		err = tx.store.InsertHold(bookISBN, userID, now)
+		if err != nil {
+			return err
+		}
+		res, err = tx.store.ActiveHold(bookISBN, userID)
+		if err != nil {
+			return err
+		}
+		return tx.audit("hold.place", userID, nil, map[string]interface{}{"isbn": bookISBN, "status": HoldWaiting})
+	})
+
+	logger := lib.log().With(F("op", "hold.place"), F("user", userID), F("isbn", bookISBN))
+	if err != nil {
+		logger.failed("Placing a hold failed.", err)
+		return Hold{}, opError(err, "hold.place", bookISBN, userID)
+	}
+
+	logger.Info("Hold placed.")
+	return res, nil
+}
+
+// CancelHold : leave the queue for a book
+// a copy already set aside goes to the next reader
+// require book's ISBN, user's ID
+func (lib *Library) CancelHold(ctx context.Context, bookISBN, userID string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(bookISBN); err != nil {
+			return err
+		}
+		hold, err := tx.store.ActiveHold(bookISBN, userID)
+		if err != nil {
+			return err
+		}
+		err = tx.store.SetHoldStatus(hold.HoldID, HoldCancelled)
+		if err != nil {
+			return err
+		}
+		if hold.Status == HoldReady {
+			err = tx.releaseHeldCopy(hold, lib.now())
+			if err != nil {
+				return err
+			}
+		}
+		return tx.audit("hold.cancel", userID, map[string]interface{}{"isbn": bookISBN, "status": hold.Status},
+			map[string]interface{}{"isbn": bookISBN, "status": HoldCancelled})
+	})
+
+	logger := lib.log().With(F("op", "hold.cancel"), F("user", userID), F("isbn", bookISBN))
+	if err != nil {
+		logger.failed("Cancelling a hold failed.", err)
+		return opError(err, "hold.cancel", bookISBN, userID)
+	}
+
+	logger.Info("Hold cancelled.")
+	return nil
+}
+
+// UserHolds : the holds a user is waiting on or can pick up
+func (lib *Library) UserHolds(ctx context.Context, userID string) ([]Hold, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	HoldList, err := lib.store.UserHolds(userID)
+	if err != nil {
+		lib.log().failed("Querying holds failed.", err, F("op", "hold.list"), F("user", userID))
+		return nil, opError(err, "hold.list", "", userID)
+	}
+	return HoldList, nil
+}
+
+// BookQueue : the queue of a book, a ready hold first if there is one
+func (lib *Library) BookQueue(ctx context.Context, bookISBN string) ([]Hold, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	if _, err := lib.store.Book(bookISBN); err != nil {
+		return nil, opError(err, "hold.list", bookISBN, "")
+	}
+	HoldList, err := lib.store.BookHolds(bookISBN)
+	if err != nil {
+		lib.log().failed("Querying holds failed.", err, F("op", "hold.list"), F("isbn", bookISBN))
+		return nil, opError(err, "hold.list", bookISBN, "")
+	}
+	return HoldList, nil
+}
+
+// QueuePosition : how many waiting holds on the book are ahead of the given one, plus one
+// ready holds are at position 0
+func (lib *Library) QueuePosition(ctx context.Context, hold Hold) (int, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if hold.Status == HoldReady {
+		return 0, nil
+	}
+	queue, err := lib.store.BookHolds(hold.ISBN)
+	if err != nil {
+		return -1, err
+	}
+	position := 0
+	for _, now := range queue {
+		if now.Status == HoldWaiting {
+			position = position + 1
+		}
+		if now.HoldID == hold.HoldID {
+			return position, nil
+		}
+	}
+	return -1, ErrNoHold
+}
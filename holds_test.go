@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newHoldLibrary : a library with four readers and a single copy of one book
+func newHoldLibrary(t *testing.T) *Library {
+	hlib := newTestLibrary(t)
+	for _, user := range []Users{
+		{`18307130006`, `Alicia`, `578152`, 0, 1},
+		{`18307130068`, `Brandon`, `987430`, 0, 1},
+		{`18307130101`, `Chloe`, `246810`, 0, 1},
+		{`18307130102`, `Daniel`, `135791`, 0, 1},
+	} {
+		if err := hlib.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hlib.AddBook(ctx, `Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday`, 1); err != nil {
+		t.Fatal(err)
+	}
+	return hlib
+}
+
+func TestHoldQueue(t *testing.T) {
+	hlib := newHoldLibrary(t)
+	defer hlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var now = time.Now()
+	var tests = []struct {
+		testid int
+		action string
+		userID string
+		err    error
+	}{
+		{0, "hold", `18307130006`, ErrBookAvailable},
+		{1, "borrow", `18307130006`, nil},
+		{2, "borrow", `18307130068`, ErrBookNotAvailable},
+		{3, "hold", `18307130068`, nil},
+		{4, "hold", `18307130101`, nil},
+		{5, "hold", `18307130068`, ErrAlreadyHeld},
+		{6, "hold", `18307130006`, ErrAlreadyBorrowed},
+		{7, "return", `18307130006`, nil},
+		{8, "borrow", `18307130101`, ErrBookNotAvailable},
+		{9, "borrow", `18307130068`, nil},
+		{10, "cancel", `18307130068`, ErrNoHold},
+		{11, "return", `18307130068`, nil},
+		{12, "cancel", `18307130101`, nil},
+		{13, "borrow", `18307130102`, nil},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var err error
+			switch tt.action {
+			case "hold":
+				_, err = hlib.PlaceHold(ctx, ISBN, tt.userID, now)
+			case "cancel":
+				err = hlib.CancelHold(ctx, ISBN, tt.userID)
+			case "borrow":
+				_, err = hlib.BorrowBook(ctx, ISBN, tt.userID, now)
+			case "return":
+				_, err = hlib.ReturnBook(ctx, ISBN, tt.userID)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	book, _ := hlib.store.Book(ISBN)
+	if book.Available != 0 {
+		t.Errorf("got %d available, want 0", book.Available)
+	}
+	if queue, _ := hlib.BookQueue(ctx, ISBN); len(queue) != 0 {
+		t.Errorf("got %d holds, want an empty queue", len(queue))
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	hlib := newHoldLibrary(t)
+	defer hlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var now = time.Now()
+	hlib.BorrowBook(ctx, ISBN, `18307130006`, now)
+	hlib.PlaceHold(ctx, ISBN, `18307130068`, now)
+	hlib.PlaceHold(ctx, ISBN, `18307130101`, now)
+	hlib.ReturnBook(ctx, ISBN, `18307130006`)
+
+	holds, _ := hlib.UserHolds(ctx, `18307130068`)
+	if len(holds) != 1 || holds[0].Status != HoldReady || !holds[0].PickupDeadline.Valid {
+		t.Fatalf("got %+v, want one ready hold", holds)
+	}
+	if position, _ := hlib.QueuePosition(ctx, holds[0]); position != 0 {
+		t.Errorf("got position %d, want 0", position)
+	}
+	holds, _ = hlib.UserHolds(ctx, `18307130101`)
+	if position, _ := hlib.QueuePosition(ctx, holds[0]); position != 1 {
+		t.Errorf("got position %d, want 1", position)
+	}
+
+	// nobody picks the copy up, so it moves down the queue and finally back to the shelf
+	later := now.Add(DefaultHoldPickup + time.Hour)
+	if _, err := hlib.BorrowBook(ctx, ISBN, `18307130102`, later); !errors.Is(err, ErrBookNotAvailable) {
+		t.Errorf("got %v, want %v", err, ErrBookNotAvailable)
+	}
+	holds, _ = hlib.UserHolds(ctx, `18307130101`)
+	if len(holds) != 1 || holds[0].Status != HoldReady {
+		t.Fatalf("got %+v, want one ready hold", holds)
+	}
+	if holds, _ := hlib.UserHolds(ctx, `18307130068`); len(holds) != 0 {
+		t.Errorf("got %+v, want the expired hold gone", holds)
+	}
+
+	if _, err := hlib.BorrowBook(ctx, ISBN, `18307130102`, later.Add(DefaultHoldPickup+time.Hour)); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestAddBookServesHolds(t *testing.T) {
+	hlib := newHoldLibrary(t)
+	defer hlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var now = time.Now()
+	hlib.BorrowBook(ctx, ISBN, `18307130006`, now)
+	hlib.PlaceHold(ctx, ISBN, `18307130068`, now)
+
+	if _, err := hlib.AddBook(ctx, `Camino Winds`, ISBN, `John Grisham`, `Doubleday`, 2); err != nil {
+		t.Fatal(err)
+	}
+	book, _ := hlib.store.Book(ISBN)
+	if book.Stock != 3 || book.Available != 1 {
+		t.Errorf("got stock %d available %d, want 3 1", book.Stock, book.Available)
+	}
+	holds, _ := hlib.UserHolds(ctx, `18307130068`)
+	if len(holds) != 1 || holds[0].Status != HoldReady {
+		t.Errorf("got %+v, want one ready hold", holds)
+	}
+}
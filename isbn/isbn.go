@@ -0,0 +1,110 @@
+// Package isbn validates ISBN-10 and ISBN-13 numbers and converts between them.
+//
+// Input may carry hyphens or spaces anywhere and a lower case check digit x.
+// The canonical form of a book number is its ISBN-13 with a hyphen after the
+// EAN prefix, e.g. 978-0062820181, which is how the library stores it.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalid = errors.New("Invalid ISBN.")
+var ErrNoISBN10 = errors.New("This ISBN-13 has no ISBN-10 form.")
+
+// digits : s without hyphens and spaces, in upper case
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		if r == 'x' {
+			return 'X'
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// check10 : the check digit of the first nine digits of an ISBN-10
+func check10(s string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(s[i]-'0')
+	}
+	c := (11 - sum%11) % 11
+	if c == 10 {
+		return 'X'
+	}
+	return byte('0' + c)
+}
+
+// check13 : the check digit of the first twelve digits of an ISBN-13
+func check13(s string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		w := 1
+		if i%2 == 1 {
+			w = 3
+		}
+		sum += w * int(s[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// To13 : the ISBN-13 of an ISBN-10 or ISBN-13, as 13 digits
+func To13(s string) (string, error) {
+	d := digits(s)
+	switch len(d) {
+	case 10:
+		if !allDigits(d[:9]) || check10(d) != d[9] {
+			return "", ErrInvalid
+		}
+		res := "978" + d[:9]
+		return res + string(check13(res)), nil
+	case 13:
+		if !allDigits(d) || (d[:3] != "978" && d[:3] != "979") || check13(d) != d[12] {
+			return "", ErrInvalid
+		}
+		return d, nil
+	}
+	return "", ErrInvalid
+}
+
+// To10 : the ISBN-10 of an ISBN-10 or ISBN-13, as 10 characters
+// only ISBN-13s starting with 978 have one
+func To10(s string) (string, error) {
+	d, err := To13(s)
+	if err != nil {
+		return "", err
+	}
+	if d[:3] != "978" {
+		return "", ErrNoISBN10
+	}
+	res := d[3:12]
+	return res + string(check10(res)), nil
+}
+
+// Valid : whether s is an ISBN-10 or ISBN-13 with the right check digit
+func Valid(s string) bool {
+	_, err := To13(s)
+	return err == nil
+}
+
+// Canonical : the canonical form of an ISBN-10 or ISBN-13, e.g. 978-0062820181
+func Canonical(s string) (string, error) {
+	d, err := To13(s)
+	if err != nil {
+		return "", err
+	}
+	return d[:3] + "-" + d[3:], nil
+}
@@ -0,0 +1,48 @@
+package isbn
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	var tests = []struct {
+		testid    int
+		input     string
+		canonical string
+		isbn10    string
+		err       error
+	}{
+		{0, `978-0062820181`, `978-0062820181`, `0062820184`, nil},
+		{1, `9780062820181`, `978-0062820181`, `0062820184`, nil},
+		{2, `0062820184`, `978-0062820181`, `0062820184`, nil},
+		{3, ` 0-06-282018-4 `, `978-0062820181`, `0062820184`, nil},
+		{4, `978-0-13-412383-7`, `978-0134123837`, `0134123832`, nil},
+		{5, `080442957x`, `978-0804429573`, `080442957X`, nil},
+		{6, `979-10-90636-07-1`, `979-1090636071`, ``, ErrNoISBN10},
+		{7, `978-0062820182`, ``, ``, ErrInvalid},
+		{8, `0062820185`, ``, ``, ErrInvalid},
+		{9, `123-0062820181`, ``, ``, ErrInvalid},
+		{10, `X062820184`, ``, ``, ErrInvalid},
+		{11, `978006282018`, ``, ``, ErrInvalid},
+		{12, ``, ``, ``, ErrInvalid},
+		{13, `978-0062820181-1`, ``, ``, ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			canonical, err := Canonical(tt.input)
+			if canonical != tt.canonical || (err != nil) != (tt.err == ErrInvalid) {
+				t.Errorf("got %q %v, want %q", canonical, err, tt.canonical)
+			}
+			if valid := Valid(tt.input); valid != (tt.canonical != "") {
+				t.Errorf("got valid %v, want %v", valid, !valid)
+			}
+			isbn10, err := To10(tt.input)
+			if isbn10 != tt.isbn10 || (tt.isbn10 == "" && err != tt.err) {
+				t.Errorf("got %q %v, want %q %v", isbn10, err, tt.isbn10, tt.err)
+			}
+		})
+	}
+}
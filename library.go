@@ -2,31 +2,40 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	// mysql connector
-	_ "github.com/go-sql-driver/mysql"
-	sqlx "github.com/jmoiron/sqlx"
-
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
 	// for better printing
 	"github.com/modood/table"
 )
 
-var (
-	User     string
-	Password string
-	DBName   string
-)
-
 type Library struct {
-	db *sqlx.DB
+	store      Store
+	hasher     PasswordHasher
+	sessionTTL time.Duration
+	holdPickup time.Duration
+	clock      Clock
+	logger     *Logger
+	// the category new users are put in, the database's default if empty
+	defaultCategory string
+	// reminders Sweep sends, and how long before a deadline
+	notifier     Notifier
+	remindBefore time.Duration
+	// how long an operation, or a batch of them, may wait for the database; 0 is no limit
+	timeout      time.Duration
+	batchTimeout time.Duration
+	// who changes are audited under, see As
+	actor  string
+	origin string
 }
 
 type Books struct {
@@ -56,11 +65,33 @@ type Records struct {
 	returnDate  sql.NullTime
 	deadline    time.Time
 	extendTimes int
+	copyID      string
+}
+
+// Loan : a book lent to a user, returned once ReturnedAt is set
+// Title is empty if the book's record can't be read
+type Loan struct {
+	RecordID   string
+	ISBN       string
+	Title      string
+	UserID     string
+	CopyID     string
+	BorrowedAt time.Time
+	Deadline   time.Time
+	ReturnedAt time.Time
+	Renewals   int
+}
+
+// Returned : whether the loan is over
+func (l Loan) Returned() bool {
+	return !l.ReturnedAt.IsZero()
 }
 
 var help string
 var timeTemplate = "2006/01/02 15:04:05"
+var dateTemplate = "2006-01-02"
 var ErrAllRemoved = errors.New("All have been removed.")
+var ErrInvalidStock = errors.New("Stock must be a whole number of at least 1.")
 var ErrUserExists = errors.New("User account already exists.")
 var ErrBookNotExists = errors.New("Book not exists.")
 var ErrUserNotExists = errors.New("User not exists.")
@@ -68,640 +99,799 @@ var ErrUserSuspended = errors.New("Account suspended.")
 var ErrBookNotAvailable = errors.New("There is no available book.")
 var ErrAlreadyBorrowed = errors.New("The book is already borrowed.")
 var ErrNotBorrowed = errors.New("The book isn't borrowed.")
-var ErrNoMoreExtended = errors.New("Already extended for three times. Can't extend again.")
+var ErrNoMoreExtended = errors.New("No renewals left. Can't extend again.")
 var ErrPassword = errors.New("Username and password don't match")
 
-// ConnectDB make connection to local database
-func (lib *Library) ConnectDB() {
-	file, err := os.Open("config.ini")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	scanner.Scan()
-	User = scanner.Text()
-	scanner.Scan()
-	Password = scanner.Text()
-	scanner.Scan()
-	DBName = scanner.Text()
-	db, err := sqlx.Open("mysql", fmt.Sprintf("%s:%s@tcp(127.0.0.1:3306)/%s", User, Password, DBName+"?charset=utf8&loc=Asia%2FShanghai&parseTime=true"))
+// ConnectDB : connect to the database cfg names, and check that it answers
+// an unreachable database is retried cfg.ConnectRetries times, waiting twice as long each time;
+// for sqlite the database name is the path of the database file, and the pool settings don't apply
+func (lib *Library) ConnectDB(ctx context.Context, cfg Config) error {
+	var store Store
+	var err error
+	switch cfg.Backend {
+	case "mysql":
+		store, err = NewMySQLStore(cfg.DSN(), cfg.MaxOpen, cfg.MaxIdle, cfg.MaxLifetime)
+	case "sqlite":
+		store, err = NewSQLiteStore(cfg.Name)
+	default:
+		err = fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
-	lib.db = db
-}
 
-var AllBookArgs = `title, ISBN, author, publisher, stock, available, removeinfo`
-var AllUserArgs = `id, name, password, overdue, type`
-var AllRecordArgs = `record_id, book_id, user_id, IsReturned, borrow_date, return_date, deadline, extendtimes`
-
-// BooksRowsScan : extract argvs from Query to struct Books
-func (lib *Library) BooksRowsScan(rows *sql.Rows) (Books, error) {
-	var res Books
-	err := rows.Scan(&res.Title, &res.ISBN, &res.Author, &res.Publisher, &res.Stock, &res.Available, &res.RemoveInfo)
-	return res, err
+	wait := cfg.ConnectBackoff
+	for try := 0; ; try++ {
+		err = ping(ctx, store, cfg.Timeout)
+		if err == nil || try == cfg.ConnectRetries || ctx.Err() != nil {
+			break
+		}
+		lib.log().Warn("Database unreachable, retrying.", F("op", "db.connect"), F("backend", cfg.Backend),
+			F("retry", try+1), F("wait", wait), F("error", err))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait *= 2
+	}
+	if err != nil {
+		store.Close()
+		return err
+	}
+	lib.store = store
+	return nil
 }
 
-// BooksRowScan : extract argvs from QueryRow to struct Books
-func (lib *Library) BooksRowScan(row *sql.Row) (Books, error) {
-	var res Books
-	err := row.Scan(&res.Title, &res.ISBN, &res.Author, &res.Publisher, &res.Stock, &res.Available, &res.RemoveInfo)
-	return res, err
+// ping : whether store answers within timeout, 0 is no limit
+func ping(ctx context.Context, store Store, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return store.WithContext(ctx).Ping()
 }
 
-// UsersRowScan : extract argvs from QueryRow to struct Users
-func (lib *Library) UsersRowScan(row *sql.Row) (Users, error) {
-	var res Users
-	err := row.Scan(&res.ID, &res.Name, &res.Password, &res.Overdue, &res.Type)
-	return res, err
+// bind : a copy of lib whose statements are cancelled with ctx or once timeout is up,
+// that context, and the function releasing it
+func (lib *Library) bind(ctx context.Context, timeout time.Duration) (*Library, context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	res := *lib
+	res.store = lib.store.WithContext(ctx)
+	return &res, ctx, cancel
 }
 
-// RecordsRowsScan : extract argvs from Query to struct Records
-func (lib *Library) RecordsRowsScan(rows *sql.Rows) (Records, error) {
-	var res Records
-	err := rows.Scan(&res.recordID, &res.bookID, &res.userID, &res.IsReturned, &res.borrowDate, &res.returnDate, &res.deadline, &res.extendTimes)
-	return res, err
+// transaction : run fn against a copy of lib whose store is one database transaction
+// fn must only use tx, never lib, until it returns
+func (lib *Library) transaction(fn func(tx *Library) error) error {
+	return lib.store.WithTx(func(s Store) error {
+		tx := *lib
+		tx.store = s
+		return fn(&tx)
+	})
 }
 
-// RecordsRowScan : extract argvs from QueryRow to struct Records
-func (lib *Library) RecordsRowScan(row *sql.Row) (Records, error) {
-	var res Records
-	err := row.Scan(&res.recordID, &res.bookID, &res.userID, &res.IsReturned, &res.borrowDate, &res.returnDate, &res.deadline, &res.extendTimes)
-	return res, err
+// CheckUserExists : check whether the user exists
+func (lib *Library) CheckUserExists(ctx context.Context, userid string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	_, err := lib.store.User(userid)
+	return opError(err, "user.check", "", userid)
 }
 
-// CheckUserExists : check whether the user exists
-func (lib *Library) CheckUserExists(userid string) error {
-	var id string
-	err := lib.db.QueryRow(`SELECT id FROM Userlist WHERE id = ?`, userid).Scan(&id)
-	if err == sql.ErrNoRows {
-		return ErrUserNotExists
+// loans : records as loans, with the titles of their books
+func (lib *Library) loans(records []Records) []Loan {
+	titles := map[string]string{}
+	res := []Loan{}
+	for _, record := range records {
+		title, ok := titles[record.bookID]
+		if !ok {
+			if book, err := lib.store.Book(record.bookID); err == nil {
+				title = book.Title
+			}
+			titles[record.bookID] = title
+		}
+		loan := Loan{RecordID: record.recordID, ISBN: record.bookID, Title: title, UserID: record.userID, CopyID: record.copyID,
+			BorrowedAt: record.borrowDate, Deadline: record.deadline, Renewals: record.extendTimes}
+		if record.IsReturned && record.returnDate.Valid {
+			loan.ReturnedAt = record.returnDate.Time
+		}
+		res = append(res, loan)
 	}
-	return err
+	return res
 }
 
-// CheckBookISBN : check whether the ID is legal
-func (lib *Library) CheckBookISBN(err error) error {
+// canonicalISBN : the canonical form of an ISBN-10 or ISBN-13, e.g. 978-0062820181
+// anything else is returned trimmed, so that books stored under a malformed ISBN can still be found
+func canonicalISBN(s string) string {
+	res, err := isbn.Canonical(s)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrBookNotExists
-		}
-		return err
+		return strings.TrimSpace(s)
 	}
-	return nil
+	return res
 }
 
 // CheckBookExists : check whether the book is still in stock
-func (lib *Library) CheckBookExists(ISBN string) error {
-	var stock int
-	err := lib.db.QueryRow(`SELECT stock FROM Booklist WHERE ISBN = ?`, ISBN).Scan(&stock)
-	if err == sql.ErrNoRows {
-		return ErrBookNotExists
-	}
-	if err == nil && stock <= 0 {
+func (lib *Library) CheckBookExists(ctx context.Context, ISBN string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	ISBN = canonicalISBN(ISBN)
+	book, err := lib.store.Book(ISBN)
+	if err == nil && book.Stock <= 0 {
 		err = ErrBookNotExists
 	}
-	return err
-}
-
-// CheckRecordID : check whether the ID is legal
-func (lib *Library) CheckRecordID(err error) error {
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrNotBorrowed
-		}
-		return err
-	}
-	return nil
+	return opError(err, "book.check", ISBN, "")
 }
 
-// CreateTables : created the tables in MySQL
-func (lib *Library) CreateTables() error {
-	sql := `CREATE TABLE IF NOT EXISTS Booklist(
-				title VARCHAR(256) NOT NULL,
-				ISBN VARCHAR(16) UNIQUE PRIMARY KEY,
-				author VARCHAR(256) NOT NULL,
-				publisher VARCHAR(256) NOT NULL,
-				stock INT NOT NULL,
-				available INT NOT NULL,
-				removeInfo TEXT,
-				CHECK (stock >= available AND stock >= 0)
-			)`
-	_, err := lib.db.Exec(sql)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	sql = `CREATE TABLE IF NOT EXISTS Userlist(
-			id VARCHAR(16) PRIMARY KEY,
-			name VARCHAR(256) NOT NULL,
-			password VARCHAR(256) NOT NULL,
-			overdue INT NOT NULL DEFAULT 0,
-			type INT NOT NULL
-			)`
-	_, err = lib.db.Exec(sql)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	sql = `CREATE TABLE IF NOT EXISTS Recordlist(
-		record_id INT PRIMARY KEY NOT NULL AUTO_INCREMENT,
-		book_id VARCHAR(16) NOT NULL,
-		user_id VARCHAR(16) NOT NULL,
-		IsReturned BOOLEAN NOT NULL DEFAULT FALSE,
-		borrow_date DATETIME NOT NULL,
-		return_date DATETIME,
-		deadline DATETIME NOT NULL,
-		extendtimes INT NOT NULL,
-		FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
-		FOREIGN KEY (user_id) REFERENCES Userlist(id),
-		CHECK (deadline >= borrow_date)
-	)AUTO_INCREMENT=1`
-	_, err = lib.db.Exec(sql)
+// AddUser : add a user into the userlist
+// user.Password is the plaintext password, only its hash is stored
+func (lib *Library) AddUser(ctx context.Context, user Users) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	logger := lib.log().With(F("op", "user.add"), F("user", user.ID))
+	hash, err := lib.hasher.Hash(user.Password)
 	if err != nil {
-		log.Println(err)
-		return err
+		logger.failed("Adding a user failed.", err)
+		return opError(err, "user.add", "", user.ID)
 	}
+	user.Password = hash
 
-	return nil
-}
-
-// AddUser : add a user into the userlist
-func (lib *Library) AddUser(user Users) error {
-	_, err := lib.db.Exec(`INSERT INTO Userlist(id, name, password, type, overdue)
-							VALUES (?, ?, ?, ?, ?)`,
-		user.ID, user.Name, user.Password, user.Type, user.Overdue)
-
+	err = lib.transaction(func(tx *Library) error {
+		if err := tx.store.InsertUser(user); err != nil {
+			return err
+		}
+		if lib.defaultCategory != "" {
+			if err := tx.store.SetUserCategory(user.ID, lib.defaultCategory); err != nil {
+				return err
+			}
+		}
+		return tx.audit("user.add", user.ID, nil, map[string]interface{}{"name": user.Name, "role": Role(user.Type).String()})
+	})
 	if err != nil {
-		log.Println(err)
-		return err
+		logger.failed("Adding a user failed.", err)
+		return opError(err, "user.add", "", user.ID)
 	}
+	logger.Info("User added.", F("role", Role(user.Type)))
 	return nil
-
 }
 
 // IdentifyUser : to identify the user by the id and password
-func (lib *Library) IdentifyUser(userid, password string) (Users, error) {
-	var user Users
-	user, err := lib.UsersRowScan(lib.db.QueryRow(`SELECT `+AllUserArgs+` FROM Userlist WHERE id = ?`, userid))
+// a password still stored in plaintext, or hashed with an outdated cost,
+// is replaced by a fresh hash once it has been verified
+func (lib *Library) IdentifyUser(ctx context.Context, userid, password string) (Users, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	logger := lib.log().With(F("op", "user.identify"), F("user", userid))
+	user, err := lib.store.User(userid)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Println(ErrPassword)
+		if errors.Is(err, ErrUserNotExists) {
+			lib.hasher.Verify(string(dummyHash), password)
+			logger.failed("Identifying a user failed.", ErrPassword)
 			return user, ErrPassword
 		}
-		log.Println(err)
-		return user, err
+		logger.failed("Identifying a user failed.", err)
+		return user, opError(err, "user.identify", "", userid)
 	}
 
-	if strings.Compare(user.Password, password) != 0 {
-		err = ErrPassword
+	ok, rehash := lib.hasher.Verify(user.Password, password)
+	if !ok {
+		logger.failed("Identifying a user failed.", ErrPassword)
+		return user, ErrPassword
+	}
+	// only the right password learns that the account is closed
+	if err := lib.checkAccount(userid, lib.now()); err != nil {
+		logger.failed("Identifying a user failed.", err)
+		return user, opError(err, "user.identify", "", userid)
 	}
 
-	if err != nil {
-		log.Println(err)
+	if rehash {
+		if hash, err := lib.hasher.Hash(password); err == nil && lib.store.SetPassword(userid, hash) == nil {
+			user.Password = hash
+			logger.Debug("Password hash upgraded.")
+		}
 	}
 
-	return user, err
+	return user, nil
 }
 
 // ModifyPassword : to modify user's password
-func (lib *Library) ModifyPassword(userid, password string) error {
-	_, err := lib.db.Exec(`UPDATE Userlist SET password = ? WHERE id = ?`, password, userid)
+func (lib *Library) ModifyPassword(ctx context.Context, userid, password string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	hash, err := lib.hasher.Hash(password)
+	if err == nil {
+		err = lib.transaction(func(tx *Library) error {
+			if err := tx.store.SetPassword(userid, hash); err != nil {
+				return err
+			}
+			// neither password nor hash goes into the log
+			return tx.audit("user.password", userid, nil, nil)
+		})
+	}
+	logger := lib.log().With(F("op", "user.password"), F("user", userid))
 	if err != nil {
-		log.Println(err)
+		logger.failed("Changing a password failed.", err)
+		return opError(err, "user.password", "", userid)
 	}
+	logger.Info("Password changed.")
+	return nil
+}
 
-	return err
+// checkStock : nil if stock is a number of copies AddBook can add
+func checkStock(stock int) error {
+	if stock < 1 {
+		return ErrInvalidStock
+	}
+	return nil
 }
 
 // AddBook : add a book into the library
-func (lib *Library) AddBook(bookTitle, bookISBN, bookAuthor, bookPublisher string, bookStock int) (int, error) {
-	var stock int
-	row := lib.db.QueryRow(`SELECT `+`stock`+` FROM Booklist WHERE ISBN = ?;`, bookISBN)
-	err := row.Scan(&stock)
-
+// the ISBN must be a valid ISBN-10 or ISBN-13 and is stored in canonical form;
+// a new book's author is split into its authors and its publisher into the name, edition and year
+func (lib *Library) AddBook(ctx context.Context, bookTitle, bookISBN, bookAuthor, bookPublisher string, bookStock int) (int, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	logger := lib.log().With(F("op", "book.add"), F("isbn", bookISBN))
+	if err := checkStock(bookStock); err != nil {
+		logger.failed("Adding a book failed.", err)
+		return -1, opError(err, "book.add", bookISBN, "")
+	}
+	bookISBN, err := isbn.Canonical(bookISBN)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_, err = lib.db.Exec(`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
-						 VALUES (?, ?, ?, ?, ?, ?);`,
-				bookTitle, bookISBN, bookAuthor, bookPublisher, bookStock, bookStock)
-			if err != nil {
-				log.Println("Insert Error: ", err)
-				return -1, err
+		logger.failed("Adding a book failed.", err)
+		return -1, opError(err, "book.add", bookISBN, "")
+	}
+	logger = lib.log().With(F("op", "book.add"), F("isbn", bookISBN))
+	var stock int
+	err = lib.transaction(func(tx *Library) error {
+		book, err := tx.store.Book(bookISBN)
+		var before interface{}
+		if err == nil {
+			before = map[string]interface{}{"stock": book.Stock}
+		}
+		if errors.Is(err, ErrBookNotExists) {
+			name, edition, year := parsePublisher(bookPublisher)
+			err = tx.store.InsertBook(Books{Title: bookTitle, ISBN: bookISBN, Author: bookAuthor, Publisher: name})
+			if err == nil {
+				err = tx.store.SaveBookDetails(BookDetails{ISBN: bookISBN, Authors: splitAuthors(bookAuthor), Edition: edition, Year: year})
 			}
-			stock = bookStock
-		} else {
-			log.Println("QueryRow Error: ", err)
-			return -1, err
 		}
-	} else {
-		_, err = lib.db.Exec(`UPDATE Booklist
-						 SET stock = stock + ?, available = available + ?
-						 WHERE ISBN = ?;`,
-			bookStock, bookStock, bookISBN)
 		if err != nil {
-			log.Println("Update Error: ", err)
-			return -1, err
+			return err
+		}
+		stock = book.Stock + bookStock
+		// every copy gets its own barcode; new copies go to readers waiting for the book first
+		now := lib.now()
+		var barcodes []string
+		for i := 0; i < bookStock; i++ {
+			barcode, err := tx.newBarcode(bookISBN)
+			if err != nil {
+				return err
+			}
+			err = tx.addCopy(Copy{Barcode: barcode, ISBN: bookISBN, AcquiredAt: now}, now)
+			if err != nil {
+				return err
+			}
+			barcodes = append(barcodes, barcode)
 		}
-		stock = stock + bookStock
+		return tx.audit("book.add", bookISBN, before, map[string]interface{}{
+			"title": bookTitle, "author": bookAuthor, "publisher": bookPublisher, "stock": stock, "copies": barcodes})
+	})
+
+	if err != nil {
+		logger.failed("Adding a book failed.", err)
+		return -1, opError(err, "book.add", bookISBN, "")
 	}
 
-	log.Println("Added successfully.")
+	logger.Info("Book added.", F("copies", bookStock), F("stock", stock))
 	return stock, nil
 }
 
-// RemoveBook : remove a book from the library
-// if an admin lost the book, he or she can just run this function and add an info
-// if a student lost the book, the borrow record must be modified before remove it
-// require book's ISBN and the remove reason
-func (lib *Library) RemoveBook(bookISBN, bookRemoveInfo string) (int, error) {
+// RemoveBook : withdraw copies on the shelf of a book, all at once
+// use RemoveCopy to pick which; if a student lost the book, declare it lost instead.
+// Returns what is left in stock
+// require book's ISBN, how many copies, the reason (lost, damaged, weeded or transferred) and an optional note
+func (lib *Library) RemoveBook(ctx context.Context, bookISBN string, copies int, reason, note string) (int, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
 	var stock int
-	row := lib.db.QueryRow(`SELECT `+`stock`+` FROM Booklist WHERE ISBN = ?`, bookISBN)
-	err := row.Scan(&stock)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Println(ErrBookNotExists, " Operation failed.")
-			return -1, ErrBookNotExists
+	var barcodes []string
+	err := lib.transaction(func(tx *Library) error {
+		if copies < 1 {
+			return ErrInvalidStock
 		}
-		log.Println("QueryErr: ", err)
-		return -1, err
-	} else {
-		if stock == 0 {
-			log.Println(ErrAllRemoved, " Operation failed.")
-			return -1, ErrAllRemoved
+		book, err := tx.store.Book(bookISBN)
+		if err != nil {
+			return err
+		}
+		if book.Stock == 0 {
+			return ErrAllRemoved
+		}
+		if copies > book.Available {
+			return ErrBookNotAvailable
+		}
+		for len(barcodes) < copies {
+			item, err := tx.store.ShelfCopy(bookISBN)
+			if err != nil {
+				return err
+			}
+			// set it aside so that the next ShelfCopy finds another
+			if err := tx.store.SetCopyStatus(item.Barcode, CopyWithdrawn); err != nil {
+				return err
+			}
+			barcodes = append(barcodes, item.Barcode)
 		}
-		_, err := lib.db.Exec(`UPDATE Booklist
-						 SET stock = stock - 1, available = available - 1, removeinfo = CONCAT(?, removeInfo)
-						 WHERE ISBN = ?;`, bookRemoveInfo, bookISBN)
+		w, err := tx.withdraw(Withdrawal{ISBN: bookISBN, Reason: reason, Note: note}, barcodes)
 		if err != nil {
-			log.Println("The book exist. update error: ", err)
-			return -1, err
+			return err
 		}
-		stock = stock - 1
+		stock = book.Stock - copies
+		return tx.audit("book.remove", bookISBN, map[string]interface{}{"stock": book.Stock},
+			map[string]interface{}{"stock": stock, "copies": barcodes, "reason": reason, "note": note, "withdrawal": w.WithdrawalID})
+	})
+
+	logger := lib.log().With(F("op", "book.remove"), F("isbn", bookISBN))
+	if err != nil {
+		logger.failed("Removing a book failed.", err)
+		return -1, opError(err, "book.remove", bookISBN, "")
 	}
 
-	log.Println("Removed successfully.")
+	logger.Info("Book removed.", F("copies", copies), F("reason", reason), F("stock", stock))
 	return stock, nil
 }
 
 // QueryBookTitle : query books by title
-func (lib *Library) QueryBookTitle(keyTitle string) ([]Books, error) {
-	rows, err := lib.db.Query(`SELECT `+AllBookArgs+
-		` FROM Booklist WHERE title LIKE ? 
-		ORDER BY LENGTH(title) ASC, title ASC;`,
-		"%"+keyTitle+"%")
+func (lib *Library) QueryBookTitle(ctx context.Context, keyTitle string) ([]Books, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	BookList, err := lib.store.BooksByTitle(keyTitle)
 	if err != nil {
-		log.Println("Exec error: ", err)
+		lib.log().failed("Querying books failed.", err, F("op", "book.query"), F("title", keyTitle))
 		return nil, err
 	}
-	defer rows.Close()
-
-	BookList := []Books{}
-	var res Books
-	for rows.Next() {
-		res, err = lib.BooksRowsScan(rows)
-		if err != nil {
-			log.Println("rows.scan error: ", err)
-			return nil, err
-		}
-		BookList = append(BookList, res)
-	}
 
 	return BookList, nil
 }
 
 // QueryBookAuthor : query books by author
-func (lib *Library) QueryBookAuthor(keyAuthor string) ([]Books, error) {
-	rows, err := lib.db.Query(`SELECT `+AllBookArgs+` FROM Booklist WHERE Author like ?;`, "%"+keyAuthor+"%")
+func (lib *Library) QueryBookAuthor(ctx context.Context, keyAuthor string) ([]Books, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	BookList, err := lib.store.BooksByAuthor(keyAuthor)
 	if err != nil {
-		log.Println("Exec error: ", err)
+		lib.log().failed("Querying books failed.", err, F("op", "book.query"), F("author", keyAuthor))
 		return nil, err
 	}
-	defer rows.Close()
-
-	BookList := []Books{}
-	var res Books
-	for rows.Next() {
-		res, err = lib.BooksRowsScan(rows)
-		if err != nil {
-			log.Println("rows.scan error: ", err)
-			return nil, err
-		}
-		BookList = append(BookList, res)
-	}
 
 	return BookList, nil
 }
 
 // QueryBookISBN : query books by ISBN
-func (lib *Library) QueryBookISBN(keyISBN string) ([]Books, error) {
-	var res Books
-	row := lib.db.QueryRow(`SELECT `+AllBookArgs+` FROM Booklist WHERE ISBN = ? AND stock > 0;`, keyISBN)
-	res, err := lib.BooksRowScan(row)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Println(ErrBookNotExists)
-			return nil, ErrBookNotExists
-		}
-		fmt.Println("Exec error: ", err)
-		return nil, err
+func (lib *Library) QueryBookISBN(ctx context.Context, keyISBN string) ([]Books, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	keyISBN = canonicalISBN(keyISBN)
+	res, err := lib.store.Book(keyISBN)
+	if err == nil && res.Stock <= 0 {
+		err = ErrBookNotExists
 	}
 
-	BookList := []Books{}
-
 	if err != nil {
-		log.Println("rows.scan error: ", err)
-		return nil, err
+		lib.log().failed("Querying books failed.", err, F("op", "book.query"), F("isbn", keyISBN))
+		return nil, opError(err, "book.query", keyISBN, "")
 	}
-	BookList = append(BookList, res)
 
+	BookList := []Books{res}
 	return BookList, nil
 }
 
 // BorrowBook : borrow a book from the library
 // borrow one book at a time
-// book need to be returned in one month unless extended
+// the loan period, the loan limit and the suspension threshold come from
+// the policy for the user's category and the book's class
+// a copy set aside for the user's hold is borrowed instead of one from the shelf
+// the checks and updates run in one transaction holding the book's row lock
 // require book's ISBN, user's ID, and borrowDate
-func (lib *Library) BorrowBook(bookISBN, userID string, borrowDate time.Time) error {
-	var recordID int
-	row := lib.db.QueryRow(`SELECT record_id FROM Recordlist WHERE book_id = ? AND user_id = ? AND IsReturned = 0`,
-		bookISBN, userID)
-	err := row.Scan(&recordID)
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("check whether borrowed", err)
-		return err
-	}
-	if err == nil {
-		log.Println(ErrAlreadyBorrowed)
-		return ErrAlreadyBorrowed
-	}
+func (lib *Library) BorrowBook(ctx context.Context, bookISBN, userID string, borrowDate time.Time) (Loan, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	return lib.borrow(ctx, bookISBN, "", userID, borrowDate)
+}
 
-	var availableAmount, stock int
-	row = lib.db.QueryRow(`SELECT stock, available FROM Booklist WHERE ISBN = ? AND stock > 0`, bookISBN)
-	err = lib.CheckBookISBN(row.Scan(&stock, &availableAmount))
+// BorrowCopy : borrow the copy with the given barcode
+// the copy must be on the shelf or set aside for the user's hold
+// require the barcode, user's ID, and borrowDate
+func (lib *Library) BorrowCopy(ctx context.Context, barcode, userID string, borrowDate time.Time) (Loan, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	item, err := lib.store.Copy(barcode)
 	if err != nil {
-		log.Println(err)
-		return err
+		lib.log().failed("Borrowing a book failed.", err, F("op", "loan.borrow"), F("user", userID), F("copy", barcode))
+		return Loan{}, copyError(err, "loan.borrow", barcode, userID)
 	}
+	return lib.borrow(ctx, item.ISBN, barcode, userID, borrowDate)
+}
 
-	if stock <= 0 {
-		log.Println(ErrBookNotExists)
-		return ErrBookNotExists
-	}
-	if availableAmount <= 0 {
-		log.Println(ErrBookNotAvailable)
-		return ErrBookNotAvailable
-	}
+// borrow : borrow a copy of a book, the given one or else any the user may take
+func (lib *Library) borrow(ctx context.Context, bookISBN, barcode, userID string, borrowDate time.Time) (Loan, error) {
+	bookISBN = canonicalISBN(bookISBN)
+	lib.ExpireHolds(ctx, bookISBN, borrowDate)
+	logger := lib.log().With(F("op", "loan.borrow"), F("user", userID), F("isbn", bookISBN))
+	var res Loan
+	err := lib.transaction(func(tx *Library) error {
+		// lock the book first so that concurrent borrows of it queue up here
+		book, err := tx.store.Book(bookISBN)
+		if err != nil {
+			return err
+		}
 
-	_, err = lib.db.Exec(`UPDATE Booklist SET available = available - 1 WHERE ISBN = ?`, bookISBN)
-	if err != nil {
-		log.Println("Modify available: ", err)
-		return err
-	}
+		_, err = tx.store.OpenRecord(bookISBN, userID)
+		if err == nil {
+			return ErrAlreadyBorrowed
+		}
+		if !errors.Is(err, ErrNotBorrowed) {
+			return err
+		}
+
+		if book.Stock <= 0 {
+			return ErrBookNotExists
+		}
+
+		loan, category, err := tx.store.Policy(userID, bookISBN)
+		if err != nil {
+			return err
+		}
+		if loan.LoanDays <= 0 {
+			return ErrNotLoanable
+		}
+		user, err := tx.store.User(userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.checkAccount(userID, borrowDate); err != nil {
+			return err
+		}
+		if user.Overdue > category.SuspendAfter {
+			return ErrUserSuspended
+		}
+		balance, err := tx.store.FineBalance(userID)
+		if err != nil {
+			return err
+		}
+		if balance > category.MaxBalance {
+			return ErrFinesOutstanding
+		}
+		loans, err := tx.store.CountOpenRecords(userID)
+		if err != nil {
+			return err
+		}
+		if loans >= category.MaxLoans {
+			return ErrTooManyLoans
+		}
 
-	deadline := borrowDate.AddDate(0, 1, 0)
+		hold, err := tx.store.ActiveHold(bookISBN, userID)
+		if err != nil && !errors.Is(err, ErrNoHold) {
+			return err
+		}
+		item, err := tx.loanCopy(bookISBN, barcode, hold, borrowDate)
+		if err != nil {
+			return err
+		}
+		if hold.HoldID != "" {
+			err = tx.store.SetHoldStatus(hold.HoldID, HoldFulfilled)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.store.SetCopyStatus(item.Barcode, CopyLoan)
+		if err != nil {
+			return err
+		}
 
-	_, err = lib.db.Exec(`Insert INTO Recordlist (book_id, user_id, IsReturned, borrow_date, deadline, extendtimes)
-							  VALUES (?, ?, 0, ?, ?, 0)`,
-		bookISBN, userID, borrowDate, deadline)
+		barcode = item.Barcode
+		deadline := borrowDate.AddDate(0, 0, loan.LoanDays)
+		err = tx.store.InsertRecord(Records{bookID: bookISBN, userID: userID, borrowDate: borrowDate, deadline: deadline,
+			copyID: item.Barcode})
+		if err != nil {
+			return err
+		}
+		record, err := tx.store.OpenRecord(bookISBN, userID)
+		if err != nil {
+			return err
+		}
+		res = tx.loans([]Records{record})[0]
+		return tx.audit("loan.borrow", userID, nil, map[string]interface{}{"isbn": bookISBN, "copy": item.Barcode, "deadline": deadline})
+	})
 
 	if err != nil {
-		log.Println("Insert record: ", err)
-		return err
+		logger.failed("Borrowing a book failed.", err, F("copy", barcode))
+		return Loan{}, opError(err, "loan.borrow", bookISBN, userID)
 	}
 
-	log.Println("Borrowed successfully.")
-	return nil
+	logger.Info("Book borrowed.", F("record_id", res.RecordID), F("copy", res.CopyID), F("deadline", res.Deadline))
+	return res, nil
 }
 
-// CheckDeadline : check the deadline of returning of a borrowed book for students
-// require book's ISBN, user's ID
-func (lib *Library) CheckDeadline(bookISBN, userID string) error {
-	var res Records
-	err := lib.CheckBookExists(bookISBN)
-	if err != nil {
-		log.Println(err)
-		return err
+// loanCopy : pick the copy a user borrows, the given barcode or else
+// the one set aside for their hold or else the first on the shelf
+// a copy set aside for them but not taken goes to the next reader
+// must run in a transaction holding the book's row lock
+func (lib *Library) loanCopy(bookISBN, barcode string, hold Hold, now time.Time) (Copy, error) {
+	ready := hold.Status == HoldReady
+	if barcode == "" {
+		if ready {
+			return lib.store.Copy(hold.CopyID)
+		}
+		return lib.store.ShelfCopy(bookISBN)
 	}
 
-	row := lib.db.QueryRow(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE book_id = ? AND user_id = ? AND IsReturned = FALSE`, bookISBN, userID)
-	res, err = lib.RecordsRowScan(row)
-	err = lib.CheckRecordID(err)
+	item, err := lib.store.Copy(barcode)
 	if err != nil {
-		return err
+		return item, err
+	}
+	if item.ISBN != bookISBN {
+		return item, ErrCopyNotExists
 	}
+	if ready && item.Barcode == hold.CopyID {
+		return item, nil
+	}
+	if item.Status != CopyShelf {
+		return item, ErrBookNotAvailable
+	}
+	if ready {
+		return item, lib.releaseHeldCopy(hold, now)
+	}
+	return item, nil
+}
 
+// CheckDeadline : the deadline of returning of a borrowed book for students
+// require book's ISBN, user's ID
+func (lib *Library) CheckDeadline(ctx context.Context, bookISBN, userID string) (time.Time, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	err := lib.CheckBookExists(ctx, bookISBN)
+	var res Records
+	if err == nil {
+		res, err = lib.store.OpenRecord(bookISBN, userID)
+	}
 	if err != nil {
-		fmt.Println("rows.scan error: ", err)
-		return err
+		lib.log().failed("Checking a deadline failed.", err, F("op", "loan.deadline"), F("user", userID), F("isbn", bookISBN))
+		return time.Time{}, opError(err, "loan.deadline", bookISBN, userID)
 	}
 
-	fmt.Println("Deadline: ", res.deadline.Format(timeTemplate))
-	return nil
+	return res.deadline, nil
 }
 
-// CheckBorrowHistory : check the student's borrow history
+// CheckBorrowHistory : every loan of the student, the latest first
 // require user's ID
-func (lib *Library) CheckBorrowHistory(userID string) ([]Records, error) {
-	rows, err := lib.db.Query(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE user_id = ? ORDER BY borrow_date DESC`, userID)
+func (lib *Library) CheckBorrowHistory(ctx context.Context, userID string) ([]Loan, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	RecordList, err := lib.store.Records(userID)
 	if err != nil {
-		fmt.Println("Record Error: ", err)
-		return nil, err
-	}
-	defer rows.Close()
-
-	RecordList := []Records{}
-	var res Records
-
-	for rows.Next() {
-		res, err = lib.RecordsRowsScan(rows)
-		if err != nil {
-			fmt.Println("rows.scan error: ", err)
-			return nil, err
-		}
-		RecordList = append(RecordList, res)
+		lib.log().failed("Querying loans failed.", err, F("op", "loan.history"), F("user", userID))
+		return nil, opError(err, "loan.history", "", userID)
 	}
 
-	return RecordList, nil
+	return lib.loans(RecordList), nil
 }
 
-// CheckUnreturned : check the student's unreturned books
+// CheckUnreturned : the student's unreturned books
 // require user's ID
-func (lib *Library) CheckUnreturned(userID string) ([]Records, error) {
-	rows, err := lib.db.Query(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE user_id = ? AND IsReturned = 0 ORDER BY borrow_date DESC`, userID)
+func (lib *Library) CheckUnreturned(ctx context.Context, userID string) ([]Loan, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	RecordList, err := lib.store.OpenRecords(userID)
 	if err != nil {
-		fmt.Println("Record Error: ", err)
-		return nil, err
-	}
-	defer rows.Close()
-
-	RecordList := []Records{}
-	var res Records
-
-	for rows.Next() {
-		res, err = lib.RecordsRowsScan(rows)
-		if err != nil {
-			fmt.Println("rows.scan error:", err)
-			return nil, err
-		}
-		RecordList = append(RecordList, res)
+		lib.log().failed("Querying loans failed.", err, F("op", "loan.list"), F("user", userID))
+		return nil, opError(err, "loan.list", "", userID)
 	}
 
-	return RecordList, nil
+	return lib.loans(RecordList), nil
 }
 
 // CheckOverdue : check if a given student has any overdue
+// an overdue book forfeits the renewals its policy had left, so it stays overdue until returned
 // require user's ID
-func (lib *Library) CheckOverdue(userID string, now time.Time) (int, []Records, error) {
-	rows, err := lib.db.Query(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE user_id = ? AND IsReturned = FALSE`, userID)
-	if err != nil {
-		log.Println("Record Error: ", err)
-		return -1, nil, err
-	}
-	defer rows.Close()
-
-	var IsExtended bool
+func (lib *Library) CheckOverdue(ctx context.Context, userID string, now time.Time) (int, []Loan, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
 	var overdue = 0
 	var RecordList []Records
 
-	for rows.Next() {
-		res, err := lib.RecordsRowsScan(rows)
+	err := lib.transaction(func(tx *Library) error {
+		records, err := tx.store.OpenRecords(userID)
 		if err != nil {
-			log.Println("rows.scan error: ", err)
-			return -1, nil, err
+			return err
 		}
 
-		IsExtended = false
-		for res.extendTimes < 3 {
-			if now.After(res.deadline) {
-				res.extendTimes = res.extendTimes + 1
-				res.deadline.AddDate(0, 1, 0)
-				IsExtended = true
-			} else {
-				break
+		for _, res := range records {
+			if !now.After(res.deadline) {
+				continue
 			}
-		}
 
-		if IsExtended {
-			_, err = lib.db.Exec(`UPDATE Recordlist
-									SET extendtimes = ?, deadline = ?
-									WHERE record_id = ?`,
-				res.extendTimes, res.deadline, res.recordID)
+			loan, _, err := tx.store.Policy(userID, res.bookID)
 			if err != nil {
-				log.Println("Update Error: ", err)
-				return -1, nil, err
+				return err
+			}
+			if res.extendTimes < loan.MaxRenewals {
+				res.extendTimes = loan.MaxRenewals
+				err = tx.store.UpdateRecordDeadline(res.recordID, res.deadline, res.extendTimes)
+				if err != nil {
+					return err
+				}
 			}
-		}
 
-		if now.After(res.deadline) {
 			overdue = overdue + 1
 			RecordList = append(RecordList, res)
 		}
-	}
 
-	_, err = lib.db.Exec(`UPDATE Userlist SET overdue = ? WHERE id = ?`, overdue, userID)
+		return tx.setOverdue(userID, overdue)
+	})
+
 	if err != nil {
-		log.Println("Update Error: ", err)
-		return -1, nil, err
+		lib.log().failed("Checking overdue books failed.", err, F("op", "user.overdue"), F("user", userID))
+		return -1, nil, opError(err, "user.overdue", "", userID)
 	}
 
-	return overdue, RecordList, nil
+	return overdue, lib.loans(RecordList), nil
 }
 
-// ReturnBook : return a borrowed book
-// require book's ISBN and user's ID
-func (lib *Library) ReturnBook(bookISBN, userID string) error {
-	err := lib.CheckBookExists(bookISBN)
+// recountOverdue : set a user's overdue counter to how many of their open loans are past due at now,
+// as CheckOverdue does, once one of them was closed
+// must run in a transaction
+func (lib *Library) recountOverdue(userID string, now time.Time) error {
+	records, err := lib.store.OpenRecords(userID)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-
-	var ddl time.Time
-	var recordID string
-	row := lib.db.QueryRow(`SELECT `+`record_id, deadline`+` FROM Recordlist WHERE user_id = ? AND book_id = ? AND IsReturned = 0`, userID, bookISBN)
-	err = row.Scan(&recordID, &ddl)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Println(ErrNotBorrowed)
-			return ErrNotBorrowed
+	overdue := 0
+	for _, record := range records {
+		if now.After(record.deadline) {
+			overdue++
 		}
-		log.Println("QueryRow: ", err)
-		return err
-	}
-
-	var flag = 0
-	var now = time.Now()
-	if now.After(ddl) {
-		flag = 1
 	}
+	return lib.setOverdue(userID, overdue)
+}
 
-	_, err = lib.db.Exec(`UPDATE Recordlist SET IsReturned = 1, return_date = ? WHERE record_id = ?`, now, recordID)
-	if err != nil {
-		log.Println("B", err)
+// setOverdue : overwrite a user's overdue counter, auditing a change
+// must run in a transaction
+func (lib *Library) setOverdue(userID string, overdue int) error {
+	user, err := lib.store.User(userID)
+	if err != nil || user.Overdue == overdue {
 		return err
 	}
-
-	_, err = lib.db.Exec(`UPDATE Userlist SET overdue = overdue - ? WHERE id = ?`, flag, userID)
+	err = lib.store.SetOverdue(userID, overdue)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	return lib.audit("user.overdue", userID, map[string]interface{}{"overdue": user.Overdue}, map[string]interface{}{"overdue": overdue})
+}
 
-	_, err = lib.db.Exec(`UPDATE Booklist SET available = available + 1 WHERE ISBN = ?`, bookISBN)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+// ReturnBook : return a borrowed book
+// require book's ISBN and user's ID
+func (lib *Library) ReturnBook(ctx context.Context, bookISBN, userID string) (Loan, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	var res Loan
+	err := lib.transaction(func(tx *Library) error {
+		err := tx.CheckBookExists(ctx, bookISBN)
+		if err != nil {
+			return err
+		}
 
-	log.Println("Returned successfully.")
-	return nil
-}
+		record, err := tx.store.OpenRecord(bookISBN, userID)
+		if err != nil {
+			return err
+		}
 
-// ExtendDeadline - extend deadline of a borrowed book for a given user
-// require book_id, user_id
-func (lib *Library) ExtendDeadline(bookISBN, userID string) error {
-	err := lib.CheckBookExists(bookISBN)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+		var now = tx.now()
+		err = tx.store.CloseRecord(record.recordID, now)
+		if err != nil {
+			return err
+		}
+		res = tx.loans([]Records{record})[0]
+		res.ReturnedAt = now
+
+		err = tx.recountOverdue(userID, now)
+		if err != nil {
+			return err
+		}
 
-	var ddl time.Time
-	var extended, recordID int
+		policy, _, err := tx.store.Policy(userID, bookISBN)
+		if err != nil {
+			return err
+		}
+		err = tx.chargeOverdue(record, policy, now)
+		if err != nil {
+			return err
+		}
 
-	row := lib.db.QueryRow(`SELECT `+`record_id, deadline, extendtimes`+` FROM Recordlist WHERE book_id = ? AND user_id = ? AND IsReturned = FALSE`, bookISBN, userID)
-	err = lib.CheckRecordID(row.Scan(&recordID, &ddl, &extended))
+		_, err = tx.expireHolds(bookISBN, now)
+		if err != nil {
+			return err
+		}
+		item, err := tx.store.Copy(record.copyID)
+		if err != nil {
+			return err
+		}
+		err = tx.releaseCopy(item, now)
+		if err != nil {
+			return err
+		}
+		return tx.audit("loan.return", userID, map[string]interface{}{"isbn": bookISBN, "copy": record.copyID, "deadline": record.deadline},
+			map[string]interface{}{"isbn": bookISBN, "copy": record.copyID, "returned": now})
+	})
 
+	logger := lib.log().With(F("op", "loan.return"), F("user", userID), F("isbn", bookISBN))
 	if err != nil {
-		log.Println(err)
-		return err
+		logger.failed("Returning a book failed.", err)
+		return Loan{}, opError(err, "loan.return", bookISBN, userID)
 	}
 
-	if extended >= 3 {
-		log.Println(ErrNoMoreExtended)
-		return ErrNoMoreExtended
-	}
+	logger.Info("Book returned.", F("record_id", res.RecordID), F("copy", res.CopyID))
+	return res, nil
+}
+
+// ExtendDeadline - extend deadline of a borrowed book for a given user
+// how often and by how much is up to the policy for the user's category and the book's class
+// require book_id, user_id
+func (lib *Library) ExtendDeadline(ctx context.Context, bookISBN, userID string) (Loan, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	var res Loan
+	err := lib.transaction(func(tx *Library) error {
+		err := tx.CheckBookExists(ctx, bookISBN)
+		if err != nil {
+			return err
+		}
+
+		record, err := tx.store.OpenRecord(bookISBN, userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.checkAccount(userID, tx.now()); err != nil {
+			return err
+		}
 
-	ddl.AddDate(0, 1, 0)
-	_, err = lib.db.Exec(`UPDATE Recordlist
-							SET extendtimes = extendtimes + 1, deadline = ?
-							WHERE record_id = ?`,
-		ddl, recordID)
+		loan, _, err := tx.store.Policy(userID, bookISBN)
+		if err != nil {
+			return err
+		}
+		// an overdue book forfeits its renewals, whether or not CheckOverdue has seen it yet
+		if record.extendTimes >= loan.MaxRenewals || tx.now().After(record.deadline) {
+			return ErrNoMoreExtended
+		}
+
+		ddl := record.deadline.AddDate(0, 0, loan.RenewalDays)
+		err = tx.store.UpdateRecordDeadline(record.recordID, ddl, record.extendTimes+1)
+		if err != nil {
+			return err
+		}
+		res = tx.loans([]Records{record})[0]
+		res.Deadline, res.Renewals = ddl, record.extendTimes+1
+		return tx.audit("loan.extend", userID, map[string]interface{}{"isbn": bookISBN, "deadline": record.deadline, "renewals": record.extendTimes},
+			map[string]interface{}{"isbn": bookISBN, "deadline": ddl, "renewals": record.extendTimes + 1})
+	})
+
+	logger := lib.log().With(F("op", "loan.extend"), F("user", userID), F("isbn", bookISBN))
 	if err != nil {
-		log.Println(err)
-		return err
+		logger.failed("Extending a loan failed.", err)
+		return Loan{}, opError(err, "loan.extend", bookISBN, userID)
 	}
 
-	log.Println("Extended successfully.")
-	return nil
+	logger.Info("Loan extended.", F("record_id", res.RecordID), F("deadline", res.Deadline))
+	return res, nil
 }
 
 // The above codes are about operating mysql and have test functions
@@ -726,21 +916,75 @@ func (lib *Library) GetInputString(field string) string {
 	return ret
 }
 
+// GetInputInt : get a whole number from user, asking again until it is one
+func (lib *Library) GetInputInt(field string) int {
+	for {
+		n, err := strconv.Atoi(lib.GetInputString(field))
+		if err == nil {
+			return n
+		}
+		fmt.Println("Please enter a whole number.")
+	}
+}
+
+// GetInputOptional : get a line from user that may be empty
+func (lib *Library) GetInputOptional(field string) string {
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print(field)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, "reading standard input:", err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(scanner.Text())
+}
+
+// GetInputDate : get a date such as "2020-05-10" from user, in local time
+// an empty answer is the zero time
+func (lib *Library) GetInputDate(field string) (time.Time, error) {
+	s := lib.GetInputOptional(field)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(dateTemplate, s, time.Local)
+}
+
+// printResult : print err, or done if there is none
+func printResult(err error, done string) {
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(done)
+	}
+}
+
+// GetInputMoney : get an amount such as "12.50" from user, in cents
+func (lib *Library) GetInputMoney(field string) int {
+	for {
+		amount, err := ParseMoney(lib.GetInputString(field))
+		if err == nil {
+			return amount
+		}
+		fmt.Println(err)
+	}
+}
+
 // Register : for new user to register
 // once they type in their username, the program will check whether the id is available immediately and ask for another try if needed
-func (lib *Library) Register(auth int) {
+func (lib *Library) Register(ctx context.Context, auth int) {
 	var user Users
 	for true {
 		user.ID = lib.GetInputString("Username: ")
-		err := lib.CheckUserExists(user.ID)
+		err := lib.CheckUserExists(ctx, user.ID)
 		if err == nil {
 			fmt.Println("Sorry. The username have already been registered.")
 			return
 		} else {
-			if err == ErrUserNotExists {
+			if errors.Is(err, ErrUserNotExists) {
 				break
 			}
-			log.Println(err)
+			fmt.Println(err)
 			return
 		}
 	}
@@ -748,12 +992,12 @@ func (lib *Library) Register(auth int) {
 	user.Password = lib.GetInputString("Password: ")
 	confirmPassword := lib.GetInputString("ConfirmPassword: ")
 	if user.Password != confirmPassword {
-		log.Println("Password and ConfirmPassword don't match.")
+		fmt.Println("Password and ConfirmPassword don't match.")
 		return
 	}
 	user.Type = 1
 	if auth == 0 {
-		fmt.Println("Please decide the user mode. Type 0 for administrator, 1 for normal user")
+		fmt.Println("Please decide the user mode. Type 0 for administrator, 1 for normal user, 3 for librarian")
 		for true {
 			fmt.Print("UserMode: ")
 			var mode string
@@ -764,25 +1008,31 @@ func (lib *Library) Register(auth int) {
 			} else if mode == "1" {
 				user.Type = 1
 				break
+			} else if mode == "3" {
+				user.Type = 3
+				break
 			}
 			fmt.Println(mode, ": user mode not found")
 		}
 
 	}
-	if err := lib.AddUser(user); err == nil {
-		log.Println("Registered Successfully. You can login now.")
+	if auth == -1 {
+		// readers register themselves
+		lib = lib.As(user.ID, lib.origin)
 	}
+	printResult(lib.AddUser(ctx, user), "Registered Successfully. You can login now.")
 }
 
 // PrintBookQuery : to print book information
-func (lib *Library) PrintBookQuery(books []Books, usermode int) {
-	if usermode == 0 {
+// removed books and removal reasons are only shown to those who manage books
+func (lib *Library) PrintBookQuery(w io.Writer, books []Books, showRemoved bool) {
+	if showRemoved {
 		if len(books) == 0 {
-			log.Println(ErrBookNotExists)
+			fmt.Fprintln(w, ErrBookNotExists)
 			return
 		}
 		t := table.Table(books)
-		fmt.Println(t)
+		fmt.Fprintln(w, t)
 	} else {
 		type Data struct {
 			ISBN, Title, Author, Publisher string
@@ -796,59 +1046,236 @@ func (lib *Library) PrintBookQuery(books []Books, usermode int) {
 			}
 		}
 		if len(res) == 0 {
-			log.Println(ErrBookNotExists)
+			fmt.Fprintln(w, ErrBookNotExists)
 		} else {
 			t := table.Table(res)
-			fmt.Println(t)
+			fmt.Fprintln(w, t)
 		}
 	}
 }
 
+// PrintBookDetails : print the bibliographic record of a book, one field a row
+func (lib *Library) PrintBookDetails(w io.Writer, details BookDetails) {
+	type data struct {
+		Field string
+		Value string
+	}
+	res := []data{
+		{"Authors", strings.Join(details.Authors, "; ")},
+		{"Subjects", strings.Join(details.Subjects, "; ")},
+		{"Edition", details.Edition},
+		{"Year", ""},
+		{"Language", details.Language},
+		{"Pages", ""},
+		{"Description", details.Description},
+	}
+	if details.Year != 0 {
+		res[3].Value = strconv.Itoa(details.Year)
+	}
+	if details.Pages != 0 {
+		res[5].Value = strconv.Itoa(details.Pages)
+	}
+	fmt.Fprintln(w, table.Table(res))
+}
+
+// PrintAudit : print audit entries, newest first
+func (lib *Library) PrintAudit(w io.Writer, entries []AuditEntry) {
+	type data struct {
+		Time   string
+		Actor  string
+		Origin string
+		Action string
+		Target string
+		Before string
+		After  string
+	}
+	var res []data
+	for _, now := range entries {
+		res = append(res, data{now.CreatedAt.Format(timeTemplate), now.Actor, now.Origin, now.Action, now.Target, now.Before, now.After})
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	} else {
+		fmt.Fprintln(w, "No entry.")
+	}
+}
+
+// PrintImport : print what an import did with every row that was skipped, and the totals
+func (lib *Library) PrintImport(w io.Writer, report ImportReport) {
+	type data struct {
+		Line   int
+		ISBN   string
+		Title  string
+		Action string
+		Error  string
+	}
+	var res []data
+	for _, now := range report.Rows {
+		if now.Err != nil {
+			res = append(res, data{now.Line, now.ISBN, now.Title, now.Action, now.Err.Error()})
+		}
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	}
+	fmt.Fprintf(w, "added: %d, merged: %d, skipped: %d\n", report.Added, report.Merged, report.Skipped)
+}
+
+// PrintSearch : print a page of search results
+func (lib *Library) PrintSearch(w io.Writer, res SearchResult) {
+	if res.Total == 0 {
+		fmt.Fprintln(w, ErrBookNotExists)
+		return
+	}
+	lib.PrintBookQuery(w, res.Books, true)
+	fmt.Fprintf(w, "page %d of %d, %d book(s)\n", res.Page, res.Pages, res.Total)
+}
+
 // PrintOverdue : to print the users' overdue information
-func (lib *Library) PrintOverdue(overdue int, records []Records) {
+func (lib *Library) PrintOverdue(w io.Writer, overdue int, suspended bool, loans []Loan) {
 	if overdue > 0 {
-		fmt.Println("Warning: You've got overdue(s). Please turn the book(s) back ASAP.")
+		fmt.Fprintln(w, "Warning: You've got overdue(s). Please turn the book(s) back ASAP.")
 	}
-	if overdue > 3 {
-		fmt.Println("Warning: ", ErrUserSuspended)
+	if suspended {
+		fmt.Fprintln(w, "Warning: ", ErrUserSuspended)
 	}
-	fmt.Println("overdue: ", overdue)
+	fmt.Fprintln(w, "overdue: ", overdue)
 	if overdue > 0 {
-		lib.PrintUnreturned(records)
+		lib.PrintUnreturned(w, loans)
+	}
+}
+
+// PrintHolds : print holds with their place in the queue
+// position 0 means a copy is waiting to be picked up before the deadline
+func (lib *Library) PrintHolds(ctx context.Context, w io.Writer, holds []Hold) {
+	type data struct {
+		ISBN           string
+		Title          string
+		UserID         string
+		Position       int
+		PlacedAt       string
+		PickupDeadline string
+	}
+	var res []data
+	for _, now := range holds {
+		var title, deadline string
+		if books, err := lib.QueryBookISBN(ctx, now.ISBN); err == nil && len(books) > 0 {
+			title = books[0].Title
+		}
+		if now.PickupDeadline.Valid {
+			deadline = now.PickupDeadline.Time.Format(timeTemplate)
+		}
+		position, _ := lib.QueuePosition(ctx, now)
+		res = append(res, data{now.ISBN, title, now.UserID, position, now.PlacedAt.Format(timeTemplate), deadline})
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	} else {
+		fmt.Fprintln(w, "No hold.")
 	}
 }
 
+// PrintCopies : print the copies of a book and where they are
+func (lib *Library) PrintCopies(w io.Writer, copies []Copy) {
+	type data struct {
+		Barcode    string
+		Status     string
+		Location   string
+		AcquiredAt string
+	}
+	var res []data
+	for _, now := range copies {
+		res = append(res, data{now.Barcode, now.Status, now.Location, now.AcquiredAt.Format(timeTemplate)})
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	} else {
+		fmt.Fprintln(w, "No copy.")
+	}
+}
+
+// PrintWithdrawals : print the withdrawals from a book's stock
+func (lib *Library) PrintWithdrawals(w io.Writer, withdrawals []Withdrawal) {
+	type data struct {
+		Date       string
+		Reason     string
+		Copies     int
+		Reinstated int
+		Actor      string
+		RecordID   string
+		Note       string
+	}
+	var res []data
+	for _, now := range withdrawals {
+		res = append(res, data{now.CreatedAt.Format(timeTemplate), now.Reason, now.Copies, now.Reinstated,
+			now.Actor, now.RecordID.String, now.Note})
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	} else {
+		fmt.Fprintln(w, "No withdrawal.")
+	}
+}
+
+// PrintFines : print what a user owes and their ledger
+func (lib *Library) PrintFines(w io.Writer, balance int, entries []FineEntry) {
+	type data struct {
+		Date   string
+		Kind   string
+		Amount string
+		ISBN   string
+		Note   string
+		Actor  string
+	}
+	var res []data
+	for _, now := range entries {
+		res = append(res, data{now.CreatedAt.Format(timeTemplate), now.Kind, FormatMoney(now.Amount), now.ISBN.String, now.Note.String, now.Actor})
+	}
+
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	}
+	fmt.Fprintln(w, "balance: ", FormatMoney(balance))
+}
+
+// PrintPolicies : print the loan policies and the category policies
+func (lib *Library) PrintPolicies(w io.Writer, loans []LoanPolicy, categories []CategoryPolicy) {
+	fmt.Fprintln(w, table.Table(loans))
+	fmt.Fprintln(w, table.Table(categories))
+}
+
 // PrintUnreturned : print users' unreturned list with deadline
-func (lib *Library) PrintUnreturned(records []Records) {
+func (lib *Library) PrintUnreturned(w io.Writer, loans []Loan) {
 	type data struct {
-		recordID    string
+		RecordID    string
 		ISBN        string
 		Title       string
+		Copy        string
 		ExtendTimes int
 		BorrowDate  string
 		Deadline    string
 	}
 	var res []data
-	for _, now := range records {
-		Title, _ := lib.QueryBookISBN(now.bookID)
-		res = append(res, data{now.recordID, now.bookID, Title[0].Title, now.extendTimes, now.borrowDate.Format(timeTemplate), now.deadline.Format(timeTemplate)})
+	for _, now := range loans {
+		res = append(res, data{now.RecordID, now.ISBN, now.Title, now.CopyID, now.Renewals, now.BorrowedAt.Format(timeTemplate), now.Deadline.Format(timeTemplate)})
 	}
 
 	if len(res) != 0 {
-		t := table.Table(res)
-		fmt.Println(t)
+		fmt.Fprintln(w, table.Table(res))
 	} else {
-		fmt.Println("No unreturned book.")
+		fmt.Fprintln(w, "No unreturned book.")
 	}
 }
 
 // PrintHistory : print users' history with return date
-func (lib *Library) PrintHistory(records []Records, sign error) {
-	if sign != nil {
-		return
-	}
+func (lib *Library) PrintHistory(w io.Writer, loans []Loan) {
 	type data struct {
-		recordID    string
+		RecordID    string
 		ISBN        string
 		Title       string
 		IsReturned  bool
@@ -856,207 +1283,611 @@ func (lib *Library) PrintHistory(records []Records, sign error) {
 		BorrowDate  string
 		ReturnDate  string
 	}
-	var ss []data
-	for _, now := range records {
-		Title, _ := lib.QueryBookISBN(now.bookID)
-		var tmp string
-		if !now.returnDate.Valid {
-			tmp = "NULL"
-		} else {
-			tmp = now.returnDate.Time.Format(timeTemplate)
+	var res []data
+	for _, now := range loans {
+		returned := "NULL"
+		if now.Returned() {
+			returned = now.ReturnedAt.Format(timeTemplate)
 		}
-		ss = append(ss, data{now.recordID, now.bookID, Title[0].Title, now.IsReturned, now.extendTimes, now.borrowDate.Format(timeTemplate), tmp})
+		res = append(res, data{now.RecordID, now.ISBN, now.Title, now.Returned(), now.Renewals, now.BorrowedAt.Format(timeTemplate), returned})
 	}
 
-	t := table.Table(ss)
-	fmt.Println(t)
+	if len(res) != 0 {
+		fmt.Fprintln(w, table.Table(res))
+	} else {
+		fmt.Fprintln(w, "No loan.")
+	}
+}
+
+// targetUser : the user a circulation command applies to
+// sessions that may act on anyone's loans are asked for a username
+func (lib *Library) targetUser(ctx context.Context, session Session) (string, error) {
+	if !session.Can(PermAnyLoans) {
+		return session.UserID, nil
+	}
+	userID := lib.GetInputString("Username: ")
+	return userID, lib.CheckUserExists(ctx, userID)
 }
 
 // Servertime : to serve the user
 // users can read readme file or type `help` for detailed instructions
-func (lib *Library) Servetime(user Users) {
+// what a user may do is decided by Authorize and commandPermissions
+func (lib *Library) Servetime(ctx context.Context, session Session) {
 	var input string
 	var book Books
-
-	var userID string
-
-	if user.Type == 1 {
-		userID = user.ID
-	}
+	lib = lib.As(session.UserID, OriginCLI)
 
 	for true {
-		fmt.Print(user.Name, "@library: ")
+		if session.Token != "" {
+			current, err := lib.Authenticate(ctx, session.Token)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			session = current
+		}
+
+		fmt.Print(session.Name, "@library: ")
 		input = lib.GetInputString("")
+		perm, ok := commandPermissions[input]
+		if !ok {
+			fmt.Println(input, ": command not found")
+			continue
+		}
+		if err := lib.Authorize(session, perm); err != nil {
+			fmt.Println(input, ":", err)
+			continue
+		}
+
 		if input == "exit" {
 			return
 		} else if input == "help" {
 			fmt.Println(help)
+		} else if input == "search" {
+			query := lib.GetInputString("Query: ")
+			for page := 1; ; page++ {
+				res, err := lib.Search(ctx, query, page, SearchPageSize, session.Can(PermManageBooks))
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
+				lib.PrintSearch(os.Stdout, res)
+				if res.Page >= res.Pages || lib.GetInputString("Next page? (y/n): ") != "y" {
+					break
+				}
+			}
 		} else if input == "title" {
 			book.Title = lib.GetInputString("BookTitle: ")
-			res, err := lib.QueryBookTitle(book.Title)
-			if err == nil {
-				lib.PrintBookQuery(res, user.Type)
+			res, err := lib.QueryBookTitle(ctx, book.Title)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
 			}
 		} else if input == "author" {
 			book.Author = lib.GetInputString("BookAuthor: ")
-			res, err := lib.QueryBookAuthor(book.Author)
-			if err == nil {
-				lib.PrintBookQuery(res, user.Type)
+			res, err := lib.QueryBookAuthor(ctx, book.Author)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
+			}
+		} else if input == "subject" {
+			res, err := lib.QueryBookSubject(ctx, lib.GetInputString("Subject: "))
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
+			}
+		} else if input == "year" {
+			from, err := strconv.Atoi(lib.GetInputString("From year: "))
+			if err != nil {
+				fmt.Println(ErrInvalidYear)
+				continue
+			}
+			to, err := strconv.Atoi(lib.GetInputString("To year: "))
+			if err != nil {
+				fmt.Println(ErrInvalidYear)
+				continue
+			}
+			res, err := lib.QueryBookYear(ctx, from, to)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
+			}
+		} else if input == "bookinfo" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			res, err := lib.QueryBookISBN(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
+			if details, err := lib.QueryBookDetails(ctx, book.ISBN); err == nil {
+				lib.PrintBookDetails(os.Stdout, details)
 			}
 		} else if input == "isbn" {
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			res, err := lib.QueryBookISBN(book.ISBN)
-			if err == nil {
-				lib.PrintBookQuery(res, user.Type)
+			res, err := lib.QueryBookISBN(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintBookQuery(os.Stdout, res, session.Can(PermManageBooks))
 			}
-		} else if user.Type > 1 {
-			fmt.Println(input, ": command not found")
 		} else if input == "borrow" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			overdue, recordlist, err := lib.CheckOverdue(userID, time.Now())
+			overdue, recordlist, err := lib.CheckOverdue(ctx, userID, lib.now())
 			if err == nil {
+				suspended, _ := lib.CheckSuspended(ctx, userID)
 				if overdue > 0 {
-					lib.PrintOverdue(overdue, recordlist)
+					lib.PrintOverdue(os.Stdout, overdue, suspended, recordlist)
 				}
-				if overdue <= 3 {
+				if !suspended {
 					book.ISBN = lib.GetInputString("BookISBN: ")
-					lib.BorrowBook(book.ISBN, userID, time.Now())
+					loan, err := lib.BorrowBook(ctx, book.ISBN, userID, lib.now())
+					printResult(err, "Borrowed successfully. Deadline: "+loan.Deadline.Format(timeTemplate))
+					if errors.Is(err, ErrBookNotAvailable) {
+						fmt.Println("Type \"hold\" to join the queue for this book.")
+					}
 				}
 			}
 		} else if input == "return" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			_, err = lib.ReturnBook(ctx, book.ISBN, userID)
+			printResult(err, "Returned successfully.")
+			if err == nil {
+				if balance, _, err := lib.Fines(ctx, userID); err == nil && balance > 0 {
+					fmt.Println("Outstanding fines: ", FormatMoney(balance))
 				}
 			}
+		} else if input == "lost" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			lib.ReturnBook(book.ISBN, userID)
+			printResult(lib.DeclareLost(ctx, book.ISBN, userID, session.UserID), "Declared lost successfully.")
+		} else if input == "fines" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			balance, entries, err := lib.Fines(ctx, userID)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintFines(os.Stdout, balance, entries)
+		} else if input == "pay" {
+			username := lib.GetInputString("Username: ")
+			amount := lib.GetInputMoney("Amount: ")
+			printResult(lib.PayFine(ctx, username, amount, session.UserID), "Paid successfully.")
+		} else if input == "waive" {
+			username := lib.GetInputString("Username: ")
+			amount := lib.GetInputMoney("Amount: ")
+			note := lib.GetInputString("Reason: ")
+			printResult(lib.WaiveFine(ctx, username, amount, note, session.UserID), "Waived successfully.")
 		} else if input == "deadline" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			lib.CheckOverdue(userID, time.Now())
-			lib.CheckDeadline(book.ISBN, userID)
+			lib.CheckOverdue(ctx, userID, lib.now())
+			if deadline, err := lib.CheckDeadline(ctx, book.ISBN, userID); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Deadline: ", deadline.Format(timeTemplate))
+			}
 		} else if input == "extend" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			lib.CheckOverdue(userID, time.Now())
-			lib.ExtendDeadline(book.ISBN, userID)
+			lib.CheckOverdue(ctx, userID, lib.now())
+			loan, err := lib.ExtendDeadline(ctx, book.ISBN, userID)
+			printResult(err, "Extended successfully. Deadline: "+loan.Deadline.Format(timeTemplate))
 		} else if input == "history" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.CheckOverdue(ctx, userID, lib.now())
+			res, err := lib.CheckBorrowHistory(ctx, userID)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			lib.CheckOverdue(userID, time.Now())
-			lib.PrintHistory(lib.CheckBorrowHistory(userID))
+			lib.PrintHistory(os.Stdout, res)
 		} else if input == "unreturned" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.CheckOverdue(ctx, userID, lib.now())
+			res, err := lib.CheckUnreturned(ctx, userID)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			lib.CheckOverdue(userID, time.Now())
-			res, _ := lib.CheckUnreturned(userID)
-			lib.PrintUnreturned(res)
+			lib.PrintUnreturned(os.Stdout, res)
 		} else if input == "overdue" {
-			if user.Type < 1 {
-				userID = lib.GetInputString("Username: ")
-				err := lib.CheckUserExists(userID)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
 			}
-			overdue, record, _ := lib.CheckOverdue(userID, time.Now())
-			lib.PrintOverdue(overdue, record)
+			overdue, record, _ := lib.CheckOverdue(ctx, userID, lib.now())
+			suspended, _ := lib.CheckSuspended(ctx, userID)
+			lib.PrintOverdue(os.Stdout, overdue, suspended, record)
 		} else if input == "pw" {
 			password := lib.GetInputString("Password: ")
-			if password != user.Password {
-				log.Println(ErrPassword)
+			if _, err := lib.IdentifyUser(ctx, session.UserID, password); err != nil {
+				fmt.Println(err)
 			} else {
 				password = lib.GetInputString("NewPassword: ")
 				confirmpw := lib.GetInputString("ConfirmNewPassword: ")
 				if password == confirmpw {
-					if lib.ModifyPassword(user.ID, password) != nil {
-						user.Password = password
-					}
+					printResult(lib.ModifyPassword(ctx, session.UserID, password), "Password changed.")
 				}
 			}
-		} else if user.Type > 0 {
-			fmt.Println(input, ": command not found")
 		} else if input == "adduser" {
-			lib.Register(0)
+			lib.Register(ctx, 0)
 		} else if input == "addbook" {
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			fmt.Print("BookTitle: ")
-			fmt.Scanln(&book.Title)
-			fmt.Print("BookAuthor: ")
-			fmt.Scanln(&book.Author)
-			fmt.Print("BookPublisher: ")
-			fmt.Scanln(&book.Publisher)
-			fmt.Print("BookStock: ")
-			fmt.Scanln(&book.Stock)
-			lib.AddBook(book.Title, book.ISBN, book.Author, book.Publisher, book.Stock)
+			book.Title = lib.GetInputString("BookTitle: ")
+			book.Author = lib.GetInputString("BookAuthor: ")
+			book.Publisher = lib.GetInputString("BookPublisher: ")
+			stock := lib.GetInputInt("BookStock: ")
+			_, err := lib.AddBook(ctx, book.Title, book.ISBN, book.Author, book.Publisher, stock)
+			printResult(err, "Added successfully.")
+		} else if input == "import" {
+			format := lib.GetInputString("Format (csv, jsonl, marc, marcxml): ")
+			file, err := os.Open(lib.GetInputString("File: "))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			dryRun := lib.GetInputString("Dry run? (y/n): ") == "y"
+			report, err := lib.ImportBooks(ctx, file, format, dryRun)
+			file.Close()
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintImport(os.Stdout, report)
+			}
+		} else if input == "export" {
+			format := lib.GetInputString("Format (csv, jsonl, marc, marcxml): ")
+			file, err := os.Create(lib.GetInputString("File: "))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			n, err := lib.ExportBooks(ctx, file, format, lib.GetInputString("Include removed books? (y/n): ") == "y")
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Printf("%d book(s) exported.\n", n)
+			}
+		} else if input == "editbook" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			details, err := lib.QueryBookDetails(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			// an empty answer keeps what is there
+			fmt.Println("Leave a field empty to keep it, list authors and subjects separated by ';'.")
+			if v := lib.GetInputOptional("Authors: "); v != "" {
+				details.Authors = strings.Split(v, ";")
+			}
+			if v := lib.GetInputOptional("Subjects: "); v != "" {
+				details.Subjects = strings.Split(v, ";")
+			}
+			if v := lib.GetInputOptional("Edition: "); v != "" {
+				details.Edition = v
+			}
+			if v := lib.GetInputOptional("Year: "); v != "" {
+				if details.Year, err = strconv.Atoi(v); err != nil {
+					fmt.Println(ErrInvalidYear)
+					continue
+				}
+			}
+			if v := lib.GetInputOptional("Language: "); v != "" {
+				details.Language = v
+			}
+			if v := lib.GetInputOptional("Pages: "); v != "" {
+				if details.Pages, err = strconv.Atoi(v); err != nil {
+					fmt.Println(ErrInvalidPages)
+					continue
+				}
+			}
+			if v := lib.GetInputOptional("Description: "); v != "" {
+				details.Description = v
+			}
+			printResult(lib.SetBookDetails(ctx, details), "Updated successfully.")
 		} else if input == "removebook" {
 			book.ISBN = lib.GetInputString("BookISBN: ")
-			book.RemoveInfo.String = lib.GetInputString("RemoveInfo: ")
-			book.RemoveInfo.String += fmt.Sprintf("Removed by %s at %s", user.ID, time.Now().Format(timeTemplate))
-			lib.RemoveBook(book.ISBN, book.RemoveInfo.String)
+			copies := 1
+			if v := lib.GetInputOptional("Copies (empty for 1): "); v != "" {
+				var err error
+				if copies, err = strconv.Atoi(v); err != nil {
+					fmt.Println(ErrInvalidStock)
+					continue
+				}
+			}
+			reason := lib.GetInputString("Reason (" + strings.Join(WithdrawalReasons, ", ") + "): ")
+			note := lib.GetInputOptional("Note (optional): ")
+			_, err := lib.RemoveBook(ctx, book.ISBN, copies, reason, note)
+			printResult(err, "Removed successfully.")
+		} else if input == "copies" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			res, err := lib.Copies(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintCopies(os.Stdout, res)
+		} else if input == "addcopy" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			barcode := lib.GetInputString("Barcode (empty to generate): ")
+			location := lib.GetInputString("Location: ")
+			if barcode, err := lib.AddCopy(ctx, book.ISBN, barcode, location, lib.now()); err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Barcode: ", barcode)
+			}
+		} else if input == "removecopy" {
+			barcode := lib.GetInputString("Barcode: ")
+			reason := lib.GetInputString("Reason (" + strings.Join(WithdrawalReasons, ", ") + "): ")
+			note := lib.GetInputOptional("Note (optional): ")
+			printResult(lib.RemoveCopy(ctx, barcode, reason, note), "Removed successfully.")
+		} else if input == "reinstate" {
+			barcode := lib.GetInputString("Barcode: ")
+			printResult(lib.ReinstateCopy(ctx, barcode), "Reinstated successfully.")
+		} else if input == "withdrawals" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			res, err := lib.Withdrawals(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintWithdrawals(os.Stdout, res)
+		} else if input == "repair" || input == "unrepair" {
+			barcode := lib.GetInputString("Barcode: ")
+			printResult(lib.RepairCopy(ctx, barcode, input == "repair"), "Updated successfully.")
+		} else if input == "movecopy" {
+			barcode := lib.GetInputString("Barcode: ")
+			location := lib.GetInputString("Location: ")
+			printResult(lib.MoveCopy(ctx, barcode, location), "Moved successfully.")
+		} else if input == "borrowcopy" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			suspended, err := lib.CheckSuspended(ctx, userID)
+			if err == nil && !suspended {
+				barcode := lib.GetInputString("Barcode: ")
+				loan, err := lib.BorrowCopy(ctx, barcode, userID, lib.now())
+				printResult(err, "Borrowed successfully. Deadline: "+loan.Deadline.Format(timeTemplate))
+			} else if suspended {
+				fmt.Println(ErrUserSuspended)
+			}
 		} else if input == "userpw" {
 			username := lib.GetInputString("Username: ")
 			password := lib.GetInputString("NewPassword: ")
 			confirmpw := lib.GetInputString("ConfirmNewPassword: ")
 			if password == confirmpw {
-				lib.ModifyPassword(username, password)
+				err := lib.ModifyPassword(ctx, username, password)
+				if err == nil {
+					err = lib.RevokeSessions(ctx, username)
+				}
+				printResult(err, "Password changed.")
+			}
+		} else if input == "revoke" {
+			username := lib.GetInputString("Username: ")
+			printResult(lib.RevokeSessions(ctx, username), "Sessions revoked.")
+		} else if input == "deactivate" {
+			username := lib.GetInputString("Username: ")
+			printResult(lib.DeactivateUser(ctx, username), "Account deactivated.")
+		} else if input == "reactivate" {
+			username := lib.GetInputString("Username: ")
+			printResult(lib.ReactivateUser(ctx, username), "Account reactivated.")
+		} else if input == "expire" {
+			username := lib.GetInputString("Username: ")
+			expiresAt, err := lib.GetInputDate("Expires on (YYYY-MM-DD, empty for never): ")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			printResult(lib.SetUserExpiry(ctx, username, expiresAt), "Expiry set.")
+		} else if input == "deleteuser" {
+			username := lib.GetInputString("Username: ")
+			if lib.GetInputString("Type the username again to delete it for good: ") != username {
+				fmt.Println("Nothing deleted.")
+				continue
+			}
+			printResult(lib.DeleteUser(ctx, username), "User deleted.")
+		} else if input == "mydata" {
+			if err := lib.ExportUserData(ctx, os.Stdout, session.UserID); err != nil {
+				fmt.Println(err)
+			}
+		} else if input == "hold" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			_, err = lib.PlaceHold(ctx, book.ISBN, userID, lib.now())
+			printResult(err, "Hold placed successfully.")
+		} else if input == "holds" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			res, _ := lib.UserHolds(ctx, userID)
+			lib.PrintHolds(ctx, os.Stdout, res)
+		} else if input == "cancelhold" {
+			userID, err := lib.targetUser(ctx, session)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			printResult(lib.CancelHold(ctx, book.ISBN, userID), "Hold cancelled successfully.")
+		} else if input == "queue" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			res, err := lib.BookQueue(ctx, book.ISBN)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintHolds(ctx, os.Stdout, res)
+		} else if input == "policy" {
+			loans, categories, err := lib.Policies(ctx)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			lib.PrintPolicies(os.Stdout, loans, categories)
+		} else if input == "setpolicy" {
+			var policy LoanPolicy
+			policy.Category = lib.GetInputString("Category: ")
+			policy.Class = lib.GetInputString("BookClass: ")
+			policy.LoanDays = lib.GetInputInt("LoanDays: ")
+			policy.MaxRenewals = lib.GetInputInt("MaxRenewals: ")
+			policy.RenewalDays = lib.GetInputInt("RenewalDays: ")
+			policy.DailyFine = lib.GetInputMoney("DailyFine: ")
+			policy.MaxFine = lib.GetInputMoney("MaxFine: ")
+			policy.ReplacementFee = lib.GetInputMoney("ReplacementFee: ")
+			printResult(lib.SetLoanPolicy(ctx, policy), "Policy set.")
+		} else if input == "setcategory" {
+			var policy CategoryPolicy
+			policy.Category = lib.GetInputString("Category: ")
+			policy.MaxLoans = lib.GetInputInt("MaxLoans: ")
+			policy.SuspendAfter = lib.GetInputInt("SuspendAfter: ")
+			policy.MaxBalance = lib.GetInputMoney("MaxBalance: ")
+			printResult(lib.SetCategoryPolicy(ctx, policy), "Policy set.")
+		} else if input == "usercategory" {
+			username := lib.GetInputString("Username: ")
+			category := lib.GetInputString("Category: ")
+			if err := lib.SetUserCategory(ctx, username, category); err != nil {
+				fmt.Println(err)
+			}
+		} else if input == "audit" {
+			var filter AuditFilter
+			filter.User = lib.GetInputOptional("User (empty for anyone): ")
+			filter.Action = lib.GetInputOptional("Action, e.g. loan or loan.borrow (empty for any): ")
+			var err error
+			if filter.From, err = lib.GetInputDate("From (YYYY-MM-DD, empty for the beginning): "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if filter.To, err = lib.GetInputDate("To (YYYY-MM-DD, included, empty for now): "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if !filter.To.IsZero() {
+				filter.To = filter.To.AddDate(0, 0, 1)
+			}
+			res, err := lib.Audit(ctx, filter)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				lib.PrintAudit(os.Stdout, res)
+			}
+		} else if input == "report" {
+			name := lib.GetInputString("Report (" + strings.Join(Reports, ", ") + "): ")
+			limit := 0
+			var err error
+			if name == ReportMostBorrowed {
+				if v := lib.GetInputOptional("How many titles (empty for all): "); v != "" {
+					if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+						fmt.Println("Invalid number.")
+						continue
+					}
+				}
+			}
+			var r ReportRange
+			if r.From, err = lib.GetInputDate("From (YYYY-MM-DD, empty for the beginning): "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if r.To, err = lib.GetInputDate("To (YYYY-MM-DD, included, empty for now): "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if !r.To.IsZero() {
+				r.To = r.To.AddDate(0, 0, 1)
+			}
+			format := lib.GetInputOptional("Format (table, csv, json; empty for table): ")
+			if format == "" {
+				format = FormatTable
+			}
+			if !contains(ReportFormats, format) {
+				fmt.Println(ErrReportFormat)
+				continue
+			}
+			rows, err := lib.Report(ctx, name, r, limit)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			path := lib.GetInputOptional("File (empty for the screen): ")
+			if path == "" {
+				err = WriteReport(os.Stdout, rows, format)
+			} else if file, ferr := os.Create(path); ferr != nil {
+				err = ferr
+			} else {
+				err = WriteReport(file, rows, format)
+				if cerr := file.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		} else if input == "bookclass" {
+			book.ISBN = lib.GetInputString("BookISBN: ")
+			class := lib.GetInputString("BookClass: ")
+			if err := lib.SetBookClass(ctx, book.ISBN, class); err != nil {
+				fmt.Println(err)
 			}
-		} else {
-			fmt.Println(input, ": command not found")
 		}
 	}
 }
 
-func main() {
+// REPL : the interactive system, until "exit"
+func (lib *Library) REPL(ctx context.Context) {
 	fmt.Println("Welcome to the Library Management System!")
 	fmt.Println("Type \"help\" for more information.")
 	s, _ := ioutil.ReadFile("readme.txt")
 	help = string(s)
 
-	var lib Library
 	var input string
-
-	lib.ConnectDB()
-	lib.CreateTables()
-
 	for true {
 		fmt.Print(">> ")
 		input = lib.GetInputString("")
@@ -1068,21 +1899,31 @@ func main() {
 			var username, password string
 			username = lib.GetInputString("Username: ")
 			password = lib.GetInputString("Password: ")
-			user, err := lib.IdentifyUser(username, password)
-			if err == nil {
-				log.Println("Login Successfully.")
-				lib.Servetime(user)
+			session, err := lib.Login(ctx, username, password)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Println("Login Successfully.")
+				lib.Servetime(ctx, session)
+				lib.Logout(ctx, session.Token)
 			}
 		} else if input == "guest-mode" {
-			var user Users
-			user.Name = "guest"
-			user.Type = 2
-			lib.Servetime(user)
+			lib.Servetime(ctx, GuestSession())
 		} else if input == "register" {
-			lib.Register(-1)
+			lib.Register(ctx, -1)
 		} else if input != "" {
 			fmt.Println(input, ": command not found")
 			fmt.Println("Type \"help\" for more information.")
 		}
 	}
 }
+
+func main() {
+	var lib Library
+	lib.origin = OriginCLI
+	code := lib.RunCLI(os.Args[1:], os.Stdout, os.Stderr)
+	if lib.store != nil {
+		lib.store.Close()
+	}
+	os.Exit(code)
+}
@@ -1,30 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var lib = Library{}
 
+// ctx : what the tests run operations with, never cancelled
+var ctx = context.Background()
+
 func TestCreateTables(t *testing.T) {
-	lib.ConnectDB()
-	_, err := lib.db.Exec(`DROP TABLE Recordlist`)
-	if err != nil {
-		panic(err)
-	}
-	_, err = lib.db.Exec(`DROP TABLE Booklist`)
-	if err != nil {
-		panic(err)
-	}
-	_, err = lib.db.Exec(`DROP TABLE Userlist;`)
+	store, err := NewSQLiteStore(":memory:")
 	if err != nil {
 		panic(err)
 	}
+	lib.store = store
+	lib.hasher = PasswordHasher{Cost: bcrypt.MinCost}
+	// the fixture dates assume the tests run in early May 2020
+	lib.clock = NewFakeClock(time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC))
 
-	err = lib.CreateTables()
+	err = lib.Migrate(ctx, LatestVersion())
 	if err != nil {
 		t.Errorf("can't create tables")
 	}
@@ -54,8 +57,8 @@ func TestAddUsers(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.AddUser(tt.user)
-			if err != tt.err {
+			err := lib.AddUser(ctx, tt.user)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 		})
@@ -75,8 +78,8 @@ func TestModifyPassword(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.ModifyPassword(tt.userID, tt.password)
-			if err != tt.err {
+			err := lib.ModifyPassword(ctx, tt.userID, tt.password)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 		})
@@ -96,8 +99,8 @@ func TestCheckUserExists(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.CheckUserExists(tt.userID)
-			if err != tt.err {
+			err := lib.CheckUserExists(ctx, tt.userID)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 		})
@@ -120,8 +123,8 @@ func TestIdentifyUser(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			user, err := lib.IdentifyUser(tt.userid, tt.password)
-			if err != tt.err {
+			user, err := lib.IdentifyUser(ctx, tt.userid, tt.password)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want %v", err, tt.err)
 			}
 			if err == nil && user.Type != tt.Type {
@@ -136,25 +139,28 @@ func TestAddBook(t *testing.T) {
 		ISBN, Title, Author, Publisher string
 		Stock                          int
 		res                            int
+		err                            error
 	}{
-		{`978-0735219090`, `Where the Crawdads Sing`, `Delia Owens`, `G.P. Putnam's Sons; Later Printing edition (August 14, 2018)`, 3, 3},
-		{`978-1984801258`, `Untamed`, `Glennon Doyle`, `The Dial Press (March 10, 2020)`, 2, 2},
-		{`978-1338635171`, `The Ballad of Songbirds and Snakes (A Hunger Games Novel)`, `Suzanne Collins`, `Scholastic Press (May 19, 2020)`, 1, 1},
-		{`978-0062820181`, `Magnolia Table, Volume 2: A Collection of Recipes for Gathering`, `Joanna Gaines`, `William Morrow Cookbooks (April 7, 2020)`, 3, 3},
-		{`978-1984822185`, `Normal People: A Novel`, `Sally Rooney`, `Hogarth; Reprint edition (February 18, 2020)`, 1, 1},
-		{`978-0385545938`, `Camino Winds`, `John Grisham`, `Doubleday (April 28, 2020)`, 3, 3},
-		{`978-0134123837`, `Computer Systems: A Programmer's Perspective (3rd Edition)`, `Randal E. Bryant, David R. O'Hallaron`, `Pearson; 3 edition (July 6, 2015)`, 1, 1},
-		{`978-0262033848`, `Introduction to Algorithms, 3rd Edition`, `Thomas H. Cormen, Charles E. Leiserson, Ronald L. Rivest , Clifford Stein`, `The MIT Press; 3rd edition (July 31, 2009)`, 2, 2},
-		{`978-0134123837`, `Computer Systems: A Programmer's Perspective (3rd Edition)`, ` Randal E. Bryant, David R. O'Hallaron`, `Pearson; 3 edition (July 6, 2015)`, 3, 4},
-		{`978-0395680902`, `Eye of the Elephant Pa`, `Delia Owens`, `Mariner (October 29, 1993)`, 2, 2},
+		{`978-0735219090`, `Where the Crawdads Sing`, `Delia Owens`, `G.P. Putnam's Sons; Later Printing edition (August 14, 2018)`, 3, 3, nil},
+		{`978-1984801258`, `Untamed`, `Glennon Doyle`, `The Dial Press (March 10, 2020)`, 2, 2, nil},
+		{`978-1338635171`, `The Ballad of Songbirds and Snakes (A Hunger Games Novel)`, `Suzanne Collins`, `Scholastic Press (May 19, 2020)`, 1, 1, nil},
+		{`978-0062820181`, `Magnolia Table, Volume 2: A Collection of Recipes for Gathering`, `Joanna Gaines`, `William Morrow Cookbooks (April 7, 2020)`, 3, 3, nil},
+		{`978-1984822185`, `Normal People: A Novel`, `Sally Rooney`, `Hogarth; Reprint edition (February 18, 2020)`, 1, 1, nil},
+		{`978-0385545938`, `Camino Winds`, `John Grisham`, `Doubleday (April 28, 2020)`, 3, 3, nil},
+		{`978-0134123837`, `Computer Systems: A Programmer's Perspective (3rd Edition)`, `Randal E. Bryant, David R. O'Hallaron`, `Pearson; 3 edition (July 6, 2015)`, 1, 1, nil},
+		{`978-0262033848`, `Introduction to Algorithms, 3rd Edition`, `Thomas H. Cormen, Charles E. Leiserson, Ronald L. Rivest , Clifford Stein`, `The MIT Press; 3rd edition (July 31, 2009)`, 2, 2, nil},
+		{`978-0134123837`, `Computer Systems: A Programmer's Perspective (3rd Edition)`, ` Randal E. Bryant, David R. O'Hallaron`, `Pearson; 3 edition (July 6, 2015)`, 3, 4, nil},
+		{`978-0395680902`, `Eye of the Elephant Pa`, `Delia Owens`, `Mariner (October 29, 1993)`, 2, 2, nil},
+		{`978-0000000000`, `Nothing`, `Nobody`, `Nowhere`, 1, -1, isbn.ErrInvalid},
+		{`123-0062820181`, `Nothing`, `Nobody`, `Nowhere`, 1, -1, isbn.ErrInvalid},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt.ISBN)
 		t.Run(testname, func(t *testing.T) {
-			ans, err := lib.AddBook(tt.Title, tt.ISBN, tt.Author, tt.Publisher, tt.Stock)
-			if ans != tt.res || err != nil {
-				t.Errorf("got %v, want nil", err)
+			ans, err := lib.AddBook(ctx, tt.Title, tt.ISBN, tt.Author, tt.Publisher, tt.Stock)
+			if ans != tt.res || !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
 				t.Errorf("got %d, want %d", ans, tt.res)
 			}
 		})
@@ -174,8 +180,8 @@ func TestCheckBookExists(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.CheckBookExists(tt.ISBN)
-			if err != tt.err {
+			err := lib.CheckBookExists(ctx, tt.ISBN)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 		})
@@ -191,19 +197,20 @@ func TestRemoveBook(t *testing.T) {
 		err    error
 	}{
 		{0, `978-0735219090`, `lost`, 2, nil},
-		{1, `978-1984801258`, `renew`, 1, nil},
+		{1, `978-1984801258`, `weeded`, 1, nil},
 		{2, `978-1338635171`, `lost`, 0, nil},
-		{3, `978-0735219090`, `lost`, 1, nil},
-		{4, `978-1338635171`, "", -1, ErrAllRemoved},
-		{5, `978-0735219090`, "", 0, nil},
-		{6, `234-2342135234`, `no reason`, -1, ErrBookNotExists},
+		{3, `978-0735219090`, `damaged`, 1, nil},
+		{4, `978-1338635171`, `weeded`, -1, ErrAllRemoved},
+		{5, `978-0735219090`, `transferred`, 0, nil},
+		{6, `234-2342135234`, `weeded`, -1, ErrBookNotExists},
+		{7, `978-1984801258`, `renew`, -1, ErrWithdrawalReason},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			ans, err := lib.RemoveBook(tt.ISBN, tt.Info)
-			if ans != tt.res || err != tt.err {
+			ans, err := lib.RemoveBook(ctx, tt.ISBN, 1, tt.Info, "")
+			if ans != tt.res || !errors.Is(err, tt.err) {
 				t.Errorf("got %d, want %d", ans, tt.res)
 				t.Errorf("got %v, want %v", err, tt.err)
 			}
@@ -220,7 +227,7 @@ func TestQueryBookTitle(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt)
 		t.Run(testname, func(t *testing.T) {
-			ans, err := lib.QueryBookTitle(tt)
+			ans, err := lib.QueryBookTitle(ctx, tt)
 			if err != nil {
 				t.Errorf("%v", err)
 			}
@@ -243,7 +250,7 @@ func TestQueryBookAuthor(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt)
 		t.Run(testname, func(t *testing.T) {
-			ans, err := lib.QueryBookAuthor(tt)
+			ans, err := lib.QueryBookAuthor(ctx, tt)
 			if err != nil {
 				t.Errorf("%v", err)
 			}
@@ -260,22 +267,26 @@ func TestQueryBookAuthor(t *testing.T) {
 func TestQueryBookISBN(t *testing.T) {
 	var tests = []struct {
 		query string
+		ISBN  string
 		err   error
 	}{
-		{`123-1234567890`, ErrBookNotExists},
-		{`978-0735219090`, ErrBookNotExists},
-		{`978-0395680902`, nil},
+		{`123-1234567890`, ``, ErrBookNotExists},
+		{`978-0735219090`, ``, ErrBookNotExists},
+		{`978-0395680902`, `978-0395680902`, nil},
+		{`9780395680902`, `978-0395680902`, nil},
+		{` 978-0-395-68090-2 `, `978-0395680902`, nil},
+		{`0395680905`, `978-0395680902`, nil},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt.query)
 		t.Run(testname, func(t *testing.T) {
-			ans, err := lib.QueryBookISBN(tt.query)
-			if err != tt.err {
+			ans, err := lib.QueryBookISBN(ctx, tt.query)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want %v", err, tt.err)
 			}
 			for _, now := range ans {
-				if strings.Compare(now.ISBN, tt.query) != 0 {
+				if strings.Compare(now.ISBN, tt.ISBN) != 0 {
 					t.Errorf("got ans, want res")
 				}
 			}
@@ -293,7 +304,7 @@ func TestBorrowBook(t *testing.T) {
 		{0, `978-0262033848`, `18307130002`, time.Date(2019, time.November, 1, 14, 0, 0, 0, time.UTC), nil},
 		{1, `978-0385545938`, `18307130002`, time.Date(2020, time.January, 9, 14, 0, 0, 0, time.UTC), nil},
 		{2, `978-1984822185`, `18307130002`, time.Date(2020, time.January, 10, 14, 0, 0, 0, time.UTC), nil},
-		{3, `978-0262033848`, `18307130002`, time.Date(2020, time.January, 14, 10, 0, 0, 0, time.UTC), ErrAlreadyBorrowed},
+		{3, `9780262033848`, `18307130002`, time.Date(2020, time.January, 14, 10, 0, 0, 0, time.UTC), ErrAlreadyBorrowed},
 		{4, `978-0735219090`, `18307130012`, time.Date(2020, time.April, 1, 14, 0, 0, 0, time.UTC), ErrBookNotExists},
 		{5, `978-0062820181`, `18307130018`, time.Date(2020, time.April, 1, 14, 0, 0, 0, time.UTC), nil},
 		{6, `978-0134123837`, `18307130018`, time.Date(2020, time.April, 15, 14, 0, 0, 0, time.UTC), nil},
@@ -302,8 +313,8 @@ func TestBorrowBook(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.BorrowBook(tt.bookISBN, tt.userID, tt.borrowDate)
-			if err != tt.err {
+			_, err := lib.BorrowBook(ctx, tt.bookISBN, tt.userID, tt.borrowDate)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want %v", err, tt.err)
 			}
 		})
@@ -314,20 +325,23 @@ func TestCheckDeadline(t *testing.T) {
 	var tests = []struct {
 		testid           int
 		bookISBN, userID string
+		deadline         time.Time
 		err              error
 	}{
-		{0, `978-0134123837`, `18307130018`, nil},
-		{1, `978-1234567890`, `18307130018`, ErrBookNotExists},
-		{2, `978-0385545938`, `18307130018`, ErrNotBorrowed},
+		{0, `978-0134123837`, `18307130018`, time.Date(2020, time.May, 15, 14, 0, 0, 0, time.UTC), nil},
+		{1, `978-1234567890`, `18307130018`, time.Time{}, ErrBookNotExists},
+		{2, `978-0385545938`, `18307130018`, time.Time{}, ErrNotBorrowed},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testid)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.CheckDeadline(tt.bookISBN, tt.userID)
-			if err != tt.err {
-				t.Errorf("got %v, want nil", err)
-
+			deadline, err := lib.CheckDeadline(ctx, tt.bookISBN, tt.userID)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if !deadline.Equal(tt.deadline) {
+				t.Errorf("got %v, want %v", deadline, tt.deadline)
 			}
 		})
 	}
@@ -344,15 +358,15 @@ func TestCheckBorrowHistory(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt.userID)
 		t.Run(testname, func(t *testing.T) {
-			res, err := lib.CheckBorrowHistory(tt.userID)
+			res, err := lib.CheckBorrowHistory(ctx, tt.userID)
 			if err != nil {
-				if err != tt.err {
+				if !errors.Is(err, tt.err) {
 					t.Errorf("got %v, want nil", err)
 				}
 			} else {
 				for _, ans := range res {
-					if strings.Compare(ans.userID, tt.userID) != 0 {
-						t.Errorf("got %s, want %s", ans.userID, tt.userID)
+					if strings.Compare(ans.UserID, tt.userID) != 0 {
+						t.Errorf("got %s, want %s", ans.UserID, tt.userID)
 					}
 				}
 			}
@@ -371,15 +385,15 @@ func TestCheckUnreturned(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%s", tt.userID)
 		t.Run(testname, func(t *testing.T) {
-			res, err := lib.CheckUnreturned(tt.userID)
+			res, err := lib.CheckUnreturned(ctx, tt.userID)
 			if err != nil {
-				if err != tt.err {
+				if !errors.Is(err, tt.err) {
 					t.Errorf("got %v, want nil", err)
 				}
 			} else {
 				for _, ans := range res {
-					if strings.Compare(ans.userID, tt.userID) != 0 || ans.IsReturned == true {
-						t.Errorf("got %s, want %s", ans.userID, tt.userID)
+					if strings.Compare(ans.UserID, tt.userID) != 0 || ans.Returned() {
+						t.Errorf("got %s, want %s", ans.UserID, tt.userID)
 					}
 				}
 			}
@@ -402,26 +416,28 @@ func TestCheckOverdue(t *testing.T) {
 		{4, `978-0395680902`, `18307130006`, time.Date(2020, time.April, 15, 14, 0, 0, 0, time.UTC), 4, nil},
 	}
 
-	var now = time.Now()
+	var now = lib.now()
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testID)
 		t.Run(testname, func(t *testing.T) {
 			if tt.testID != 5 {
-				_, err := lib.db.Exec(`INSERT INTO Recordlist(book_id, user_id, IsReturned, borrow_date, deadline, extendtimes)
-						VALUES (?, ?, 0, ?, ?, 0)`,
-					tt.bookISBN, tt.userID, tt.borrowDate, tt.borrowDate.AddDate(0, 1, 0))
+				item, err := lib.store.ShelfCopy(tt.bookISBN)
+				if err != nil {
+					t.Fatalf("exec err %v", err)
+				}
+				err = lib.store.InsertRecord(Records{bookID: tt.bookISBN, userID: tt.userID,
+					borrowDate: tt.borrowDate, deadline: tt.borrowDate.AddDate(0, 1, 0), copyID: item.Barcode})
 				if err != nil {
 					t.Errorf("exec err %v", err)
 				}
-				_, err = lib.db.Exec(`UPDATE Booklist SET available = available - 1 WHERE ISBN = ?`,
-					tt.bookISBN)
+				err = lib.store.SetCopyStatus(item.Barcode, CopyLoan)
 				if err != nil {
 					t.Errorf("exec err %v", err)
 				}
 			}
-			res, _, err := lib.CheckOverdue(tt.userID, now)
+			res, _, err := lib.CheckOverdue(ctx, tt.userID, now)
 			if err != nil {
-				if err != tt.err {
+				if !errors.Is(err, tt.err) {
 					t.Errorf("got %v, want nil", err)
 				}
 			} else {
@@ -447,9 +463,9 @@ func TestExtendDeadline(t *testing.T) {
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testID)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.ExtendDeadline(tt.bookISBN, tt.userID)
+			_, err := lib.ExtendDeadline(ctx, tt.bookISBN, tt.userID)
 
-			if err != tt.err {
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 
@@ -465,14 +481,14 @@ func TestReturnBook(t *testing.T) {
 	}{
 		{0, `123-0062820181`, `18307130006`, ErrBookNotExists},
 		{1, `978-0385545938`, `18307130006`, nil},
-		{2, `978-0395680902`, `18307130006`, nil},
+		{2, `0-395-68090-5`, `18307130006`, nil},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%d", tt.testID)
 		t.Run(testname, func(t *testing.T) {
-			err := lib.ReturnBook(tt.bookISBN, tt.userID)
-			if err != tt.err {
+			_, err := lib.ReturnBook(ctx, tt.bookISBN, tt.userID)
+			if !errors.Is(err, tt.err) {
 				t.Errorf("got %v, want nil", err)
 			}
 
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log levels, from the most verbose; LogLevels names them in this order
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// log formats: "key=value" text or one JSON object a line
+var LogFormats = []string{"text", "json"}
+
+// Field : a named value an entry is about, such as the user, ISBN, record_id or op(eration)
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F : the field key=value
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger : writes entries at or above its level, one line each, with the fields it was made With
+// the loggers With makes share the writer and can be used concurrently
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  int
+	json   bool
+	fields []Field
+	now    func() time.Time
+}
+
+// NewLogger : a logger of entries at level and above, written to out in format
+// an unknown level is info and an unknown format text
+func NewLogger(out io.Writer, level, format string) *Logger {
+	l := &Logger{out: out, mu: &sync.Mutex{}, level: LevelInfo, json: format == "json", now: time.Now}
+	for i, name := range LogLevels {
+		if name == level {
+			l.level = i
+		}
+	}
+	return l
+}
+
+// defaultLogger : what a library logs to unless configured otherwise
+var defaultLogger = NewLogger(os.Stderr, "info", "text")
+
+// log : the logger of lib, the default one if none was configured
+// entries say who acted, once As has said so
+func (lib *Library) log() *Logger {
+	l := lib.logger
+	if l == nil {
+		l = defaultLogger
+	}
+	if lib.actor != "" {
+		l = l.With(F("actor", lib.actor), F("origin", lib.origin))
+	}
+	return l
+}
+
+// failed : log an operation that failed with err
+// errors a user can run into are warnings, the rest, such as a lost database connection, errors
+func (l *Logger) failed(msg string, err error, fields ...Field) {
+	fields = append(fields, F("error", err))
+	if statusOf(err) >= http.StatusInternalServerError {
+		l.write(LevelError, msg, fields)
+	} else {
+		l.write(LevelWarn, msg, fields)
+	}
+}
+
+// With : a logger adding fields to every entry
+func (l *Logger) With(fields ...Field) *Logger {
+	res := *l
+	res.fields = append(append([]Field{}, l.fields...), fields...)
+	return &res
+}
+
+// Debug : log details only needed to trace a problem
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.write(LevelDebug, msg, fields)
+}
+
+// Info : log something the library did
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.write(LevelInfo, msg, fields)
+}
+
+// Warn : log something that went wrong for a user but not for the library
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.write(LevelWarn, msg, fields)
+}
+
+// Error : log something that went wrong for the library
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.write(LevelError, msg, fields)
+}
+
+func (l *Logger) write(level int, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	all := append(append([]Field{F("time", l.now().Format(time.RFC3339)), F("level", LogLevels[level]),
+		F("msg", msg)}, l.fields...), fields...)
+
+	var buf bytes.Buffer
+	for i, field := range all {
+		value := logValue(field.Value)
+		if l.json {
+			key, _ := json.Marshal(field.Key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			if i == 0 {
+				buf.WriteByte('{')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(v)
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(field.Key + "=" + s)
+	}
+	if l.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+// logValue : how a value is written, errors as their message and times in RFC 3339
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	at := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		testid int
+		level  string
+		format string
+		log    func(l *Logger)
+		want   string
+	}{
+		{0, "info", "text", func(l *Logger) { l.Info("Book borrowed.", F("user", "18307130006"), F("isbn", "978-0385545938")) },
+			`time=2020-05-10T14:00:00Z level=info msg="Book borrowed." user=18307130006 isbn=978-0385545938` + "\n"},
+		{1, "info", "text", func(l *Logger) { l.Debug("Password hash upgraded.") }, ""},
+		{2, "warn", "text", func(l *Logger) {
+			l.Info("Book borrowed.")
+			l.Warn("Borrowing a book failed.", F("error", ErrUserSuspended))
+		},
+			`time=2020-05-10T14:00:00Z level=warn msg="Borrowing a book failed." error="Account suspended."` + "\n"},
+		{3, "debug", "json", func(l *Logger) {
+			l.With(F("op", "loan.extend")).Info("Loan extended.", F("record_id", "3"), F("deadline", at), F("renewals", 1))
+		},
+			`{"time":"2020-05-10T14:00:00Z","level":"info","msg":"Loan extended.","op":"loan.extend","record_id":"3","deadline":"2020-05-10T14:00:00Z","renewals":1}` + "\n"},
+		{4, "info", "json", func(l *Logger) { l.failed("Borrowing a book failed.", ErrUserSuspended) },
+			`{"time":"2020-05-10T14:00:00Z","level":"warn","msg":"Borrowing a book failed.","error":"Account suspended."}` + "\n"},
+		{5, "info", "text", func(l *Logger) { l.failed("Sweeping failed.", errors.New("database is locked"), F("empty", "")) },
+			`time=2020-05-10T14:00:00Z level=error msg="Sweeping failed." empty="" error="database is locked"` + "\n"},
+		{6, "loud", "xml", func(l *Logger) { l.Info("Copy moved.", F("location", `A "3" = B`)) },
+			`time=2020-05-10T14:00:00Z level=info msg="Copy moved." location="A \"3\" = B"` + "\n"},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := NewLogger(&buf, tt.level, tt.format)
+			l.now = func() time.Time { return at }
+			tt.log(l)
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLibraryLog(t *testing.T) {
+	hlib := newHoldLibrary(t)
+	defer hlib.store.Close()
+
+	var buf bytes.Buffer
+	hlib.logger = NewLogger(&buf, "info", "text")
+	hlib = hlib.As(`18307130006`, OriginCLI)
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		testid int
+		op     func()
+		want   []string
+	}{
+		{0, func() { hlib.BorrowBook(ctx, `978-0385545938`, `18307130006`, now) },
+			[]string{`level=info msg="Book borrowed." actor=18307130006 origin=cli op=loan.borrow user=18307130006 isbn=978-0385545938 record_id=1 copy=978-0385545938-1 deadline=2020-06-09T14:00:00Z`}},
+		{1, func() { hlib.BorrowBook(ctx, `978-0385545938`, `18307130068`, now) },
+			[]string{`level=warn msg="Borrowing a book failed."`, `op=loan.borrow user=18307130068`, `error="There is no available book."`}},
+		{2, func() { hlib.CheckDeadline(ctx, `978-0385545938`, `18307130068`) },
+			[]string{`level=warn msg="Checking a deadline failed." actor=18307130006 origin=cli op=loan.deadline`}},
+		{3, func() { hlib.ReturnBook(ctx, `978-0385545938`, `18307130006`) },
+			[]string{`level=info msg="Book returned."`, `op=loan.return`, `record_id=1 copy=978-0385545938-1`}},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			buf.Reset()
+			tt.op()
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("got %q, want %q in it", buf.String(), want)
+				}
+			}
+		})
+	}
+}
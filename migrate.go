@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/modood/table"
+)
+
+// Migration : one numbered step of the schema
+// Up and Down return the statements to apply and revert it on the given dialect
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(d dialect) []string
+	Down    func(d dialect) []string
+}
+
+// MigrationState : a migration and whether it has been applied
+type MigrationState struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt string
+}
+
+var ErrUnknownVersion = errors.New("Unknown schema version.")
+
+// LatestVersion : the version of the newest migration
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion : the highest applied migration, 0 for an empty database
+func (lib *Library) SchemaVersion(ctx context.Context) (int, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	applied, err := lib.store.SchemaVersions()
+	if err != nil {
+		return -1, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Migrate : apply or revert migrations until the schema is at the target version
+func (lib *Library) Migrate(ctx context.Context, target int) error {
+	lib, _, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	if target < 0 || target > LatestVersion() {
+		return ErrUnknownVersion
+	}
+	logger := lib.log().With(F("op", "migrate"))
+	applied, err := lib.store.SchemaVersions()
+	if err != nil {
+		logger.failed("Reading the schema version failed.", err)
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Version > target {
+			continue
+		}
+		if err := lib.store.ApplyMigration(m, true); err != nil {
+			logger.failed("Applying a migration failed.", err, F("version", m.Version), F("name", m.Name))
+			return err
+		}
+		logger.Info("Migration applied.", F("version", m.Version), F("name", m.Name))
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok || m.Version <= target {
+			continue
+		}
+		if err := lib.store.ApplyMigration(m, false); err != nil {
+			logger.failed("Reverting a migration failed.", err, F("version", m.Version), F("name", m.Name))
+			return err
+		}
+		logger.Info("Migration reverted.", F("version", m.Version), F("name", m.Name))
+	}
+	return nil
+}
+
+// Rollback : revert the last steps applied migrations
+func (lib *Library) Rollback(ctx context.Context, steps int) error {
+	lib, ctx, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	current, err := lib.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if steps <= 0 {
+		return nil
+	}
+	target := 0
+	for i, m := range migrations {
+		if m.Version == current && i >= steps {
+			target = migrations[i-steps].Version
+		}
+	}
+	return lib.Migrate(ctx, target)
+}
+
+// MigrationStatus : every known migration and whether it has been applied
+func (lib *Library) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	applied, err := lib.store.SchemaVersions()
+	if err != nil {
+		lib.log().failed("Reading the schema version failed.", err, F("op", "migrate"))
+		return nil, err
+	}
+
+	var res []MigrationState
+	for _, m := range migrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = at.Format(timeTemplate)
+		}
+		res = append(res, state)
+	}
+	return res, nil
+}
+
+// ResetDB : drop everything, rebuild the latest schema and recreate the root account
+func (lib *Library) ResetDB(ctx context.Context) error {
+	lib, ctx, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	if err := lib.Migrate(ctx, 0); err != nil {
+		return err
+	}
+	if err := lib.Migrate(ctx, LatestVersion()); err != nil {
+		return err
+	}
+	return lib.AddUser(ctx, Users{ID: "root", Name: "admin", Password: "root", Type: 0})
+}
+
+// RunMigrate : handle `migrate` on the command line
+//
+//	migrate              apply all pending migrations
+//	migrate up [VERSION] migrate up to VERSION
+//	migrate down [STEPS] roll back STEPS migrations, one by default
+//	migrate status       list the migrations and whether they are applied
+//	migrate reset        roll back everything, migrate and recreate root/root
+func (lib *Library) RunMigrate(ctx context.Context, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	number := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		return strconv.Atoi(args[1])
+	}
+
+	switch cmd {
+	case "up":
+		target, err := number(LatestVersion())
+		if err != nil {
+			return err
+		}
+		return lib.Migrate(ctx, target)
+	case "down":
+		steps, err := number(1)
+		if err != nil {
+			return err
+		}
+		return lib.Rollback(ctx, steps)
+	case "status":
+		res, err := lib.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(table.Table(res))
+		return nil
+	case "reset":
+		return lib.ResetDB(ctx)
+	}
+	return fmt.Errorf("migrate %s: command not found", cmd)
+}
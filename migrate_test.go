@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMigrate(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	mlib := Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+
+	var tests = []struct {
+		testid  int
+		target  int
+		version int
+		err     error
+	}{
+		{0, LatestVersion(), LatestVersion(), nil},
+		{1, LatestVersion(), LatestVersion(), nil},
+		{2, 0, 0, nil},
+		{3, LatestVersion() + 1, 0, ErrUnknownVersion},
+		{4, -1, 0, ErrUnknownVersion},
+		{5, LatestVersion(), LatestVersion(), nil},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			err := mlib.Migrate(ctx, tt.target)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			version, err := mlib.SchemaVersion(ctx)
+			if err != nil || version != tt.version {
+				t.Errorf("got %d, want %d", version, tt.version)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	mlib := Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+
+	if err := mlib.Migrate(ctx, LatestVersion()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if err := mlib.Rollback(ctx, len(migrations)); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+
+	res, err := mlib.MigrationStatus(ctx)
+	if err != nil || len(res) != len(migrations) {
+		t.Fatalf("got %v, want %d migrations", err, len(migrations))
+	}
+	for _, state := range res {
+		if state.Applied {
+			t.Errorf("migration %d still applied", state.Version)
+		}
+	}
+
+	if err := mlib.ResetDB(ctx); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if _, err := mlib.IdentifyUser(ctx, `root`, `root`); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestNormalizeISBNs(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	defer store.Close()
+	mlib := Library{store: store, hasher: PasswordHasher{Cost: bcrypt.MinCost}}
+
+	if err := mlib.Migrate(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	for _, query := range []string{
+		`INSERT INTO Userlist(id, name, password, overdue, type) VALUES ('18307130006', 'Alicia', '', 0, 1)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Camino Winds', '9780385545938', 'John Grisham', 'Doubleday', 0, 0)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Untamed', '1984801252', 'Glennon Doyle', 'The Dial Press', 0, 0)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('The Owl Who Was Afraid of the Dark', '978-1-4052-7218-6', 'Jill Tomlinson', 'Egmont', 0, 0)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Hamlet', '080442957x', 'William Shakespeare', 'Ungar', 0, 0)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Secrets of the Savanna', '978-0544379657', 'Mark Owens', 'Mariner Books', 0, 0)`,
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+		 VALUES ('Typo', '978-0544379658', 'Nobody', 'Nowhere', 0, 0)`,
+		`INSERT INTO Copylist(barcode, book_id, status, acquired_at) VALUES ('CW-1', '9780385545938', 'loan', ?)`,
+		`INSERT INTO Recordlist(book_id, user_id, IsReturned, borrow_date, deadline, extendtimes, copy_id)
+		 VALUES ('9780385545938', '18307130006', FALSE, ?, ?, 0, 'CW-1')`,
+	} {
+		if _, err := store.(*sqlStore).db.Exec(query, now, now.AddDate(0, 1, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ISBNs = func() string {
+		var res []string
+		rows, err := store.(*sqlStore).db.Query(`SELECT ISBN FROM Booklist ORDER BY title`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ISBN string
+			rows.Scan(&ISBN)
+			res = append(res, ISBN)
+		}
+		return fmt.Sprint(res)
+	}
+	before := ISBNs()
+
+	if err := mlib.Migrate(ctx, 8); err != nil {
+		t.Fatal(err)
+	}
+	want := `[978-0385545938 978-0804429573 978-0544379657 978-1405272186 978-0544379658 978-1984801258]`
+	if got := ISBNs(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	record, err := store.OpenRecord(`978-0385545938`, `18307130006`)
+	if err != nil || record.copyID != `CW-1` {
+		t.Errorf("got %+v %v, want the loan moved over", record, err)
+	}
+	if item, err := store.Copy(`CW-1`); err != nil || item.ISBN != `978-0385545938` {
+		t.Errorf("got %+v %v, want the copy moved over", item, err)
+	}
+
+	if err := mlib.Migrate(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := ISBNs(); got != before {
+		t.Errorf("got %s, want %s", got, before)
+	}
+}
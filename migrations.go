@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// migrations : every schema change, in order
+// never edit a migration that has been released; add a new one instead
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create booklist, userlist and recordlist",
+		// IF NOT EXISTS adopts databases created before migrations existed
+		Up: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS Booklist(
+					title VARCHAR(256) NOT NULL,
+					ISBN VARCHAR(16) UNIQUE PRIMARY KEY,
+					author VARCHAR(256) NOT NULL,
+					publisher VARCHAR(256) NOT NULL,
+					stock INT NOT NULL,
+					available INT NOT NULL,
+					removeInfo TEXT,
+					CHECK (stock >= available AND stock >= 0)
+				)`,
+				`CREATE TABLE IF NOT EXISTS Userlist(
+					id VARCHAR(16) PRIMARY KEY,
+					name VARCHAR(256) NOT NULL,
+					password VARCHAR(256) NOT NULL,
+					overdue INT NOT NULL DEFAULT 0,
+					type INT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS Recordlist(
+					record_id ` + d.autoIncrement + `,
+					book_id VARCHAR(16) NOT NULL,
+					user_id VARCHAR(16) NOT NULL,
+					IsReturned BOOLEAN NOT NULL DEFAULT FALSE,
+					borrow_date DATETIME NOT NULL,
+					return_date DATETIME,
+					deadline DATETIME NOT NULL,
+					extendtimes INT NOT NULL,
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
+					FOREIGN KEY (user_id) REFERENCES Userlist(id),
+					CHECK (deadline >= borrow_date)
+				)` + d.tableSuffix,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Recordlist`,
+				`DROP TABLE Booklist`,
+				`DROP TABLE Userlist`,
+			}
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create sessionlist",
+		Up: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE Sessionlist(
+					token_hash CHAR(64) PRIMARY KEY,
+					user_id VARCHAR(16) NOT NULL,
+					created_at DATETIME NOT NULL,
+					expires_at DATETIME NOT NULL,
+					revoked BOOLEAN NOT NULL DEFAULT FALSE,
+					FOREIGN KEY (user_id) REFERENCES Userlist(id)
+				)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Sessionlist`,
+			}
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add reader categories, book classes and loan policies",
+		// the seeded values reproduce the old fixed rules for undergrads borrowing normal books
+		Up: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE Userlist ADD COLUMN category VARCHAR(16) NOT NULL DEFAULT 'undergrad'`,
+				`ALTER TABLE Booklist ADD COLUMN class VARCHAR(16) NOT NULL DEFAULT 'normal'`,
+				`CREATE TABLE Categorylist(
+					category VARCHAR(16) PRIMARY KEY,
+					max_loans INT NOT NULL,
+					suspend_after INT NOT NULL
+				)`,
+				`CREATE TABLE Policylist(
+					category VARCHAR(16) NOT NULL,
+					class VARCHAR(16) NOT NULL,
+					loan_days INT NOT NULL,
+					max_renewals INT NOT NULL,
+					renewal_days INT NOT NULL,
+					PRIMARY KEY (category, class),
+					FOREIGN KEY (category) REFERENCES Categorylist(category)
+				)`,
+				`INSERT INTO Categorylist(category, max_loans, suspend_after) VALUES
+					('undergrad', 10, 3),
+					('postgrad', 20, 3),
+					('staff', 30, 5)`,
+				`INSERT INTO Policylist(category, class, loan_days, max_renewals, renewal_days) VALUES
+					('undergrad', 'normal', 30, 3, 30),
+					('postgrad', 'normal', 60, 3, 30),
+					('staff', 'normal', 90, 5, 30),
+					('undergrad', 'short', 7, 1, 7),
+					('postgrad', 'short', 7, 1, 7),
+					('staff', 'short', 7, 1, 7),
+					('undergrad', 'reference', 0, 0, 0),
+					('postgrad', 'reference', 0, 0, 0),
+					('staff', 'reference', 0, 0, 0)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Policylist`,
+				`DROP TABLE Categorylist`,
+				`ALTER TABLE Booklist DROP COLUMN class`,
+				`ALTER TABLE Userlist DROP COLUMN category`,
+			}
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create holdlist",
+		Up: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE Holdlist(
+					hold_id ` + d.autoIncrement + `,
+					book_id VARCHAR(16) NOT NULL,
+					user_id VARCHAR(16) NOT NULL,
+					status VARCHAR(16) NOT NULL DEFAULT 'waiting',
+					placed_at DATETIME NOT NULL,
+					pickup_deadline DATETIME,
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
+					FOREIGN KEY (user_id) REFERENCES Userlist(id)
+				)` + d.tableSuffix,
+				`CREATE INDEX holdlist_book ON Holdlist(book_id, status)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Holdlist`,
+			}
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add fines to loan policies and create finelist",
+		// amounts are in cents; charges are positive, payments and waivers negative
+		Up: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE Policylist ADD COLUMN daily_fine INT NOT NULL DEFAULT 0`,
+				`ALTER TABLE Policylist ADD COLUMN max_fine INT NOT NULL DEFAULT 0`,
+				`ALTER TABLE Policylist ADD COLUMN replacement_fee INT NOT NULL DEFAULT 0`,
+				`ALTER TABLE Categorylist ADD COLUMN max_balance INT NOT NULL DEFAULT 1000`,
+				`UPDATE Policylist SET daily_fine = 50, max_fine = 2000, replacement_fee = 5000 WHERE class = 'normal'`,
+				`UPDATE Policylist SET daily_fine = 100, max_fine = 2000, replacement_fee = 5000 WHERE class = 'short'`,
+				`UPDATE Policylist SET replacement_fee = 10000 WHERE class = 'reference'`,
+				`CREATE TABLE Finelist(
+					entry_id ` + d.autoIncrement + `,
+					user_id VARCHAR(16) NOT NULL,
+					kind VARCHAR(16) NOT NULL,
+					amount INT NOT NULL,
+					book_id VARCHAR(16),
+					record_id INT,
+					note TEXT,
+					actor VARCHAR(16) NOT NULL,
+					created_at DATETIME NOT NULL,
+					FOREIGN KEY (user_id) REFERENCES Userlist(id),
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
+					FOREIGN KEY (record_id) REFERENCES Recordlist(record_id)
+				)` + d.tableSuffix,
+				`CREATE INDEX finelist_user ON Finelist(user_id)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Finelist`,
+				`ALTER TABLE Categorylist DROP COLUMN max_balance`,
+				`ALTER TABLE Policylist DROP COLUMN replacement_fee`,
+				`ALTER TABLE Policylist DROP COLUMN max_fine`,
+				`ALTER TABLE Policylist DROP COLUMN daily_fine`,
+			}
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create copylist and link loans and holds to copies",
+		// existing open loans and ready holds get a copy each, barcoded ISBN-L<record> and ISBN-H<hold>,
+		// and every available copy becomes a shelf copy ISBN-1, ISBN-2, ...
+		// Booklist.stock and available stay behind because the CHECK on them keeps them from
+		// being dropped, but they are no longer kept up to date: both are counted from Copylist
+		// copy_id has no foreign key so that rolling back can drop it
+		Up: func(d dialect) []string {
+			statements := []string{
+				`CREATE TABLE Copylist(
+					barcode VARCHAR(32) PRIMARY KEY,
+					book_id VARCHAR(16) NOT NULL,
+					status VARCHAR(16) NOT NULL DEFAULT 'shelf',
+					location VARCHAR(64) NOT NULL DEFAULT '',
+					acquired_at DATETIME NOT NULL,
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN)
+				)`,
+				`CREATE INDEX copylist_book ON Copylist(book_id, status)`,
+				`ALTER TABLE Recordlist ADD COLUMN copy_id VARCHAR(32)`,
+				`ALTER TABLE Holdlist ADD COLUMN copy_id VARCHAR(32)`,
+				`INSERT INTO Copylist(barcode, book_id, status, acquired_at)
+				SELECT ` + d.concat(d.concat("book_id", "'-L'"), "record_id") + `, book_id, 'loan', borrow_date
+				FROM Recordlist WHERE IsReturned = FALSE`,
+				`UPDATE Recordlist SET copy_id = ` + d.concat(d.concat("book_id", "'-L'"), "record_id") + `
+				WHERE IsReturned = FALSE`,
+				`INSERT INTO Copylist(barcode, book_id, status, acquired_at)
+				SELECT ` + d.concat(d.concat("book_id", "'-H'"), "hold_id") + `, book_id, 'held', placed_at
+				FROM Holdlist WHERE status = 'ready'`,
+				`UPDATE Holdlist SET copy_id = ` + d.concat(d.concat("book_id", "'-H'"), "hold_id") + `
+				WHERE status = 'ready'`,
+			}
+			shelf := `INSERT INTO Copylist(barcode, book_id, status, acquired_at)
+				WITH RECURSIVE n(i) AS (
+					SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < (SELECT MAX(available) FROM Booklist)
+				)
+				SELECT ` + d.concat(d.concat("ISBN", "'-'"), "i") + `, ISBN, 'shelf', CURRENT_TIMESTAMP
+				FROM Booklist JOIN n ON n.i <= Booklist.available`
+			if d.name == "mysql" {
+				// MySQL stops a recursive CTE at cte_max_recursion_depth, 1000 by default, so it is raised
+				// to the most copies of a book; the migration runs in one transaction, on one session
+				return append(statements,
+					`SET @copies = (SELECT COALESCE(MAX(available), 0) FROM Booklist)`,
+					`SET SESSION cte_max_recursion_depth = GREATEST(@@SESSION.cte_max_recursion_depth, @copies)`,
+					shelf,
+					`SET SESSION cte_max_recursion_depth = DEFAULT`,
+				)
+			}
+			return append(statements, shelf)
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`UPDATE Booklist SET
+					stock = (SELECT COUNT(*) FROM Copylist c
+						WHERE c.book_id = Booklist.ISBN AND c.status IN ('shelf', 'loan', 'held', 'repair')),
+					available = (SELECT COUNT(*) FROM Copylist c
+						WHERE c.book_id = Booklist.ISBN AND c.status = 'shelf')`,
+				`ALTER TABLE Holdlist DROP COLUMN copy_id`,
+				`ALTER TABLE Recordlist DROP COLUMN copy_id`,
+				`DROP TABLE Copylist`,
+			}
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add full-text search index on books",
+		// SQLite keeps an FTS4 table in step with Booklist through triggers, isbn holds the ISBN without
+		// hyphens so it can be searched either way; MySQL has FULLTEXT indexes for every field and all of them
+		Up: func(d dialect) []string {
+			if d.name == "mysql" {
+				return []string{
+					`ALTER TABLE Booklist ADD FULLTEXT INDEX booklist_search(title, author, publisher)`,
+					`ALTER TABLE Booklist ADD FULLTEXT INDEX booklist_search_title(title)`,
+					`ALTER TABLE Booklist ADD FULLTEXT INDEX booklist_search_author(author)`,
+					`ALTER TABLE Booklist ADD FULLTEXT INDEX booklist_search_publisher(publisher)`,
+				}
+			}
+			return []string{
+				`CREATE VIRTUAL TABLE Booksearch USING fts4(book_id, title, author, publisher, isbn, tokenize=unicode61)`,
+				`INSERT INTO Booksearch(book_id, title, author, publisher, isbn)
+				SELECT ISBN, title, author, publisher, REPLACE(ISBN, '-', '') FROM Booklist`,
+				`CREATE TRIGGER booksearch_insert AFTER INSERT ON Booklist BEGIN
+					INSERT INTO Booksearch(book_id, title, author, publisher, isbn)
+					VALUES (NEW.ISBN, NEW.title, NEW.author, NEW.publisher, REPLACE(NEW.ISBN, '-', ''));
+				END`,
+				`CREATE TRIGGER booksearch_update AFTER UPDATE OF ISBN, title, author, publisher ON Booklist BEGIN
+					DELETE FROM Booksearch WHERE book_id = OLD.ISBN;
+					INSERT INTO Booksearch(book_id, title, author, publisher, isbn)
+					VALUES (NEW.ISBN, NEW.title, NEW.author, NEW.publisher, REPLACE(NEW.ISBN, '-', ''));
+				END`,
+				`CREATE TRIGGER booksearch_delete AFTER DELETE ON Booklist BEGIN
+					DELETE FROM Booksearch WHERE book_id = OLD.ISBN;
+				END`,
+			}
+		},
+		Down: func(d dialect) []string {
+			if d.name == "mysql" {
+				return []string{
+					`ALTER TABLE Booklist DROP INDEX booklist_search_publisher`,
+					`ALTER TABLE Booklist DROP INDEX booklist_search_author`,
+					`ALTER TABLE Booklist DROP INDEX booklist_search_title`,
+					`ALTER TABLE Booklist DROP INDEX booklist_search`,
+				}
+			}
+			return []string{
+				`DROP TRIGGER booksearch_delete`,
+				`DROP TRIGGER booksearch_update`,
+				`DROP TRIGGER booksearch_insert`,
+				`DROP TABLE Booksearch`,
+			}
+		},
+	},
+	{
+		Version: 8,
+		Name:    "normalize isbns",
+		// valid ISBN-10s and ISBN-13s are rewritten to the canonical 978-XXXXXXXXXX form, see canonicalISBNSQL;
+		// a book is copied to its new ISBN, its loans, holds, copies and fines moved over, and the old row deleted,
+		// since foreign keys keep the ISBN from being updated in place. Isbnhistory keeps what changed for Down.
+		// Malformed ISBNs, and those whose canonical form is already taken, are left alone
+		Up: func(d dialect) []string {
+			statements := []string{
+				`CREATE TABLE Isbnhistory(
+					old_isbn VARCHAR(16) PRIMARY KEY,
+					new_isbn VARCHAR(16) NOT NULL UNIQUE
+				)`,
+				`INSERT INTO Isbnhistory(old_isbn, new_isbn)
+				SELECT MIN(ISBN), canonical FROM (SELECT ISBN, ` + canonicalISBNSQL(d, "ISBN") + ` AS canonical FROM Booklist) t
+				WHERE canonical IS NOT NULL AND canonical <> ISBN AND canonical NOT IN (SELECT ISBN FROM Booklist)
+				GROUP BY canonical`,
+			}
+			return append(statements, moveISBNs("old_isbn", "new_isbn")...)
+		},
+		Down: func(d dialect) []string {
+			return append(moveISBNs("new_isbn", "old_isbn"), `DROP TABLE Isbnhistory`)
+		},
+	},
+	{
+		Version: 9,
+		Name:    "split authors, edition and year out of booklist",
+		// Booklist.author stays as the authors joined for display, and every author also gets a row in Authorlist,
+		// linked to the book in order; names are split the way splitAuthors does, see splitAuthorsSQL.
+		// Publishers written "Pearson; 3 edition (July 6, 2015)" are split like parsePublisher does into
+		// the name, the edition and the year, and Publisherhistory keeps what they were for Down
+		Up: func(d dialect) []string {
+			edition, year, name := parsePublisherSQL("publisher")
+			return []string{
+				`ALTER TABLE Booklist ADD COLUMN edition VARCHAR(64) NOT NULL DEFAULT ''`,
+				`ALTER TABLE Booklist ADD COLUMN year INT`,
+				`ALTER TABLE Booklist ADD COLUMN language VARCHAR(16) NOT NULL DEFAULT ''`,
+				`ALTER TABLE Booklist ADD COLUMN pages INT NOT NULL DEFAULT 0`,
+				`ALTER TABLE Booklist ADD COLUMN description TEXT`,
+				`CREATE TABLE Publisherhistory(
+					book_id VARCHAR(16) PRIMARY KEY,
+					publisher VARCHAR(256) NOT NULL
+				)`,
+				`INSERT INTO Publisherhistory(book_id, publisher)
+				SELECT ISBN, publisher FROM Booklist WHERE INSTR(publisher, ';') > 0 OR publisher LIKE '% (%)'`,
+				// MySQL assigns from left to right, so publisher goes last
+				`UPDATE Booklist SET edition = ` + edition + `, year = ` + year + `, publisher = ` + name + `
+				WHERE ISBN IN (SELECT book_id FROM Publisherhistory)`,
+				`CREATE TABLE Authorlist(
+					author_id ` + d.autoIncrement + `,
+					name VARCHAR(256) NOT NULL UNIQUE
+				)` + d.tableSuffix,
+				`CREATE TABLE Bookauthor(
+					book_id VARCHAR(16) NOT NULL,
+					author_id INT NOT NULL,
+					seq INT NOT NULL,
+					PRIMARY KEY (book_id, author_id),
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
+					FOREIGN KEY (author_id) REFERENCES Authorlist(author_id)
+				)`,
+				`CREATE INDEX bookauthor_author ON Bookauthor(author_id)`,
+				`INSERT INTO Authorlist(name) ` + splitAuthorsSQL(d) + `
+				SELECT DISTINCT name FROM split WHERE name <> ''`,
+				`INSERT INTO Bookauthor(book_id, author_id, seq) ` + splitAuthorsSQL(d) + `
+				SELECT s.book_id, a.author_id, MIN(s.seq) FROM split s JOIN Authorlist a ON a.name = s.name
+				WHERE s.name <> '' GROUP BY s.book_id, a.author_id`,
+				`CREATE TABLE Booksubject(
+					book_id VARCHAR(16) NOT NULL,
+					subject VARCHAR(64) NOT NULL,
+					PRIMARY KEY (book_id, subject),
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN)
+				)`,
+				`CREATE INDEX booksubject_subject ON Booksubject(subject)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Booksubject`,
+				`DROP TABLE Bookauthor`,
+				`DROP TABLE Authorlist`,
+				`UPDATE Booklist SET publisher = (SELECT publisher FROM Publisherhistory WHERE book_id = ISBN)
+				WHERE ISBN IN (SELECT book_id FROM Publisherhistory)`,
+				`DROP TABLE Publisherhistory`,
+				`ALTER TABLE Booklist DROP COLUMN description`,
+				`ALTER TABLE Booklist DROP COLUMN pages`,
+				`ALTER TABLE Booklist DROP COLUMN language`,
+				`ALTER TABLE Booklist DROP COLUMN year`,
+				`ALTER TABLE Booklist DROP COLUMN edition`,
+			}
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create auditlist",
+		// triggers keep the log append-only
+		Up: func(d dialect) []string {
+			statements := []string{
+				`CREATE TABLE Auditlist(
+					entry_id ` + d.autoIncrement + `,
+					actor VARCHAR(16) NOT NULL,
+					action VARCHAR(32) NOT NULL,
+					target VARCHAR(64) NOT NULL,
+					before_value TEXT,
+					after_value TEXT,
+					origin VARCHAR(8) NOT NULL,
+					created_at DATETIME NOT NULL
+				)` + d.tableSuffix,
+				`CREATE INDEX auditlist_actor ON Auditlist(actor, created_at)`,
+				`CREATE INDEX auditlist_target ON Auditlist(target, created_at)`,
+				`CREATE INDEX auditlist_created ON Auditlist(created_at)`,
+			}
+			if d.name == "mysql" {
+				return append(statements,
+					`CREATE TRIGGER auditlist_update BEFORE UPDATE ON Auditlist FOR EACH ROW
+					SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Auditlist is append-only'`,
+					`CREATE TRIGGER auditlist_delete BEFORE DELETE ON Auditlist FOR EACH ROW
+					SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'Auditlist is append-only'`,
+				)
+			}
+			return append(statements,
+				`CREATE TRIGGER auditlist_update BEFORE UPDATE ON Auditlist BEGIN
+					SELECT RAISE(ABORT, 'Auditlist is append-only');
+				END`,
+				`CREATE TRIGGER auditlist_delete BEFORE DELETE ON Auditlist BEGIN
+					SELECT RAISE(ABORT, 'Auditlist is append-only');
+				END`,
+			)
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TRIGGER auditlist_delete`,
+				`DROP TRIGGER auditlist_update`,
+				`DROP TABLE Auditlist`,
+			}
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create noticelist",
+		Up: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE Noticelist(
+					notice_id ` + d.autoIncrement + `,
+					record_id INT NOT NULL,
+					kind VARCHAR(16) NOT NULL,
+					deadline DATETIME NOT NULL,
+					created_at DATETIME NOT NULL,
+					sent_at DATETIME,
+					FOREIGN KEY (record_id) REFERENCES Recordlist(record_id),
+					UNIQUE (record_id, kind, deadline)
+				)` + d.tableSuffix,
+				`CREATE INDEX noticelist_pending ON Noticelist(sent_at)`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`DROP TABLE Noticelist`,
+			}
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add account status and expiry to userlist",
+		Up: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE Userlist ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active'`,
+				`ALTER TABLE Userlist ADD COLUMN expires_at DATETIME`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE Userlist DROP COLUMN expires_at`,
+				`ALTER TABLE Userlist DROP COLUMN status`,
+			}
+		},
+	},
+	{
+		Version: 13,
+		Name:    "create withdrawallist and link copies to their withdrawal",
+		// Booklist.removeInfo keeps the free-text reasons of earlier removals but is no longer written;
+		// withdrawal_id has no foreign key so that rolling back can drop it
+		Up: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE Withdrawallist(
+					withdrawal_id ` + d.autoIncrement + `,
+					book_id VARCHAR(16) NOT NULL,
+					copies INT NOT NULL,
+					reinstated INT NOT NULL DEFAULT 0,
+					reason VARCHAR(16) NOT NULL,
+					note TEXT,
+					actor VARCHAR(16) NOT NULL,
+					record_id INT,
+					created_at DATETIME NOT NULL,
+					FOREIGN KEY (book_id) REFERENCES Booklist(ISBN),
+					FOREIGN KEY (record_id) REFERENCES Recordlist(record_id)
+				)` + d.tableSuffix,
+				`CREATE INDEX withdrawallist_book ON Withdrawallist(book_id)`,
+				`ALTER TABLE Copylist ADD COLUMN withdrawal_id INT`,
+			}
+		},
+		Down: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE Copylist DROP COLUMN withdrawal_id`,
+				`DROP TABLE Withdrawallist`,
+			}
+		},
+	},
+}
+
+// moveISBNs : move every book in Isbnhistory from the ISBN in column from to the one in column to
+func moveISBNs(from, to string) []string {
+	statements := []string{
+		`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available, removeInfo, class)
+		SELECT title, ` + to + `, author, publisher, stock, available, removeInfo, class
+		FROM Booklist JOIN Isbnhistory ON ISBN = ` + from,
+	}
+	for _, table := range []string{"Recordlist", "Holdlist", "Copylist", "Finelist"} {
+		statements = append(statements, `UPDATE `+table+`
+			SET book_id = (SELECT `+to+` FROM Isbnhistory WHERE `+from+` = book_id)
+			WHERE book_id IN (SELECT `+from+` FROM Isbnhistory)`)
+	}
+	return append(statements, `DELETE FROM Booklist WHERE ISBN IN (SELECT `+from+` FROM Isbnhistory)`)
+}
+
+// canonicalISBNSQL : an SQL expression for the canonical form of the ISBN in col, NULL if it isn't valid
+// it does what isbn.Canonical does, with the same check digits
+func canonicalISBNSQL(d dialect, col string) string {
+	n := "REPLACE(REPLACE(UPPER(TRIM(" + col + ")), '-', ''), ' ', '')"
+	char := func(i int) string {
+		return fmt.Sprintf("SUBSTR(%s, %d, 1)", n, i)
+	}
+	// a character as a number, by arithmetic so that it works the same everywhere
+	digit := func(i int) string {
+		return "(" + char(i) + " + 0)"
+	}
+	sum := func(weight func(i int) int, from, to int) string {
+		var terms []string
+		for i := from; i <= to; i++ {
+			terms = append(terms, fmt.Sprintf("%d * %s", weight(i), digit(i)))
+		}
+		return "(" + strings.Join(terms, " + ") + ")"
+	}
+
+	sum13 := sum(func(i int) int { return 3 - 2*(i%2) }, 1, 13)
+	sum10 := sum(func(i int) int { return 11 - i }, 1, 9) +
+		" + CASE WHEN " + char(10) + " = 'X' THEN 10 ELSE " + digit(10) + " END"
+	// 978 weighs 9 + 3 * 7 + 8 = 38, then the nine digits weigh 3, 1, 3, ...
+	check := "CAST((10 - (38 + " + sum(func(i int) int { return 1 + 2*(i%2) }, 1, 9) + ") % 10) % 10 AS CHAR)"
+
+	return `CASE
+		WHEN LENGTH(` + n + `) = 13 AND ` + onlyDigitsSQL(n) + ` AND SUBSTR(` + n + `, 1, 3) IN ('978', '979')
+			AND ` + sum13 + ` % 10 = 0
+		THEN ` + d.concat(d.concat("SUBSTR("+n+", 1, 3)", "'-'"), "SUBSTR("+n+", 4, 10)") + `
+		WHEN LENGTH(` + n + `) = 10 AND ` + onlyDigitsSQL("SUBSTR("+n+", 1, 9)") + `
+			AND (` + onlyDigitsSQL(char(10)) + ` OR ` + char(10) + ` = 'X')
+			AND (` + sum10 + `) % 11 = 0
+		THEN ` + d.concat(d.concat("'978-'", "SUBSTR("+n+", 1, 9)"), check) + `
+		END`
+}
+
+// onlyDigitsSQL : an SQL condition that the string s has no characters but digits
+func onlyDigitsSQL(s string) string {
+	for c := 0; c <= 9; c++ {
+		s = fmt.Sprintf("REPLACE(%s, '%d', '')", s, c)
+	}
+	return s + " = ''"
+}
+
+// splitAuthorsSQL : a WITH clause for split(book_id, seq, name, rest), every author of every book
+// numbered from 1 in order, split the way splitAuthors does; names may be empty or repeated
+func splitAuthorsSQL(d dialect) string {
+	list := "REPLACE(REPLACE(REPLACE(author, ';', ','), ' & ', ','), ' and ', ',')"
+	return `WITH RECURSIVE split(book_id, seq, name, rest) AS (
+		SELECT ISBN, 0, CAST('' AS CHAR(256)), ` + d.concat(list, "','") + ` FROM Booklist
+		UNION ALL
+		SELECT book_id, seq + 1, TRIM(SUBSTR(rest, 1, INSTR(rest, ',') - 1)), SUBSTR(rest, INSTR(rest, ',') + 1)
+		FROM split WHERE rest <> ''
+	)`
+}
+
+// parsePublisherSQL : SQL expressions for the edition, the year and the name of the publisher in col,
+// as parsePublisher finds them, for publishers that have a ';' or end in a parenthesis
+func parsePublisherSQL(col string) (edition, year, name string) {
+	semicolon := "INSTR(" + col + ", ';')"
+	rest := "LOWER(TRIM(SUBSTR(" + col + ", " + semicolon + " + 1)))"
+	edition = `CASE WHEN ` + semicolon + ` > 0 AND INSTR(` + rest + `, ' edition') > 0
+		THEN TRIM(SUBSTR(TRIM(SUBSTR(` + col + `, ` + semicolon + ` + 1)), 1, INSTR(` + rest + `, ' edition') - 1))
+		ELSE '' END`
+	// the four characters before the closing parenthesis, counted from the end
+	last := "SUBSTR(" + col + ", -5, 4)"
+	year = `CASE WHEN SUBSTR(` + col + `, -1, 1) = ')' AND LENGTH(` + last + `) = 4 AND ` + onlyDigitsSQL(last) + `
+		THEN ` + last + ` + 0 END`
+	name = `CASE WHEN ` + semicolon + ` > 0 THEN TRIM(SUBSTR(` + col + `, 1, ` + semicolon + ` - 1))
+		WHEN ` + col + ` LIKE '% (%)' THEN TRIM(SUBSTR(` + col + `, 1, INSTR(` + col + `, ' (') - 1))
+		ELSE ` + col + ` END`
+	return edition, year, name
+}
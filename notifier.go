@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// reminder kinds, stored in Noticelist.kind
+const (
+	NoticeDueSoon = "due-soon"
+	NoticeOverdue = "overdue"
+)
+
+// Notice : a reminder about one loan, queued by Sweep until a Notifier delivers it
+type Notice struct {
+	NoticeID  string
+	Kind      string
+	RecordID  string
+	UserID    string
+	Name      string
+	ISBN      string
+	Title     string
+	CopyID    string
+	Deadline  time.Time
+	CreatedAt time.Time
+}
+
+// Subject : the one-line summary of a notice
+func (n Notice) Subject() string {
+	if n.Kind == NoticeOverdue {
+		return fmt.Sprintf("%s is overdue", n.Title)
+	}
+	return fmt.Sprintf("%s is due on %s", n.Title, n.Deadline.Format(timeTemplate))
+}
+
+// Body : what a notice says to the reader
+func (n Notice) Body() string {
+	if n.Kind == NoticeOverdue {
+		return fmt.Sprintf("Dear %s,\n\n%s (ISBN %s, copy %s) was due on %s. Please return it as soon as possible;\n"+
+			"fines may apply, and overdue books can suspend your account.\n",
+			n.Name, n.Title, n.ISBN, n.CopyID, n.Deadline.Format(timeTemplate))
+	}
+	return fmt.Sprintf("Dear %s,\n\n%s (ISBN %s, copy %s) is due on %s. Please return or extend it by then.\n",
+		n.Name, n.Title, n.ISBN, n.CopyID, n.Deadline.Format(timeTemplate))
+}
+
+// Notifier : delivers notices to readers, e.g. by mail
+// a notice Notify fails on stays queued and is tried again at the next sweep
+type Notifier interface {
+	Notify(n Notice) error
+}
+
+// DefaultNotifyFile : where FileNotifier writes unless configured otherwise
+var DefaultNotifyFile = "notifications.txt"
+
+// FileNotifier : a stand-in for a mail server, appending each notice to a file as a message
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Notify : append the notice to the file, dated when the sweep queued it,
+// so that notices sent under a fake clock carry its time
+func (f *FileNotifier) Notify(n Notice) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "Date: %s\nTo: %s <%s>\nSubject: %s\n\n%s\n",
+		n.CreatedAt.Format(time.RFC1123Z), n.Name, n.UserID, n.Subject(), n.Body())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher : turns passwords into salted bcrypt hashes and checks them
+// a Cost below bcrypt.MinCost means bcrypt.DefaultCost
+type PasswordHasher struct {
+	Cost int
+}
+
+// dummyHash : compared against when the user doesn't exist, so that a wrong
+// username takes as long to reject as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// cost : the bcrypt cost new hashes are made with
+func (h PasswordHasher) cost() int {
+	if h.Cost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	if h.Cost > bcrypt.MaxCost {
+		return bcrypt.MaxCost
+	}
+	return h.Cost
+}
+
+// Hash : hash a password for storage
+func (h PasswordHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	return string(hash), err
+}
+
+// Verify : check a password against the stored value in constant time
+// stored may still be a plaintext password from before hashing was introduced;
+// rehash reports that the stored value should be replaced by a fresh hash
+func (h PasswordHasher) Verify(stored, password string) (ok, rehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	return ok, ok && cost != h.cost()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	hasher := PasswordHasher{Cost: bcrypt.MinCost}
+	hash, err := hasher.Hash(`578152`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := PasswordHasher{Cost: bcrypt.MinCost + 1}.Hash(`578152`)
+
+	var tests = []struct {
+		testid   int
+		stored   string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{0, hash, `578152`, true, false},
+		{1, hash, `123456`, false, false},
+		{2, `578152`, `578152`, true, true},
+		{3, `578152`, `123456`, false, false},
+		{4, stale, `578152`, true, true},
+		{5, hash, hash, false, false},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			ok, rehash := hasher.Verify(tt.stored, tt.password)
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("got %v %v, want %v %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestLegacyPasswordUpgrade(t *testing.T) {
+	clib := newTestLibrary(t)
+	defer clib.store.Close()
+
+	// a row written before passwords were hashed
+	err := clib.store.InsertUser(Users{`18307130006`, `Alicia`, `578152`, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clib.IdentifyUser(ctx, `18307130006`, `123456`); !errors.Is(err, ErrPassword) {
+		t.Errorf("got %v, want %v", err, ErrPassword)
+	}
+	user, _ := clib.store.User(`18307130006`)
+	if user.Password != `578152` {
+		t.Errorf("password upgraded after a failed login")
+	}
+
+	if _, err := clib.IdentifyUser(ctx, `18307130006`, `578152`); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	user, _ = clib.store.User(`18307130006`)
+	if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+		t.Errorf("got %q, want a bcrypt hash", user.Password)
+	}
+
+	if _, err := clib.IdentifyUser(ctx, `18307130006`, `578152`); err != nil {
+		t.Errorf("got %v, want nil after upgrade", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// reader categories, stored in Userlist.category
+var Categories = []string{"undergrad", "postgrad", "staff"}
+
+// book classes, stored in Booklist.class
+var BookClasses = []string{"normal", "short", "reference"}
+
+// LoanPolicy : how a reader category may borrow a book class
+// a LoanDays of 0 means the class can't be borrowed at all
+// fines are in cents: DailyFine per day late up to MaxFine a loan, ReplacementFee for a lost copy
+type LoanPolicy struct {
+	Category       string
+	Class          string
+	LoanDays       int
+	MaxRenewals    int
+	RenewalDays    int
+	DailyFine      int
+	MaxFine        int
+	ReplacementFee int
+}
+
+// CategoryPolicy : limits on a reader category as a whole
+// a reader is suspended once they have more than SuspendAfter overdue books,
+// and can't borrow while they owe more than MaxBalance cents
+type CategoryPolicy struct {
+	Category     string
+	MaxLoans     int
+	SuspendAfter int
+	MaxBalance   int
+}
+
+var ErrNotLoanable = errors.New("This book can't be borrowed.")
+var ErrTooManyLoans = errors.New("Too many books borrowed at the same time.")
+var ErrNoPolicy = errors.New("No loan policy applies.")
+var ErrUnknownCategory = errors.New("Unknown reader category.")
+var ErrUnknownClass = errors.New("Unknown book class.")
+var ErrInvalidPolicy = errors.New("Policy values can't be negative.")
+
+func contains(list []string, s string) bool {
+	for _, now := range list {
+		if now == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies : every loan policy and category policy
+func (lib *Library) Policies(ctx context.Context) ([]LoanPolicy, []CategoryPolicy, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	loans, err := lib.store.LoanPolicies()
+	var categories []CategoryPolicy
+	if err == nil {
+		categories, err = lib.store.CategoryPolicies()
+	}
+	if err != nil {
+		lib.log().failed("Querying policies failed.", err, F("op", "policy.list"))
+		return nil, nil, opError(err, "policy.list", "", "")
+	}
+	return loans, categories, nil
+}
+
+// SetLoanPolicy : change how a category may borrow a class
+func (lib *Library) SetLoanPolicy(ctx context.Context, p LoanPolicy) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if !contains(Categories, p.Category) {
+		return ErrUnknownCategory
+	}
+	if !contains(BookClasses, p.Class) {
+		return ErrUnknownClass
+	}
+	if p.LoanDays < 0 || p.MaxRenewals < 0 || p.RenewalDays < 0 ||
+		p.DailyFine < 0 || p.MaxFine < 0 || p.ReplacementFee < 0 {
+		return ErrInvalidPolicy
+	}
+	err := lib.transaction(func(tx *Library) error {
+		loans, err := tx.store.LoanPolicies()
+		if err != nil {
+			return err
+		}
+		var before interface{}
+		for _, loan := range loans {
+			if loan.Category == p.Category && loan.Class == p.Class {
+				before = loan
+			}
+		}
+		if err := tx.store.SaveLoanPolicy(p); err != nil {
+			return err
+		}
+		return tx.audit("policy.loan", p.Category+"/"+p.Class, before, p)
+	})
+	logger := lib.log().With(F("op", "policy.loan"), F("category", p.Category), F("class", p.Class))
+	if err != nil {
+		logger.failed("Changing a loan policy failed.", err)
+		return opError(err, "policy.loan", "", "")
+	}
+	logger.Info("Loan policy changed.")
+	return nil
+}
+
+// SetCategoryPolicy : change the limits on a category
+func (lib *Library) SetCategoryPolicy(ctx context.Context, p CategoryPolicy) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if !contains(Categories, p.Category) {
+		return ErrUnknownCategory
+	}
+	if p.MaxLoans < 0 || p.SuspendAfter < 0 || p.MaxBalance < 0 {
+		return ErrInvalidPolicy
+	}
+	err := lib.transaction(func(tx *Library) error {
+		categories, err := tx.store.CategoryPolicies()
+		if err != nil {
+			return err
+		}
+		var before interface{}
+		for _, category := range categories {
+			if category.Category == p.Category {
+				before = category
+			}
+		}
+		if err := tx.store.SaveCategoryPolicy(p); err != nil {
+			return err
+		}
+		return tx.audit("policy.category", p.Category, before, p)
+	})
+	logger := lib.log().With(F("op", "policy.category"), F("category", p.Category))
+	if err != nil {
+		logger.failed("Changing a category policy failed.", err)
+		return opError(err, "policy.category", "", "")
+	}
+	logger.Info("Category policy changed.")
+	return nil
+}
+
+// SetUserCategory : put a reader into a category
+func (lib *Library) SetUserCategory(ctx context.Context, userID, category string) error {
+	lib, ctx, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	if !contains(Categories, category) {
+		return ErrUnknownCategory
+	}
+	if err := lib.CheckUserExists(ctx, userID); err != nil {
+		return opError(err, "user.category", "", userID)
+	}
+	err := lib.transaction(func(tx *Library) error {
+		before, err := tx.store.UserCategoryPolicy(userID)
+		if err != nil {
+			return err
+		}
+		if err := tx.store.SetUserCategory(userID, category); err != nil {
+			return err
+		}
+		return tx.audit("user.category", userID, map[string]interface{}{"category": before.Category},
+			map[string]interface{}{"category": category})
+	})
+	logger := lib.log().With(F("op", "user.category"), F("user", userID), F("category", category))
+	if err != nil {
+		logger.failed("Changing a user's category failed.", err)
+		return opError(err, "user.category", "", userID)
+	}
+	logger.Info("User category changed.")
+	return nil
+}
+
+// SetBookClass : put a book into a class
+func (lib *Library) SetBookClass(ctx context.Context, ISBN, class string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	ISBN = canonicalISBN(ISBN)
+	if !contains(BookClasses, class) {
+		return ErrUnknownClass
+	}
+	err := lib.transaction(func(tx *Library) error {
+		if _, err := tx.store.Book(ISBN); err != nil {
+			return err
+		}
+		if err := tx.store.SetBookClass(ISBN, class); err != nil {
+			return err
+		}
+		return tx.audit("book.class", ISBN, nil, map[string]interface{}{"class": class})
+	})
+	logger := lib.log().With(F("op", "book.class"), F("isbn", ISBN), F("class", class))
+	if err != nil {
+		logger.failed("Changing a book's class failed.", err)
+		return opError(err, "book.class", ISBN, "")
+	}
+	logger.Info("Book class changed.")
+	return nil
+}
+
+// CheckSuspended : whether the user has more overdue books than their category allows
+// the overdue counter is the one last stored by CheckOverdue
+func (lib *Library) CheckSuspended(ctx context.Context, userID string) (bool, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	user, err := lib.store.User(userID)
+	if err != nil {
+		return false, err
+	}
+	category, err := lib.store.UserCategoryPolicy(userID)
+	if err != nil {
+		return false, err
+	}
+	return user.Overdue > category.SuspendAfter, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newPolicyLibrary : a library with one reader per category and one book per class
+func newPolicyLibrary(t *testing.T) *Library {
+	plib := newTestLibrary(t)
+	for _, user := range []Users{
+		{`18307130006`, `Alicia`, `578152`, 0, 1},
+		{`18307130068`, `Bob`, `987430`, 0, 1},
+		{`teacher`, `Carol`, `123456`, 0, 1},
+	} {
+		if err := plib.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for userID, category := range map[string]string{`18307130068`: `postgrad`, `teacher`: `staff`} {
+		if err := plib.SetUserCategory(ctx, userID, category); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := plib.AddBook(ctx, `Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday`, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plib.AddBook(ctx, `Introduction to Algorithms`, `978-0262033848`, `Thomas H. Cormen`, `MIT Press`, 5); err != nil {
+		t.Fatal(err)
+	}
+	for ISBN, class := range map[string]string{`978-1984801258`: `short`, `978-0262033848`: `reference`} {
+		if err := plib.SetBookClass(ctx, ISBN, class); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return plib
+}
+
+func TestBorrowPolicy(t *testing.T) {
+	plib := newPolicyLibrary(t)
+	defer plib.store.Close()
+
+	var now = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		testid           int
+		bookISBN, userID string
+		days             int
+		err              error
+	}{
+		{0, `978-0385545938`, `18307130006`, 30, nil},
+		{1, `978-0385545938`, `18307130068`, 60, nil},
+		{2, `978-0385545938`, `teacher`, 90, nil},
+		{3, `978-1984801258`, `18307130006`, 7, nil},
+		{4, `978-0262033848`, `teacher`, 0, ErrNotLoanable},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			_, err := plib.BorrowBook(ctx, tt.bookISBN, tt.userID, now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			record, _ := plib.store.OpenRecord(tt.bookISBN, tt.userID)
+			if want := now.AddDate(0, 0, tt.days); !record.deadline.Equal(want) {
+				t.Errorf("got deadline %v, want %v", record.deadline, want)
+			}
+		})
+	}
+}
+
+func TestBorrowLimits(t *testing.T) {
+	plib := newPolicyLibrary(t)
+	defer plib.store.Close()
+
+	var now = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	if err := plib.SetCategoryPolicy(ctx, CategoryPolicy{`undergrad`, 1, 3, 1000}); err != nil {
+		t.Fatal(err)
+	}
+	plib.store.SetOverdue(`18307130068`, 4)
+	plib.store.SetOverdue(`teacher`, 4)
+
+	var tests = []struct {
+		testid           int
+		bookISBN, userID string
+		err              error
+	}{
+		{0, `978-0385545938`, `18307130006`, nil},
+		{1, `978-1984801258`, `18307130006`, ErrTooManyLoans},
+		{2, `978-0385545938`, `18307130068`, ErrUserSuspended},
+		{3, `978-0385545938`, `teacher`, nil},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			_, err := plib.BorrowBook(ctx, tt.bookISBN, tt.userID, now)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestExtendPolicy(t *testing.T) {
+	plib := newPolicyLibrary(t)
+	defer plib.store.Close()
+
+	var now = time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	plib.clock = NewFakeClock(now)
+	plib.BorrowBook(ctx, `978-1984801258`, `18307130006`, now)
+
+	var tests = []struct {
+		testid int
+		days   int
+		err    error
+	}{
+		{0, 14, nil},
+		{1, 14, ErrNoMoreExtended},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			_, err := plib.ExtendDeadline(ctx, `978-1984801258`, `18307130006`)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			record, _ := plib.store.OpenRecord(`978-1984801258`, `18307130006`)
+			if want := now.AddDate(0, 0, tt.days); !record.deadline.Equal(want) {
+				t.Errorf("got deadline %v, want %v", record.deadline, want)
+			}
+		})
+	}
+}
+
+func TestOverdueForfeitsRenewals(t *testing.T) {
+	plib := newPolicyLibrary(t)
+	defer plib.store.Close()
+
+	var borrowDate = time.Date(2020, time.April, 1, 14, 0, 0, 0, time.UTC)
+	plib.BorrowBook(ctx, `978-0385545938`, `teacher`, borrowDate)
+
+	overdue, _, err := plib.CheckOverdue(ctx, `teacher`, borrowDate.AddDate(0, 0, 91))
+	if err != nil || overdue != 1 {
+		t.Fatalf("got %d %v, want 1 nil", overdue, err)
+	}
+	if _, err := plib.ExtendDeadline(ctx, `978-0385545938`, `teacher`); !errors.Is(err, ErrNoMoreExtended) {
+		t.Errorf("got %v, want %v", err, ErrNoMoreExtended)
+	}
+	suspended, err := plib.CheckSuspended(ctx, `teacher`)
+	if err != nil || suspended {
+		t.Errorf("got %v %v, want false nil", suspended, err)
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	plib := newPolicyLibrary(t)
+	defer plib.store.Close()
+
+	var tests = []struct {
+		testid int
+		policy LoanPolicy
+		err    error
+	}{
+		{0, LoanPolicy{`postgrad`, `short`, 14, 2, 14, 100, 2000, 5000}, nil},
+		{1, LoanPolicy{`alumni`, `short`, 14, 2, 14, 100, 2000, 5000}, ErrUnknownCategory},
+		{2, LoanPolicy{`postgrad`, `rare`, 14, 2, 14, 100, 2000, 5000}, ErrUnknownClass},
+		{3, LoanPolicy{`postgrad`, `short`, -1, 2, 14, 100, 2000, 5000}, ErrInvalidPolicy},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			err := plib.SetLoanPolicy(ctx, tt.policy)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	loans, categories, err := plib.Policies(ctx)
+	if err != nil || len(loans) != 9 || len(categories) != 3 {
+		t.Fatalf("got %d %d %v, want 9 3 nil", len(loans), len(categories), err)
+	}
+	for _, p := range loans {
+		if p.Category == `postgrad` && p.Class == `short` && p.LoanDays != 14 {
+			t.Errorf("got %+v, want 14 loan days", p)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/modood/table"
+)
+
+// reports, see Report
+const (
+	ReportMostBorrowed  = "most-borrowed"
+	ReportUserLoans     = "user-loans"
+	ReportOverdue       = "overdue"
+	ReportCirculation   = "circulation"
+	ReportNeverBorrowed = "never-borrowed"
+	ReportUtilization   = "utilization"
+)
+
+var Reports = []string{ReportMostBorrowed, ReportUserLoans, ReportOverdue, ReportCirculation, ReportNeverBorrowed, ReportUtilization}
+
+// report output formats, besides FormatCSV
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+var ReportFormats = []string{FormatTable, FormatCSV, FormatJSON}
+
+// ReportRange : the period a report covers, by when books were borrowed
+// overdue covers loans due in it, and utilization ignores it; zero bounds are open, To excluded
+type ReportRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// TitleLoans : a row of most-borrowed
+type TitleLoans struct {
+	ISBN  string `json:"isbn"`
+	Title string `json:"title"`
+	Loans int    `json:"loans"`
+}
+
+// UserLoans : a row of user-loans, Loans in the range, Open and Overdue now
+type UserLoans struct {
+	UserID  string `json:"user_id" table:"User"`
+	Name    string `json:"name"`
+	Loans   int    `json:"loans"`
+	Open    int    `json:"open"`
+	Overdue int    `json:"overdue"`
+}
+
+// OverdueLoan : a row of overdue
+type OverdueLoan struct {
+	UserID   string `json:"user_id" table:"User"`
+	Name     string `json:"name"`
+	ISBN     string `json:"isbn"`
+	Title    string `json:"title"`
+	CopyID   string `json:"copy" table:"Copy"`
+	Deadline string `json:"deadline"`
+	DaysLate int    `json:"days_late" table:"Days late"`
+}
+
+// overdueRow : an overdue loan as the store finds it
+type overdueRow struct {
+	UserID, Name, ISBN, Title, CopyID string
+	Deadline                          time.Time
+}
+
+// MonthCirculation : a row of circulation, Month as "2006-01"
+type MonthCirculation struct {
+	Month   string `json:"month"`
+	Loans   int    `json:"loans"`
+	Returns int    `json:"returns"`
+}
+
+// IdleBook : a row of never-borrowed
+type IdleBook struct {
+	ISBN   string `json:"isbn"`
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Stock  int    `json:"stock"`
+}
+
+// BookUtilization : a row of utilization, Utilization the share of copies off the shelf
+type BookUtilization struct {
+	ISBN        string  `json:"isbn"`
+	Title       string  `json:"title"`
+	Stock       int     `json:"stock"`
+	Available   int     `json:"available"`
+	Utilization float64 `json:"utilization"`
+}
+
+var ErrUnknownReport = errors.New("Unknown report.")
+var ErrReportFormat = errors.New("Unknown report format.")
+
+// Report : the rows of a report, a slice of one of the row types above
+// most-borrowed lists the top limit titles, all of them if limit is 0; other reports ignore limit
+func (lib *Library) Report(ctx context.Context, name string, r ReportRange, limit int) (interface{}, error) {
+	lib, _, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	if !r.From.IsZero() && !r.To.IsZero() && !r.To.After(r.From) {
+		return nil, ErrDateRange
+	}
+	var res interface{}
+	var err error
+	switch name {
+	case ReportMostBorrowed:
+		res, err = lib.store.MostBorrowed(r.From, r.To, limit)
+	case ReportUserLoans:
+		res, err = lib.store.UserLoans(r.From, r.To, lib.now())
+	case ReportOverdue:
+		res, err = lib.overdueReport(r)
+	case ReportCirculation:
+		res, err = lib.circulationReport(r)
+	case ReportNeverBorrowed:
+		res, err = lib.neverBorrowedReport(r)
+	case ReportUtilization:
+		res, err = lib.utilizationReport()
+	default:
+		return nil, ErrUnknownReport
+	}
+	if err != nil {
+		lib.log().failed("Running a report failed.", err, F("op", "report"), F("report", name))
+		return nil, err
+	}
+	return res, nil
+}
+
+// overdueReport : unreturned loans past their deadline, longest overdue first
+func (lib *Library) overdueReport(r ReportRange) ([]OverdueLoan, error) {
+	now := lib.now()
+	loans, err := lib.store.OverdueLoans(r.From, r.To, now)
+	if err != nil {
+		return nil, err
+	}
+	res := []OverdueLoan{}
+	for _, loan := range loans {
+		res = append(res, OverdueLoan{loan.UserID, loan.Name, loan.ISBN, loan.Title, loan.CopyID,
+			loan.Deadline.Format(timeTemplate), overdueDays(loan.Deadline, now)})
+	}
+	return res, nil
+}
+
+// circulationReport : loans and returns per calendar month, months without either left out
+func (lib *Library) circulationReport(r ReportRange) ([]MonthCirculation, error) {
+	borrowed, returned, err := lib.store.LoanEvents(r.From, r.To)
+	if err != nil {
+		return nil, err
+	}
+	months := map[string]*MonthCirculation{}
+	month := func(t time.Time) *MonthCirculation {
+		key := t.Format("2006-01")
+		if months[key] == nil {
+			months[key] = &MonthCirculation{Month: key}
+		}
+		return months[key]
+	}
+	for _, t := range borrowed {
+		month(t).Loans++
+	}
+	for _, t := range returned {
+		month(t).Returns++
+	}
+
+	res := []MonthCirculation{}
+	for _, m := range months {
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Month < res[j].Month })
+	return res, nil
+}
+
+// neverBorrowedReport : books with copies that nobody borrowed in the range, by title
+func (lib *Library) neverBorrowedReport(r ReportRange) ([]IdleBook, error) {
+	books, err := lib.store.BooksNotBorrowed(r.From, r.To)
+	if err != nil {
+		return nil, err
+	}
+	res := []IdleBook{}
+	for _, book := range books {
+		res = append(res, IdleBook{book.ISBN, book.Title, book.Author, book.Stock})
+	}
+	return res, nil
+}
+
+// utilizationReport : how much of each book's stock is off the shelf, busiest first
+func (lib *Library) utilizationReport() ([]BookUtilization, error) {
+	books, err := lib.store.AllBooks()
+	if err != nil {
+		return nil, err
+	}
+	res := []BookUtilization{}
+	for _, book := range books {
+		if book.Stock <= 0 {
+			continue
+		}
+		used := float64(book.Stock-book.Available) / float64(book.Stock)
+		res = append(res, BookUtilization{book.ISBN, book.Title, book.Stock, book.Available, math.Round(used*100) / 100})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Utilization > res[j].Utilization })
+	return res, nil
+}
+
+// WriteReport : write the rows of a report as a table, CSV with a header line, or a JSON array
+func WriteReport(w io.Writer, rows interface{}, format string) error {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		return ErrUnknownReport
+	}
+	switch format {
+	case FormatTable:
+		if v.Len() == 0 {
+			_, err := fmt.Fprintln(w, "No row.")
+			return err
+		}
+		_, err := fmt.Fprintln(w, table.Table(rows))
+		return err
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case FormatCSV:
+		t := v.Type().Elem()
+		cw := csv.NewWriter(w)
+		var header []string
+		for i := 0; i < t.NumField(); i++ {
+			header = append(header, t.Field(i).Tag.Get("json"))
+		}
+		cw.Write(header)
+		for i := 0; i < v.Len(); i++ {
+			var record []string
+			for j := 0; j < t.NumField(); j++ {
+				record = append(record, fmt.Sprint(v.Index(i).Field(j).Interface()))
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return ErrReportFormat
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReportLibrary(t *testing.T) *Library {
+	rlib := newHoldLibrary(t)
+	if _, err := rlib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rlib.AddBook(ctx, `Where the Crawdads Sing`, `978-0735219090`, `Delia Owens`, `G.P. Putnam's Sons`, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Time{})
+	rlib.clock = clock
+	for _, loan := range []struct {
+		ISBN, userID string
+		on           time.Time
+		returned     bool
+	}{
+		{`978-0385545938`, `18307130006`, time.Date(2020, time.April, 1, 9, 0, 0, 0, time.UTC), true},
+		{`978-0385545938`, `18307130068`, time.Date(2020, time.May, 2, 9, 0, 0, 0, time.UTC), false},
+		{`978-1984801258`, `18307130006`, time.Date(2020, time.May, 10, 9, 0, 0, 0, time.UTC), false},
+		{`978-1984801258`, `18307130101`, time.Date(2020, time.June, 10, 9, 0, 0, 0, time.UTC), false},
+	} {
+		clock.Set(loan.on)
+		if _, err := rlib.BorrowBook(ctx, loan.ISBN, loan.userID, rlib.now()); err != nil {
+			t.Fatal(err)
+		}
+		if loan.returned {
+			clock.AdvanceDays(19)
+			if _, err := rlib.ReturnBook(ctx, loan.ISBN, loan.userID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	clock.Set(time.Date(2020, time.June, 15, 9, 0, 0, 0, time.UTC))
+	return rlib
+}
+
+func TestReport(t *testing.T) {
+	rlib := newReportLibrary(t)
+	defer rlib.store.Close()
+
+	may := ReportRange{time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)}
+	june := ReportRange{From: time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)}
+	var tests = []struct {
+		testid int
+		name   string
+		r      ReportRange
+		limit  int
+		err    error
+		rows   string
+	}{
+		{0, ReportMostBorrowed, ReportRange{}, 0, nil, `[{978-0385545938 Camino Winds 2} {978-1984801258 Untamed 2}]`},
+		{1, ReportMostBorrowed, ReportRange{}, 1, nil, `[{978-0385545938 Camino Winds 2}]`},
+		{2, ReportMostBorrowed, june, 0, nil, `[{978-1984801258 Untamed 1}]`},
+		{3, ReportUserLoans, ReportRange{}, 0, nil, `[{18307130006 Alicia 2 1 1} {18307130068 Brandon 1 1 1} {18307130101 Chloe 1 1 0}]`},
+		{4, ReportUserLoans, june, 0, nil, `[{18307130101 Chloe 1 1 0} {18307130006 Alicia 0 1 1} {18307130068 Brandon 0 1 1}]`},
+		{5, ReportOverdue, ReportRange{}, 0, nil, `[{18307130068 Brandon 978-0385545938 Camino Winds 978-0385545938-1 2020/06/01 09:00:00 14} ` +
+			`{18307130006 Alicia 978-1984801258 Untamed 978-1984801258-1 2020/06/09 09:00:00 6}]`},
+		{6, ReportOverdue, ReportRange{From: time.Date(2020, time.June, 5, 0, 0, 0, 0, time.UTC)}, 0, nil, `[{18307130006 Alicia 978-1984801258 Untamed 978-1984801258-1 2020/06/09 09:00:00 6}]`},
+		{7, ReportCirculation, ReportRange{}, 0, nil, `[{2020-04 1 1} {2020-05 2 0} {2020-06 1 0}]`},
+		{8, ReportCirculation, may, 0, nil, `[{2020-05 2 0}]`},
+		{9, ReportNeverBorrowed, ReportRange{}, 0, nil, `[{978-0735219090 Where the Crawdads Sing Delia Owens 1}]`},
+		{10, ReportNeverBorrowed, june, 0, nil, `[{978-0385545938 Camino Winds John Grisham 1} {978-0735219090 Where the Crawdads Sing Delia Owens 1}]`},
+		{11, ReportUtilization, june, 0, nil, `[{978-0385545938 Camino Winds 1 0 1} {978-1984801258 Untamed 2 0 1} {978-0735219090 Where the Crawdads Sing 1 1 0}]`},
+		{12, "popular", ReportRange{}, 0, ErrUnknownReport, `<nil>`},
+		{13, ReportOverdue, ReportRange{june.From, may.From}, 0, ErrDateRange, `<nil>`},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			rows, err := rlib.Report(ctx, tt.name, tt.r, tt.limit)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			if got := fmt.Sprint(rows); got != tt.rows {
+				t.Errorf("got %s, want %s", got, tt.rows)
+			}
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	rows := []TitleLoans{{`978-0385545938`, `Camino Winds`, 2}, {`978-1984801258`, `Untamed, a memoir`, 1}}
+	var tests = []struct {
+		testid int
+		rows   interface{}
+		format string
+		err    error
+		want   string
+	}{
+		{0, rows, FormatCSV, nil, "isbn,title,loans\n978-0385545938,Camino Winds,2\n978-1984801258,\"Untamed, a memoir\",1\n"},
+		{1, []TitleLoans{}, FormatCSV, nil, "isbn,title,loans\n"},
+		{2, []TitleLoans{}, FormatJSON, nil, "[]\n"},
+		{3, []TitleLoans{}, FormatTable, nil, "No row.\n"},
+		{4, rows, "xlsx", ErrReportFormat, ""},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteReport(&buf, tt.rows, tt.format)
+			if !errors.Is(err, tt.err) || buf.String() != tt.want {
+				t.Errorf("got %v %q, want %v %q", err, buf.String(), tt.err, tt.want)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, rows, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var back []TitleLoans
+	if err := json.Unmarshal(buf.Bytes(), &back); err != nil || fmt.Sprint(back) != fmt.Sprint(rows) {
+		t.Errorf("got %v %v, want %v", back, err, rows)
+	}
+	buf.Reset()
+	if err := WriteReport(&buf, rows, FormatTable); err != nil || !strings.Contains(buf.String(), "Untamed, a memoir") {
+		t.Errorf("got %v %s, want a table of the rows", err, buf.String())
+	}
+}
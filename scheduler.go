@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// DefaultRemindBefore : how long before its deadline a loan is reminded of unless configured otherwise
+var DefaultRemindBefore = 72 * time.Hour
+
+// DefaultSweepInterval : how often the scheduler sweeps unless told otherwise
+var DefaultSweepInterval = time.Hour
+
+// SweepReport : what one sweep did
+type SweepReport struct {
+	Expired   int
+	Users     int
+	Overdue   int
+	Suspended int
+	Queued    int
+	Sent      int
+}
+
+// Sweep : expire the holds past their pickup deadline, bring every borrower's overdue counter up to date
+// and send the reminders that are due.
+// A copy set aside for an expired hold goes to the next reader in the queue, or back to the shelf;
+// users with open loans or a stale counter are checked as CheckOverdue would at their next command;
+// loans due within the reminder window get a due-soon notice and overdue ones an overdue notice,
+// each once per deadline. Without a notifier the notices just stay queued
+func (lib *Library) Sweep(ctx context.Context, now time.Time) (SweepReport, error) {
+	lib, ctx, cancel := lib.bind(ctx, lib.batchTimeout)
+	defer cancel()
+	var report SweepReport
+	lib = lib.As(SystemActor, OriginSystem)
+	logger := lib.log().With(F("op", "sweep"))
+
+	books, err := lib.store.ExpiredHoldBooks(now)
+	if err != nil {
+		logger.failed("Sweeping failed.", err)
+		return report, err
+	}
+	for _, ISBN := range books {
+		// one book at a time, so that a failure leaves the others' queues moved on
+		var expired int
+		err := lib.transaction(func(tx *Library) error {
+			if _, err := tx.store.Book(ISBN); err != nil {
+				return err
+			}
+			expired, err = tx.expireHolds(ISBN, now)
+			return err
+		})
+		if err != nil {
+			logger.failed("Sweeping failed.", err, F("isbn", ISBN))
+			return report, err
+		}
+		report.Expired += expired
+	}
+
+	users, err := lib.store.SweepUsers()
+	if err != nil {
+		logger.failed("Sweeping failed.", err)
+		return report, err
+	}
+	for _, userID := range users {
+		overdue, _, err := lib.CheckOverdue(ctx, userID, now)
+		if err != nil {
+			return report, err
+		}
+		report.Users++
+		report.Overdue += overdue
+		if suspended, err := lib.CheckSuspended(ctx, userID); err == nil && suspended {
+			report.Suspended++
+		}
+	}
+
+	before := lib.remindBefore
+	if before <= 0 {
+		before = DefaultRemindBefore
+	}
+	records, err := lib.store.DueRecords(now.Add(before))
+	if err != nil {
+		logger.failed("Sweeping failed.", err)
+		return report, err
+	}
+	for _, record := range records {
+		kind := NoticeDueSoon
+		if now.After(record.deadline) {
+			kind = NoticeOverdue
+		}
+		queued, err := lib.store.InsertNotice(record, kind, now)
+		if err != nil {
+			logger.failed("Sweeping failed.", err, F("record_id", record.recordID))
+			return report, err
+		}
+		if queued {
+			report.Queued++
+		}
+	}
+
+	if lib.notifier == nil {
+		return report, nil
+	}
+	notices, err := lib.store.PendingNotices()
+	if err != nil {
+		logger.failed("Sweeping failed.", err)
+		return report, err
+	}
+	for _, notice := range notices {
+		if err := lib.notifier.Notify(notice); err != nil {
+			logger.failed("Sending a notice failed.", err, F("record_id", notice.RecordID), F("user", notice.UserID), F("kind", notice.Kind))
+			continue
+		}
+		if err := lib.store.MarkNoticeSent(notice.NoticeID, now); err != nil {
+			logger.failed("Sweeping failed.", err, F("record_id", notice.RecordID))
+			return report, err
+		}
+		report.Sent++
+	}
+	return report, nil
+}
+
+// RunScheduler : sweep now and then every interval until a signal arrives on stop or ctx is done
+func (lib *Library) RunScheduler(ctx context.Context, interval time.Duration, stop <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	logger := lib.log().With(F("op", "sweep"))
+	logger.Info("Scheduler started.", F("interval", interval))
+
+	for {
+		report, err := lib.Sweep(ctx, lib.now())
+		if err == nil {
+			logger.Info("Swept.", F("expired", report.Expired), F("users", report.Users), F("overdue", report.Overdue), F("suspended", report.Suspended),
+				F("queued", report.Queued), F("sent", report.Sent))
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			logger.Info("Scheduler stopped.")
+			return
+		case <-ctx.Done():
+			logger.Info("Scheduler stopped.")
+			return
+		}
+	}
+}
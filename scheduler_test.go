@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingNotifier : keeps what it is asked to deliver, or fails while broken
+type recordingNotifier struct {
+	notices []Notice
+	broken  bool
+}
+
+func (r *recordingNotifier) Notify(n Notice) error {
+	if r.broken {
+		return errors.New("mail server down")
+	}
+	r.notices = append(r.notices, n)
+	return nil
+}
+
+func TestSweep(t *testing.T) {
+	slib := newHoldLibrary(t)
+	defer slib.store.Close()
+
+	var now = time.Now()
+	if _, err := slib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Alicia is ten days late, Brandon's book is due in two days; Chloe is suspended after one overdue book
+	if _, err := slib.BorrowBook(ctx, `978-0385545938`, `18307130006`, now.AddDate(0, 0, -40)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slib.BorrowBook(ctx, `978-1984801258`, `18307130068`, now.AddDate(0, 0, -28)); err != nil {
+		t.Fatal(err)
+	}
+	if err := slib.SetCategoryPolicy(ctx, CategoryPolicy{Category: "undergrad", MaxLoans: 10, SuspendAfter: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingNotifier{}
+	var tests = []struct {
+		testid   int
+		now      time.Time
+		notifier Notifier
+		broken   bool
+		report   SweepReport
+	}{
+		{0, now, nil, false, SweepReport{Users: 2, Overdue: 1, Suspended: 1, Queued: 2, Sent: 0}},
+		{1, now, recorder, true, SweepReport{Users: 2, Overdue: 1, Suspended: 1, Queued: 0, Sent: 0}},
+		{2, now, recorder, false, SweepReport{Users: 2, Overdue: 1, Suspended: 1, Queued: 0, Sent: 2}},
+		{3, now.Add(time.Hour), recorder, false, SweepReport{Users: 2, Overdue: 1, Suspended: 1, Queued: 0, Sent: 0}},
+		{4, now.AddDate(0, 0, 3), recorder, false, SweepReport{Users: 2, Overdue: 2, Suspended: 2, Queued: 1, Sent: 1}},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			slib.notifier = tt.notifier
+			recorder.broken = tt.broken
+			report, err := slib.Sweep(ctx, tt.now)
+			if err != nil || report != tt.report {
+				t.Errorf("got %+v %v, want %+v", report, err, tt.report)
+			}
+		})
+	}
+
+	var kinds []string
+	for _, notice := range recorder.notices {
+		kinds = append(kinds, notice.UserID+" "+notice.Kind)
+	}
+	if got, want := fmt.Sprint(kinds), `[18307130006 overdue 18307130068 due-soon 18307130068 overdue]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if user, _ := slib.store.User(`18307130006`); user.Overdue != 1 {
+		t.Errorf("got %d, want the sweep to count Alicia's overdue book", user.Overdue)
+	}
+	if res, _ := slib.Audit(ctx, AuditFilter{Action: "user.overdue"}); len(res) != 2 || res[0].Actor != SystemActor {
+		t.Errorf("got %+v, want two changes by the system", res)
+	}
+
+	// a returned book is swept once more to clear the counter, then no longer
+	if _, err := slib.ReturnBook(ctx, `978-0385545938`, `18307130006`); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := slib.store.SweepUsers(); fmt.Sprint(users) != `[18307130068]` {
+		t.Errorf("got %v, want only Brandon left to sweep", users)
+	}
+}
+
+func TestSweepHolds(t *testing.T) {
+	slib := newHoldLibrary(t)
+	defer slib.store.Close()
+
+	const ISBN = `978-0385545938`
+	var now = time.Now()
+	slib.BorrowBook(ctx, ISBN, `18307130006`, now)
+	slib.PlaceHold(ctx, ISBN, `18307130068`, now)
+	slib.PlaceHold(ctx, ISBN, `18307130101`, now)
+	slib.ReturnBook(ctx, ISBN, `18307130006`)
+
+	// nobody touches the book, yet the copy moves down the queue and finally back to the shelf
+	var tests = []struct {
+		testid  int
+		now     time.Time
+		expired int
+		status  string
+	}{
+		{0, now, 0, CopyHeld},
+		{1, now.Add(DefaultHoldPickup + time.Hour), 1, CopyHeld},
+		{2, now.Add(DefaultHoldPickup + 2*time.Hour), 0, CopyHeld},
+		{3, now.Add(2*DefaultHoldPickup + 2*time.Hour), 1, CopyShelf},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			report, err := slib.Sweep(ctx, tt.now)
+			if err != nil || report.Expired != tt.expired {
+				t.Errorf("got %+v %v, want %d expired", report, err, tt.expired)
+			}
+			if item, _ := slib.store.Copy(`978-0385545938-1`); item.Status != tt.status {
+				t.Errorf("got %s, want %s", item.Status, tt.status)
+			}
+		})
+	}
+
+	if holds, _ := slib.UserHolds(ctx, `18307130101`); len(holds) != 0 {
+		t.Errorf("got %+v, want the expired hold gone", holds)
+	}
+	if res, _ := slib.Audit(ctx, AuditFilter{Action: "hold.expire"}); len(res) != 2 || res[0].Actor != SystemActor {
+		t.Errorf("got %+v, want two expiries by the system", res)
+	}
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notifier := &FileNotifier{Path: filepath.Join(dir, "notifications.txt")}
+	deadline := time.Date(2020, 5, 20, 12, 0, 0, 0, time.Local)
+	queued := time.Date(2020, 5, 18, 9, 30, 0, 0, time.Local)
+	for _, kind := range []string{NoticeDueSoon, NoticeOverdue} {
+		err := notifier.Notify(Notice{Kind: kind, UserID: `18307130006`, Name: `Alicia`,
+			ISBN: `978-0385545938`, Title: `Camino Winds`, CopyID: `978-0385545938-1`, Deadline: deadline, CreatedAt: queued})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile(notifier.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Date: " + queued.Format(time.RFC1123Z) + "\n",
+		"To: Alicia <18307130006>\n",
+		"Subject: Camino Winds is due on 2020/05/20 12:00:00\n",
+		"Subject: Camino Winds is overdue\n",
+		"copy 978-0385545938-1",
+	} {
+		if !strings.Contains(string(buf), want) {
+			t.Errorf("got %q, want it to contain %q", buf, want)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unsafe"
+
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// SearchPageSize : how many books a page of search results holds by default
+const SearchPageSize = 10
+
+// text fields a search term can be limited to with "field:term"
+var SearchFields = []string{"title", "author", "publisher", "isbn"}
+
+// numeric fields a search can filter on with "field:>N", "field:<=N", "field:N", ...
+var SearchFilters = map[string]string{
+	"stock":     bookStockSQL,
+	"available": bookAvailableSQL,
+	"year":      "Booklist.year",
+}
+
+var ErrSearchSyntax = errors.New("Can't parse the search query.")
+var ErrSearchField = errors.New("Unknown search field.")
+var ErrEmptySearch = errors.New("Empty search query.")
+
+// searchNode : one node of a parsed search query
+// op is "and", "or", "not", "term" or "filter"
+// a term matches words, as a phrase if there are several, in field or in every text field if it is empty;
+// a filter compares field to value with cmp
+type searchNode struct {
+	op       string
+	children []*searchNode
+	field    string
+	words    []string
+	prefix   bool
+	cmp      string
+	value    int
+}
+
+// SearchQuery : a parsed search query
+type SearchQuery struct {
+	root *searchNode
+}
+
+// SearchResult : one page of search results, best match first
+type SearchResult struct {
+	Books []Books
+	Total int
+	Page  int
+	Pages int
+}
+
+// ParseSearch : parse a search query
+//
+//	owens crawdads           both words, in any field
+//	"where the crawdads"     the phrase
+//	owen*                    words starting with owen
+//	author:owens title:crawdads isbn:9780735219090
+//	delia OR owens, NOT owens, -owens, (a OR b) c
+//	available:>0 stock:<=2   compare the number of copies
+func ParseSearch(query string) (SearchQuery, error) {
+	tokens, err := searchTokens(query)
+	if err != nil {
+		return SearchQuery{}, err
+	}
+	if len(tokens) == 0 {
+		return SearchQuery{}, ErrEmptySearch
+	}
+	p := searchParser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return SearchQuery{}, err
+	}
+	if p.pos != len(p.tokens) {
+		return SearchQuery{}, ErrSearchSyntax
+	}
+	return SearchQuery{root: root}, nil
+}
+
+// Search : one page of the books matching a query, pages count from 1
+// removed books, those with no copy left, only show up if includeRemoved is set
+func (lib *Library) Search(ctx context.Context, query string, page, pageSize int, includeRemoved bool) (SearchResult, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	q, err := ParseSearch(query)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	if !includeRemoved {
+		q = q.and(&searchNode{op: "filter", field: "stock", cmp: ">", value: 0})
+	}
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = SearchPageSize
+	}
+
+	BookList, total, err := lib.store.SearchBooks(q, pageSize, (page-1)*pageSize)
+	if err != nil {
+		lib.log().failed("Searching books failed.", err, F("op", "book.search"), F("query", query))
+		return SearchResult{}, err
+	}
+	pages := (total + pageSize - 1) / pageSize
+	return SearchResult{Books: BookList, Total: total, Page: page, Pages: pages}, nil
+}
+
+// searchToken : a parenthesis, a keyword, or a term with the field before it
+type searchToken struct {
+	text   string
+	field  string
+	phrase bool
+}
+
+// searchTokens : split a query into tokens
+func searchTokens(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		switch {
+		case unicode.IsSpace(rs[i]):
+			i++
+		case rs[i] == '(' || rs[i] == ')':
+			tokens = append(tokens, searchToken{text: string(rs[i])})
+			i++
+		case rs[i] == '-' && (i == 0 || unicode.IsSpace(rs[i-1]) || rs[i-1] == '('):
+			tokens = append(tokens, searchToken{text: "NOT"})
+			i++
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && rs[j] != '(' && rs[j] != ')' && rs[j] != '"' {
+				j++
+			}
+			token := searchToken{text: string(rs[i:j])}
+			if k := strings.Index(token.text, ":"); k >= 0 {
+				token.field = strings.ToLower(token.text[:k])
+				token.text = token.text[k+1:]
+				if _, ok := SearchFilters[token.field]; !ok && !contains(SearchFields, token.field) {
+					return nil, ErrSearchField
+				}
+			}
+			if j < len(rs) && rs[j] == '"' {
+				if token.text != "" {
+					return nil, ErrSearchSyntax
+				}
+				end := j + 1
+				for end < len(rs) && rs[end] != '"' {
+					end++
+				}
+				if end == len(rs) {
+					return nil, ErrSearchSyntax
+				}
+				token.text = string(rs[j+1 : end])
+				token.phrase = true
+				j = end + 1
+			}
+			tokens = append(tokens, token)
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// searchParser : recursive descent over the tokens of a query
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return searchToken{}, false
+}
+
+// keyword : whether the next token is the bare keyword k
+func (p *searchParser) keyword(k string) bool {
+	token, ok := p.peek()
+	return ok && !token.phrase && token.field == "" && token.text == k
+}
+
+// or : and ("OR" and)*
+func (p *searchParser) or() (*searchNode, error) {
+	node, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	res := &searchNode{op: "or", children: []*searchNode{node}}
+	for p.keyword("OR") {
+		p.pos++
+		node, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		res.children = append(res.children, node)
+	}
+	if len(res.children) == 1 {
+		return node, nil
+	}
+	return res, nil
+}
+
+// and : not (["AND"] not)*
+func (p *searchParser) and() (*searchNode, error) {
+	res := &searchNode{op: "and"}
+	for {
+		if p.keyword("AND") {
+			if len(res.children) == 0 {
+				return nil, ErrSearchSyntax
+			}
+			p.pos++
+		} else if _, ok := p.peek(); !ok || p.keyword("OR") || p.keyword(")") {
+			break
+		}
+		node, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		res.children = append(res.children, node)
+	}
+	if len(res.children) == 0 {
+		return nil, ErrSearchSyntax
+	}
+	if len(res.children) == 1 {
+		return res.children[0], nil
+	}
+	return res, nil
+}
+
+// not : "NOT" not | "(" or ")" | term
+func (p *searchParser) not() (*searchNode, error) {
+	if p.keyword("NOT") {
+		p.pos++
+		node, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &searchNode{op: "not", children: []*searchNode{node}}, nil
+	}
+	if p.keyword("(") {
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, ErrSearchSyntax
+		}
+		p.pos++
+		return node, nil
+	}
+	token, ok := p.peek()
+	if !ok || p.keyword(")") {
+		return nil, ErrSearchSyntax
+	}
+	p.pos++
+	return searchTerm(token)
+}
+
+// searchTerm : the node a term token stands for
+func searchTerm(token searchToken) (*searchNode, error) {
+	if _, ok := SearchFilters[token.field]; ok {
+		return searchFilter(token)
+	}
+	node := &searchNode{op: "term", field: token.field}
+	text := token.text
+	if !token.phrase && strings.HasSuffix(text, "*") {
+		node.prefix = true
+		text = strings.TrimRight(text, "*")
+	}
+	// a whole ISBN, in either form, is looked up as the ISBN-13 the isbn field holds
+	if d, err := isbn.To13(text); err == nil && !token.phrase && !node.prefix && (node.field == "" || node.field == "isbn") {
+		node.field = "isbn"
+		text = d
+	}
+	if node.field == "isbn" {
+		text = strings.Replace(text, "-", "", -1)
+	}
+	node.words = searchWords(text)
+	if len(node.words) == 0 {
+		return nil, ErrSearchSyntax
+	}
+	return node, nil
+}
+
+// searchFilter : the node of a numeric filter like "available:>=2"
+func searchFilter(token searchToken) (*searchNode, error) {
+	if token.phrase {
+		return nil, ErrSearchSyntax
+	}
+	node := &searchNode{op: "filter", field: token.field, cmp: "="}
+	text := token.text
+	for _, cmp := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(text, cmp) {
+			node.cmp = cmp
+			text = text[len(cmp):]
+			break
+		}
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		return nil, ErrSearchSyntax
+	}
+	node.value = value
+	return node, nil
+}
+
+// searchWords : the lower case words of text, split the way the full-text index splits them
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ranked : the terms that make a book rank higher, those not under a NOT
+func (n *searchNode) ranked() []*searchNode {
+	switch n.op {
+	case "term":
+		return []*searchNode{n}
+	case "and", "or":
+		var res []*searchNode
+		for _, child := range n.children {
+			res = append(res, child.ranked()...)
+		}
+		return res
+	}
+	return nil
+}
+
+// where : the SQL condition on Booklist a node stands for, and its arguments
+func (n *searchNode) where(d dialect) (string, []interface{}) {
+	switch n.op {
+	case "term":
+		return d.matchTerm(n)
+	case "filter":
+		return "(" + SearchFilters[n.field] + ") " + n.cmp + " ?", []interface{}{n.value}
+	case "not":
+		cond, args := n.children[0].where(d)
+		return "NOT " + cond, args
+	}
+	var conds []string
+	var args []interface{}
+	for _, child := range n.children {
+		cond, childArgs := child.where(d)
+		conds = append(conds, cond)
+		args = append(args, childArgs...)
+	}
+	return "(" + strings.Join(conds, " "+strings.ToUpper(n.op)+" ") + ")", args
+}
+
+// and : the query with node as one more condition
+func (q SearchQuery) and(node *searchNode) SearchQuery {
+	return SearchQuery{root: &searchNode{op: "and", children: []*searchNode{q.root, node}}}
+}
+
+// ftsTerm : a term in the FTS4 query syntax
+func ftsTerm(n *searchNode) string {
+	res := strings.Join(n.words, " ")
+	if len(n.words) > 1 {
+		res = `"` + res + `"`
+	}
+	if n.prefix {
+		res += "*"
+	}
+	if n.field != "" {
+		res = n.field + ":" + res
+	}
+	return res
+}
+
+// sqliteMatchTerm : a term looked up in the Booksearch FTS4 table
+func sqliteMatchTerm(n *searchNode) (string, []interface{}) {
+	return "Booklist.ISBN IN (SELECT book_id FROM Booksearch WHERE Booksearch MATCH ?)", []interface{}{ftsTerm(n)}
+}
+
+// sqliteRank : join the score of every book matching any of the terms
+func sqliteRank(terms []*searchNode) (string, string, []interface{}, []interface{}) {
+	if len(terms) == 0 {
+		return "", "", nil, nil
+	}
+	var match []string
+	for _, term := range terms {
+		match = append(match, ftsTerm(term))
+	}
+	join := ` LEFT JOIN (SELECT book_id, search_rank(matchinfo(Booksearch, 'pcx')) AS score
+						FROM Booksearch WHERE Booksearch MATCH ?) r ON r.book_id = Booklist.ISBN`
+	return join, "COALESCE(r.score, 0)", []interface{}{strings.Join(match, " OR ")}, nil
+}
+
+// mysqlBoolean : a term in the MySQL boolean full-text syntax
+func mysqlBoolean(n *searchNode) string {
+	res := strings.Join(n.words, " ")
+	if len(n.words) > 1 {
+		return `"` + res + `"`
+	}
+	if n.prefix {
+		res += "*"
+	}
+	return res
+}
+
+// mysqlMatchTerm : a term looked up in the FULLTEXT indexes of Booklist
+func mysqlMatchTerm(n *searchNode) (string, []interface{}) {
+	isbn := strings.Join(n.words, "")
+	if n.prefix {
+		isbn += "%"
+	}
+	switch n.field {
+	case "":
+		return "(MATCH(title, author, publisher) AGAINST(? IN BOOLEAN MODE) OR REPLACE(ISBN, '-', '') LIKE ?)",
+			[]interface{}{mysqlBoolean(n), isbn}
+	case "isbn":
+		return "REPLACE(ISBN, '-', '') LIKE ?", []interface{}{isbn}
+	}
+	return "MATCH(" + n.field + ") AGAINST(? IN BOOLEAN MODE)", []interface{}{mysqlBoolean(n)}
+}
+
+// mysqlRank : order by natural language relevance to the terms
+func mysqlRank(terms []*searchNode) (string, string, []interface{}, []interface{}) {
+	if len(terms) == 0 {
+		return "", "", nil, nil
+	}
+	var words []string
+	for _, term := range terms {
+		words = append(words, term.words...)
+	}
+	return "", "MATCH(title, author, publisher) AGAINST(?)", nil, []interface{}{strings.Join(words, " ")}
+}
+
+// searchWeights : how much a hit in each column of Booksearch counts, in column order
+var searchWeights = []float64{2, 4, 3, 1, 2}
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+	sql.Register("sqlite3_library", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("search_rank", searchRank, true)
+		},
+	})
+}
+
+// searchRank : the score of a row from its matchinfo(Booksearch, 'pcx')
+// every hit counts by the weight of its column, and by how rare the phrase is across the catalog
+func searchRank(info []byte) float64 {
+	if len(info) < 8 {
+		return 0
+	}
+	phrases := int(nativeEndian.Uint32(info[0:]))
+	columns := int(nativeEndian.Uint32(info[4:]))
+	if len(info) < 4*(2+3*phrases*columns) {
+		return 0
+	}
+	var score float64
+	for i := 0; i < phrases; i++ {
+		for j := 0; j < columns && j < len(searchWeights); j++ {
+			at := 4 * (2 + 3*(i*columns+j))
+			hits := nativeEndian.Uint32(info[at:])
+			all := nativeEndian.Uint32(info[at+4:])
+			if hits > 0 {
+				score += searchWeights[j] * float64(hits) / float64(all)
+			}
+		}
+	}
+	return score
+}
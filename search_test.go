@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	var tests = []struct {
+		testid int
+		query  string
+		err    error
+	}{
+		{0, `owens crawdads`, nil},
+		{1, `"where the crawdads"`, nil},
+		{2, `author:owens OR (title:untamed -doyle)`, nil},
+		{3, `isbn:978-0735219090 available:>=1`, nil},
+		{4, `owen* AND NOT stock:0`, nil},
+		{5, ``, ErrEmptySearch},
+		{6, `   `, ErrEmptySearch},
+		{7, `editor:owens`, ErrSearchField},
+		{8, `"where the crawdads`, ErrSearchSyntax},
+		{9, `(owens`, ErrSearchSyntax},
+		{10, `owens)`, ErrSearchSyntax},
+		{11, `OR owens`, ErrSearchSyntax},
+		{12, `owens AND`, ErrSearchSyntax},
+		{13, `available:>many`, ErrSearchSyntax},
+		{14, `title:--`, ErrSearchSyntax},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			if _, err := ParseSearch(tt.query); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	slib := newTestLibrary(t)
+	defer slib.store.Close()
+
+	for _, book := range []Books{
+		{`Where the Crawdads Sing`, `978-0735219090`, `Delia Owens`, `G.P. Putnam's Sons`, 2, 0, sql.NullString{}},
+		{`Secrets of the Savanna`, `978-0544379657`, `Mark Owens, Delia Owens`, `Mariner Books`, 1, 0, sql.NullString{}},
+		{`Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press`, 1, 0, sql.NullString{}},
+		{`Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday`, 1, 0, sql.NullString{}},
+		{`The Owl Who Was Afraid of the Dark`, `978-1405272186`, `Jill Tomlinson`, `Egmont`, 1, 0, sql.NullString{}},
+	} {
+		if _, err := slib.AddBook(ctx, book.Title, book.ISBN, book.Author, book.Publisher, book.Stock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slib.RemoveBook(ctx, `978-1405272186`, 1, WithdrawWeeded, "")
+	slib.AddUser(ctx, Users{`18307130006`, `Alicia`, `578152`, 0, 1})
+	slib.BorrowBook(ctx, `978-1984801258`, `18307130006`, time.Now())
+
+	var tests = []struct {
+		testid  int
+		query   string
+		removed bool
+		ISBNs   string
+	}{
+		{0, `owens`, false, `[978-0544379657 978-0735219090]`},
+		{1, `title:owens`, false, `[]`},
+		{2, `author:owens crawdads`, false, `[978-0735219090]`},
+		{3, `"delia owens"`, false, `[978-0544379657 978-0735219090]`},
+		{4, `crawdads OR untamed`, false, `[978-1984801258 978-0735219090]`},
+		{5, `owens -savanna`, false, `[978-0735219090]`},
+		{6, `ow*`, false, `[978-0544379657 978-0735219090]`},
+		{7, `ow*`, true, `[978-1405272186 978-0544379657 978-0735219090]`},
+		{8, `isbn:9781984801258`, false, `[978-1984801258]`},
+		{9, `isbn:978-198*`, false, `[978-1984801258]`},
+		{10, `978-0385545938`, false, `[978-0385545938]`},
+		{11, `NOT owens available:0`, false, `[978-1984801258]`},
+		{12, `(grisham OR doyle) available:>0`, false, `[978-0385545938]`},
+		{13, `stock:>=2`, false, `[978-0735219090]`},
+		{14, `dial`, false, `[978-1984801258]`},
+		{15, `1984801252`, false, `[978-1984801258]`},
+		{16, `isbn:0-385-54593-2`, false, `[978-0385545938]`},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			res, err := slib.Search(ctx, tt.query, 1, 10, tt.removed)
+			if err != nil {
+				t.Fatalf("got %v, want nil", err)
+			}
+			var ISBNs []string
+			for _, book := range res.Books {
+				ISBNs = append(ISBNs, book.ISBN)
+			}
+			if got := fmt.Sprint(ISBNs); got != tt.ISBNs && !(len(ISBNs) == 0 && tt.ISBNs == `[]`) {
+				t.Errorf("got %s, want %s", got, tt.ISBNs)
+			}
+			if res.Total != len(ISBNs) {
+				t.Errorf("got total %d, want %d", res.Total, len(ISBNs))
+			}
+		})
+	}
+
+	// pages of two, the third one empty
+	var seen = map[string]bool{}
+	for page := 1; page <= 3; page++ {
+		res, err := slib.Search(ctx, `d*`, page, 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Total != 4 || res.Pages != 2 {
+			t.Errorf("got total %d pages %d, want 4 2", res.Total, res.Pages)
+		}
+		for _, book := range res.Books {
+			seen[book.ISBN] = true
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("got %v, want four different books over two pages", seen)
+	}
+}
@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ichn-hu/IDBS-Spring20-Fudan/assignments/ass3/boilerplate/isbn"
+)
+
+// Server : HTTP/JSON front end over a Library
+// requests carry a session token from POST /sessions as "Authorization: Bearer TOKEN",
+// or HTTP basic auth for one-off calls; without either they run as a guest.
+// Every handler checks its permission through Library.Authorize, and sessions
+// that may act on anyone's loans pick the user with ?user=ID
+//
+//	POST   /sessions                       log in {"id", "password"}
+//	DELETE /sessions                       log out
+//	GET    /books?title=KEY | ?author=KEY  query books
+//	GET    /books?subject=S | ?year=Y[-Y]  query books by subject or publication year
+//	GET    /books/ISBN                     one book, with its authors, subjects, edition, year, ...
+//	GET    /search?q=QUERY&page=N&per_page=N  full-text search, best match first
+//	GET    /books/ISBN/holds               the queue of holds on a book
+//	GET    /books/ISBN/copies              the copies of a book, their status and location
+//	GET    /books/ISBN/withdrawals         copies taken out of stock, why, by whom and when
+//	POST   /users                          register {"id", "name", "password"}
+//	PUT    /users/ID/password              change password {"password"}, one's own also {"old_password"}
+//	DELETE /users/ID/sessions              revoke every session of a user
+//	POST   /users/ID/deactivate            stop a user from logging in and borrowing
+//	POST   /users/ID/reactivate            let a deactivated user back in
+//	PUT    /users/ID/expiry                set when an account expires {"expires_at"}, never if null
+//	DELETE /users/ID                       delete a user, keeping their loans anonymized
+//	GET    /users/ID/data                  everything the library holds about a user
+//	GET    /loans                          unreturned books
+//	POST   /loans                          borrow {"isbn"} or a given copy {"barcode"}
+//	DELETE /loans/ISBN                     return
+//	POST   /loans/ISBN/extend              extend the deadline
+//	POST   /loans/ISBN/lost                declare the book lost and charge for it
+//	GET    /history                        borrow history
+//	GET    /overdue                        overdue books
+//	GET    /holds                          holds and their place in the queue
+//	POST   /holds                          join the queue for a book {"isbn"}
+//	DELETE /holds/ISBN                     leave the queue
+//	GET    /fines                          balance and ledger, amounts in cents
+//	POST   /fines                          pay or waive {"kind": "payment" | "waiver", "amount", "note"}
+//	GET    /audit?user=ID&action=A&from=T&to=T  the audit log, newest first; times in RFC 3339
+type Server struct {
+	lib *Library
+	mux *http.ServeMux
+}
+
+// bookJSON : a book as the API shows it
+// isbn10 is left out for ISBN-13s that have no ISBN-10 form
+type bookJSON struct {
+	ISBN      string `json:"isbn"`
+	ISBN10    string `json:"isbn10,omitempty"`
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	Publisher string `json:"publisher"`
+	Stock     int    `json:"stock"`
+	Available int    `json:"available"`
+}
+
+// bookDetailsJSON : a book with its bibliographic record
+type bookDetailsJSON struct {
+	bookJSON
+	Authors     []string `json:"authors"`
+	Subjects    []string `json:"subjects"`
+	Edition     string   `json:"edition,omitempty"`
+	Year        int      `json:"year,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Pages       int      `json:"pages,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// loanJSON : a borrow record as the API shows it
+type loanJSON struct {
+	RecordID    string     `json:"record_id"`
+	ISBN        string     `json:"isbn"`
+	Title       string     `json:"title,omitempty"`
+	UserID      string     `json:"user_id"`
+	Returned    bool       `json:"returned"`
+	BorrowDate  time.Time  `json:"borrow_date"`
+	ReturnDate  *time.Time `json:"return_date,omitempty"`
+	Deadline    time.Time  `json:"deadline"`
+	ExtendTimes int        `json:"extend_times"`
+	Barcode     string     `json:"barcode"`
+}
+
+// copyJSON : a copy as the API shows it
+type copyJSON struct {
+	Barcode    string    `json:"barcode"`
+	Status     string    `json:"status"`
+	Location   string    `json:"location"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// withdrawalJSON : a withdrawal as the API shows it
+// record_id is only there for a book lost on loan
+type withdrawalJSON struct {
+	WithdrawalID string    `json:"withdrawal_id"`
+	ISBN         string    `json:"isbn"`
+	Copies       int       `json:"copies"`
+	Reinstated   int       `json:"reinstated"`
+	Reason       string    `json:"reason"`
+	Note         string    `json:"note,omitempty"`
+	Actor        string    `json:"actor"`
+	RecordID     string    `json:"record_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// holdJSON : a hold as the API shows it
+// position is 0 once a copy is set aside, until pickup_deadline
+type holdJSON struct {
+	ISBN           string     `json:"isbn"`
+	UserID         string     `json:"user_id"`
+	Status         string     `json:"status"`
+	Position       int        `json:"position"`
+	PlacedAt       time.Time  `json:"placed_at"`
+	PickupDeadline *time.Time `json:"pickup_deadline,omitempty"`
+}
+
+// fineJSON : a ledger entry as the API shows it
+type fineJSON struct {
+	Kind      string    `json:"kind"`
+	Amount    int       `json:"amount"`
+	ISBN      string    `json:"isbn,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// auditJSON : an audit entry as the API shows it
+type auditJSON struct {
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Origin    string          `json:"origin"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// searchJSON : a page of search results as the API shows it
+type searchJSON struct {
+	Books []bookJSON `json:"books"`
+	Total int        `json:"total"`
+	Page  int        `json:"page"`
+	Pages int        `json:"pages"`
+}
+
+// userJSON : the body of POST /users and PUT /users/ID/password
+type userJSON struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Password    string `json:"password"`
+	OldPassword string `json:"old_password,omitempty"`
+	Type        *int   `json:"type,omitempty"`
+}
+
+// errorJSON : the body of every error response
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+func toBookJSON(books []Books) []bookJSON {
+	res := []bookJSON{}
+	for _, now := range books {
+		if now.Stock > 0 {
+			isbn10, _ := isbn.To10(now.ISBN)
+			res = append(res, bookJSON{now.ISBN, isbn10, now.Title, now.Author, now.Publisher, now.Stock, now.Available})
+		}
+	}
+	return res
+}
+
+func toLoanJSON(loans []Loan) []loanJSON {
+	res := []loanJSON{}
+	for _, now := range loans {
+		loan := loanJSON{now.RecordID, now.ISBN, now.Title, now.UserID, now.Returned(), now.BorrowedAt, nil, now.Deadline, now.Renewals, now.CopyID}
+		if now.Returned() {
+			returnDate := now.ReturnedAt
+			loan.ReturnDate = &returnDate
+		}
+		res = append(res, loan)
+	}
+	return res
+}
+
+func toCopyJSON(copies []Copy) []copyJSON {
+	res := []copyJSON{}
+	for _, now := range copies {
+		res = append(res, copyJSON{now.Barcode, now.Status, now.Location, now.AcquiredAt})
+	}
+	return res
+}
+
+func toWithdrawalJSON(withdrawals []Withdrawal) []withdrawalJSON {
+	res := []withdrawalJSON{}
+	for _, now := range withdrawals {
+		res = append(res, withdrawalJSON{now.WithdrawalID, now.ISBN, now.Copies, now.Reinstated, now.Reason,
+			now.Note, now.Actor, now.RecordID.String, now.CreatedAt})
+	}
+	return res
+}
+
+func toFineJSON(entries []FineEntry) []fineJSON {
+	res := []fineJSON{}
+	for _, now := range entries {
+		res = append(res, fineJSON{now.Kind, now.Amount, now.ISBN.String, now.Note.String, now.Actor, now.CreatedAt})
+	}
+	return res
+}
+
+func toHoldJSON(ctx context.Context, lib *Library, holds []Hold) ([]holdJSON, error) {
+	res := []holdJSON{}
+	for _, now := range holds {
+		position, err := lib.QueuePosition(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+		hold := holdJSON{now.ISBN, now.UserID, now.Status, position, now.PlacedAt, nil}
+		if now.PickupDeadline.Valid {
+			pickupDeadline := now.PickupDeadline.Time
+			hold.PickupDeadline = &pickupDeadline
+		}
+		res = append(res, hold)
+	}
+	return res, nil
+}
+
+func toAuditJSON(entries []AuditEntry) []auditJSON {
+	res := []auditJSON{}
+	for _, now := range entries {
+		entry := auditJSON{Actor: now.Actor, Action: now.Action, Target: now.Target, Origin: now.Origin, CreatedAt: now.CreatedAt}
+		if now.Before != "" {
+			entry.Before = json.RawMessage(now.Before)
+		}
+		if now.After != "" {
+			entry.After = json.RawMessage(now.After)
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+// NewServer : route the API to lib
+func NewServer(lib *Library) *Server {
+	s := &Server{lib: lib.As(lib.actor, OriginAPI), mux: http.NewServeMux()}
+	s.mux.HandleFunc("/sessions", s.handleSessions)
+	s.mux.HandleFunc("/books", s.handleBooks)
+	s.mux.HandleFunc("/books/", s.handleBook)
+	s.mux.HandleFunc("/search", s.handleSearch)
+	s.mux.HandleFunc("/users", s.handleUsers)
+	s.mux.HandleFunc("/users/", s.handleUser)
+	s.mux.HandleFunc("/loans", s.handleLoans)
+	s.mux.HandleFunc("/loans/", s.handleLoan)
+	s.mux.HandleFunc("/history", s.handleHistory)
+	s.mux.HandleFunc("/overdue", s.handleOverdue)
+	s.mux.HandleFunc("/holds", s.handleHolds)
+	s.mux.HandleFunc("/holds/", s.handleHold)
+	s.mux.HandleFunc("/fines", s.handleFines)
+	s.mux.HandleFunc("/audit", s.handleAudit)
+	return s
+}
+
+// statusWriter : a response writer remembering the status it was given
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{w, http.StatusOK}
+	s.mux.ServeHTTP(sw, r)
+	s.lib.log().Info("Request served.", F("op", "http"), F("method", r.Method), F("path", r.URL.Path),
+		F("status", sw.status), F("duration", time.Since(start)))
+}
+
+// Serve : run the API on l until a signal arrives on stop or ctx is done, then shut down gracefully
+func (lib *Library) Serve(ctx context.Context, l net.Listener, stop <-chan os.Signal) error {
+	srv := &http.Server{
+		Handler:      NewServer(lib),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		// requests are cancelled with ctx, and each when its client goes away
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+	logger := lib.log().With(F("op", "serve"))
+	logger.Info("Serving.", F("addr", l.Addr()))
+
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down.")
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdown)
+}
+
+// statusOf : the HTTP status code an error, or the error it wraps, maps to
+func statusOf(err error) int {
+	switch {
+	case isAny(err, ErrBookNotExists, ErrUserNotExists, ErrNotBorrowed, ErrNoHold, ErrCopyNotExists):
+		return http.StatusNotFound
+	case isAny(err, ErrBookNotAvailable, ErrAlreadyBorrowed, ErrNoMoreExtended, ErrAllRemoved, ErrUserExists,
+		ErrNotLoanable, ErrTooManyLoans, ErrAlreadyHeld, ErrBookAvailable, ErrInvalidAmount,
+		ErrCopyExists, ErrCopyStatus, ErrUnreturnedBooks):
+		return http.StatusConflict
+	case isAny(err, ErrPassword, ErrNotLoggedIn, ErrSessionInvalid, ErrSessionExpired):
+		return http.StatusUnauthorized
+	case isAny(err, ErrUserSuspended, ErrPermissionDenied, ErrFinesOutstanding, ErrAccountInactive, ErrAccountExpired):
+		return http.StatusForbidden
+	case isAny(err, errBadRequest, ErrSearchSyntax, ErrSearchField, ErrEmptySearch, isbn.ErrInvalid, ErrDateRange,
+		ErrWithdrawalReason):
+		return http.StatusBadRequest
+	case isAny(err, errMethod):
+		return http.StatusMethodNotAllowed
+	case isAny(err, ErrTimeout, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+var errBadRequest = errors.New("Malformed request.")
+var errMethod = errors.New("Method not allowed.")
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	status := statusOf(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="library"`)
+	}
+	// the request already says which book and user it is about
+	msg := err.Error()
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		msg = opErr.Err.Error()
+	}
+	switch status {
+	case http.StatusInternalServerError:
+		s.lib.log().Error("Request failed.", F("error", err))
+		msg = http.StatusText(status)
+	case http.StatusServiceUnavailable:
+		msg = ErrTimeout.Error()
+	}
+	writeJSON(w, status, errorJSON{msg})
+}
+
+// session : the session behind a request, a guest's if it has no credentials
+func (s *Server) session(r *http.Request) (Session, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return s.lib.Authenticate(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+	}
+	if id, password, ok := r.BasicAuth(); ok {
+		user, err := s.lib.IdentifyUser(r.Context(), id, password)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{UserID: user.ID, Name: user.Name, Role: Role(user.Type)}, nil
+	}
+	return GuestSession(), nil
+}
+
+// authorize : the session behind a request, if it grants p
+func (s *Server) authorize(r *http.Request, p Permission) (Session, error) {
+	session, err := s.session(r)
+	if err != nil {
+		return session, err
+	}
+	return session, s.lib.Authorize(session, p)
+}
+
+// actingOn : the session behind a request and the user whose loans it applies to,
+// the caller unless ?user= says otherwise
+func (s *Server) actingOn(r *http.Request) (Session, string, error) {
+	session, err := s.session(r)
+	if err != nil {
+		return session, "", err
+	}
+	target := r.URL.Query().Get("user")
+	if target == "" {
+		target = session.UserID
+	}
+	if err := s.lib.AuthorizeFor(session, target, PermOwnLoans, PermAnyLoans); err != nil {
+		return session, "", err
+	}
+	return session, target, s.lib.CheckUserExists(r.Context(), target)
+}
+
+// as : the library acting for a session, so that what a request changes is audited under its user
+func (s *Server) as(session Session) *Library {
+	return s.lib.As(session.UserID, OriginAPI)
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req userJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		session, err := s.lib.Login(r.Context(), req.ID, req.Password)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct {
+			Token     string    `json:"token"`
+			UserID    string    `json:"user_id"`
+			Role      string    `json:"role"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{session.Token, session.UserID, session.Role.String(), session.ExpiresAt})
+	case http.MethodDelete:
+		session, err := s.session(r)
+		if err == nil && session.Token == "" {
+			err = ErrSessionInvalid
+		}
+		if err == nil {
+			err = s.lib.Logout(r.Context(), session.Token)
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, errMethod)
+	}
+}
+
+func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	if _, err := s.authorize(r, PermQueryBooks); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	var res []Books
+	var err error
+	query := r.URL.Query()
+	if title := query.Get("title"); title != "" {
+		res, err = s.lib.QueryBookTitle(r.Context(), title)
+	} else if author := query.Get("author"); author != "" {
+		res, err = s.lib.QueryBookAuthor(r.Context(), author)
+	} else if subject := query.Get("subject"); subject != "" {
+		res, err = s.lib.QueryBookSubject(r.Context(), subject)
+	} else if year := query.Get("year"); year != "" {
+		// one year, or a range FROM-TO
+		bounds := strings.SplitN(year, "-", 2)
+		from, fromErr := strconv.Atoi(bounds[0])
+		to, toErr := from, error(nil)
+		if len(bounds) == 2 {
+			to, toErr = strconv.Atoi(bounds[1])
+		}
+		if fromErr != nil || toErr != nil {
+			err = errBadRequest
+		} else {
+			res, err = s.lib.QueryBookYear(r.Context(), from, to)
+		}
+	} else {
+		err = errBadRequest
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toBookJSON(res))
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	if _, err := s.authorize(r, PermQueryBooks); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	page, perPage := 1, SearchPageSize
+	var err error
+	if v := query.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			s.writeError(w, errBadRequest)
+			return
+		}
+	}
+	if v := query.Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 || perPage > 100 {
+			s.writeError(w, errBadRequest)
+			return
+		}
+	}
+	res, err := s.lib.Search(r.Context(), query.Get("q"), page, perPage, false)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, searchJSON{toBookJSON(res.Books), res.Total, res.Page, res.Pages})
+}
+
+func (s *Server) handleBook(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/books/"), "/")
+	ISBN := parts[0]
+	holds := len(parts) == 2 && parts[1] == "holds"
+	copies := len(parts) == 2 && parts[1] == "copies"
+	withdrawals := len(parts) == 2 && parts[1] == "withdrawals"
+	if ISBN == "" || len(parts) > 2 || (len(parts) == 2 && !holds && !copies && !withdrawals) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+
+	if holds {
+		if _, err := s.authorize(r, PermAnyLoans); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		queue, err := s.lib.BookQueue(r.Context(), ISBN)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		res, err := toHoldJSON(r.Context(), s.lib, queue)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if copies {
+		if _, err := s.authorize(r, PermManageBooks); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		res, err := s.lib.Copies(r.Context(), ISBN)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toCopyJSON(res))
+		return
+	}
+
+	if withdrawals {
+		if _, err := s.authorize(r, PermManageBooks); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		res, err := s.lib.Withdrawals(r.Context(), ISBN)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toWithdrawalJSON(res))
+		return
+	}
+
+	if _, err := s.authorize(r, PermQueryBooks); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	res, err := s.lib.QueryBookISBN(r.Context(), ISBN)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	details, err := s.lib.QueryBookDetails(r.Context(), ISBN)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bookDetailsJSON{toBookJSON(res)[0], details.Authors, details.Subjects,
+		details.Edition, details.Year, details.Language, details.Pages, details.Description})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, errMethod)
+		return
+	}
+	var req userJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Name == "" || req.Password == "" {
+		s.writeError(w, errBadRequest)
+		return
+	}
+
+	user := Users{ID: req.ID, Name: req.Name, Password: req.Password, Type: 1}
+	// readers register themselves
+	lib := s.lib.As(user.ID, OriginAPI)
+	if req.Type != nil {
+		// only those who manage users may choose the user mode
+		session, err := s.authorize(r, PermManageUsers)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		user.Type = *req.Type
+		lib = s.as(session)
+	}
+
+	err := s.lib.CheckUserExists(r.Context(), user.ID)
+	if err == nil {
+		err = ErrUserExists
+	} else if errors.Is(err, ErrUserNotExists) {
+		err = lib.AddUser(r.Context(), user)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, userJSON{ID: user.ID, Name: user.Name, Type: &user.Type})
+}
+
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	if len(parts) == 1 || parts[1] == "deactivate" || parts[1] == "reactivate" || parts[1] == "expiry" {
+		s.handleAccount(w, r, parts)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "data" {
+		s.handleUserData(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 || (parts[1] != "password" && parts[1] != "sessions") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if parts[1] == "sessions" {
+		if r.Method != http.MethodDelete {
+			s.writeError(w, errMethod)
+			return
+		}
+		session, err := s.authorize(r, PermManageUsers)
+		if err == nil {
+			err = s.as(session).RevokeSessions(r.Context(), parts[0])
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		s.writeError(w, errMethod)
+		return
+	}
+	session, err := s.session(r)
+	if err == nil {
+		err = s.lib.AuthorizeFor(session, parts[0], PermOwnPassword, PermManageUsers)
+	}
+	if err == nil {
+		err = s.lib.CheckUserExists(r.Context(), parts[0])
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	var req userJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		s.writeError(w, errBadRequest)
+		return
+	}
+	// a token alone must not be enough to take over an account for good, as with pw
+	if parts[0] == session.UserID {
+		if req.OldPassword == "" {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		if _, err := s.lib.IdentifyUser(r.Context(), session.UserID, req.OldPassword); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+	if err := s.as(session).ModifyPassword(r.Context(), parts[0], req.Password); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if parts[0] != session.UserID {
+		// a password reset by someone else ends the old sessions
+		s.as(session).RevokeSessions(r.Context(), parts[0])
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAccount : DELETE /users/ID, POST /users/ID/deactivate or reactivate, PUT /users/ID/expiry
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) > 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	method := http.MethodPost
+	if len(parts) == 1 {
+		method = http.MethodDelete
+	} else if parts[1] == "expiry" {
+		method = http.MethodPut
+	}
+	if r.Method != method {
+		s.writeError(w, errMethod)
+		return
+	}
+	session, err := s.authorize(r, PermManageUsers)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	lib := s.as(session)
+	switch {
+	case len(parts) == 1:
+		err = lib.DeleteUser(r.Context(), parts[0])
+	case parts[1] == "deactivate":
+		err = lib.DeactivateUser(r.Context(), parts[0])
+	case parts[1] == "reactivate":
+		err = lib.ReactivateUser(r.Context(), parts[0])
+	default:
+		// a null or missing expires_at means never
+		var req struct {
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		var expiresAt time.Time
+		if req.ExpiresAt != nil {
+			expiresAt = *req.ExpiresAt
+		}
+		err = lib.SetUserExpiry(r.Context(), parts[0], expiresAt)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUserData : GET /users/ID/data, everything the library holds about a user
+func (s *Server) handleUserData(w http.ResponseWriter, r *http.Request, userID string) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	session, err := s.session(r)
+	if err == nil {
+		err = s.lib.AuthorizeFor(session, userID, PermOwnData, PermManageUsers)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	// nothing is sent before the export is complete, so that a failure is still an error status
+	var buf bytes.Buffer
+	if err := s.as(session).ExportUserData(r.Context(), &buf, userID); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	buf.WriteTo(w)
+}
+
+func (s *Server) handleLoans(w http.ResponseWriter, r *http.Request) {
+	session, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		res, err := s.lib.CheckUnreturned(r.Context(), userID)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toLoanJSON(res))
+	case http.MethodPost:
+		var req struct {
+			ISBN    string `json:"isbn"`
+			Barcode string `json:"barcode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ISBN == "") == (req.Barcode == "") {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		var loan Loan
+		_, _, err := s.as(session).CheckOverdue(r.Context(), userID, s.lib.now())
+		if err == nil && req.Barcode != "" {
+			loan, err = s.as(session).BorrowCopy(r.Context(), req.Barcode, userID, s.lib.now())
+		} else if err == nil {
+			loan, err = s.as(session).BorrowBook(r.Context(), req.ISBN, userID, s.lib.now())
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, toLoanJSON([]Loan{loan})[0])
+	default:
+		s.writeError(w, errMethod)
+	}
+}
+
+func (s *Server) handleLoan(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/loans/"), "/")
+	ISBN := parts[0]
+	extend := len(parts) == 2 && parts[1] == "extend"
+	lost := len(parts) == 2 && parts[1] == "lost"
+	if ISBN == "" || len(parts) > 2 || (len(parts) == 2 && !extend && !lost) {
+		http.NotFound(w, r)
+		return
+	}
+	if (len(parts) == 2 && r.Method != http.MethodPost) || (len(parts) == 1 && r.Method != http.MethodDelete) {
+		s.writeError(w, errMethod)
+		return
+	}
+
+	session, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if lost {
+		session, err := s.authorize(r, PermManageBooks)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		if err := s.as(session).DeclareLost(r.Context(), ISBN, userID, session.UserID); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !extend {
+		if _, err := s.as(session).ReturnBook(r.Context(), ISBN, userID); err != nil {
+			s.writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, _, err := s.as(session).CheckOverdue(r.Context(), userID, s.lib.now()); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	loan, err := s.as(session).ExtendDeadline(r.Context(), ISBN, userID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toLoanJSON([]Loan{loan})[0])
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	_, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	res, err := s.lib.CheckBorrowHistory(r.Context(), userID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toLoanJSON(res))
+}
+
+func (s *Server) handleOverdue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	session, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	overdue, res, err := s.as(session).CheckOverdue(r.Context(), userID, s.lib.now())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	suspended, err := s.lib.CheckSuspended(r.Context(), userID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Overdue   int        `json:"overdue"`
+		Suspended bool       `json:"suspended"`
+		Loans     []loanJSON `json:"loans"`
+	}{overdue, suspended, toLoanJSON(res)})
+}
+
+func (s *Server) handleHolds(w http.ResponseWriter, r *http.Request) {
+	session, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		holds, err := s.lib.UserHolds(r.Context(), userID)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		res, err := toHoldJSON(r.Context(), s.lib, holds)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		var req struct {
+			ISBN string `json:"isbn"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ISBN == "" {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		hold, err := s.as(session).PlaceHold(r.Context(), req.ISBN, userID, s.lib.now())
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		res, err := toHoldJSON(r.Context(), s.lib, []Hold{hold})
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, res[0])
+	default:
+		s.writeError(w, errMethod)
+	}
+}
+
+func (s *Server) handleHold(w http.ResponseWriter, r *http.Request) {
+	ISBN := strings.TrimPrefix(r.URL.Path, "/holds/")
+	if ISBN == "" || strings.Contains(ISBN, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		s.writeError(w, errMethod)
+		return
+	}
+	session, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if err := s.as(session).CancelHold(r.Context(), ISBN, userID); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleFines(w http.ResponseWriter, r *http.Request) {
+	_, userID, err := s.actingOn(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		session, err := s.authorize(r, PermManageFines)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		var req struct {
+			Kind   string `json:"kind"`
+			Amount int    `json:"amount"`
+			Note   string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, errBadRequest)
+			return
+		}
+		switch req.Kind {
+		case FinePayment:
+			err = s.as(session).PayFine(r.Context(), userID, req.Amount, session.UserID)
+		case FineWaiver:
+			err = s.as(session).WaiveFine(r.Context(), userID, req.Amount, req.Note, session.UserID)
+		default:
+			err = errBadRequest
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+	default:
+		s.writeError(w, errMethod)
+		return
+	}
+
+	balance, entries, err := s.lib.Fines(r.Context(), userID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Balance int        `json:"balance"`
+		Entries []fineJSON `json:"entries"`
+	}{balance, toFineJSON(entries)})
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, errMethod)
+		return
+	}
+	if _, err := s.authorize(r, PermAudit); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	filter := AuditFilter{User: query.Get("user"), Action: query.Get("action")}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				s.writeError(w, errBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+	entries, err := s.lib.Audit(r.Context(), filter)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAuditJSON(entries))
+}
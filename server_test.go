@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestServer : an API over a fresh library with a few books and users
+func newTestServer(t *testing.T) (*httptest.Server, *Library) {
+	slib := newTestLibrary(t)
+	users := []Users{
+		{`root`, `admin`, `root`, 0, 0},
+		{`18307130006`, `Alicia`, `578152`, 0, 1},
+		{`18307130068`, `Brandon`, `987430`, 0, 1},
+		{`librarian`, `Lydia`, `shelves`, 0, 3},
+	}
+	for _, user := range users {
+		if err := slib.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := slib.AddBook(ctx, `Camino Winds`, `978-0385545938`, `John Grisham`, `Doubleday (April 28, 2020)`, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slib.AddBook(ctx, `Untamed`, `978-1984801258`, `Glennon Doyle`, `The Dial Press (March 10, 2020)`, 2); err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(NewServer(slib)), slib
+}
+
+// do : send a request as user (no auth if user is empty) and decode the JSON reply into out
+func do(t *testing.T, ts *httptest.Server, method, path, user, password, body string, out interface{}) int {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var tests = []struct {
+		testid         int
+		method, path   string
+		user, password string
+		body           string
+		status         int
+	}{
+		{0, "GET", "/books?title=camino", "", "", "", http.StatusOK},
+		{1, "GET", "/books?author=doyle", "", "", "", http.StatusOK},
+		{2, "GET", "/books", "", "", "", http.StatusBadRequest},
+		{3, "GET", "/books/978-0385545938", "", "", "", http.StatusOK},
+		{4, "GET", "/books/123-1234567890", "", "", "", http.StatusNotFound},
+		{5, "POST", "/books/978-0385545938", "", "", "", http.StatusMethodNotAllowed},
+		{6, "GET", "/loans", "", "", "", http.StatusUnauthorized},
+		{7, "GET", "/loans", "18307130006", "wrong", "", http.StatusUnauthorized},
+		{8, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-0385545938"}`, http.StatusCreated},
+		{9, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-0385545938"}`, http.StatusConflict},
+		{10, "POST", "/loans", "18307130068", "987430", `{"isbn": "978-0385545938"}`, http.StatusConflict},
+		{11, "POST", "/loans", "18307130068", "987430", `{"isbn": "123-1234567890"}`, http.StatusNotFound},
+		{12, "POST", "/loans", "18307130068", "987430", `not json`, http.StatusBadRequest},
+		{13, "GET", "/loans", "18307130006", "578152", "", http.StatusOK},
+		{14, "POST", "/loans/978-0385545938/extend", "18307130006", "578152", "", http.StatusOK},
+		{15, "POST", "/loans/978-0385545938/extend", "18307130068", "987430", "", http.StatusNotFound},
+		{16, "GET", "/loans?user=18307130006", "18307130068", "987430", "", http.StatusForbidden},
+		{17, "GET", "/loans?user=18307130006", "root", "root", "", http.StatusOK},
+		{18, "GET", "/loans?user=nobody", "root", "root", "", http.StatusNotFound},
+		{19, "DELETE", "/loans/978-0385545938", "18307130068", "987430", "", http.StatusNotFound},
+		{20, "DELETE", "/loans/978-0385545938?user=18307130006", "root", "root", "", http.StatusNoContent},
+		{21, "DELETE", "/loans/978-0385545938", "18307130006", "578152", "", http.StatusNotFound},
+		{22, "GET", "/history", "18307130006", "578152", "", http.StatusOK},
+		{23, "GET", "/overdue", "18307130006", "578152", "", http.StatusOK},
+		{24, "POST", "/users", "", "", `{"id": "18307130078", "name": "Cary", "password": "15652"}`, http.StatusCreated},
+		{25, "POST", "/users", "", "", `{"id": "18307130078", "name": "Cary", "password": "15652"}`, http.StatusConflict},
+		{26, "POST", "/users", "", "", `{"id": "18307130091", "name": "Doreen", "password": "740509", "type": 0}`, http.StatusUnauthorized},
+		{27, "POST", "/users", "18307130078", "15652", `{"id": "18307130091", "name": "Doreen", "password": "740509", "type": 0}`, http.StatusForbidden},
+		{28, "POST", "/users", "root", "root", `{"id": "18307130091", "name": "Doreen", "password": "740509", "type": 0}`, http.StatusCreated},
+		{29, "PUT", "/users/18307130078/password", "18307130078", "15652", `{"password": "new", "old_password": "15652"}`, http.StatusNoContent},
+		{30, "GET", "/loans", "18307130078", "new", "", http.StatusOK},
+		{31, "PUT", "/users/18307130006/password", "18307130078", "new", `{"password": "x"}`, http.StatusForbidden},
+		{32, "PUT", "/users/18307130006/password", "root", "root", `{"password": "x"}`, http.StatusNoContent},
+		{33, "POST", "/loans?user=18307130068", "librarian", "shelves", `{"isbn": "978-1984801258"}`, http.StatusCreated},
+		{34, "POST", "/users", "librarian", "shelves", `{"id": "x", "name": "x", "password": "x", "type": 0}`, http.StatusForbidden},
+		{35, "DELETE", "/users/18307130068/sessions", "librarian", "shelves", "", http.StatusForbidden},
+		{36, "DELETE", "/users/18307130068/sessions", "root", "root", "", http.StatusNoContent},
+		{37, "POST", "/sessions", "", "", `{"id": "18307130068", "password": "wrong"}`, http.StatusUnauthorized},
+		{38, "DELETE", "/sessions", "", "", "", http.StatusUnauthorized},
+		{39, "PUT", "/users/18307130078/password", "18307130078", "new", `{"password": "y"}`, http.StatusBadRequest},
+		{40, "PUT", "/users/18307130078/password", "18307130078", "new", `{"password": "y", "old_password": "15652"}`, http.StatusUnauthorized},
+		{41, "GET", "/loans", "18307130078", "new", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			status := do(t, ts, tt.method, tt.path, tt.user, tt.password, tt.body, nil)
+			if status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestServerBodies(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var books []bookJSON
+	do(t, ts, "GET", "/books?title=untamed", "", "", "", &books)
+	if len(books) != 1 || books[0].ISBN != `978-1984801258` || books[0].Available != 2 {
+		t.Errorf("got %+v", books)
+	}
+
+	var loan loanJSON
+	do(t, ts, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-1984801258"}`, &loan)
+	if loan.ISBN != `978-1984801258` || loan.UserID != `18307130006` || loan.Returned || !loan.Deadline.After(loan.BorrowDate) {
+		t.Errorf("got %+v", loan)
+	}
+
+	var loans []loanJSON
+	do(t, ts, "GET", "/loans", "18307130006", "578152", "", &loans)
+	if len(loans) != 1 || loans[0].RecordID != loan.RecordID {
+		t.Errorf("got %+v, want [%+v]", loans, loan)
+	}
+
+	var failure errorJSON
+	status := do(t, ts, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-1984801258"}`, &failure)
+	if status != http.StatusConflict || failure.Error != ErrAlreadyBorrowed.Error() {
+		t.Errorf("got %d %q, want %d %q", status, failure.Error, http.StatusConflict, ErrAlreadyBorrowed)
+	}
+}
+
+func TestServerHolds(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var tests = []struct {
+		testid         int
+		method, path   string
+		user, password string
+		body           string
+		status         int
+	}{
+		{0, "POST", "/holds", "18307130006", "578152", `{"isbn": "978-0385545938"}`, http.StatusConflict},
+		{1, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-0385545938"}`, http.StatusCreated},
+		{2, "POST", "/holds", "18307130068", "987430", `{"isbn": "978-0385545938"}`, http.StatusCreated},
+		{3, "POST", "/holds", "18307130068", "987430", `{"isbn": "978-0385545938"}`, http.StatusConflict},
+		{4, "GET", "/holds", "18307130068", "987430", "", http.StatusOK},
+		{5, "GET", "/books/978-0385545938/holds", "18307130068", "987430", "", http.StatusForbidden},
+		{6, "GET", "/books/978-0385545938/holds", "librarian", "shelves", "", http.StatusOK},
+		{7, "GET", "/books/978-0385545938/other", "librarian", "shelves", "", http.StatusNotFound},
+		{8, "POST", "/loans", "librarian", "shelves", `{"isbn": "978-0385545938"}`, http.StatusConflict},
+		{9, "DELETE", "/holds/978-0385545938", "librarian", "shelves", "", http.StatusNotFound},
+		{10, "DELETE", "/holds/978-0385545938", "18307130068", "987430", "", http.StatusNoContent},
+		{11, "GET", "/holds/978-0385545938", "18307130068", "987430", "", http.StatusMethodNotAllowed},
+		{12, "POST", "/holds", "18307130068", "987430", `{"isbn": "9780385545938"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			status := do(t, ts, tt.method, tt.path, tt.user, tt.password, tt.body, nil)
+			if status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	var holds []holdJSON
+	do(t, ts, "POST", "/holds", "18307130068", "987430", `{"isbn": "978-0385545938"}`, nil)
+	do(t, ts, "DELETE", "/loans/978-0385545938", "18307130006", "578152", "", nil)
+	do(t, ts, "GET", "/holds", "18307130068", "987430", "", &holds)
+	if len(holds) != 1 || holds[0].Status != HoldReady || holds[0].Position != 0 || holds[0].PickupDeadline == nil {
+		t.Errorf("got %+v, want one ready hold", holds)
+	}
+}
+
+func TestServerSearch(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var tests = []struct {
+		testid int
+		path   string
+		status int
+		total  int
+	}{
+		{0, "/search?q=doyle", http.StatusOK, 1},
+		{1, "/search?q=winds+OR+untamed&per_page=1&page=2", http.StatusOK, 2},
+		{2, "/search?q=editor:doyle", http.StatusBadRequest, 0},
+		{3, "/search?q=", http.StatusBadRequest, 0},
+		{4, "/search?q=doyle&page=0", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var res searchJSON
+			status := do(t, ts, "GET", tt.path, "", "", "", &res)
+			if status != tt.status || res.Total != tt.total {
+				t.Errorf("got %d %d, want %d %d", status, res.Total, tt.status, tt.total)
+			}
+		})
+	}
+}
+
+func TestServerBookDetails(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	err := slib.SetBookDetails(ctx, BookDetails{ISBN: `978-0385545938`, Authors: []string{`John Grisham`},
+		Subjects: []string{`Thrillers`}, Year: 2020, Pages: 304})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		testid int
+		path   string
+		status int
+		books  int
+	}{
+		{0, "/books?subject=thrillers", http.StatusOK, 1},
+		{1, "/books?year=2020", http.StatusOK, 2},
+		{2, "/books?year=2000-2019", http.StatusOK, 0},
+		{3, "/books?year=recent", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var res []bookJSON
+			status := do(t, ts, "GET", tt.path, "", "", "", &res)
+			if status != tt.status || len(res) != tt.books {
+				t.Errorf("got %d %d, want %d %d", status, len(res), tt.status, tt.books)
+			}
+		})
+	}
+
+	var book bookDetailsJSON
+	do(t, ts, "GET", "/books/0385545932", "", "", "", &book)
+	if book.ISBN != `978-0385545938` || fmt.Sprint(book.Authors, book.Subjects, book.Year, book.Pages) != `[John Grisham] [Thrillers] 2020 304` {
+		t.Errorf("got %+v, want the book with its details", book)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	do(t, ts, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-0385545938"}`, nil)
+
+	var tests = []struct {
+		testid         int
+		path           string
+		user, password string
+		status         int
+		entries        int
+	}{
+		{0, "/audit?action=loan", "root", "root", http.StatusOK, 1},
+		{1, "/audit?user=18307130006", "root", "root", http.StatusOK, 2},
+		{2, "/audit?from=2020-05-10T14:00:00Z&to=2020-05-11T00:00:00Z", "root", "root", http.StatusOK, 0},
+		{3, "/audit?from=yesterday", "root", "root", http.StatusBadRequest, 0},
+		{4, "/audit", "librarian", "shelves", http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var res []auditJSON
+			status := do(t, ts, "GET", tt.path, tt.user, tt.password, "", &res)
+			if status != tt.status || len(res) != tt.entries {
+				t.Errorf("got %d %d, want %d %d", status, len(res), tt.status, tt.entries)
+			}
+			if tt.testid == 0 && len(res) == 1 && (res[0].Actor != "18307130006" || res[0].Origin != OriginAPI) {
+				t.Errorf("got %+v, want the reader over the API", res[0])
+			}
+		})
+	}
+}
+
+func TestServerCopies(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var tests = []struct {
+		testid         int
+		method, path   string
+		user, password string
+		body           string
+		status         int
+	}{
+		{0, "GET", "/books/978-1984801258/copies", "18307130006", "578152", "", http.StatusForbidden},
+		{1, "GET", "/books/978-1984801258/copies", "librarian", "shelves", "", http.StatusOK},
+		{2, "GET", "/books/978-0000000000/copies", "librarian", "shelves", "", http.StatusNotFound},
+		{3, "POST", "/loans", "18307130006", "578152", `{"barcode": "978-1984801258-2"}`, http.StatusCreated},
+		{4, "POST", "/loans", "18307130068", "987430", `{"barcode": "978-1984801258-2"}`, http.StatusConflict},
+		{5, "POST", "/loans", "18307130068", "987430", `{"barcode": "nowhere"}`, http.StatusNotFound},
+		{6, "POST", "/loans", "18307130068", "987430", `{"isbn": "978-1984801258", "barcode": "978-1984801258-1"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			status := do(t, ts, tt.method, tt.path, tt.user, tt.password, tt.body, nil)
+			if status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	var loans []loanJSON
+	do(t, ts, "GET", "/loans", "18307130006", "578152", "", &loans)
+	if len(loans) != 1 || loans[0].Barcode != "978-1984801258-2" {
+		t.Errorf("got %+v, want the loan of 978-1984801258-2", loans)
+	}
+	var copies []copyJSON
+	do(t, ts, "GET", "/books/978-1984801258/copies", "librarian", "shelves", "", &copies)
+	if len(copies) != 2 || copies[0].Status != CopyShelf || copies[1].Status != CopyLoan {
+		t.Errorf("got %+v, want one copy on the shelf and one on loan", copies)
+	}
+}
+
+func TestServerFines(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var tests = []struct {
+		testid         int
+		method, path   string
+		user, password string
+		body           string
+		status         int
+	}{
+		{0, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-0385545938"}`, http.StatusCreated},
+		{1, "POST", "/loans/978-0385545938/lost", "18307130006", "578152", "", http.StatusForbidden},
+		{2, "DELETE", "/loans/978-0385545938/lost?user=18307130006", "librarian", "shelves", "", http.StatusMethodNotAllowed},
+		{3, "POST", "/loans/978-0385545938/lost?user=18307130006", "librarian", "shelves", "", http.StatusNoContent},
+		{4, "GET", "/fines", "18307130006", "578152", "", http.StatusOK},
+		{5, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-1984801258"}`, http.StatusForbidden},
+		{6, "POST", "/fines", "18307130006", "578152", `{"kind": "payment", "amount": 5000}`, http.StatusForbidden},
+		{7, "POST", "/fines?user=18307130006", "librarian", "shelves", `{"kind": "refund", "amount": 5000}`, http.StatusBadRequest},
+		{8, "POST", "/fines?user=18307130006", "librarian", "shelves", `{"kind": "payment", "amount": 9000}`, http.StatusConflict},
+		{9, "POST", "/fines?user=18307130006", "librarian", "shelves", `{"kind": "payment", "amount": 4000}`, http.StatusOK},
+		{10, "POST", "/fines?user=18307130006", "root", "root", `{"kind": "waiver", "amount": 1000, "note": "x"}`, http.StatusOK},
+		{11, "POST", "/loans", "18307130006", "578152", `{"isbn": "978-1984801258"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			status := do(t, ts, tt.method, tt.path, tt.user, tt.password, tt.body, nil)
+			if status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	var fines struct {
+		Balance int        `json:"balance"`
+		Entries []fineJSON `json:"entries"`
+	}
+	do(t, ts, "GET", "/fines", "18307130006", "578152", "", &fines)
+	if fines.Balance != 0 || len(fines.Entries) != 3 || fines.Entries[0].Amount != 5000 {
+		t.Errorf("got %+v", fines)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	ts, slib := newTestServer(t)
+	defer ts.Close()
+	defer slib.store.Close()
+
+	var login struct {
+		Token string `json:"token"`
+		Role  string `json:"role"`
+	}
+	status := do(t, ts, "POST", "/sessions", "", "", `{"id": "18307130068", "password": "987430"}`, &login)
+	if status != http.StatusCreated || login.Token == "" || login.Role != "reader" {
+		t.Fatalf("got %d %+v", status, login)
+	}
+
+	bearer := func(method, path string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := bearer("GET", "/loans"); status != http.StatusOK {
+		t.Errorf("got %d, want %d", status, http.StatusOK)
+	}
+	if status := bearer("GET", "/loans?user=18307130006"); status != http.StatusForbidden {
+		t.Errorf("got %d, want %d", status, http.StatusForbidden)
+	}
+	if status := bearer("DELETE", "/sessions"); status != http.StatusNoContent {
+		t.Errorf("got %d, want %d", status, http.StatusNoContent)
+	}
+	if status := bearer("GET", "/loans"); status != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d after logout", status, http.StatusUnauthorized)
+	}
+	if status := bearer("GET", "/books?title=the"); status != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d for a dead token", status, http.StatusUnauthorized)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	slib := newTestLibrary(t)
+	defer slib.store.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- slib.Serve(ctx, l, stop)
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/books?title=the")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	stop <- os.Interrupt
+	if err := <-done; err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/books?title=the"); err == nil {
+		t.Errorf("server still accepting connections after shutdown")
+	}
+}
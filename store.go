@@ -0,0 +1,1434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// mysql connector
+	_ "github.com/go-sql-driver/mysql"
+	sqlx "github.com/jmoiron/sqlx"
+
+	// sqlite connector
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store : the persistence layer behind Library
+// every book, user and record operation Library needs goes through it,
+// so the same Library can run against MySQL or an embedded SQLite file
+type Store interface {
+	SchemaVersions() (map[int]time.Time, error)
+	ApplyMigration(m Migration, up bool) error
+	WithTx(fn func(Store) error) error
+	WithContext(ctx context.Context) Store
+	Ping() error
+	Close() error
+
+	Book(ISBN string) (Books, error)
+	InsertBook(book Books) error
+	BooksByTitle(keyTitle string) ([]Books, error)
+	BooksByAuthor(keyAuthor string) ([]Books, error)
+	BooksBySubject(subject string) ([]Books, error)
+	BooksByYear(from, to int) ([]Books, error)
+	BookDetails(ISBN string) (BookDetails, error)
+	SaveBookDetails(details BookDetails) error
+	AllBooks() ([]Books, error)
+	SearchBooks(query SearchQuery, limit, offset int) ([]Books, int, error)
+
+	InsertCopy(item Copy) error
+	Copy(barcode string) (Copy, error)
+	Copies(ISBN string) ([]Copy, error)
+	CountCopies(ISBN string) (int, error)
+	ShelfCopy(ISBN string) (Copy, error)
+	SetCopyStatus(barcode, status string) error
+	SetCopyLocation(barcode, location string) error
+	WithdrawCopy(barcode, status, withdrawalID string) error
+	ReinstateCopy(barcode string) error
+
+	User(userID string) (Users, error)
+	InsertUser(user Users) error
+	SetPassword(userID, password string) error
+	SetOverdue(userID string, overdue int) error
+	Account(userID string) (Account, error)
+	SetAccountStatus(userID, status string) error
+	SetAccountExpiry(userID string, expiresAt sql.NullTime) error
+	AnonymizeUser(userID, anonID, password string) error
+
+	InsertSession(tokenHash, userID string, createdAt, expiresAt time.Time) error
+	Session(tokenHash string) (Session, error)
+	RevokeSession(tokenHash string) error
+	RevokeSessions(userID string) error
+
+	OpenRecord(bookISBN, userID string) (Records, error)
+	InsertRecord(record Records) error
+	UpdateRecordDeadline(recordID string, deadline time.Time, extendTimes int) error
+	CloseRecord(recordID string, returnDate time.Time) error
+	Records(userID string) ([]Records, error)
+	OpenRecords(userID string) ([]Records, error)
+	CountOpenRecords(userID string) (int, error)
+	SweepUsers() ([]string, error)
+	DueRecords(before time.Time) ([]Records, error)
+
+	Policy(userID, ISBN string) (LoanPolicy, CategoryPolicy, error)
+	UserCategoryPolicy(userID string) (CategoryPolicy, error)
+	LoanPolicies() ([]LoanPolicy, error)
+	CategoryPolicies() ([]CategoryPolicy, error)
+	SaveLoanPolicy(p LoanPolicy) error
+	SaveCategoryPolicy(p CategoryPolicy) error
+	SetUserCategory(userID, category string) error
+	SetBookClass(ISBN, class string) error
+
+	InsertHold(ISBN, userID string, placedAt time.Time) error
+	ActiveHold(ISBN, userID string) (Hold, error)
+	NextHold(ISBN string) (Hold, error)
+	BookHolds(ISBN string) ([]Hold, error)
+	UserHolds(userID string) ([]Hold, error)
+	ExpiredHolds(ISBN string, now time.Time) ([]Hold, error)
+	ExpiredHoldBooks(now time.Time) ([]string, error)
+	ReadyHold(holdID, copyID string, pickupDeadline time.Time) error
+	SetHoldStatus(holdID, status string) error
+
+	InsertFine(entry FineEntry) error
+	Fines(userID string) ([]FineEntry, error)
+	FineBalance(userID string) (int, error)
+
+	InsertWithdrawal(w Withdrawal) (string, error)
+	Withdrawals(ISBN string) ([]Withdrawal, error)
+
+	InsertAudit(entry AuditEntry) error
+	Audit(filter AuditFilter) ([]AuditEntry, error)
+
+	MostBorrowed(from, to time.Time, limit int) ([]TitleLoans, error)
+	UserLoans(from, to, now time.Time) ([]UserLoans, error)
+	OverdueLoans(from, to, now time.Time) ([]overdueRow, error)
+	LoanEvents(from, to time.Time) ([]time.Time, []time.Time, error)
+	BooksNotBorrowed(from, to time.Time) ([]Books, error)
+
+	InsertNotice(record Records, kind string, now time.Time) (bool, error)
+	PendingNotices() ([]Notice, error)
+	MarkNoticeSent(noticeID string, sentAt time.Time) error
+}
+
+// dialect : the bits of SQL that differ between the supported databases
+type dialect struct {
+	name          string
+	autoIncrement string
+	tableSuffix   string
+	forUpdate     string
+	concat        func(a, b string) string
+	// matchTerm and rank look search terms up in the dialect's full-text index, see search.go
+	// rank returns a join, the score to order by, and the arguments of each; no score without terms
+	matchTerm func(n *searchNode) (string, []interface{})
+	rank      func(terms []*searchNode) (string, string, []interface{}, []interface{})
+}
+
+var mysqlDialect = dialect{
+	name:          "mysql",
+	autoIncrement: "INT PRIMARY KEY NOT NULL AUTO_INCREMENT",
+	tableSuffix:   "AUTO_INCREMENT=1",
+	forUpdate:     " FOR UPDATE",
+	concat:        func(a, b string) string { return "CONCAT(" + a + ", " + b + ")" },
+	matchTerm:     mysqlMatchTerm,
+	rank:          mysqlRank,
+}
+
+var sqliteDialect = dialect{
+	name:          "sqlite3",
+	autoIncrement: "INTEGER PRIMARY KEY AUTOINCREMENT",
+	concat:        func(a, b string) string { return a + " || " + b },
+	matchTerm:     sqliteMatchTerm,
+	rank:          sqliteRank,
+}
+
+// sqliteDialect has no row locks: a SQLite transaction holds the only connection
+
+// sqlStore : Store implementation on top of database/sql
+// a store returned to WithTx runs every statement in that transaction,
+// and its reads lock the rows they return until the transaction ends;
+// every statement is cancelled with ctx, see WithContext
+type sqlStore struct {
+	db      *sqlx.DB
+	tx      *sqlx.Tx
+	dialect dialect
+	ctx     context.Context
+}
+
+// querier : the statements a store runs
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn : common part of *sqlx.DB and *sqlx.Tx
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// boundQuerier : a querier running statements on conn until ctx is done
+type boundQuerier struct {
+	conn conn
+	ctx  context.Context
+}
+
+func (b boundQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return b.conn.ExecContext(b.ctx, query, args...)
+}
+
+func (b boundQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return b.conn.QueryContext(b.ctx, query, args...)
+}
+
+func (b boundQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return b.conn.QueryRowContext(b.ctx, query, args...)
+}
+
+// q : where statements go, the transaction if there is one
+func (s *sqlStore) q() querier {
+	if s.tx != nil {
+		return boundQuerier{s.tx, s.ctx}
+	}
+	return boundQuerier{s.db, s.ctx}
+}
+
+// WithContext : the store, in the same transaction if any, with statements cancelled with ctx
+// a slow or unreachable database then fails the statement with ctx.Err() instead of hanging
+func (s *sqlStore) WithContext(ctx context.Context) Store {
+	res := *s
+	res.ctx = ctx
+	return &res
+}
+
+// Ping : check that the database answers
+func (s *sqlStore) Ping() error {
+	return s.db.PingContext(s.ctx)
+}
+
+// lock : suffix for reads that must lock their rows
+func (s *sqlStore) lock() string {
+	if s.tx != nil {
+		return s.dialect.forUpdate
+	}
+	return ""
+}
+
+// WithTx : run fn against a store bound to a single transaction
+// the transaction commits if fn returns nil and rolls back otherwise;
+// calling WithTx on a store already in a transaction joins it
+func (s *sqlStore) WithTx(fn func(Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTxx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqlStore{db: s.db, tx: tx, dialect: s.dialect, ctx: s.ctx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// NewMySQLStore : open a store on a MySQL server
+func NewMySQLStore(dsn string, maxOpen, maxIdle int, maxLifetime time.Duration) (Store, error) {
+	db, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(maxLifetime)
+	return &sqlStore{db: db, dialect: mysqlDialect, ctx: context.Background()}, nil
+}
+
+// NewSQLiteStore : open a store on an embedded SQLite database
+// path is a file name, or ":memory:" for a throwaway database
+func NewSQLiteStore(path string) (Store, error) {
+	// the driver registered in search.go, with the functions full-text search needs
+	db, err := sqlx.Open("sqlite3_library", fmt.Sprintf("file:%s?_foreign_keys=1", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, and every connection to ":memory:" is a new database
+	db.SetMaxOpenConns(1)
+	return &sqlStore{db: db, dialect: sqliteDialect, ctx: context.Background()}, nil
+}
+
+// stock and available are counted from Copylist, the Booklist columns of the same name are stale
+const bookStockSQL = `SELECT COUNT(*) FROM Copylist c WHERE c.book_id = Booklist.ISBN
+		AND c.status IN ('` + CopyShelf + `', '` + CopyLoan + `', '` + CopyHeld + `', '` + CopyRepair + `')`
+const bookAvailableSQL = `SELECT COUNT(*) FROM Copylist c WHERE c.book_id = Booklist.ISBN AND c.status = '` + CopyShelf + `'`
+
+var AllBookArgs = `title, ISBN, author, publisher, (` + bookStockSQL + `) AS stock, (` + bookAvailableSQL + `) AS available, removeinfo`
+var AllUserArgs = `id, name, password, overdue, type`
+var AllRecordArgs = `record_id, book_id, user_id, IsReturned, borrow_date, return_date, deadline, extendtimes, COALESCE(copy_id, '')`
+
+var AllCopyArgs = `barcode, book_id, status, location, acquired_at`
+
+var AllHoldArgs = `hold_id, book_id, user_id, status, placed_at, pickup_deadline, COALESCE(copy_id, '')`
+
+var AllFineArgs = `entry_id, user_id, kind, amount, book_id, record_id, note, actor, created_at`
+
+var AllWithdrawalArgs = `withdrawal_id, book_id, copies, reinstated, reason, COALESCE(note, ''), actor, record_id, created_at`
+
+var AllAuditArgs = `entry_id, actor, action, target, COALESCE(before_value, ''), COALESCE(after_value, ''), origin, created_at`
+
+// scanner : common part of *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBook : extract argvs from a row to struct Books
+func scanBook(row scanner) (Books, error) {
+	var res Books
+	err := row.Scan(&res.Title, &res.ISBN, &res.Author, &res.Publisher, &res.Stock, &res.Available, &res.RemoveInfo)
+	return res, err
+}
+
+// scanUser : extract argvs from a row to struct Users
+func scanUser(row scanner) (Users, error) {
+	var res Users
+	err := row.Scan(&res.ID, &res.Name, &res.Password, &res.Overdue, &res.Type)
+	return res, err
+}
+
+// scanRecord : extract argvs from a row to struct Records
+func scanRecord(row scanner) (Records, error) {
+	var res Records
+	err := row.Scan(&res.recordID, &res.bookID, &res.userID, &res.IsReturned, &res.borrowDate, &res.returnDate, &res.deadline, &res.extendTimes, &res.copyID)
+	return res, err
+}
+
+// scanHold : extract argvs from a row to struct Hold
+func scanHold(row scanner) (Hold, error) {
+	var res Hold
+	err := row.Scan(&res.HoldID, &res.ISBN, &res.UserID, &res.Status, &res.PlacedAt, &res.PickupDeadline, &res.CopyID)
+	return res, err
+}
+
+// scanCopy : extract argvs from a row to struct Copy
+func scanCopy(row scanner) (Copy, error) {
+	var res Copy
+	err := row.Scan(&res.Barcode, &res.ISBN, &res.Status, &res.Location, &res.AcquiredAt)
+	return res, err
+}
+
+// ensureSchemaTable : create the schema_version bookkeeping table
+func (s *sqlStore) ensureSchemaTable() error {
+	_, err := s.q().Exec(`CREATE TABLE IF NOT EXISTS schema_version(
+		version INT PRIMARY KEY,
+		name VARCHAR(256) NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// SchemaVersions : applied migrations and when they were applied
+func (s *sqlStore) SchemaVersions() (map[int]time.Time, error) {
+	if err := s.ensureSchemaTable(); err != nil {
+		return nil, err
+	}
+	rows, err := s.q().Query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// ApplyMigration : run one migration up or down and record it in schema_version
+// the statements share a transaction, but MySQL commits DDL implicitly,
+// so a failed MySQL migration may need to be repaired by hand
+func (s *sqlStore) ApplyMigration(m Migration, up bool) error {
+	if err := s.ensureSchemaTable(); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTxx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := m.Down(s.dialect)
+	if up {
+		statements = m.Up(s.dialect)
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(s.ctx, statement); err != nil {
+			return fmt.Errorf("migration %04d %s: %v", m.Version, m.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(s.ctx, `INSERT INTO schema_version(version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now())
+	} else {
+		_, err = tx.ExecContext(s.ctx, `DELETE FROM schema_version WHERE version = ?`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close : release the database handle
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// Book : fetch a book by ISBN, removed books included
+func (s *sqlStore) Book(ISBN string) (Books, error) {
+	res, err := scanBook(s.q().QueryRow(`SELECT `+AllBookArgs+` FROM Booklist WHERE ISBN = ?`+s.lock(), ISBN))
+	if err == sql.ErrNoRows {
+		return res, ErrBookNotExists
+	}
+	return res, err
+}
+
+// InsertBook : insert a new book without copies
+func (s *sqlStore) InsertBook(book Books) error {
+	_, err := s.q().Exec(`INSERT INTO Booklist(title, ISBN, author, publisher, stock, available)
+						 VALUES (?, ?, ?, ?, 0, 0)`,
+		book.Title, book.ISBN, book.Author, book.Publisher)
+	return err
+}
+
+// queryBooks : run a query returning AllBookArgs columns
+func (s *sqlStore) queryBooks(query string, args ...interface{}) ([]Books, error) {
+	rows, err := s.q().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	BookList := []Books{}
+	for rows.Next() {
+		res, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		BookList = append(BookList, res)
+	}
+	return BookList, rows.Err()
+}
+
+// BooksByTitle : books whose title contains the key, shortest title first
+func (s *sqlStore) BooksByTitle(keyTitle string) ([]Books, error) {
+	return s.queryBooks(`SELECT `+AllBookArgs+
+		` FROM Booklist WHERE title LIKE ?
+		ORDER BY LENGTH(title) ASC, title ASC`,
+		"%"+keyTitle+"%")
+}
+
+// BooksByAuthor : books with an author whose name contains the key
+func (s *sqlStore) BooksByAuthor(keyAuthor string) ([]Books, error) {
+	return s.queryBooks(`SELECT `+AllBookArgs+` FROM Booklist WHERE ISBN IN (
+			SELECT b.book_id FROM Bookauthor b JOIN Authorlist a ON a.author_id = b.author_id WHERE a.name LIKE ?
+		) ORDER BY title ASC`, "%"+keyAuthor+"%")
+}
+
+// BooksBySubject : books with the subject, ignoring case
+func (s *sqlStore) BooksBySubject(subject string) ([]Books, error) {
+	return s.queryBooks(`SELECT `+AllBookArgs+` FROM Booklist WHERE ISBN IN (
+			SELECT book_id FROM Booksubject WHERE LOWER(subject) = LOWER(?)
+		) ORDER BY title ASC`, subject)
+}
+
+// BooksByYear : books published in the years from and to, oldest first
+func (s *sqlStore) BooksByYear(from, to int) ([]Books, error) {
+	return s.queryBooks(`SELECT `+AllBookArgs+` FROM Booklist WHERE year BETWEEN ? AND ?
+		ORDER BY year ASC, title ASC`, from, to)
+}
+
+// BookDetails : the bibliographic record of a book
+func (s *sqlStore) BookDetails(ISBN string) (BookDetails, error) {
+	res := BookDetails{ISBN: ISBN, Authors: []string{}, Subjects: []string{}}
+	err := s.q().QueryRow(`SELECT edition, COALESCE(year, 0), language, pages, COALESCE(description, '')
+						 FROM Booklist WHERE ISBN = ?`, ISBN).
+		Scan(&res.Edition, &res.Year, &res.Language, &res.Pages, &res.Description)
+	if err == sql.ErrNoRows {
+		return res, ErrBookNotExists
+	}
+	if err != nil {
+		return res, err
+	}
+
+	for _, list := range []struct {
+		query string
+		items *[]string
+	}{
+		{`SELECT a.name FROM Bookauthor b JOIN Authorlist a ON a.author_id = b.author_id
+		 WHERE b.book_id = ? ORDER BY b.seq`, &res.Authors},
+		{`SELECT subject FROM Booksubject WHERE book_id = ? ORDER BY subject`, &res.Subjects},
+	} {
+		rows, err := s.q().Query(list.query, ISBN)
+		if err != nil {
+			return res, err
+		}
+		for rows.Next() {
+			var item string
+			if err := rows.Scan(&item); err != nil {
+				rows.Close()
+				return res, err
+			}
+			*list.items = append(*list.items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// SaveBookDetails : replace the bibliographic record of a book, adding authors not seen before
+func (s *sqlStore) SaveBookDetails(details BookDetails) error {
+	var year interface{}
+	if details.Year != 0 {
+		year = details.Year
+	}
+	_, err := s.q().Exec(`UPDATE Booklist SET author = ?, edition = ?, year = ?, language = ?, pages = ?, description = ?
+						 WHERE ISBN = ?`,
+		strings.Join(details.Authors, ", "), details.Edition, year, details.Language, details.Pages, details.Description,
+		details.ISBN)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.q().Exec(`DELETE FROM Bookauthor WHERE book_id = ?`, details.ISBN); err != nil {
+		return err
+	}
+	for i, name := range details.Authors {
+		var authorID int64
+		err := s.q().QueryRow(`SELECT author_id FROM Authorlist WHERE name = ?`, name).Scan(&authorID)
+		if err == sql.ErrNoRows {
+			var res sql.Result
+			res, err = s.q().Exec(`INSERT INTO Authorlist(name) VALUES (?)`, name)
+			if err == nil {
+				authorID, err = res.LastInsertId()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, err = s.q().Exec(`INSERT INTO Bookauthor(book_id, author_id, seq) VALUES (?, ?, ?)`, details.ISBN, authorID, i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.q().Exec(`DELETE FROM Booksubject WHERE book_id = ?`, details.ISBN); err != nil {
+		return err
+	}
+	for _, subject := range details.Subjects {
+		_, err := s.q().Exec(`INSERT INTO Booksubject(book_id, subject) VALUES (?, ?)`, details.ISBN, subject)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllBooks : every book, removed ones included, by ISBN
+func (s *sqlStore) AllBooks() ([]Books, error) {
+	return s.queryBooks(`SELECT ` + AllBookArgs + ` FROM Booklist ORDER BY ISBN`)
+}
+
+// SearchBooks : one page of the books matching a query, best match first, and how many match in all
+func (s *sqlStore) SearchBooks(query SearchQuery, limit, offset int) ([]Books, int, error) {
+	where, args := query.root.where(s.dialect)
+
+	var total int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM Booklist WHERE `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// without words to rank by, as for a query of filters only, books come in title order
+	join, score, joinArgs, scoreArgs := s.dialect.rank(query.root.ranked())
+	if score != "" {
+		score += " DESC, "
+	}
+	all := append(append(append(joinArgs, args...), scoreArgs...), limit, offset)
+	BookList, err := s.queryBooks(`SELECT `+AllBookArgs+` FROM Booklist`+join+`
+		WHERE `+where+`
+		ORDER BY `+score+`title ASC, ISBN ASC LIMIT ? OFFSET ?`, all...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return BookList, total, nil
+}
+
+// InsertCopy : insert a new copy
+func (s *sqlStore) InsertCopy(item Copy) error {
+	_, err := s.q().Exec(`INSERT INTO Copylist(barcode, book_id, status, location, acquired_at)
+						 VALUES (?, ?, ?, ?, ?)`,
+		item.Barcode, item.ISBN, item.Status, item.Location, item.AcquiredAt)
+	return err
+}
+
+// Copy : fetch a copy by barcode
+func (s *sqlStore) Copy(barcode string) (Copy, error) {
+	res, err := scanCopy(s.q().QueryRow(`SELECT `+AllCopyArgs+` FROM Copylist WHERE barcode = ?`+s.lock(), barcode))
+	if err == sql.ErrNoRows {
+		return res, ErrCopyNotExists
+	}
+	return res, err
+}
+
+// Copies : every copy of a book, by barcode
+func (s *sqlStore) Copies(ISBN string) ([]Copy, error) {
+	rows, err := s.q().Query(`SELECT `+AllCopyArgs+` FROM Copylist WHERE book_id = ? ORDER BY acquired_at, barcode`, ISBN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	CopyList := []Copy{}
+	for rows.Next() {
+		res, err := scanCopy(rows)
+		if err != nil {
+			return nil, err
+		}
+		CopyList = append(CopyList, res)
+	}
+	return CopyList, rows.Err()
+}
+
+// CountCopies : how many copies a book has ever had
+func (s *sqlStore) CountCopies(ISBN string) (int, error) {
+	var n int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM Copylist WHERE book_id = ?`, ISBN).Scan(&n)
+	return n, err
+}
+
+// ShelfCopy : a copy of a book on the shelf, ErrBookNotAvailable if there is none
+func (s *sqlStore) ShelfCopy(ISBN string) (Copy, error) {
+	res, err := scanCopy(s.q().QueryRow(`SELECT `+AllCopyArgs+` FROM Copylist
+										 WHERE book_id = ? AND status = ?
+										 ORDER BY barcode LIMIT 1`+s.lock(), ISBN, CopyShelf))
+	if err == sql.ErrNoRows {
+		return res, ErrBookNotAvailable
+	}
+	return res, err
+}
+
+// SetCopyStatus : overwrite the status of a copy
+func (s *sqlStore) SetCopyStatus(barcode, status string) error {
+	_, err := s.q().Exec(`UPDATE Copylist SET status = ? WHERE barcode = ?`, status, barcode)
+	return err
+}
+
+// SetCopyLocation : overwrite where a copy is shelved
+func (s *sqlStore) SetCopyLocation(barcode, location string) error {
+	_, err := s.q().Exec(`UPDATE Copylist SET location = ? WHERE barcode = ?`, location, barcode)
+	return err
+}
+
+// WithdrawCopy : take a copy out of stock with the given status, as part of a withdrawal
+func (s *sqlStore) WithdrawCopy(barcode, status, withdrawalID string) error {
+	_, err := s.q().Exec(`UPDATE Copylist SET status = ?, withdrawal_id = ? WHERE barcode = ?`, status, withdrawalID, barcode)
+	return err
+}
+
+// ReinstateCopy : count a copy back from the withdrawal that took it out of stock and unlink it
+// the copy's status is left to the caller
+func (s *sqlStore) ReinstateCopy(barcode string) error {
+	_, err := s.q().Exec(`UPDATE Withdrawallist SET reinstated = reinstated + 1
+						 WHERE withdrawal_id = (SELECT withdrawal_id FROM Copylist WHERE barcode = ?)`, barcode)
+	if err != nil {
+		return err
+	}
+	_, err = s.q().Exec(`UPDATE Copylist SET withdrawal_id = NULL WHERE barcode = ?`, barcode)
+	return err
+}
+
+// User : fetch a user by ID
+func (s *sqlStore) User(userID string) (Users, error) {
+	res, err := scanUser(s.q().QueryRow(`SELECT `+AllUserArgs+` FROM Userlist WHERE id = ? AND status <> '`+AccountDeleted+`'`+s.lock(), userID))
+	if err == sql.ErrNoRows {
+		return res, ErrUserNotExists
+	}
+	return res, err
+}
+
+// InsertUser : insert a new user
+// ErrUserExists if the ID is taken, also by a deleted user
+func (s *sqlStore) InsertUser(user Users) error {
+	var taken int
+	if err := s.q().QueryRow(`SELECT COUNT(*) FROM Userlist WHERE id = ?`, user.ID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrUserExists
+	}
+	_, err := s.q().Exec(`INSERT INTO Userlist(id, name, password, type, overdue)
+						 VALUES (?, ?, ?, ?, ?)`,
+		user.ID, user.Name, user.Password, user.Type, user.Overdue)
+	return err
+}
+
+// SetPassword : overwrite the stored password
+func (s *sqlStore) SetPassword(userID, password string) error {
+	_, err := s.q().Exec(`UPDATE Userlist SET password = ? WHERE id = ?`, password, userID)
+	return err
+}
+
+// SetOverdue : overwrite the overdue counter
+func (s *sqlStore) SetOverdue(userID string, overdue int) error {
+	_, err := s.q().Exec(`UPDATE Userlist SET overdue = ? WHERE id = ?`, overdue, userID)
+	return err
+}
+
+// Account : the status and expiry of a user's account, ErrUserNotExists if there is none
+func (s *sqlStore) Account(userID string) (Account, error) {
+	res := Account{UserID: userID}
+	err := s.q().QueryRow(`SELECT status, expires_at FROM Userlist WHERE id = ? AND status <> '`+AccountDeleted+`'`+s.lock(),
+		userID).Scan(&res.Status, &res.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return res, ErrUserNotExists
+	}
+	return res, err
+}
+
+// SetAccountStatus : overwrite the account status
+func (s *sqlStore) SetAccountStatus(userID, status string) error {
+	_, err := s.q().Exec(`UPDATE Userlist SET status = ? WHERE id = ?`, status, userID)
+	return err
+}
+
+// SetAccountExpiry : overwrite when the account expires, never if NULL
+func (s *sqlStore) SetAccountExpiry(userID string, expiresAt sql.NullTime) error {
+	_, err := s.q().Exec(`UPDATE Userlist SET expires_at = ? WHERE id = ?`, expiresAt, userID)
+	return err
+}
+
+// AnonymizeUser : move a user's loans, holds and fines to a new deleted user anonID, and leave the user
+// a deleted row with neither name nor a usable password, so that their ID is never given out again.
+// anonID keeps the category and role, for statistics; ErrUserExists if anonID is taken
+func (s *sqlStore) AnonymizeUser(userID, anonID, password string) error {
+	var taken int
+	if err := s.q().QueryRow(`SELECT COUNT(*) FROM Userlist WHERE id = ?`, anonID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrUserExists
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO Userlist(id, name, password, overdue, type, category, status)
+		  SELECT ?, '', ?, 0, type, category, '` + AccountDeleted + `' FROM Userlist WHERE id = ?`,
+			[]interface{}{anonID, password, userID}},
+		{`UPDATE Recordlist SET user_id = ? WHERE user_id = ?`, []interface{}{anonID, userID}},
+		{`UPDATE Holdlist SET user_id = ? WHERE user_id = ?`, []interface{}{anonID, userID}},
+		{`UPDATE Finelist SET user_id = ?, note = NULL WHERE user_id = ?`, []interface{}{anonID, userID}},
+		{`DELETE FROM Sessionlist WHERE user_id = ?`, []interface{}{userID}},
+		{`UPDATE Userlist SET name = '', password = ?, overdue = 0, expires_at = NULL, status = '` + AccountDeleted + `'
+		  WHERE id = ?`, []interface{}{password, userID}},
+	}
+	for _, statement := range statements {
+		if _, err := s.q().Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertSession : remember a new session by the hash of its token
+func (s *sqlStore) InsertSession(tokenHash, userID string, createdAt, expiresAt time.Time) error {
+	_, err := s.q().Exec(`INSERT INTO Sessionlist(token_hash, user_id, created_at, expires_at)
+						  VALUES (?, ?, ?, ?)`,
+		tokenHash, userID, createdAt, expiresAt)
+	return err
+}
+
+// Session : the session with the given token hash, ErrSessionInvalid if there is none
+func (s *sqlStore) Session(tokenHash string) (Session, error) {
+	var res Session
+	err := s.q().QueryRow(`SELECT s.user_id, u.name, u.type, s.expires_at, s.revoked
+						   FROM Sessionlist s JOIN Userlist u ON u.id = s.user_id
+						   WHERE s.token_hash = ?`, tokenHash).
+		Scan(&res.UserID, &res.Name, &res.Role, &res.ExpiresAt, &res.Revoked)
+	if err == sql.ErrNoRows {
+		return res, ErrSessionInvalid
+	}
+	return res, err
+}
+
+// RevokeSession : end one session
+func (s *sqlStore) RevokeSession(tokenHash string) error {
+	_, err := s.q().Exec(`UPDATE Sessionlist SET revoked = TRUE WHERE token_hash = ?`, tokenHash)
+	return err
+}
+
+// RevokeSessions : end every session of a user
+func (s *sqlStore) RevokeSessions(userID string) error {
+	_, err := s.q().Exec(`UPDATE Sessionlist SET revoked = TRUE WHERE user_id = ?`, userID)
+	return err
+}
+
+// OpenRecord : the unreturned record of a book borrowed by a user
+func (s *sqlStore) OpenRecord(bookISBN, userID string) (Records, error) {
+	res, err := scanRecord(s.q().QueryRow(`SELECT `+AllRecordArgs+` FROM Recordlist
+										  WHERE book_id = ? AND user_id = ? AND IsReturned = FALSE`+s.lock(),
+		bookISBN, userID))
+	if err == sql.ErrNoRows {
+		return res, ErrNotBorrowed
+	}
+	return res, err
+}
+
+// InsertRecord : insert a new borrow record
+func (s *sqlStore) InsertRecord(record Records) error {
+	_, err := s.q().Exec(`INSERT INTO Recordlist (book_id, user_id, IsReturned, borrow_date, deadline, extendtimes, copy_id)
+						 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		record.bookID, record.userID, record.IsReturned, record.borrowDate, record.deadline, record.extendTimes, record.copyID)
+	return err
+}
+
+// UpdateRecordDeadline : overwrite deadline and extendtimes of a record
+func (s *sqlStore) UpdateRecordDeadline(recordID string, deadline time.Time, extendTimes int) error {
+	_, err := s.q().Exec(`UPDATE Recordlist
+						 SET extendtimes = ?, deadline = ?
+						 WHERE record_id = ?`,
+		extendTimes, deadline, recordID)
+	return err
+}
+
+// CloseRecord : mark a record as returned, ErrNotBorrowed if it already is
+func (s *sqlStore) CloseRecord(recordID string, returnDate time.Time) error {
+	res, err := s.q().Exec(`UPDATE Recordlist SET IsReturned = TRUE, return_date = ?
+							WHERE record_id = ? AND IsReturned = FALSE`, returnDate, recordID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrNotBorrowed
+		}
+		return err
+	}
+	return nil
+}
+
+// queryRecords : run a query returning AllRecordArgs columns
+func (s *sqlStore) queryRecords(query string, args ...interface{}) ([]Records, error) {
+	rows, err := s.q().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	RecordList := []Records{}
+	for rows.Next() {
+		res, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		RecordList = append(RecordList, res)
+	}
+	return RecordList, rows.Err()
+}
+
+// Records : all records of a user, latest first
+func (s *sqlStore) Records(userID string) ([]Records, error) {
+	return s.queryRecords(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE user_id = ? ORDER BY borrow_date DESC`, userID)
+}
+
+// OpenRecords : unreturned records of a user, latest first
+func (s *sqlStore) OpenRecords(userID string) ([]Records, error) {
+	return s.queryRecords(`SELECT `+AllRecordArgs+` FROM Recordlist WHERE user_id = ? AND IsReturned = FALSE ORDER BY borrow_date DESC`+s.lock(), userID)
+}
+
+// CountOpenRecords : how many books a user has not returned yet
+func (s *sqlStore) CountOpenRecords(userID string) (int, error) {
+	var n int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM Recordlist WHERE user_id = ? AND IsReturned = FALSE`, userID).Scan(&n)
+	return n, err
+}
+
+// SweepUsers : users with unreturned books or a non-zero overdue counter
+func (s *sqlStore) SweepUsers() ([]string, error) {
+	rows, err := s.q().Query(`SELECT user_id FROM Recordlist WHERE IsReturned = FALSE
+							  UNION
+							  SELECT id FROM Userlist WHERE overdue > 0
+							  ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	UserList := []string{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		UserList = append(UserList, userID)
+	}
+	return UserList, rows.Err()
+}
+
+// DueRecords : unreturned records of every user due before a time, earliest deadline first
+func (s *sqlStore) DueRecords(before time.Time) ([]Records, error) {
+	return s.queryRecords(`SELECT `+AllRecordArgs+` FROM Recordlist
+						   WHERE IsReturned = FALSE AND deadline < ?
+						   ORDER BY deadline ASC, record_id ASC`, before)
+}
+
+// Policy : the loan policy for a user borrowing a book, and the policy of the user's category
+func (s *sqlStore) Policy(userID, ISBN string) (LoanPolicy, CategoryPolicy, error) {
+	var loan LoanPolicy
+	var category CategoryPolicy
+	err := s.q().QueryRow(`SELECT p.category, p.class, p.loan_days, p.max_renewals, p.renewal_days,
+						   p.daily_fine, p.max_fine, p.replacement_fee,
+						   c.max_loans, c.suspend_after, c.max_balance
+						   FROM Userlist u
+						   JOIN Booklist b ON b.ISBN = ?
+						   JOIN Policylist p ON p.category = u.category AND p.class = b.class
+						   JOIN Categorylist c ON c.category = u.category
+						   WHERE u.id = ?`, ISBN, userID).
+		Scan(&loan.Category, &loan.Class, &loan.LoanDays, &loan.MaxRenewals, &loan.RenewalDays,
+			&loan.DailyFine, &loan.MaxFine, &loan.ReplacementFee,
+			&category.MaxLoans, &category.SuspendAfter, &category.MaxBalance)
+	if err == sql.ErrNoRows {
+		return loan, category, ErrNoPolicy
+	}
+	category.Category = loan.Category
+	return loan, category, err
+}
+
+// UserCategoryPolicy : the policy of the category a user is in
+func (s *sqlStore) UserCategoryPolicy(userID string) (CategoryPolicy, error) {
+	var res CategoryPolicy
+	err := s.q().QueryRow(`SELECT c.category, c.max_loans, c.suspend_after, c.max_balance
+						   FROM Userlist u JOIN Categorylist c ON c.category = u.category
+						   WHERE u.id = ?`, userID).
+		Scan(&res.Category, &res.MaxLoans, &res.SuspendAfter, &res.MaxBalance)
+	if err == sql.ErrNoRows {
+		return res, ErrNoPolicy
+	}
+	return res, err
+}
+
+// LoanPolicies : every loan policy, by category then class
+func (s *sqlStore) LoanPolicies() ([]LoanPolicy, error) {
+	rows, err := s.q().Query(`SELECT category, class, loan_days, max_renewals, renewal_days,
+							  daily_fine, max_fine, replacement_fee
+							  FROM Policylist ORDER BY category, class`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	PolicyList := []LoanPolicy{}
+	for rows.Next() {
+		var res LoanPolicy
+		err := rows.Scan(&res.Category, &res.Class, &res.LoanDays, &res.MaxRenewals, &res.RenewalDays,
+			&res.DailyFine, &res.MaxFine, &res.ReplacementFee)
+		if err != nil {
+			return nil, err
+		}
+		PolicyList = append(PolicyList, res)
+	}
+	return PolicyList, rows.Err()
+}
+
+// CategoryPolicies : every category policy, by category
+func (s *sqlStore) CategoryPolicies() ([]CategoryPolicy, error) {
+	rows, err := s.q().Query(`SELECT category, max_loans, suspend_after, max_balance FROM Categorylist ORDER BY category`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	PolicyList := []CategoryPolicy{}
+	for rows.Next() {
+		var res CategoryPolicy
+		if err := rows.Scan(&res.Category, &res.MaxLoans, &res.SuspendAfter, &res.MaxBalance); err != nil {
+			return nil, err
+		}
+		PolicyList = append(PolicyList, res)
+	}
+	return PolicyList, rows.Err()
+}
+
+// SaveLoanPolicy : overwrite a loan policy, inserting it if there is none yet
+func (s *sqlStore) SaveLoanPolicy(p LoanPolicy) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*sqlStore)
+		var n int
+		err := t.q().QueryRow(`SELECT COUNT(*) FROM Policylist WHERE category = ? AND class = ?`+t.lock(),
+			p.Category, p.Class).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			_, err = t.q().Exec(`UPDATE Policylist SET loan_days = ?, max_renewals = ?, renewal_days = ?,
+								 daily_fine = ?, max_fine = ?, replacement_fee = ?
+								 WHERE category = ? AND class = ?`,
+				p.LoanDays, p.MaxRenewals, p.RenewalDays, p.DailyFine, p.MaxFine, p.ReplacementFee, p.Category, p.Class)
+			return err
+		}
+		_, err = t.q().Exec(`INSERT INTO Policylist(category, class, loan_days, max_renewals, renewal_days,
+							 daily_fine, max_fine, replacement_fee)
+							 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.Category, p.Class, p.LoanDays, p.MaxRenewals, p.RenewalDays, p.DailyFine, p.MaxFine, p.ReplacementFee)
+		return err
+	})
+}
+
+// SaveCategoryPolicy : overwrite a category policy, inserting it if there is none yet
+func (s *sqlStore) SaveCategoryPolicy(p CategoryPolicy) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*sqlStore)
+		var n int
+		err := t.q().QueryRow(`SELECT COUNT(*) FROM Categorylist WHERE category = ?`+t.lock(), p.Category).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			_, err = t.q().Exec(`UPDATE Categorylist SET max_loans = ?, suspend_after = ?, max_balance = ? WHERE category = ?`,
+				p.MaxLoans, p.SuspendAfter, p.MaxBalance, p.Category)
+			return err
+		}
+		_, err = t.q().Exec(`INSERT INTO Categorylist(category, max_loans, suspend_after, max_balance) VALUES (?, ?, ?, ?)`,
+			p.Category, p.MaxLoans, p.SuspendAfter, p.MaxBalance)
+		return err
+	})
+}
+
+// SetUserCategory : move a user to another reader category
+func (s *sqlStore) SetUserCategory(userID, category string) error {
+	_, err := s.q().Exec(`UPDATE Userlist SET category = ? WHERE id = ?`, category, userID)
+	return err
+}
+
+// SetBookClass : move a book to another class
+func (s *sqlStore) SetBookClass(ISBN, class string) error {
+	_, err := s.q().Exec(`UPDATE Booklist SET class = ? WHERE ISBN = ?`, class, ISBN)
+	return err
+}
+
+// InsertHold : put a user at the end of a book's queue
+func (s *sqlStore) InsertHold(ISBN, userID string, placedAt time.Time) error {
+	_, err := s.q().Exec(`INSERT INTO Holdlist(book_id, user_id, status, placed_at) VALUES (?, ?, ?, ?)`,
+		ISBN, userID, HoldWaiting, placedAt)
+	return err
+}
+
+// ActiveHold : the waiting or ready hold of a user on a book, ErrNoHold if there is none
+func (s *sqlStore) ActiveHold(ISBN, userID string) (Hold, error) {
+	res, err := scanHold(s.q().QueryRow(`SELECT `+AllHoldArgs+` FROM Holdlist
+										 WHERE book_id = ? AND user_id = ? AND status IN (?, ?)`+s.lock(),
+		ISBN, userID, HoldWaiting, HoldReady))
+	if err == sql.ErrNoRows {
+		return res, ErrNoHold
+	}
+	return res, err
+}
+
+// NextHold : the first waiting hold on a book, ErrNoHold if nobody is waiting
+func (s *sqlStore) NextHold(ISBN string) (Hold, error) {
+	res, err := scanHold(s.q().QueryRow(`SELECT `+AllHoldArgs+` FROM Holdlist
+										 WHERE book_id = ? AND status = ?
+										 ORDER BY hold_id ASC LIMIT 1`+s.lock(),
+		ISBN, HoldWaiting))
+	if err == sql.ErrNoRows {
+		return res, ErrNoHold
+	}
+	return res, err
+}
+
+// queryHolds : run a query returning AllHoldArgs columns
+func (s *sqlStore) queryHolds(query string, args ...interface{}) ([]Hold, error) {
+	rows, err := s.q().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	HoldList := []Hold{}
+	for rows.Next() {
+		res, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		HoldList = append(HoldList, res)
+	}
+	return HoldList, rows.Err()
+}
+
+// BookHolds : the queue of a book, ready holds first, then in the order they were placed
+func (s *sqlStore) BookHolds(ISBN string) ([]Hold, error) {
+	return s.queryHolds(`SELECT `+AllHoldArgs+` FROM Holdlist
+						 WHERE book_id = ? AND status IN (?, ?)
+						 ORDER BY status = ? DESC, hold_id ASC`,
+		ISBN, HoldWaiting, HoldReady, HoldReady)
+}
+
+// UserHolds : the waiting and ready holds of a user, oldest first
+func (s *sqlStore) UserHolds(userID string) ([]Hold, error) {
+	return s.queryHolds(`SELECT `+AllHoldArgs+` FROM Holdlist
+						 WHERE user_id = ? AND status IN (?, ?)
+						 ORDER BY hold_id ASC`,
+		userID, HoldWaiting, HoldReady)
+}
+
+// ExpiredHolds : ready holds on a book whose pickup deadline has passed
+func (s *sqlStore) ExpiredHolds(ISBN string, now time.Time) ([]Hold, error) {
+	return s.queryHolds(`SELECT `+AllHoldArgs+` FROM Holdlist
+						 WHERE book_id = ? AND status = ? AND pickup_deadline < ?
+						 ORDER BY hold_id ASC`+s.lock(),
+		ISBN, HoldReady, now)
+}
+
+// ExpiredHoldBooks : the books with a ready hold whose pickup deadline has passed
+func (s *sqlStore) ExpiredHoldBooks(now time.Time) ([]string, error) {
+	rows, err := s.q().Query(`SELECT DISTINCT book_id FROM Holdlist
+							  WHERE status = ? AND pickup_deadline < ?
+							  ORDER BY book_id`, HoldReady, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	BookList := []string{}
+	for rows.Next() {
+		var ISBN string
+		if err := rows.Scan(&ISBN); err != nil {
+			return nil, err
+		}
+		BookList = append(BookList, ISBN)
+	}
+	return BookList, rows.Err()
+}
+
+// ReadyHold : mark a hold as having a copy set aside until pickupDeadline
+func (s *sqlStore) ReadyHold(holdID, copyID string, pickupDeadline time.Time) error {
+	_, err := s.q().Exec(`UPDATE Holdlist SET status = ?, copy_id = ?, pickup_deadline = ? WHERE hold_id = ?`,
+		HoldReady, copyID, pickupDeadline, holdID)
+	return err
+}
+
+// SetHoldStatus : overwrite the status of a hold
+func (s *sqlStore) SetHoldStatus(holdID, status string) error {
+	_, err := s.q().Exec(`UPDATE Holdlist SET status = ? WHERE hold_id = ?`, status, holdID)
+	return err
+}
+
+// InsertFine : append an entry to a user's ledger
+func (s *sqlStore) InsertFine(entry FineEntry) error {
+	_, err := s.q().Exec(`INSERT INTO Finelist(user_id, kind, amount, book_id, record_id, note, actor, created_at)
+						 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.UserID, entry.Kind, entry.Amount, entry.ISBN, entry.RecordID, entry.Note, entry.Actor, entry.CreatedAt)
+	return err
+}
+
+// Fines : a user's ledger, oldest entry first
+func (s *sqlStore) Fines(userID string) ([]FineEntry, error) {
+	rows, err := s.q().Query(`SELECT `+AllFineArgs+` FROM Finelist WHERE user_id = ? ORDER BY entry_id ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	FineList := []FineEntry{}
+	for rows.Next() {
+		var res FineEntry
+		err := rows.Scan(&res.EntryID, &res.UserID, &res.Kind, &res.Amount, &res.ISBN, &res.RecordID, &res.Note, &res.Actor, &res.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		FineList = append(FineList, res)
+	}
+	return FineList, rows.Err()
+}
+
+// InsertWithdrawal : record a withdrawal and return its ID
+func (s *sqlStore) InsertWithdrawal(w Withdrawal) (string, error) {
+	res, err := s.q().Exec(`INSERT INTO Withdrawallist(book_id, copies, reason, note, actor, record_id, created_at)
+						   VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		w.ISBN, w.Copies, w.Reason, sql.NullString{String: w.Note, Valid: w.Note != ""}, w.Actor, w.RecordID, w.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	id, err := res.LastInsertId()
+	return strconv.FormatInt(id, 10), err
+}
+
+// Withdrawals : every withdrawal from a book's stock, newest first
+func (s *sqlStore) Withdrawals(ISBN string) ([]Withdrawal, error) {
+	rows, err := s.q().Query(`SELECT `+AllWithdrawalArgs+` FROM Withdrawallist WHERE book_id = ? ORDER BY withdrawal_id DESC`, ISBN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	WithdrawalList := []Withdrawal{}
+	for rows.Next() {
+		var res Withdrawal
+		err := rows.Scan(&res.WithdrawalID, &res.ISBN, &res.Copies, &res.Reinstated, &res.Reason, &res.Note, &res.Actor, &res.RecordID, &res.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		WithdrawalList = append(WithdrawalList, res)
+	}
+	return WithdrawalList, rows.Err()
+}
+
+// FineBalance : what a user owes, the sum of their ledger
+func (s *sqlStore) FineBalance(userID string) (int, error) {
+	var balance int
+	err := s.q().QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM Finelist WHERE user_id = ?`, userID).Scan(&balance)
+	return balance, err
+}
+
+// InsertAudit : append an entry to the audit log
+func (s *sqlStore) InsertAudit(entry AuditEntry) error {
+	nullable := func(v string) sql.NullString {
+		return sql.NullString{String: v, Valid: v != ""}
+	}
+	_, err := s.q().Exec(`INSERT INTO Auditlist(actor, action, target, before_value, after_value, origin, created_at)
+						 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.Actor, entry.Action, entry.Target, nullable(entry.Before), nullable(entry.After), entry.Origin, entry.CreatedAt)
+	return err
+}
+
+// Audit : the audit entries matching a filter, newest first
+func (s *sqlStore) Audit(filter AuditFilter) ([]AuditEntry, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.User != "" {
+		where = append(where, "(actor = ? OR target = ?)")
+		args = append(args, filter.User, filter.User)
+	}
+	if filter.Action != "" {
+		where = append(where, "(action = ? OR action LIKE ?)")
+		args = append(args, filter.Action, filter.Action+".%")
+	}
+	if !filter.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, filter.To)
+	}
+	rows, err := s.q().Query(`SELECT `+AllAuditArgs+` FROM Auditlist
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY entry_id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	AuditList := []AuditEntry{}
+	for rows.Next() {
+		var res AuditEntry
+		err := rows.Scan(&res.EntryID, &res.Actor, &res.Action, &res.Target, &res.Before, &res.After, &res.Origin, &res.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		AuditList = append(AuditList, res)
+	}
+	return AuditList, rows.Err()
+}
+
+// InsertNotice : queue a notice about a record, unless one of that kind was queued for its current deadline
+// the result tells whether it was queued
+func (s *sqlStore) InsertNotice(record Records, kind string, now time.Time) (bool, error) {
+	var n int
+	err := s.q().QueryRow(`SELECT COUNT(*) FROM Noticelist WHERE record_id = ? AND kind = ? AND deadline = ?`,
+		record.recordID, kind, record.deadline).Scan(&n)
+	if err != nil || n > 0 {
+		return false, err
+	}
+	_, err = s.q().Exec(`INSERT INTO Noticelist(record_id, kind, deadline, created_at) VALUES (?, ?, ?, ?)`,
+		record.recordID, kind, record.deadline, now)
+	return err == nil, err
+}
+
+// PendingNotices : queued notices not delivered yet, oldest first
+func (s *sqlStore) PendingNotices() ([]Notice, error) {
+	rows, err := s.q().Query(`SELECT n.notice_id, n.kind, n.record_id, u.id, u.name, b.ISBN, b.title,
+							  COALESCE(r.copy_id, ''), n.deadline, n.created_at
+							  FROM Noticelist n
+							  JOIN Recordlist r ON r.record_id = n.record_id
+							  JOIN Userlist u ON u.id = r.user_id
+							  JOIN Booklist b ON b.ISBN = r.book_id
+							  WHERE n.sent_at IS NULL
+							  ORDER BY n.notice_id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	NoticeList := []Notice{}
+	for rows.Next() {
+		var res Notice
+		err := rows.Scan(&res.NoticeID, &res.Kind, &res.RecordID, &res.UserID, &res.Name, &res.ISBN, &res.Title,
+			&res.CopyID, &res.Deadline, &res.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		NoticeList = append(NoticeList, res)
+	}
+	return NoticeList, rows.Err()
+}
+
+// MarkNoticeSent : record that a notice was delivered
+func (s *sqlStore) MarkNoticeSent(noticeID string, sentAt time.Time) error {
+	_, err := s.q().Exec(`UPDATE Noticelist SET sent_at = ? WHERE notice_id = ?`, sentAt, noticeID)
+	return err
+}
+
+// rangeSQL : the condition that column falls between from and to, to excluded, zero bounds open
+func rangeSQL(column string, from, to time.Time) (string, []interface{}) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if !from.IsZero() {
+		where = append(where, column+" >= ?")
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where = append(where, column+" < ?")
+		args = append(args, to)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// MostBorrowed : titles by how often they were borrowed in a range, the first limit of them unless limit is 0
+func (s *sqlStore) MostBorrowed(from, to time.Time, limit int) ([]TitleLoans, error) {
+	where, args := rangeSQL("r.borrow_date", from, to)
+	query := `SELECT b.ISBN, b.title, COUNT(*) AS loans FROM Recordlist r
+			  JOIN Booklist b ON b.ISBN = r.book_id
+			  WHERE ` + where + `
+			  GROUP BY b.ISBN, b.title
+			  ORDER BY loans DESC, b.title ASC, b.ISBN ASC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := s.q().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []TitleLoans{}
+	for rows.Next() {
+		var row TitleLoans
+		if err := rows.Scan(&row.ISBN, &row.Title, &row.Loans); err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// UserLoans : per user with loans in a range or books still out, how many they borrowed in it,
+// and how many they have out and overdue at now; most books out first
+func (s *sqlStore) UserLoans(from, to, now time.Time) ([]UserLoans, error) {
+	inRange, args := rangeSQL("r.borrow_date", from, to)
+	args = append(args, now)
+	rows, err := s.q().Query(`SELECT u.id, u.name,
+							  SUM(CASE WHEN `+inRange+` THEN 1 ELSE 0 END) AS loans,
+							  SUM(CASE WHEN r.IsReturned = FALSE THEN 1 ELSE 0 END) AS open_loans,
+							  SUM(CASE WHEN r.IsReturned = FALSE AND r.deadline < ? THEN 1 ELSE 0 END) AS overdue_loans
+							  FROM Userlist u
+							  JOIN Recordlist r ON r.user_id = u.id
+							  GROUP BY u.id, u.name
+							  HAVING loans > 0 OR open_loans > 0
+							  ORDER BY open_loans DESC, loans DESC, u.id ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []UserLoans{}
+	for rows.Next() {
+		var row UserLoans
+		if err := rows.Scan(&row.UserID, &row.Name, &row.Loans, &row.Open, &row.Overdue); err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// OverdueLoans : unreturned loans past their deadline at now and due in a range, earliest deadline first
+func (s *sqlStore) OverdueLoans(from, to, now time.Time) ([]overdueRow, error) {
+	where, args := rangeSQL("r.deadline", from, to)
+	rows, err := s.q().Query(`SELECT u.id, u.name, b.ISBN, b.title, COALESCE(r.copy_id, ''), r.deadline
+							  FROM Recordlist r
+							  JOIN Userlist u ON u.id = r.user_id
+							  JOIN Booklist b ON b.ISBN = r.book_id
+							  WHERE r.IsReturned = FALSE AND r.deadline < ? AND `+where+`
+							  ORDER BY r.deadline ASC, u.id ASC`, append([]interface{}{now}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []overdueRow{}
+	for rows.Next() {
+		var row overdueRow
+		if err := rows.Scan(&row.UserID, &row.Name, &row.ISBN, &row.Title, &row.CopyID, &row.Deadline); err != nil {
+			return nil, err
+		}
+		res = append(res, row)
+	}
+	return res, rows.Err()
+}
+
+// LoanEvents : when books were borrowed, and when books were returned, in a range
+func (s *sqlStore) LoanEvents(from, to time.Time) ([]time.Time, []time.Time, error) {
+	var events [2][]time.Time
+	for i, column := range []string{"borrow_date", "return_date"} {
+		where, args := rangeSQL(column, from, to)
+		rows, err := s.q().Query(`SELECT `+column+` FROM Recordlist WHERE `+column+` IS NOT NULL AND `+where, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var t time.Time
+			if err := rows.Scan(&t); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			events[i] = append(events[i], t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return events[0], events[1], nil
+}
+
+// BooksNotBorrowed : books with copies that weren't borrowed in a range, by title
+func (s *sqlStore) BooksNotBorrowed(from, to time.Time) ([]Books, error) {
+	where, args := rangeSQL("r.borrow_date", from, to)
+	return s.queryBooks(`SELECT `+AllBookArgs+` FROM Booklist
+						 WHERE (`+bookStockSQL+`) > 0 AND NOT EXISTS (
+							SELECT 1 FROM Recordlist r WHERE r.book_id = Booklist.ISBN AND `+where+`)
+						 ORDER BY title ASC, ISBN ASC`, args...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// withdrawal reasons, stored in Withdrawallist.reason
+// lost copies become lost, the others withdrawn
+const (
+	WithdrawLost        = "lost"
+	WithdrawDamaged     = "damaged"
+	WithdrawWeeded      = "weeded"
+	WithdrawTransferred = "transferred"
+)
+
+// WithdrawalReasons : every reason a copy may leave stock for
+var WithdrawalReasons = []string{WithdrawLost, WithdrawDamaged, WithdrawWeeded, WithdrawTransferred}
+
+var ErrWithdrawalReason = errors.New("Unknown withdrawal reason. Use lost, damaged, weeded or transferred.")
+
+// Withdrawal : copies of a book taken out of stock at once, why, by whom and when
+// RecordID is the loan a lost book was on, if any; Reinstated counts the copies since put back
+type Withdrawal struct {
+	WithdrawalID string
+	ISBN         string
+	Copies       int
+	Reinstated   int
+	Reason       string
+	Note         string
+	Actor        string
+	RecordID     sql.NullString
+	CreatedAt    time.Time
+}
+
+// withdraw : record w and take the copies with the given barcodes out of stock under it
+// the actor defaults to whoever the library acts as
+// must run in a transaction holding the book's row lock
+func (lib *Library) withdraw(w Withdrawal, barcodes []string) (Withdrawal, error) {
+	if !contains(WithdrawalReasons, w.Reason) {
+		return w, ErrWithdrawalReason
+	}
+	if w.Actor == "" {
+		w.Actor = lib.actorID()
+	}
+	w.Copies, w.CreatedAt = len(barcodes), lib.now()
+	var err error
+	w.WithdrawalID, err = lib.store.InsertWithdrawal(w)
+	if err != nil {
+		return w, err
+	}
+	status := CopyWithdrawn
+	if w.Reason == WithdrawLost {
+		status = CopyLost
+	}
+	for _, barcode := range barcodes {
+		if err := lib.store.WithdrawCopy(barcode, status, w.WithdrawalID); err != nil {
+			return w, err
+		}
+	}
+	return w, nil
+}
+
+// ReinstateCopy : put a withdrawn or lost copy back into stock, to a waiting reader first if there is one
+// its withdrawal is kept, counting the copy as reinstated; fines for a lost copy are not refunded, waive them
+func (lib *Library) ReinstateCopy(ctx context.Context, barcode string) error {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	err := lib.lockCopy(barcode, func(tx *Library, item Copy) error {
+		if item.Status != CopyWithdrawn && item.Status != CopyLost {
+			return ErrCopyStatus
+		}
+		if err := tx.store.ReinstateCopy(barcode); err != nil {
+			return err
+		}
+		if err := tx.releaseCopy(item, lib.now()); err != nil {
+			return err
+		}
+		after, err := tx.store.Copy(barcode)
+		if err != nil {
+			return err
+		}
+		return tx.audit("copy.reinstate", barcode, map[string]interface{}{"status": item.Status},
+			map[string]interface{}{"status": after.Status})
+	})
+
+	logger := lib.log().With(F("op", "copy.reinstate"), F("copy", barcode))
+	if err != nil {
+		logger.failed("Reinstating a copy failed.", err)
+		return copyError(err, "copy.reinstate", barcode, "")
+	}
+	logger.Info("Copy reinstated.")
+	return nil
+}
+
+// Withdrawals : every withdrawal from a book's stock, newest first
+func (lib *Library) Withdrawals(ctx context.Context, bookISBN string) ([]Withdrawal, error) {
+	lib, _, cancel := lib.bind(ctx, lib.timeout)
+	defer cancel()
+	bookISBN = canonicalISBN(bookISBN)
+	if _, err := lib.store.Book(bookISBN); err != nil {
+		return nil, opError(err, "book.withdrawals", bookISBN, "")
+	}
+	WithdrawalList, err := lib.store.Withdrawals(bookISBN)
+	if err != nil {
+		lib.log().failed("Querying withdrawals failed.", err, F("op", "book.withdrawals"), F("isbn", bookISBN))
+		return nil, opError(err, "book.withdrawals", bookISBN, "")
+	}
+	return WithdrawalList, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWithdrawals(t *testing.T) {
+	wlib := newHoldLibrary(t)
+	defer wlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	wlib.clock = NewFakeClock(now)
+	wlib = wlib.As(`root`, OriginCLI)
+	// shelf copies are withdrawn by barcode, so the -1 and CW-0002 are weeded and CW-0003 is lent
+	for _, barcode := range []string{`CW-0002`, `CW-0003`} {
+		if _, err := wlib.AddCopy(ctx, ISBN, barcode, `A1-01`, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		testid    int
+		action    string
+		barcode   string
+		copies    int
+		reason    string
+		err       error
+		stock     int
+		available int
+	}{
+		{0, "remove", ``, 4, WithdrawWeeded, ErrBookNotAvailable, 3, 3},
+		{1, "remove", ``, 1, `renew`, ErrWithdrawalReason, 3, 3},
+		{2, "remove", ``, 2, WithdrawWeeded, nil, 1, 1},
+		{3, "borrow", ``, 0, ``, nil, 1, 0},
+		{4, "lost", ``, 0, ``, nil, 0, 0},
+		{5, "remove", ``, 1, WithdrawWeeded, ErrAllRemoved, 0, 0},
+		{6, "reinstate", `CW-0003`, 0, ``, nil, 1, 1},
+		{7, "reinstate", `CW-0003`, 0, ``, ErrCopyStatus, 1, 1},
+		{8, "removecopy", `CW-0003`, 0, WithdrawTransferred, nil, 0, 0},
+		{9, "reinstate", `CW-0002`, 0, ``, nil, 1, 1},
+	}
+
+	for _, tt := range tests {
+		testname := fmt.Sprintf("%d", tt.testid)
+		t.Run(testname, func(t *testing.T) {
+			var err error
+			switch tt.action {
+			case "remove":
+				_, err = wlib.RemoveBook(ctx, ISBN, tt.copies, tt.reason, `mouldy`)
+			case "removecopy":
+				err = wlib.RemoveCopy(ctx, tt.barcode, tt.reason, `to the law library`)
+			case "reinstate":
+				err = wlib.ReinstateCopy(ctx, tt.barcode)
+			case "borrow":
+				_, err = wlib.BorrowBook(ctx, ISBN, `18307130006`, now)
+			case "lost":
+				err = wlib.DeclareLost(ctx, ISBN, `18307130006`, `root`)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			book, _ := wlib.store.Book(ISBN)
+			if book.Stock != tt.stock || book.Available != tt.available {
+				t.Errorf("got stock %d available %d, want %d %d", book.Stock, book.Available, tt.stock, tt.available)
+			}
+		})
+	}
+
+	res, err := wlib.Withdrawals(ctx, ISBN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newest first: the transfer, the lost loan, the two weeded copies
+	if len(res) != 3 {
+		t.Fatalf("got %+v, want 3 withdrawals", res)
+	}
+	if res[0].Reason != WithdrawTransferred || res[0].Copies != 1 || res[0].Note != `to the law library` || res[0].RecordID.Valid {
+		t.Errorf("got %+v, want the transfer of one copy", res[0])
+	}
+	if res[1].Reason != WithdrawLost || !res[1].RecordID.Valid || res[1].Reinstated != 1 || res[1].Actor != `root` {
+		t.Errorf("got %+v, want the lost loan, its copy reinstated", res[1])
+	}
+	if res[2].Reason != WithdrawWeeded || res[2].Copies != 2 || res[2].Reinstated != 1 || !res[2].CreatedAt.Equal(now) {
+		t.Errorf("got %+v, want two weeded copies, one reinstated", res[2])
+	}
+	if loans, err := wlib.CheckUnreturned(ctx, `18307130006`); err != nil || len(loans) != 0 {
+		t.Errorf("got %v, %v, want the lost loan closed", loans, err)
+	}
+	if _, err := wlib.Withdrawals(ctx, `978-0000000000`); !errors.Is(err, ErrBookNotExists) {
+		t.Errorf("got %v, want %v", err, ErrBookNotExists)
+	}
+}
+
+func TestReinstateToHold(t *testing.T) {
+	wlib := newHoldLibrary(t)
+	defer wlib.store.Close()
+
+	const ISBN = `978-0385545938`
+	now := time.Date(2020, time.May, 10, 14, 0, 0, 0, time.UTC)
+	wlib.clock = NewFakeClock(now)
+	if _, err := wlib.BorrowBook(ctx, ISBN, `18307130006`, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := wlib.DeclareLost(ctx, ISBN, `18307130006`, `root`); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is left to borrow, but a hold needs a copy in stock
+	if _, err := wlib.AddCopy(ctx, ISBN, `CW-0002`, ``, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wlib.BorrowBook(ctx, ISBN, `18307130101`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wlib.PlaceHold(ctx, ISBN, `18307130068`, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lost copy turns up again and goes to the reader waiting for it
+	if err := wlib.ReinstateCopy(ctx, `978-0385545938-1`); err != nil {
+		t.Fatal(err)
+	}
+	item, err := wlib.store.Copy(`978-0385545938-1`)
+	if err != nil || item.Status != CopyHeld {
+		t.Errorf("got %+v, %v, want the copy held", item, err)
+	}
+	if _, err := wlib.BorrowBook(ctx, ISBN, `18307130068`, now); err != nil {
+		t.Errorf("got %v, want the held copy borrowed", err)
+	}
+}